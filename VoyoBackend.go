@@ -46,10 +46,20 @@ func init() {
 }
 
 func main() {
-	app := fiber.New()
+	app := fiber.New(fiber.Config{
+		// Behind a load balancer, the address of the client is only read from the header set by the proxies listed in
+		// TRUSTED_PROXIES, so that the rate limits apply per client
+		ProxyHeader:             fiber.HeaderXForwardedFor,
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          getEnvList("TRUSTED_PROXIES"),
+		EnableIPValidation:      true,
+		// Photos are sent in a single multipart request, videos in chunks of the resumable upload which fit in the
+		// same limit. 1 MB is left for the other fields of the form.
+		BodyLimit: int(mediaMaxSize("PHOTO")) + 1<<20,
+	})
 
 	// Define root routes
-	root := app.Group("/api")
+	root := app.Group("/api", rateLimit("default"))
 	root.Get("/status", func(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusOK)
 	})
@@ -82,16 +92,34 @@ func main() {
 	user := root.Group("/user")
 	user.Get("/", VerifyJWT, GetUser) // TODO: To check 1 and add verifyJWT
 	user.Get("/status", VerifyJWT, GetUserStatus)
-	user.Get("/login", LoginUser) // TODO: To check
-	user.Post("/", CreateUser)    // TODO: To check
+	user.Get("/login", rateLimit("auth"), LoginUser) // TODO: To check
+	user.Post("/", rateLimit("auth"), CreateUser)    // TODO: To check
 	user.Put("/", VerifyJWT, UpdateUser)
-	user.Delete("/", DeleteUser) // TODO: To check & add jwt verification
+	user.Delete("/", VerifyJWT, DeleteUser)
+	user.Post("/restore", VerifyJWT, restrictTo("ADMIN"), RestoreUser)
+	user.Post("/picture", VerifyJWT, UploadProfilePicture)
 	user.Get("/homeStats", VerifyJWT, GetHomeStats)
 	user.Get("/search", VerifyJWT, restrictTo("ADMIN"), SearchUsers)
-	user.Get("/tbv", VerifyJWT, restrictTo("ADMIN"), UsersToBeValidated)
 	user.Patch("/update", VerifyJWT, restrictTo("ADMIN"), AdminUpdateUser)
 	user.Get("/email", VerifyJWT, GetUserEmailByPhoneNumber) // SUPER UNSAFE!!!! SHOULD BE REMOVED LATER
 	user.Get("/all", VerifyJWT, restrictTo("ADMIN"), GetAllUsers)
+	user.Post("/device", VerifyJWT, RegisterDevice)
+	user.Delete("/device", VerifyJWT, UnregisterDevice)
+
+	// Define routes for the GDPR personal data export
+	export := user.Group("/export", VerifyJWT)
+	export.Get("/", ExportUserData)
+	export.Get("/admin", restrictTo("ADMIN"), AdminExportUserData)
+	export.Get("/status", GetDataExportStatus)
+	export.Get("/download", DownloadDataExport)
+
+	// Define routes for the visitors' identity verification
+	verification := user.Group("/verification", VerifyJWT)
+	verification.Get("/", GetVerificationHistory)
+	verification.Post("/", restrictTo("VISITOR"), SubmitVerification)
+	verification.Get("/queue", restrictTo("ADMIN"), GetVerificationQueue)
+	verification.Patch("/review", restrictTo("ADMIN"), ReviewVerification)
+	verification.Get("/document", GetIdentityDocument)
 
 	// Define routes for "Visit"
 	visit := root.Group("/visit", VerifyJWT)
@@ -100,10 +128,40 @@ func main() {
 	visit.Post("/", CreateVisit)
 	visit.Delete("/", DeleteVisit) // TODO: To check
 	visit.Get("/homeList", GetVisitsList)
+	visit.Get("/completion", GetVisitCompletion)
+	visit.Get("/report.pdf", GetVisitReport)
+	visit.Get("/share", restrictTo("PROSPECT"), GetVisitShares)
+	visit.Post("/share", restrictTo("PROSPECT"), CreateVisitShare)
+	visit.Delete("/share", restrictTo("PROSPECT"), RevokeVisitShare)
+	visit.Get("/cancel", GetVisitCancellationQuote)
+	visit.Post("/cancel", CancelVisit)
+	visit.Get("/candidates", restrictTo("PROSPECT"), GetVisitCandidates)
+	visit.Post("/rematch", restrictTo("PROSPECT"), RematchVisit)
+	visit.Post("/reschedule", ProposeVisitReschedule)
+	visit.Post("/reschedule/accept", AcceptVisitReschedule)
+	visit.Post("/reschedule/decline", DeclineVisitReschedule)
+	visit.Post("/checkin", restrictTo("VISITOR"), CheckInVisit)
+	visit.Post("/checkout", restrictTo("VISITOR"), CheckOutVisit)
+
+	// Open visit requests, posted without choosing a visitor and claimed by the first eligible one
+	visitRequest := visit.Group("/request")
+	visitRequest.Get("/", restrictTo("PROSPECT"), GetVisitRequests)
+	visitRequest.Post("/", restrictTo("PROSPECT"), CreateVisitRequest)
+	visitRequest.Delete("/", restrictTo("PROSPECT"), CancelVisitRequest)
+	visitRequest.Get("/open", restrictTo("VISITOR"), GetOpenVisitRequests)
+	visitRequest.Post("/claim", restrictTo("VISITOR"), ClaimVisitRequest)
+
+	// One conversation per visit between the prospect and the visitor
+	visitMessage := visit.Group("/message")
+	visitMessage.Get("/", GetVisitMessages)
+	visitMessage.Post("/", SendVisitMessage)
+	visitMessage.Post("/read", MarkVisitMessagesRead)
+	visitMessage.Get("/threads", GetMessageThreads)
 
 	visitCode := visit.Group("/code")
 	visitCode.Get("/", GetVisitVerificationCode)
-	visitCode.Post("/", CheckVisitVerificationCode)
+	visitCode.Post("/", rateLimit("code"), CheckVisitVerificationCode)
+	visitCode.Post("/reset", ResetVisitVerificationCode)
 
 	// Define routes for "Criteria"
 	criteria := root.Group("/criteria", VerifyJWT)
@@ -112,13 +170,44 @@ func main() {
 	criteria.Patch("/", UpdateCriteria)  // TODO:May be okay we'll see when using it in the backend
 	criteria.Delete("/", DeleteCriteria) // TODO: To check
 
+	// Checklists of criteria, per type of real estate
+	criteria.Get("/template", GetCriteriaTemplates)
+	criteria.Post("/template", restrictTo("PROSPECT", "ADMIN"), CreateCriteriaTemplate)
+	criteria.Put("/template", restrictTo("PROSPECT", "ADMIN"), UpdateCriteriaTemplate)
+	criteria.Delete("/template", restrictTo("PROSPECT", "ADMIN"), DeleteCriteriaTemplate)
+
+	// Photos and videos answering the criteria
+	criteria.Post("/media", restrictTo("VISITOR"), UploadCriteriaMedia)
+	criteria.Post("/media/uploads", restrictTo("VISITOR"), CreateMediaUpload)
+	criteria.Head("/media/uploads/:id", restrictTo("VISITOR"), HeadMediaUpload)
+	criteria.Patch("/media/uploads/:id", restrictTo("VISITOR"), PatchMediaUpload)
+	criteria.Patch("/media", restrictTo("VISITOR"), UpdateCriteriaMedia)
+	criteria.Put("/media/order", restrictTo("VISITOR"), ReorderCriteriaMedia)
+	criteria.Delete("/media", restrictTo("VISITOR"), DeleteCriteriaMedia)
+
+	root.Get("/media", VerifyJWT, GetMedia)
+
+	// Read-only access to a visit report for people without an account, with a link shared by the prospect
+	share := root.Group("/share", rateLimit("share"))
+	share.Get("/:token", GetSharedVisit)
+	share.Get("/:token/report.pdf", GetSharedVisitReport)
+	share.Get("/:token/media", GetSharedMedia)
+
 	// Define routes for "linkCriteriaVisit" TODO: maybe will be deleted because a criteria is linked to a visit when creating the visit
 	linkcriteriavisit := root.Group("/linkcriteriavisit")
 	linkcriteriavisit.Get("/", GetLinkCriteriaVisit)       // TODO: To check
 	linkcriteriavisit.Post("/", CreateLinkCriteriaVisit)   // TODO: To check
 	linkcriteriavisit.Delete("/", DeleteLinkCriteriaVisit) // TODO: To check
 
-	root.Get("/search", VerifyJWT, Search)
+	root.Get("/search", VerifyJWT, rateLimit("search"), Search)
+
+	// Background jobs abandoned after their last attempt
+	jobs := root.Group("/jobs", VerifyJWT, restrictTo("ADMIN"))
+	jobs.Get("/dead", GetDeadJobs)
+	jobs.Post("/dead/retry", RetryDeadJob)
+
+	// Transactional emails and their delivery status
+	root.Get("/emails", VerifyJWT, restrictTo("ADMIN"), GetEmails)
 
 	// Security routes
 	security := root.Group("/security")
@@ -126,6 +215,21 @@ func main() {
 		return c.SendStatus(fiber.StatusOK)
 	})
 
+	// Refuse to start with a configuration that would make the visit codes unusable
+	if err := checkVisitCodeConfig(); err != nil {
+		fmt.Println("💥 Error in the configuration of the visit codes : ", err)
+		os.Exit(1)
+	}
+
+	// Encrypt the identity documents still stored in plain text, then start the background jobs (purges, exports, ...)
+	if err := migratePlainIdentityDocuments(); err != nil {
+		fmt.Println("💥 Error encrypting the plain identity documents : ", err)
+	}
+	if err := startJobs(); err != nil {
+		fmt.Println("💥 Error starting the background jobs : ", err)
+		os.Exit(1)
+	}
+
 	// Start the server
 	fmt.Printf("Server is running on :%d...\n", 3000)
 	err := app.Listen(":3000")
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"math"
+	"strings"
+	"time"
+)
+
+// Paliers de la politique d'annulation
+const (
+	cancellationFree       = "FREE"
+	cancellationLate       = "LATE"
+	cancellationLastMinute = "LAST_MINUTE"
+	cancellationVisitor    = "VISITOR"
+)
+
+var errVisitNotCancellable = errors.New("visit not cancellable")
+var errNotVisitParty = errors.New("not a party of the visit")
+var errVisitNotRematchable = errors.New("visit not rematchable")
+
+// cancellationPolicy décrit la politique d'annulation, configurable avec les variables d'environnement :
+// une annulation par le prospect plus de CANCELLATION_FREE_HOURS heures avant le début de la visite est gratuite, puis
+// coûte CANCELLATION_LATE_FEE_PERCENT % du prix, et CANCELLATION_LAST_MINUTE_FEE_PERCENT % à moins de
+// CANCELLATION_LAST_MINUTE_HOURS heures. Les frais reviennent au visiteur.
+type cancellationPolicy struct {
+	FreeHours            int `json:"free_hours"`
+	LastMinuteHours      int `json:"last_minute_hours"`
+	LateFeePercent       int `json:"late_fee_percent"`
+	LastMinuteFeePercent int `json:"last_minute_fee_percent"`
+}
+
+// getCancellationPolicy renvoie la politique d'annulation en vigueur.
+func getCancellationPolicy() cancellationPolicy {
+	return cancellationPolicy{
+		FreeHours:            getEnvInt("CANCELLATION_FREE_HOURS", 24),
+		LastMinuteHours:      getEnvInt("CANCELLATION_LAST_MINUTE_HOURS", 2),
+		LateFeePercent:       getEnvInt("CANCELLATION_LATE_FEE_PERCENT", 50),
+		LastMinuteFeePercent: getEnvInt("CANCELLATION_LAST_MINUTE_FEE_PERCENT", 100),
+	}
+}
+
+// roundAmount arrondit une somme au centime.
+func roundAmount(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// visitorReliability renvoie la part, en pourcentage, des visites acceptées par un visiteur qu'il a menées à terme.
+func visitorReliability(done int, cancellations int) float64 {
+	if done+cancellations == 0 {
+		return 100
+	}
+	return math.Round(float64(done)/float64(done+cancellations)*1000) / 10
+}
+
+// computeCancellation calcule l'issue d'une annulation à l'instant now, selon qui annule et le statut de la visite.
+func (p cancellationPolicy) computeCancellation(role string, status string, start time.Time, price float64, now time.Time) VisitCancellation {
+	hours := start.Sub(now).Hours()
+	cancellation := VisitCancellation{
+		CancelledBy: role,
+		HoursBefore: math.Round(hours*100) / 100,
+		Price:       price,
+		Refund:      price,
+		Tier:        cancellationFree,
+	}
+
+	if role == "VISITOR" {
+		// The prospect is refunded in full and the cancellation of an accepted visit counts against the visitor
+		cancellation.Tier = cancellationVisitor
+		cancellation.Counted = status == "ACCEPTED"
+		return cancellation
+	}
+
+	// A request that the visitor has not accepted yet can always be withdrawn for free
+	if status != "ACCEPTED" || hours >= float64(p.FreeHours) {
+		return cancellation
+	}
+
+	percent := p.LateFeePercent
+	cancellation.Tier = cancellationLate
+	if hours < float64(p.LastMinuteHours) {
+		percent = p.LastMinuteFeePercent
+		cancellation.Tier = cancellationLastMinute
+	}
+
+	cancellation.Fee = roundAmount(price * float64(min(max(percent, 0), 100)) / 100)
+	cancellation.Refund = roundAmount(price - cancellation.Fee)
+	cancellation.Compensation = cancellation.Fee
+	return cancellation
+}
+
+// visitRowQueryer est implémenté par *sql.DB et *sql.Tx.
+type visitRowQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// getVisitParty lit une visite et le rôle de l'utilisateur dans celle-ci (PROSPECT ou VISITOR), éventuellement en la
+// verrouillant.
+func getVisitParty(q visitRowQueryer, idVisit string, phoneNumber string, lock bool) (role string, status string, start time.Time, price float64, err error) {
+	query := `SELECT phonenumberprospect, phonenumbervisitor, status, starttime, price FROM visit WHERE idvisit = $1`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+
+	var prospect, visitor string
+	err = q.QueryRow(query, idVisit).Scan(&prospect, &visitor, &status, &start, &price)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errNotVisitParty
+		}
+		return
+	}
+
+	switch phoneNumber {
+	case prospect:
+		role = "PROSPECT"
+	case visitor:
+		role = "VISITOR"
+	default:
+		err = errNotVisitParty
+	}
+	return
+}
+
+// getCancellableVisit lit une visite qui peut encore être annulée et le rôle de l'utilisateur dans celle-ci.
+func getCancellableVisit(q visitRowQueryer, idVisit string, phoneNumber string, lock bool) (role string, status string, start time.Time, price float64, err error) {
+	role, status, start, price, err = getVisitParty(q, idVisit, phoneNumber, lock)
+	if err == nil && status != "PENDING" && status != "ACCEPTED" {
+		err = errVisitNotCancellable
+	}
+	return
+}
+
+// cancelVisit annule une visite au nom de l'utilisateur connecté et enregistre l'issue de l'annulation.
+func cancelVisit(claims *CustomClaims, idVisit string, reason *string) (VisitCancellation, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return VisitCancellation{}, err
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in cancelVisit() : ", err)
+		}
+	}(tx)
+
+	role, status, start, price, err := getCancellableVisit(tx, idVisit, claims.PhoneNumber, true)
+	if err != nil {
+		return VisitCancellation{}, err
+	}
+
+	cancellation := getCancellationPolicy().computeCancellation(role, status, start, price, time.Now())
+	cancellation.Reason = reason
+
+	err = tx.QueryRow(`
+		INSERT INTO visitcancellation (idvisit, cancelledby, role, reason, tier, hoursbefore, price, fee, refund, compensation, counted)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING idvisitcancellation, idvisit, cancelledat`,
+		idVisit, claims.PhoneNumber, role, reason, cancellation.Tier, cancellation.HoursBefore, cancellation.Price,
+		cancellation.Fee, cancellation.Refund, cancellation.Compensation, cancellation.Counted).Scan(&cancellation.ID, &cancellation.IdVisit, &cancellation.CancelledAt)
+	if err != nil {
+		return VisitCancellation{}, err
+	}
+
+	if _, err := tx.Exec(`UPDATE visit SET status = 'CANCELLED' WHERE idvisit = $1`, idVisit); err != nil {
+		return VisitCancellation{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return VisitCancellation{}, err
+	}
+
+	go notifyVisitCancellation(idVisit, cancellation, start)
+	go notifyVisitEvent(idVisit, pushVisitCancelled, claims.PhoneNumber)
+	go emailVisit(idVisit, "visit.cancelled", []string{"PROSPECT", "VISITOR"}, map[string]interface{}{
+		"CancelledBy":  cancellation.CancelledBy,
+		"Refund":       cancellation.Refund,
+		"Fee":          cancellation.Fee,
+		"Compensation": cancellation.Compensation,
+	})
+	return cancellation, nil
+}
+
+// notifyVisitCancellation prévient l'autre partie d'une annulation. Lorsque le visiteur annule, le prospect est
+// informé des visiteurs disponibles pour le remplacer.
+func notifyVisitCancellation(idVisit string, cancellation VisitCancellation, start time.Time) {
+	var prospect, visitor string
+	err := db.QueryRow(`SELECT phonenumberprospect, phonenumbervisitor FROM visit WHERE idvisit = $1`, idVisit).Scan(&prospect, &visitor)
+	if err != nil {
+		fmt.Println("💥 Error scanning the row in notifyVisitCancellation() : ", err)
+		return
+	}
+
+	date := start.Format("02/01 à 15h04")
+	if cancellation.CancelledBy == "PROSPECT" {
+		message := fmt.Sprintf("Voyo : la visite du %s a été annulée par le prospect.", date)
+		if cancellation.Compensation > 0 {
+			message += fmt.Sprintf(" Vous recevrez un dédommagement de %.2f €.", cancellation.Compensation)
+		}
+		notifyUser(visitor, message)
+		return
+	}
+
+	candidates, err := getVisitCandidates(idVisit, prospect, "")
+	if err != nil {
+		fmt.Println("💥 Error getting the candidates in notifyVisitCancellation() : ", err)
+	}
+
+	message := fmt.Sprintf("Voyo : le visiteur a annulé la visite du %s, vous serez intégralement remboursé.", date)
+	if len(candidates) > 0 {
+		message += fmt.Sprintf(" %d visiteur(s) disponible(s) peuvent le remplacer, retrouvez-les dans l'application.", len(candidates))
+	}
+	notifyUser(prospect, message)
+}
+
+// getVisitCancellation renvoie la dernière annulation d'une visite.
+func getVisitCancellation(idVisit string) (*VisitCancellation, error) {
+	var cancellation VisitCancellation
+	err := db.QueryRow(`
+		SELECT idvisitcancellation, idvisit, role, reason, tier, hoursbefore, price, fee, refund, compensation, counted, cancelledat, rematchedat
+		FROM visitcancellation
+		WHERE idvisit = $1
+		ORDER BY cancelledat DESC
+		LIMIT 1`, idVisit).Scan(&cancellation.ID, &cancellation.IdVisit, &cancellation.CancelledBy, &cancellation.Reason, &cancellation.Tier,
+		&cancellation.HoursBefore, &cancellation.Price, &cancellation.Fee, &cancellation.Refund, &cancellation.Compensation,
+		&cancellation.Counted, &cancellation.CancelledAt, &cancellation.RematchedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &cancellation, nil
+}
+
+// getVisitCandidates renvoie les visiteurs qui peuvent remplacer celui qui a annulé une visite : leur zone couvre le
+// bien, ils n'ont pas d'autre visite sur le créneau et n'ont pas déjà annulé cette visite. Les photos de profil sont
+// signées pour l'utilisateur phoneNumber. Avec only, seul ce visiteur est recherché.
+func getVisitCandidates(idVisit string, phoneNumber string, only string) ([]VisitCandidate, error) {
+	rows, err := db.Query(`
+		SELECT u.phonenumber,
+		       u.firstname,
+		       UPPER(CONCAT(LEFT(u.lastname, 1), '.')),
+		       COALESCE(u.profilepicture, ''),
+		       COALESCE(u.pricing, 0),
+		       COALESCE((SELECT AVG(note) FROM visit WHERE phonenumbervisitor = u.phonenumber AND status = 'DONE' AND note != 0.0), 0) AS noteavg,
+		       (SELECT COUNT(*) FROM visit WHERE phonenumbervisitor = u.phonenumber AND status = 'DONE')                               AS visitcount,
+		       (SELECT COUNT(*) FROM visitcancellation WHERE cancelledby = u.phonenumber AND counted)                                  AS cancellations,
+		       `+visitorResponseStatsSQL("u.phonenumber")+`
+		FROM visit v
+		         JOIN typerealestate tr ON v.idtyperealestate = tr.idtyperealestate
+		         JOIN "user" u ON u.idrole = 1 AND u.status = 'VALIDATED'
+		WHERE v.idvisit = $1
+		  AND v.starttime > NOW()
+		  AND u.phonenumber != v.phonenumbervisitor
+		  AND ($2 = '' OR u.phonenumber = $2)
+		  AND st_intersects(u.geom, st_transform(ST_SetSRID(ST_MakePoint(v.y, v.x), 4326), 2154))
+		  AND NOT EXISTS(SELECT 1 FROM visitcancellation vc WHERE vc.idvisit = v.idvisit AND vc.cancelledby = u.phonenumber)
+		  AND NOT EXISTS(SELECT 1
+		                 FROM visit o
+		                          JOIN typerealestate otr ON o.idtyperealestate = otr.idtyperealestate
+		                 WHERE o.phonenumbervisitor = u.phonenumber
+		                   AND o.status IN ('PENDING', 'ACCEPTED')
+		                   AND o.starttime < v.starttime + tr.duration
+		                   AND o.starttime + otr.duration > v.starttime)
+		ORDER BY noteavg DESC, visitcount DESC
+		LIMIT 10`, idVisit, only)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in getVisitCandidates() : ", err)
+		}
+	}(rows)
+
+	candidates := []VisitCandidate{}
+	for rows.Next() {
+		var candidate VisitCandidate
+		var cancellations int
+		err := rows.Scan(&candidate.PhoneNumber, &candidate.FirstName, &candidate.LastName, &candidate.ProfilePicture, &candidate.Pricing,
+			&candidate.NoteAvg, &candidate.VisitCount, &cancellations, &candidate.ExpiredCount, &candidate.ResponseHours)
+		if err != nil {
+			return nil, err
+		}
+
+		candidate.ProfilePicture = profilePictureURL(candidate.ProfilePicture, phoneNumber)
+		candidate.Reliability = visitorReliability(candidate.VisitCount, cancellations)
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates, rows.Err()
+}
+
+// visitCancellationErrorResponse renvoie la réponse adaptée à une annulation refusée.
+func visitCancellationErrorResponse(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errNotVisitParty):
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	case errors.Is(err, errVisitNotCancellable):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only a pending or accepted visit can be cancelled",
+		})
+	}
+
+	fmt.Println("💥 Error cancelling the visit in visitCancellationErrorResponse() : ", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "An error has occurred, please try again later.",
+	})
+}
+
+// GetVisitCancellationQuote indique à l'utilisateur connecté ce que lui coûterait l'annulation de la visite maintenant.
+func GetVisitCancellationQuote(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+
+	role, status, start, price, err := getCancellableVisit(db, id, c.Locals("user").(*CustomClaims).PhoneNumber, false)
+	if err != nil {
+		return visitCancellationErrorResponse(c, err)
+	}
+
+	policy := getCancellationPolicy()
+	return c.JSON(fiber.Map{
+		"policy": policy,
+		"quote":  policy.computeCancellation(role, status, start, price, time.Now()),
+	})
+}
+
+// CancelVisit annule une visite selon la politique d'annulation, avec un motif facultatif ("reason").
+func CancelVisit(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&body); err != nil {
+			fmt.Println("💥 Error parsing the body in CancelVisit() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+	}
+
+	return cancelVisitResponse(c, id, body.Reason)
+}
+
+// cancelVisitResponse annule une visite et renvoie l'issue de l'annulation.
+func cancelVisitResponse(c *fiber.Ctx, id string, reason string) error {
+	var trimmed *string
+	if reason = strings.TrimSpace(reason); reason != "" {
+		if len([]rune(reason)) > 500 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "The reason must not exceed 500 characters",
+			})
+		}
+		trimmed = &reason
+	}
+
+	cancellation, err := cancelVisit(c.Locals("user").(*CustomClaims), id, trimmed)
+	if err != nil {
+		return visitCancellationErrorResponse(c, err)
+	}
+
+	return c.JSON(cancellation)
+}
+
+// GetVisitCandidates renvoie au prospect les visiteurs qui peuvent remplacer celui qui a annulé sa visite.
+func GetVisitCandidates(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+	phoneNumber := c.Locals("user").(*CustomClaims).PhoneNumber
+
+	if err := checkVisitRematchable(id, phoneNumber); err != nil {
+		return visitRematchErrorResponse(c, err)
+	}
+
+	candidates, err := getVisitCandidates(id, phoneNumber, "")
+	if err != nil {
+		fmt.Println("💥 Error getting the candidates in GetVisitCandidates() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	return c.JSON(candidates)
+}
+
+// checkVisitRematchable vérifie que la visite appartient au prospect et a été annulée par son visiteur.
+func checkVisitRematchable(idVisit string, phoneNumber string) error {
+	var status string
+	err := db.QueryRow(`SELECT status FROM visit WHERE idvisit = $1 AND phonenumberprospect = $2`, idVisit, phoneNumber).Scan(&status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errNotVisitParty
+		}
+		return err
+	}
+
+	cancellation, err := getVisitCancellation(idVisit)
+	if err != nil {
+		return err
+	}
+
+	// A request left unanswered by the visitor can also be given to someone else
+	if status == "EXPIRED" {
+		return nil
+	}
+
+	if status != "CANCELLED" || cancellation == nil || cancellation.Tier != cancellationVisitor {
+		return errVisitNotRematchable
+	}
+	return nil
+}
+
+// visitRematchErrorResponse renvoie la réponse adaptée à un remplacement de visiteur refusé.
+func visitRematchErrorResponse(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errNotVisitParty):
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	case errors.Is(err, errVisitNotRematchable):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only a visit cancelled or left unanswered by its visitor can be given to another visitor",
+		})
+	}
+
+	fmt.Println("💥 Error checking the visit in visitRematchErrorResponse() : ", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "An error has occurred, please try again later.",
+	})
+}
+
+// RematchVisit confie une visite annulée par son visiteur, ou restée sans réponse, à l'un des visiteurs proposés
+// ("phone_number_visitor").
+// La visite repart en attente de son acceptation.
+func RematchVisit(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+	phoneNumber := c.Locals("user").(*CustomClaims).PhoneNumber
+
+	var body struct {
+		PhoneNumberVisitor string `json:"phone_number_visitor"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		fmt.Println("💥 Error parsing the body in RematchVisit() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if strings.TrimSpace(body.PhoneNumberVisitor) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the phone number of the new visitor",
+		})
+	}
+
+	if err := checkVisitRematchable(id, phoneNumber); err != nil {
+		return visitRematchErrorResponse(c, err)
+	}
+
+	candidates, err := getVisitCandidates(id, phoneNumber, strings.TrimSpace(body.PhoneNumberVisitor))
+	if err != nil {
+		fmt.Println("💥 Error getting the candidates in RematchVisit() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if len(candidates) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "This visitor is not available for this visit",
+		})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println("💥 Error starting the transaction in RematchVisit() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in RematchVisit() : ", err)
+		}
+	}(tx)
+
+	result, err := tx.Exec(`
+		UPDATE visit
+		SET phonenumbervisitor = $1, status = 'PENDING', requestedat = NOW()
+		WHERE idvisit = $2 AND status IN ('CANCELLED', 'EXPIRED')`,
+		candidates[0].PhoneNumber, id)
+	if err == nil {
+		if count, _ := result.RowsAffected(); count == 0 {
+			return visitRematchErrorResponse(c, errVisitNotRematchable)
+		}
+		_, err = tx.Exec(`UPDATE visitcancellation SET rematchedat = NOW() WHERE idvisit = $1 AND rematchedat IS NULL`, id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		fmt.Println("💥 Error updating the visit in RematchVisit() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	notifyUser(candidates[0].PhoneNumber, "Voyo : une nouvelle demande de visite vous attend dans l'application.")
+	go notifyVisitEvent(id, pushVisitCreated, "")
+	go emailVisit(id, "visit.booked", []string{"VISITOR"}, nil)
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeCancellation(t *testing.T) {
+	policy := cancellationPolicy{FreeHours: 24, LastMinuteHours: 2, LateFeePercent: 50, LastMinuteFeePercent: 100}
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		policy       cancellationPolicy
+		role         string
+		status       string
+		before       time.Duration
+		price        float64
+		tier         string
+		fee          float64
+		refund       float64
+		compensation float64
+		counted      bool
+	}{
+		{"prospect well in advance", policy, "PROSPECT", "ACCEPTED", 48 * time.Hour, 40, cancellationFree, 0, 40, 0, false},
+		{"prospect at the free limit", policy, "PROSPECT", "ACCEPTED", 24 * time.Hour, 40, cancellationFree, 0, 40, 0, false},
+		{"prospect late", policy, "PROSPECT", "ACCEPTED", 10 * time.Hour, 40, cancellationLate, 20, 20, 20, false},
+		{"prospect at the last minute limit", policy, "PROSPECT", "ACCEPTED", 2 * time.Hour, 40, cancellationLate, 20, 20, 20, false},
+		{"prospect at the last minute", policy, "PROSPECT", "ACCEPTED", 30 * time.Minute, 40, cancellationLastMinute, 40, 0, 40, false},
+		{"prospect after the start", policy, "PROSPECT", "ACCEPTED", -time.Hour, 40, cancellationLastMinute, 40, 0, 40, false},
+		{"prospect withdraws a pending request", policy, "PROSPECT", "PENDING", 30 * time.Minute, 40, cancellationFree, 0, 40, 0, false},
+		{"fee rounded to the cent", policy, "PROSPECT", "ACCEPTED", 10 * time.Hour, 33.33, cancellationLate, 16.67, 16.66, 16.67, false},
+		{"visitor cancels an accepted visit", policy, "VISITOR", "ACCEPTED", 30 * time.Minute, 40, cancellationVisitor, 0, 40, 0, true},
+		{"visitor refuses a pending visit", policy, "VISITOR", "PENDING", 30 * time.Minute, 40, cancellationVisitor, 0, 40, 0, false},
+		{"fee percent above 100", cancellationPolicy{FreeHours: 24, LastMinuteHours: 2, LateFeePercent: 150, LastMinuteFeePercent: 100}, "PROSPECT", "ACCEPTED", 10 * time.Hour, 40, cancellationLate, 40, 0, 40, false},
+		{"negative fee percent", cancellationPolicy{FreeHours: 24, LastMinuteHours: 2, LateFeePercent: -10, LastMinuteFeePercent: 100}, "PROSPECT", "ACCEPTED", 10 * time.Hour, 40, cancellationLate, 0, 40, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.computeCancellation(tt.role, tt.status, now.Add(tt.before), tt.price, now)
+
+			if got.CancelledBy != tt.role {
+				t.Errorf("CancelledBy = %q, want %q", got.CancelledBy, tt.role)
+			}
+			if got.Tier != tt.tier {
+				t.Errorf("Tier = %q, want %q", got.Tier, tt.tier)
+			}
+			if got.Fee != tt.fee || got.Refund != tt.refund || got.Compensation != tt.compensation {
+				t.Errorf("Fee, Refund, Compensation = %v, %v, %v, want %v, %v, %v",
+					got.Fee, got.Refund, got.Compensation, tt.fee, tt.refund, tt.compensation)
+			}
+			if got.Counted != tt.counted {
+				t.Errorf("Counted = %v, want %v", got.Counted, tt.counted)
+			}
+			if got.HoursBefore != tt.before.Hours() {
+				t.Errorf("HoursBefore = %v, want %v", got.HoursBefore, tt.before.Hours())
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"strings"
+	"time"
+)
+
+// recordVisitCheck enregistre l'arrivée (IN) ou le départ (OUT) du visiteur. La distance au bien est calculée par PostGIS
+// à partir des coordonnées envoyées par le téléphone.
+func recordVisitCheck(c *fiber.Ctx, kind string) error {
+	claims := c.Locals("user").(*CustomClaims)
+	idVisit := strings.TrimSpace(c.Query("id"))
+
+	if idVisit == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the ID of the visit",
+		})
+	}
+
+	var position VisitCheck
+	if err := c.BodyParser(&position); err != nil {
+		fmt.Println("💥 Error parsing the body in recordVisitCheck() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if position.X < -90 || position.X > 90 || position.Y < -180 || position.Y > 180 || (position.X == 0 && position.Y == 0) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide valid GPS coordinates",
+		})
+	}
+
+	// Only the visitor of the visit can check in and out
+	var visitor, status string
+	var checkedIn bool
+	err := db.QueryRow(`
+		SELECT phonenumbervisitor, status, EXISTS(SELECT 1 FROM visitcheck WHERE idvisit = v.idvisit AND kind = 'IN')
+		FROM visit v
+		WHERE idvisit = $1`, idVisit).Scan(&visitor, &status, &checkedIn)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Visit not found",
+			})
+		}
+
+		fmt.Println("💥 Error scanning the row in recordVisitCheck() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if visitor != claims.PhoneNumber {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	}
+
+	if kind == "IN" && status != "ACCEPTED" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "You can only check in for an accepted visit",
+		})
+	}
+
+	if kind == "OUT" && (!checkedIn || (status != "ACCEPTED" && status != "DONE")) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "You need to check in before checking out",
+		})
+	}
+
+	radius := float64(getEnvInt("VISIT_CHECKIN_RADIUS", 200))
+
+	// The visits store the latitude in X and the longitude in Y, as the users do
+	err = db.QueryRow(`
+		INSERT INTO visitcheck (idvisit, kind, x, y, accuracy, distance, outofrange)
+		SELECT v.idvisit, $2, $3, $4, $5, d.distance, d.distance > $6
+		FROM visit v
+		         CROSS JOIN LATERAL (SELECT ST_Distance(ST_SetSRID(ST_MakePoint(v.y, v.x), 4326)::geography,
+		                                                ST_SetSRID(ST_MakePoint($4, $3), 4326)::geography) AS distance) d
+		WHERE v.idvisit = $1
+		ON CONFLICT (idvisit, kind) DO NOTHING
+		RETURNING distance, outofrange, checkedat`,
+		idVisit, kind, position.X, position.Y, position.Accuracy, radius,
+	).Scan(&position.Distance, &position.OutOfRange, &position.CheckedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "This has already been recorded for the visit",
+			})
+		}
+
+		fmt.Println("💥 Error executing the request in recordVisitCheck() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(position)
+}
+
+// CheckInVisit enregistre l'arrivée du visiteur sur le lieu de la visite.
+func CheckInVisit(c *fiber.Ctx) error {
+	return recordVisitCheck(c, "IN")
+}
+
+// CheckOutVisit enregistre le départ du visiteur du lieu de la visite.
+func CheckOutVisit(c *fiber.Ctx) error {
+	return recordVisitCheck(c, "OUT")
+}
+
+// getVisitChecks renvoie l'arrivée et le départ enregistrés pour une visite, ainsi que le temps passé sur place.
+func getVisitChecks(idVisit string) (checkIn *VisitCheck, checkOut *VisitCheck, timeOnSite string, err error) {
+	rows, err := db.Query(`SELECT kind, x, y, accuracy, distance, outofrange, checkedat FROM visitcheck WHERE idvisit = $1`, idVisit)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in getVisitChecks() : ", err)
+		}
+	}(rows)
+
+	for rows.Next() {
+		var kind string
+		var check VisitCheck
+		if err := rows.Scan(&kind, &check.X, &check.Y, &check.Accuracy, &check.Distance, &check.OutOfRange, &check.CheckedAt); err != nil {
+			return nil, nil, "", err
+		}
+
+		if kind == "IN" {
+			checkIn = &check
+		} else {
+			checkOut = &check
+		}
+	}
+
+	if checkIn != nil && checkOut != nil {
+		timeOnSite = checkOut.CheckedAt.Sub(checkIn.CheckedAt).Round(time.Minute).String()
+	}
+
+	return checkIn, checkOut, timeOnSite, rows.Err()
+}
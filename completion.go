@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"strings"
+)
+
+// Éléments qui peuvent manquer à un critère pour que la visite soit terminée
+const (
+	criteriaMissingAnswer = "ANSWER"
+	criteriaMissingPhoto  = "PHOTO"
+	criteriaMissingVideo  = "VIDEO"
+)
+
+// CriteriaCompletion liste ce qu'il manque à un critère.
+type CriteriaCompletion struct {
+	ID       int      `json:"id"`
+	Criteria string   `json:"criteria"`
+	Missing  []string `json:"missing"`
+}
+
+// VisitCompletion est le rapport de complétion des critères d'une visite.
+type VisitCompletion struct {
+	Complete  bool                 `json:"complete"`
+	Total     int                  `json:"total"`
+	Completed int                  `json:"completed"`
+	Missing   []CriteriaCompletion `json:"missing"`
+}
+
+// getVisitCompletion vérifie que chaque critère de la visite a une réponse, et la photo ou la vidéo demandée.
+func getVisitCompletion(idVisit string) (VisitCompletion, error) {
+	report := VisitCompletion{Missing: []CriteriaCompletion{}}
+
+	rows, err := db.Query(`
+		SELECT c.idcriteria, c.criteria,
+		       c.answer IS NULL AND COALESCE(c.criteriaanswer, '') = '',
+		       c.photorequired AND NOT EXISTS(SELECT 1
+		                                      FROM criteriamedia cm
+		                                               JOIN media m ON cm.idmedia = m.idmedia
+		                                      WHERE cm.idcriteria = c.idcriteria AND m.kind = 'PHOTO'),
+		       c.videorequired AND NOT EXISTS(SELECT 1
+		                                      FROM criteriamedia cm
+		                                               JOIN media m ON cm.idmedia = m.idmedia
+		                                      WHERE cm.idcriteria = c.idcriteria AND m.kind = 'VIDEO')
+		FROM criteria c
+		         JOIN linkcriteriavisit l ON c.idcriteria = l.idcriteria
+		WHERE l.idvisit = $1
+		ORDER BY c.idcriteria`, idVisit)
+	if err != nil {
+		return report, err
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in getVisitCompletion() : ", err)
+		}
+	}(rows)
+
+	for rows.Next() {
+		var crit CriteriaCompletion
+		var noAnswer, noPhoto, noVideo bool
+		if err := rows.Scan(&crit.ID, &crit.Criteria, &noAnswer, &noPhoto, &noVideo); err != nil {
+			return report, err
+		}
+
+		report.Total++
+		if noAnswer {
+			crit.Missing = append(crit.Missing, criteriaMissingAnswer)
+		}
+		if noPhoto {
+			crit.Missing = append(crit.Missing, criteriaMissingPhoto)
+		}
+		if noVideo {
+			crit.Missing = append(crit.Missing, criteriaMissingVideo)
+		}
+
+		if len(crit.Missing) == 0 {
+			report.Completed++
+		} else {
+			report.Missing = append(report.Missing, crit)
+		}
+	}
+
+	report.Complete = report.Completed == report.Total
+	return report, rows.Err()
+}
+
+// visitIncompleteResponse refuse de terminer une visite dont les critères ne sont pas tous remplis.
+func visitIncompleteResponse(c *fiber.Ctx, report VisitCompletion) error {
+	return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+		"error":      "All the criteria must be completed before the visit can be closed",
+		"completion": report,
+	})
+}
+
+// criteriaVisitDone indique si le critère est lié à une visite terminée. Ses réponses et ses médias ne peuvent alors
+// plus changer.
+func criteriaVisitDone(idCriteria string) (bool, error) {
+	var done bool
+	err := db.QueryRow(`
+		SELECT EXISTS(SELECT 1
+		              FROM linkcriteriavisit l
+		                       JOIN visit v ON l.idvisit = v.idvisit
+		              WHERE l.idcriteria = $1 AND v.status = 'DONE')`, idCriteria).Scan(&done)
+	return done, err
+}
+
+// criteriaClosedResponse refuse de modifier un critère d'une visite terminée.
+func criteriaClosedResponse(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+		"error": "The visit is done, its criteria can no longer be changed",
+	})
+}
+
+// GetVisitCompletion renvoie le rapport de complétion des critères d'une visite.
+func GetVisitCompletion(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+
+	if id == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the ID of the visit",
+		})
+	}
+
+	if !hasAuthorizedVisitAccess(c.Locals("user").(*CustomClaims).PhoneNumber, id) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	}
+
+	report, err := getVisitCompletion(id)
+	if err != nil {
+		fmt.Println("💥 Error getting the completion in GetVisitCompletion() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	return c.JSON(report)
+}
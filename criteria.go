@@ -2,8 +2,10 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
 	"log"
 )
 
@@ -16,9 +18,23 @@ func CreateCriteria(c *fiber.Ctx) error {
 		})
 	}
 
+	if err := normalizeCriteriaDefinition(&criteria); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	options, err := criteriaOptionsValue(criteria.Options)
+	if err != nil {
+		fmt.Println("💥 Error encoding the options in CreateCriteria() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
 	stmt, err := db.Prepare(`
-		INSERT INTO criteria (criteria, criteriaAnswer, photoRequired, photo, videoRequired, video, phoneNumber, reusable)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		INSERT INTO criteria (criteria, criteriaType, options, photoRequired, videoRequired, phoneNumber, reusable)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 	`)
 	if err != nil {
 		fmt.Println("💥 Error preparing the SQL statement in CreateCriteria() : ", err)
@@ -37,11 +53,10 @@ func CreateCriteria(c *fiber.Ctx) error {
 
 	_, err = stmt.Exec(
 		criteria.Criteria,
-		criteria.CriteriaAnswer,
+		criteria.Type,
+		options,
 		criteria.PhotoRequired,
-		criteria.Photo,
 		criteria.VideoRequired,
-		criteria.Video,
 		c.Locals("user").(*CustomClaims).PhoneNumber, // Retrieve the phone number from the context (middleware
 		criteria.Reusable,
 	)
@@ -64,14 +79,14 @@ func GetCriteria(c *fiber.Ctx) error {
 	var args []interface{}
 	if id != "" && hasAuthorizedCriteriaAccess(c.Locals("user").(*CustomClaims).PhoneNumber, id) {
 		query = `
-            SELECT idCriteria, criteria, criteriaAnswer, photoRequired, photo, videoRequired, video, reusable
+            SELECT idCriteria, criteria, criteriaType, options, criteriaAnswer, answer, photoRequired, videoRequired, evidenceFlags, reusable
             FROM criteria
             WHERE idCriteria = $1
         `
 		args = []interface{}{id}
 	} else if idVisit != "" && hasAuthorizedVisitAccess(c.Locals("user").(*CustomClaims).PhoneNumber, idVisit) {
 		query = `
-            SELECT idCriteria, criteria, criteriaAnswer, photoRequired, photo, videoRequired, video, reusable
+            SELECT idCriteria, criteria, criteriaType, options, criteriaAnswer, answer, photoRequired, videoRequired, evidenceFlags, reusable
             FROM criteria
             WHERE idCriteria IN (
                 SELECT idCriteria
@@ -82,7 +97,7 @@ func GetCriteria(c *fiber.Ctx) error {
 		args = []interface{}{idVisit}
 	} else {
 		query = `
-            SELECT idCriteria, criteria, criteriaAnswer, photoRequired, photo, videoRequired, video, reusable
+            SELECT idCriteria, criteria, criteriaType, options, criteriaAnswer, answer, photoRequired, videoRequired, evidenceFlags, reusable
             FROM criteria
             WHERE phoneNumber=$1 AND reusable=true
         `
@@ -107,16 +122,22 @@ func GetCriteria(c *fiber.Ctx) error {
 	var criterias []Criteria
 	for rows.Next() {
 		var criteria Criteria
+		var options, answer []byte
 		err := rows.Scan(
 			&criteria.ID,
 			&criteria.Criteria,
+			&criteria.Type,
+			&options,
 			&criteria.CriteriaAnswer,
+			&answer,
 			&criteria.PhotoRequired,
-			&criteria.Photo,
 			&criteria.VideoRequired,
-			&criteria.Video,
+			pq.Array(&criteria.EvidenceFlags),
 			&criteria.Reusable,
 		)
+		if err == nil {
+			err = scanCriteriaTyping(&criteria, options, answer)
+		}
 		if err != nil {
 			log.Println("Error scanning the row in GetCriteria():", err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -134,6 +155,13 @@ func GetCriteria(c *fiber.Ctx) error {
 		})
 	}
 
+	if err := fillCriteriaMedia(criterias, c.Locals("user").(*CustomClaims).PhoneNumber); err != nil {
+		log.Println("Error getting the media in GetCriteria():", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
 	return c.JSON(criterias)
 }
 
@@ -160,6 +188,20 @@ func UpdateCriteria(c *fiber.Ctx) error {
 		})
 	}
 
+	// The answers and the definition of the criteria are final once the visit is done
+	if criteria.Criteria != "" || criteria.Type != "" || criteria.Options != nil || len(criteria.Answer) > 0 || criteria.CriteriaAnswer != "" {
+		done, err := criteriaVisitDone(id)
+		if err != nil {
+			fmt.Println("💥 Error checking the visit in UpdateCriteria() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+		if done {
+			return criteriaClosedResponse(c)
+		}
+	}
+
 	var updateQuery string
 	var args []interface{}
 
@@ -171,10 +213,79 @@ func UpdateCriteria(c *fiber.Ctx) error {
 		placeholderIndex++
 	}
 
-	if criteria.CriteriaAnswer != "" && c.Locals("user").(*CustomClaims).Role == "VISITOR" {
-		updateQuery += fmt.Sprintf("criteriaAnswer=$%d, ", placeholderIndex)
-		args = append(args, criteria.CriteriaAnswer)
-		placeholderIndex++
+	// The type and the options can only change before the visitor answers, so that no answer is discarded
+	if (criteria.Type != "" || criteria.Options != nil) && c.Locals("user").(*CustomClaims).Role == "PROSPECT" {
+		answered, err := criteriaAnswered(id)
+		if err != nil {
+			fmt.Println("💥 Error checking the answer in UpdateCriteria() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+		if answered {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "The criteria has already been answered, its type and options can no longer be changed",
+			})
+		}
+
+		if criteria.Type == "" {
+			criteriaType, _, err := getCriteriaDefinition(id)
+			if err != nil {
+				fmt.Println("💥 Error getting the criteria definition in UpdateCriteria() : ", err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "An error has occurred, please try again later.",
+				})
+			}
+			criteria.Type = criteriaType
+		}
+
+		if err := normalizeCriteriaDefinition(&criteria); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		options, err := criteriaOptionsValue(criteria.Options)
+		if err != nil {
+			fmt.Println("💥 Error encoding the options in UpdateCriteria() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+
+		updateQuery += fmt.Sprintf("criteriaType=$%d, options=$%d, answer=NULL, criteriaAnswer='', ", placeholderIndex, placeholderIndex+1)
+		args = append(args, criteria.Type, options)
+		placeholderIndex += 2
+	}
+
+	// The answer is validated against the type of the criteria. It can be sent typed in "answer" or as text in "criteria_answer"
+	answered := false
+	if (len(criteria.Answer) > 0 || criteria.CriteriaAnswer != "") && c.Locals("user").(*CustomClaims).Role == "VISITOR" {
+		criteriaType, options, err := getCriteriaDefinition(id)
+		if err != nil {
+			fmt.Println("💥 Error getting the criteria definition in UpdateCriteria() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+
+		raw := criteria.Answer
+		if len(raw) == 0 {
+			raw, _ = json.Marshal(criteria.CriteriaAnswer)
+		}
+
+		answer, display, err := parseCriteriaAnswer(criteriaType, options, raw)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+				"type":  criteriaType,
+			})
+		}
+
+		updateQuery += fmt.Sprintf("answer=$%d, criteriaAnswer=$%d, ", placeholderIndex, placeholderIndex+1)
+		args = append(args, string(answer), display)
+		placeholderIndex += 2
+		answered = true
 	}
 
 	//// TODO: Investigate because it may not work if the photoRequired is false
@@ -184,11 +295,7 @@ func UpdateCriteria(c *fiber.Ctx) error {
 	//	placeholderIndex++
 	//}
 
-	if criteria.Photo != "" && c.Locals("user").(*CustomClaims).Role == "VISITOR" {
-		updateQuery += fmt.Sprintf("photo=$%d, ", placeholderIndex)
-		args = append(args, criteria.Photo)
-		placeholderIndex++
-	}
+	// Photos and videos are sent to /api/criteria/media, which validates and stores the file
 
 	//// TODO: Investigate because it may not work if the videoRequired is false
 	//if criteria.VideoRequired {
@@ -197,12 +304,6 @@ func UpdateCriteria(c *fiber.Ctx) error {
 	//	placeholderIndex++
 	//}
 
-	if criteria.Video != "" && c.Locals("user").(*CustomClaims).Role == "VISITOR" {
-		updateQuery += fmt.Sprintf("video=$%d, ", placeholderIndex)
-		args = append(args, criteria.Video)
-		placeholderIndex++
-	}
-
 	// TODO: Investigate because it may not work if the Reusable is false
 	if criteria.Reusable && c.Locals("user").(*CustomClaims).Role == "PROSPECT" {
 		updateQuery += fmt.Sprintf("reusable=$%d, ", placeholderIndex)
@@ -217,6 +318,12 @@ func UpdateCriteria(c *fiber.Ctx) error {
 	//	})
 	//}
 
+	if updateQuery == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Nothing to update",
+		})
+	}
+
 	// Remove the trailing comma and space
 	updateQuery = updateQuery[:len(updateQuery)-2]
 
@@ -250,6 +357,14 @@ func UpdateCriteria(c *fiber.Ctx) error {
 		})
 	}
 
+	if err := invalidateVisitReports(id); err != nil {
+		fmt.Println("💥 Error invalidating the reports in UpdateCriteria() : ", err)
+	}
+
+	if answered {
+		go notifyCriteriaAnswered(id)
+	}
+
 	return c.SendStatus(fiber.StatusNoContent)
 }
 
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+	"strings"
+	"unicode/utf8"
+)
+
+// Longueur maximale de la légende d'une photo ou d'une vidéo
+const mediaMaxCaption = 500
+
+// parseMediaCaption nettoie la légende envoyée avec un média. Une légende vide n'est pas enregistrée.
+func parseMediaCaption(caption string) (*string, error) {
+	caption = strings.TrimSpace(caption)
+	if caption == "" {
+		return nil, nil
+	}
+	if utf8.RuneCountInString(caption) > mediaMaxCaption {
+		return nil, fmt.Errorf("the caption must not exceed %d characters", mediaMaxCaption)
+	}
+	return &caption, nil
+}
+
+// tusMetadata lit l'en-tête Upload-Metadata d'un envoi reprenable : des paires "clé valeur-en-base64" séparées par des virgules.
+func tusMetadata(header string) map[string]string {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if key == "" || err != nil {
+			continue
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata
+}
+
+// attachCriteriaMedia ajoute un média à la fin de la collection d'un critère.
+func attachCriteriaMedia(idCriteria string, idMedia int, caption *string) (int, error) {
+	var id int
+	err := db.QueryRow(`
+		INSERT INTO criteriamedia (idcriteria, idmedia, position, caption)
+		SELECT $1, $2, COALESCE(MAX(position) + 1, 0), $3
+		FROM criteriamedia
+		WHERE idcriteria = $1
+		RETURNING idcriteriamedia`, idCriteria, idMedia, caption).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := invalidateVisitReports(idCriteria); err != nil {
+		fmt.Println("💥 Error invalidating the reports in attachCriteriaMedia() : ", err)
+	}
+	return id, nil
+}
+
+// getCriteriaMedia renvoie, pour chaque critère demandé, ses photos et vidéos dans l'ordre, avec des URL signées pour
+// l'utilisateur phoneNumber.
+func getCriteriaMedia(idCriterias []int, phoneNumber string) (map[int][]CriteriaMedia, error) {
+	rows, err := db.Query(`
+		SELECT cm.idcriteria, cm.idcriteriamedia, cm.idmedia, m.kind, cm.position, cm.caption, m.capturedat, cm.addedat, cm.evidenceflags
+		FROM criteriamedia cm
+		         JOIN media m ON cm.idmedia = m.idmedia
+		WHERE cm.idcriteria = ANY ($1)
+		ORDER BY cm.idcriteria, cm.position, cm.idcriteriamedia`, pq.Array(idCriterias))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in getCriteriaMedia() : ", err)
+		}
+	}(rows)
+
+	collections := map[int][]CriteriaMedia{}
+	for rows.Next() {
+		var idCriteria int
+		var item CriteriaMedia
+		if err := rows.Scan(&idCriteria, &item.ID, &item.MediaID, &item.Kind, &item.Position, &item.Caption, &item.CapturedAt, &item.AddedAt, pq.Array(&item.EvidenceFlags)); err != nil {
+			return nil, err
+		}
+
+		if item.Kind == "PHOTO" {
+			item.URL = mediaURL(&item.MediaID, "web", phoneNumber)
+			item.Thumbnail = mediaURL(&item.MediaID, "thumb", phoneNumber)
+		} else {
+			item.URL = mediaURL(&item.MediaID, "", phoneNumber)
+		}
+
+		collections[idCriteria] = append(collections[idCriteria], item)
+	}
+
+	return collections, rows.Err()
+}
+
+// fillCriteriaMedia complète des critères avec leurs collections de médias.
+func fillCriteriaMedia(criterias []Criteria, phoneNumber string) error {
+	ids := make([]int, len(criterias))
+	for i, crit := range criterias {
+		ids[i] = crit.ID
+	}
+
+	collections, err := getCriteriaMedia(ids, phoneNumber)
+	if err != nil {
+		return err
+	}
+
+	for i := range criterias {
+		criterias[i].Media = collections[criterias[i].ID]
+		if criterias[i].Media == nil {
+			criterias[i].Media = []CriteriaMedia{}
+		}
+
+		// The first photo and video are still returned in the old fields for the previous versions of the app
+		for _, item := range criterias[i].Media {
+			if item.Kind == "PHOTO" && criterias[i].Photo == "" {
+				criterias[i].Photo = item.URL
+			}
+			if item.Kind == "VIDEO" && criterias[i].Video == "" {
+				criterias[i].Video = item.URL
+			}
+		}
+	}
+
+	return nil
+}
+
+// getEditableCriteriaMedia renvoie le critère d'un élément de collection si le visiteur connecté peut le modifier.
+func getEditableCriteriaMedia(c *fiber.Ctx, id string) (string, error) {
+	var idCriteria string
+	err := db.QueryRow(`SELECT idcriteria FROM criteriamedia WHERE idcriteriamedia = $1`, id).Scan(&idCriteria)
+	if err != nil {
+		return "", err
+	}
+
+	if !canUploadCriteriaMedia(c, idCriteria) {
+		return "", errors.New("unauthorized")
+	}
+	return idCriteria, nil
+}
+
+// UpdateCriteriaMedia modifie la légende d'une photo ou d'une vidéo de la collection.
+func UpdateCriteriaMedia(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+
+	idCriteria, err := getEditableCriteriaMedia(c, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Media not found",
+			})
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	}
+
+	done, err := criteriaVisitDone(idCriteria)
+	if err != nil {
+		fmt.Println("💥 Error checking the visit in UpdateCriteriaMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+	if done {
+		return criteriaClosedResponse(c)
+	}
+
+	var body struct {
+		Caption string `json:"caption"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		fmt.Println("💥 Error parsing the body in UpdateCriteriaMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	caption, err := parseMediaCaption(body.Caption)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if _, err := db.Exec(`UPDATE criteriamedia SET caption = $1 WHERE idcriteriamedia = $2`, caption, id); err != nil {
+		fmt.Println("💥 Error updating the media in UpdateCriteriaMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if err := invalidateVisitReports(idCriteria); err != nil {
+		fmt.Println("💥 Error invalidating the reports in UpdateCriteriaMedia() : ", err)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ReorderCriteriaMedia change l'ordre de la collection d'un critère. Le corps contient la liste complète des identifiants
+// des éléments dans le nouvel ordre.
+func ReorderCriteriaMedia(c *fiber.Ctx) error {
+	idCriteria := strings.TrimSpace(c.Query("id"))
+
+	if !canUploadCriteriaMedia(c, idCriteria) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	}
+
+	done, err := criteriaVisitDone(idCriteria)
+	if err != nil {
+		fmt.Println("💥 Error checking the visit in ReorderCriteriaMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+	if done {
+		return criteriaClosedResponse(c)
+	}
+
+	var body struct {
+		Order []int `json:"order"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		fmt.Println("💥 Error parsing the body in ReorderCriteriaMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println("💥 Error starting the transaction in ReorderCriteriaMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in ReorderCriteriaMedia() : ", err)
+		}
+	}(tx)
+
+	// The new order must contain every item of the collection exactly once
+	var count int
+	var matching int
+	err = tx.QueryRow(`
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE idcriteriamedia = ANY ($2))
+		FROM (SELECT idcriteriamedia FROM criteriamedia WHERE idcriteria = $1 FOR UPDATE) cm`,
+		idCriteria, pq.Array(body.Order)).Scan(&count, &matching)
+	if err != nil {
+		fmt.Println("💥 Error scanning the row in ReorderCriteriaMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	seen := map[int]bool{}
+	for _, id := range body.Order {
+		seen[id] = true
+	}
+	if count != len(body.Order) || matching != count || len(seen) != count {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The order must list every media of the criteria once",
+		})
+	}
+
+	for position, id := range body.Order {
+		if _, err := tx.Exec(`UPDATE criteriamedia SET position = $1 WHERE idcriteriamedia = $2`, position, id); err != nil {
+			fmt.Println("💥 Error updating the position in ReorderCriteriaMedia() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		fmt.Println("💥 Error committing the transaction in ReorderCriteriaMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if err := invalidateVisitReports(idCriteria); err != nil {
+		fmt.Println("💥 Error invalidating the reports in ReorderCriteriaMedia() : ", err)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// DeleteCriteriaMedia retire une photo ou une vidéo de la collection d'un critère.
+func DeleteCriteriaMedia(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+
+	idCriteria, err := getEditableCriteriaMedia(c, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Media not found",
+			})
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	}
+
+	done, err := criteriaVisitDone(idCriteria)
+	if err != nil {
+		fmt.Println("💥 Error checking the visit in DeleteCriteriaMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+	if done {
+		return criteriaClosedResponse(c)
+	}
+
+	if _, err := db.Exec(`DELETE FROM criteriamedia WHERE idcriteriamedia = $1`, id); err != nil {
+		fmt.Println("💥 Error deleting the media in DeleteCriteriaMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	// The evidence flags of the criteria only concern the remaining photos
+	if err := refreshCriteriaEvidence(idCriteria); err != nil {
+		fmt.Println("💥 Error refreshing the evidence in DeleteCriteriaMedia() : ", err)
+	}
+
+	if err := invalidateVisitReports(idCriteria); err != nil {
+		fmt.Println("💥 Error invalidating the reports in DeleteCriteriaMedia() : ", err)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// refreshCriteriaEvidence regroupe sur le critère les anomalies relevées sur chacune de ses photos.
+func refreshCriteriaEvidence(idCriteria string) error {
+	_, err := db.Exec(`
+		UPDATE criteria
+		SET evidenceflags = COALESCE((SELECT ARRAY_AGG(DISTINCT flag ORDER BY flag)
+		                              FROM criteriamedia cm
+		                                       CROSS JOIN LATERAL UNNEST(cm.evidenceflags) AS flag
+		                              WHERE cm.idcriteria = $1), '{}')
+		WHERE idcriteria = $1`, idCriteria)
+	return err
+}
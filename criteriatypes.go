@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Types de critères
+const (
+	criteriaText           = "TEXT"
+	criteriaYesNo          = "YES_NO"
+	criteriaRating         = "RATING"
+	criteriaNumber         = "NUMBER"
+	criteriaSingleChoice   = "SINGLE_CHOICE"
+	criteriaMultipleChoice = "MULTIPLE_CHOICE"
+)
+
+var criteriaTypes = map[string]bool{
+	criteriaText:           true,
+	criteriaYesNo:          true,
+	criteriaRating:         true,
+	criteriaNumber:         true,
+	criteriaSingleChoice:   true,
+	criteriaMultipleChoice: true,
+}
+
+// Longueur maximale d'une réponse en texte libre
+const criteriaMaxTextAnswer = 2000
+
+// normalizeCriteriaDefinition vérifie le type et les options d'un critère défini par un prospect, et complète les
+// valeurs par défaut (note de 1 à 5).
+func normalizeCriteriaDefinition(criteria *Criteria) error {
+	criteria.Type = strings.ToUpper(strings.TrimSpace(criteria.Type))
+	if criteria.Type == "" {
+		criteria.Type = criteriaText
+	}
+
+	if !criteriaTypes[criteria.Type] {
+		return fmt.Errorf("unknown criteria type %q", criteria.Type)
+	}
+
+	options := criteria.Options
+	if options == nil {
+		options = &CriteriaOptions{}
+	}
+
+	switch criteria.Type {
+	case criteriaRating:
+		if options.Min == nil {
+			options.Min = new(float64)
+			*options.Min = 1
+		}
+		if options.Max == nil {
+			options.Max = new(float64)
+			*options.Max = 5
+		}
+		if *options.Min != math.Trunc(*options.Min) || *options.Max != math.Trunc(*options.Max) {
+			return errors.New("the bounds of a rating must be whole numbers")
+		}
+	case criteriaSingleChoice, criteriaMultipleChoice:
+		seen := map[string]bool{}
+		for i, choice := range options.Choices {
+			options.Choices[i] = strings.TrimSpace(choice)
+			if options.Choices[i] == "" || seen[options.Choices[i]] {
+				return errors.New("the choices must be distinct and not empty")
+			}
+			seen[options.Choices[i]] = true
+		}
+		if len(options.Choices) < 2 {
+			return errors.New("a choice criteria needs at least 2 choices")
+		}
+	}
+
+	if options.Min != nil && options.Max != nil && *options.Min >= *options.Max {
+		return errors.New("the minimum must be lower than the maximum")
+	}
+
+	if criteria.Type == criteriaText || criteria.Type == criteriaYesNo {
+		options = nil
+	}
+	criteria.Options = options
+	return nil
+}
+
+// parseCriteriaAnswer valide la réponse d'un visiteur selon le type du critère. Elle renvoie la réponse typée, en JSON,
+// et sa version texte enregistrée dans criteriaAnswer.
+func parseCriteriaAnswer(criteriaType string, options *CriteriaOptions, raw json.RawMessage) (json.RawMessage, string, error) {
+	if options == nil {
+		options = &CriteriaOptions{}
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, "", errors.New("the answer is not valid JSON")
+	}
+
+	// Answers sent as text (e.g. "yes" or "2.5") are accepted for every type
+	text, isText := value.(string)
+	text = strings.TrimSpace(text)
+
+	var answer interface{}
+	var display string
+
+	switch criteriaType {
+	case criteriaText:
+		if !isText || text == "" || utf8.RuneCountInString(text) > criteriaMaxTextAnswer {
+			return nil, "", fmt.Errorf("the answer must be a text of 1 to %d characters", criteriaMaxTextAnswer)
+		}
+		answer, display = text, text
+
+	case criteriaYesNo:
+		b, ok := value.(bool)
+		if isText {
+			switch strings.ToLower(text) {
+			case "yes", "oui", "true":
+				b, ok = true, true
+			case "no", "non", "false":
+				b, ok = false, true
+			}
+		}
+		if !ok {
+			return nil, "", errors.New("the answer must be yes or no")
+		}
+		answer, display = b, "No"
+		if b {
+			display = "Yes"
+		}
+
+	case criteriaRating, criteriaNumber:
+		n, ok := value.(float64)
+		if isText {
+			parsed, err := strconv.ParseFloat(strings.ReplaceAll(text, ",", "."), 64)
+			n, ok = parsed, err == nil
+		}
+		if !ok || math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, "", errors.New("the answer must be a number")
+		}
+		if criteriaType == criteriaRating && n != math.Trunc(n) {
+			return nil, "", errors.New("the rating must be a whole number")
+		}
+		if (options.Min != nil && n < *options.Min) || (options.Max != nil && n > *options.Max) {
+			return nil, "", fmt.Errorf("the answer must be between %s and %s", formatCriteriaBound(options.Min), formatCriteriaBound(options.Max))
+		}
+		answer = n
+		display = strings.TrimSpace(strconv.FormatFloat(n, 'f', -1, 64) + " " + options.Unit)
+		if criteriaType == criteriaRating {
+			display = fmt.Sprintf("%s/%s", strconv.FormatFloat(n, 'f', -1, 64), formatCriteriaBound(options.Max))
+		}
+
+	case criteriaSingleChoice:
+		if !isText || !containsString(options.Choices, text) {
+			return nil, "", fmt.Errorf("the answer must be one of: %s", strings.Join(options.Choices, ", "))
+		}
+		answer, display = text, text
+
+	case criteriaMultipleChoice:
+		values, ok := value.([]interface{})
+		if !ok || len(values) == 0 {
+			return nil, "", errors.New("the answer must be a list of choices")
+		}
+
+		chosen := []string{}
+		for _, v := range values {
+			choice, ok := v.(string)
+			if !ok || !containsString(options.Choices, choice) || containsString(chosen, choice) {
+				return nil, "", fmt.Errorf("the answer must only contain distinct choices among: %s", strings.Join(options.Choices, ", "))
+			}
+			chosen = append(chosen, choice)
+		}
+		answer, display = chosen, strings.Join(chosen, ", ")
+
+	default:
+		return nil, "", fmt.Errorf("unknown criteria type %q", criteriaType)
+	}
+
+	typed, err := json.Marshal(answer)
+	return typed, display, err
+}
+
+func formatCriteriaBound(bound *float64) string {
+	if bound == nil {
+		return "∞"
+	}
+	return strconv.FormatFloat(*bound, 'f', -1, 64)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// scanCriteriaTyping complète un critère avec ses options et sa réponse typée, lues en JSON dans la base de données.
+func scanCriteriaTyping(criteria *Criteria, options []byte, answer []byte) error {
+	criteria.Options = nil
+	if len(options) > 0 {
+		if err := json.Unmarshal(options, &criteria.Options); err != nil {
+			return err
+		}
+	}
+
+	criteria.Answer = nil
+	if len(answer) > 0 {
+		criteria.Answer = answer
+	}
+	return nil
+}
+
+// getCriteriaDefinition renvoie le type et les options d'un critère enregistré.
+func getCriteriaDefinition(idCriteria string) (string, *CriteriaOptions, error) {
+	var criteriaType string
+	var raw []byte
+	err := db.QueryRow(`SELECT criteriatype, options FROM criteria WHERE idcriteria = $1`, idCriteria).Scan(&criteriaType, &raw)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var options *CriteriaOptions
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &options); err != nil {
+			return "", nil, err
+		}
+	}
+	return criteriaType, options, nil
+}
+
+// criteriaAnswered indique si le visiteur a déjà répondu au critère.
+func criteriaAnswered(idCriteria string) (bool, error) {
+	var answered bool
+	err := db.QueryRow(`SELECT answer IS NOT NULL OR COALESCE(criteriaanswer, '') != '' FROM criteria WHERE idcriteria = $1`, idCriteria).Scan(&answered)
+	return answered, err
+}
+
+// criteriaOptionsValue convertit les options d'un critère pour les enregistrer dans une colonne JSONB.
+func criteriaOptionsValue(options *CriteriaOptions) (interface{}, error) {
+	if options == nil {
+		return nil, nil
+	}
+
+	raw, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	return string(raw), nil
+}
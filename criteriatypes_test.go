@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+func TestNormalizeCriteriaDefinition(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   Criteria
+		want    Criteria
+		wantErr bool
+	}{
+		{
+			name:  "text by default",
+			input: Criteria{},
+			want:  Criteria{Type: criteriaText},
+		},
+		{
+			name:  "type is case insensitive",
+			input: Criteria{Type: " yes_no "},
+			want:  Criteria{Type: criteriaYesNo},
+		},
+		{
+			name:  "options of a text are dropped",
+			input: Criteria{Type: "TEXT", Options: &CriteriaOptions{Unit: "m²"}},
+			want:  Criteria{Type: criteriaText},
+		},
+		{
+			name:  "rating from 1 to 5 by default",
+			input: Criteria{Type: "RATING"},
+			want:  Criteria{Type: criteriaRating, Options: &CriteriaOptions{Min: floatPtr(1), Max: floatPtr(5)}},
+		},
+		{
+			name:  "rating with custom bounds",
+			input: Criteria{Type: "RATING", Options: &CriteriaOptions{Min: floatPtr(0), Max: floatPtr(10)}},
+			want:  Criteria{Type: criteriaRating, Options: &CriteriaOptions{Min: floatPtr(0), Max: floatPtr(10)}},
+		},
+		{
+			name:    "rating with decimal bounds",
+			input:   Criteria{Type: "RATING", Options: &CriteriaOptions{Max: floatPtr(4.5)}},
+			wantErr: true,
+		},
+		{
+			name:    "minimum above the maximum",
+			input:   Criteria{Type: "NUMBER", Options: &CriteriaOptions{Min: floatPtr(10), Max: floatPtr(2)}},
+			wantErr: true,
+		},
+		{
+			name:  "number without bounds",
+			input: Criteria{Type: "NUMBER", Options: &CriteriaOptions{Unit: "m²"}},
+			want:  Criteria{Type: criteriaNumber, Options: &CriteriaOptions{Unit: "m²"}},
+		},
+		{
+			name:  "choices are trimmed",
+			input: Criteria{Type: "SINGLE_CHOICE", Options: &CriteriaOptions{Choices: []string{" North ", "South"}}},
+			want:  Criteria{Type: criteriaSingleChoice, Options: &CriteriaOptions{Choices: []string{"North", "South"}}},
+		},
+		{
+			name:    "a single choice",
+			input:   Criteria{Type: "MULTIPLE_CHOICE", Options: &CriteriaOptions{Choices: []string{"Gas"}}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate choices",
+			input:   Criteria{Type: "SINGLE_CHOICE", Options: &CriteriaOptions{Choices: []string{"Gas", " Gas"}}},
+			wantErr: true,
+		},
+		{
+			name:    "empty choice",
+			input:   Criteria{Type: "SINGLE_CHOICE", Options: &CriteriaOptions{Choices: []string{"Gas", ""}}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown type",
+			input:   Criteria{Type: "DATE"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			criteria := tt.input
+			err := normalizeCriteriaDefinition(&criteria)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if criteria.Type != tt.want.Type {
+				t.Errorf("Type = %q, want %q", criteria.Type, tt.want.Type)
+			}
+			if !reflect.DeepEqual(criteria.Options, tt.want.Options) {
+				got, _ := json.Marshal(criteria.Options)
+				want, _ := json.Marshal(tt.want.Options)
+				t.Errorf("Options = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestParseCriteriaAnswer(t *testing.T) {
+	rating := &CriteriaOptions{Min: floatPtr(1), Max: floatPtr(5)}
+	surface := &CriteriaOptions{Min: floatPtr(0), Unit: "m²"}
+	choices := &CriteriaOptions{Choices: []string{"Gas", "Electric", "Wood"}}
+	// The length of a text is counted in characters, not in bytes
+	longest := strings.Repeat("é", criteriaMaxTextAnswer)
+
+	tests := []struct {
+		name         string
+		criteriaType string
+		options      *CriteriaOptions
+		raw          string
+		typed        string
+		display      string
+		wantErr      bool
+	}{
+		{"text", criteriaText, nil, `" Bright living room "`, `"Bright living room"`, "Bright living room", false},
+		{"empty text", criteriaText, nil, `"  "`, "", "", true},
+		{"text as a number", criteriaText, nil, `12`, "", "", true},
+		{"longest text", criteriaText, nil, `"` + longest + `"`, `"` + longest + `"`, longest, false},
+		{"text too long", criteriaText, nil, `"` + longest + `e"`, "", "", true},
+		{"yes", criteriaYesNo, nil, `true`, `true`, "Yes", false},
+		{"no", criteriaYesNo, nil, `false`, `false`, "No", false},
+		{"yes as text", criteriaYesNo, nil, `"Oui"`, `true`, "Yes", false},
+		{"no as text", criteriaYesNo, nil, `"no"`, `false`, "No", false},
+		{"neither yes nor no", criteriaYesNo, nil, `"maybe"`, "", "", true},
+		{"rating", criteriaRating, rating, `4`, `4`, "4/5", false},
+		{"rating as text", criteriaRating, rating, `"3"`, `3`, "3/5", false},
+		{"decimal rating", criteriaRating, rating, `3.5`, "", "", true},
+		{"rating out of bounds", criteriaRating, rating, `6`, "", "", true},
+		{"number with unit", criteriaNumber, surface, `42.5`, `42.5`, "42.5 m²", false},
+		{"number with a decimal comma", criteriaNumber, surface, `"42,5"`, `42.5`, "42.5 m²", false},
+		{"number below the minimum", criteriaNumber, surface, `-1`, "", "", true},
+		{"number without options", criteriaNumber, nil, `7`, `7`, "7", false},
+		{"not a number", criteriaNumber, surface, `"big"`, "", "", true},
+		{"single choice", criteriaSingleChoice, choices, `"Gas"`, `"Gas"`, "Gas", false},
+		{"unknown choice", criteriaSingleChoice, choices, `"Oil"`, "", "", true},
+		{"multiple choice", criteriaMultipleChoice, choices, `["Gas", "Wood"]`, `["Gas","Wood"]`, "Gas, Wood", false},
+		{"empty multiple choice", criteriaMultipleChoice, choices, `[]`, "", "", true},
+		{"repeated choice", criteriaMultipleChoice, choices, `["Gas", "Gas"]`, "", "", true},
+		{"unknown type", "DATE", nil, `"2024-01-01"`, "", "", true},
+		{"invalid JSON", criteriaText, nil, `{`, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typed, display, err := parseCriteriaAnswer(tt.criteriaType, tt.options, json.RawMessage(tt.raw))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if string(typed) != tt.typed {
+				t.Errorf("typed = %s, want %s", typed, tt.typed)
+			}
+			if display != tt.display {
+				t.Errorf("display = %q, want %q", display, tt.display)
+			}
+		})
+	}
+}
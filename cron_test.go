@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{"* * * * *", false},
+		{"*/5 * * * *", false},
+		{"0 9-18/3 * * 1-5", false},
+		{"0,30 * 1,15 * *", false},
+		{"5/15 * * * *", false},
+		{"0 0 * * 7", false},
+		{"* * * *", true},
+		{"* * * * * *", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"*/0 * * * *", true},
+		{"5-1 * * * *", true},
+		{"a * * * *", true},
+		{"1-a * * * *", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := parseCron(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseCron(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	// Friday, May 10th 2024
+	from := time.Date(2024, 5, 10, 12, 34, 56, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", from, time.Date(2024, 5, 10, 12, 35, 0, 0, time.UTC)},
+		{"*/5 * * * *", from, time.Date(2024, 5, 10, 12, 35, 0, 0, time.UTC)},
+		{"*/5 * * * *", time.Date(2024, 5, 10, 12, 35, 0, 0, time.UTC), time.Date(2024, 5, 10, 12, 40, 0, 0, time.UTC)},
+		{"30 * * * *", from, time.Date(2024, 5, 10, 13, 30, 0, 0, time.UTC)},
+		{"0 0 * * *", from, time.Date(2024, 5, 11, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1", from, time.Date(2024, 5, 13, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 0", from, time.Date(2024, 5, 12, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", from, time.Date(2024, 5, 12, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", from, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 1 *", from, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", from, time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// The day of the month or the day of the week: the 15th, or the next Monday
+		{"0 0 15 * 1", from, time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", from, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			schedule, err := parseCron(tt.spec)
+			if err != nil {
+				t.Fatalf("parseCron(%q) error = %v", tt.spec, err)
+			}
+
+			if got := schedule.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.from, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"strconv"
+	"strings"
+)
+
+// Événements du cycle de vie d'une visite notifiés sur les téléphones
+const (
+	pushVisitCreated     = "VISIT_CREATED"
+	pushVisitAccepted    = "VISIT_ACCEPTED"
+	pushVisitCancelled   = "VISIT_CANCELLED"
+	pushCriteriaAnswered = "CRITERIA_ANSWERED"
+	pushCodeVerified     = "CODE_VERIFIED"
+	pushVisitReminder    = "VISIT_REMINDER"
+	pushMessageReceived  = "MESSAGE_RECEIVED"
+)
+
+// pushJob est la tâche d'envoi d'une notification à un appareil.
+type pushJob struct {
+	IDDevice     int              `json:"device_id"`
+	Notification pushNotification `json:"notification"`
+}
+
+// RegisterDevice enregistre le jeton de notifications ("token") du téléphone de l'utilisateur connecté, fourni par FCM
+// ou APNS ("provider").
+func RegisterDevice(c *fiber.Ctx) error {
+	var body struct {
+		Provider string `json:"provider"`
+		Token    string `json:"token"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the provider and the token of the device",
+		})
+	}
+
+	provider := strings.ToUpper(strings.TrimSpace(body.Provider))
+	token := strings.TrimSpace(body.Token)
+	if (provider != "FCM" && provider != "APNS") || token == "" || len(token) > 512 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide a valid token and a provider among FCM and APNS",
+		})
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO device (phonenumber, provider, token)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (token) DO UPDATE SET phonenumber = EXCLUDED.phonenumber, provider = EXCLUDED.provider, lastseenat = NOW()`,
+		c.Locals("user").(*CustomClaims).PhoneNumber, provider, token)
+	if err != nil {
+		fmt.Println("💥 Error registering the device in RegisterDevice() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// UnregisterDevice oublie un téléphone de l'utilisateur connecté, par exemple lorsqu'il se déconnecte de l'application.
+func UnregisterDevice(c *fiber.Ctx) error {
+	token := strings.TrimSpace(c.Query("token"))
+	if token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the token of the device",
+		})
+	}
+
+	_, err := db.Exec(`DELETE FROM device WHERE token = $1 AND phonenumber = $2`, token, c.Locals("user").(*CustomClaims).PhoneNumber)
+	if err != nil {
+		fmt.Println("💥 Error deleting the device in UnregisterDevice() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// deviceStore donne accès aux appareils enregistrés lors de l'envoi d'une notification.
+type deviceStore interface {
+	Device(id int) (provider string, token string, err error)
+	Forget(id int) error
+}
+
+// postgresDeviceStore lit les appareils dans la table device.
+type postgresDeviceStore struct{}
+
+func (postgresDeviceStore) Device(id int) (string, string, error) {
+	var provider, token string
+	err := db.QueryRow(`SELECT provider, token FROM device WHERE iddevice = $1`, id).Scan(&provider, &token)
+	return provider, token, err
+}
+
+func (postgresDeviceStore) Forget(id int) error {
+	_, err := db.Exec(`DELETE FROM device WHERE iddevice = $1`, id)
+	return err
+}
+
+// Appareils utilisés par sendPush
+var pushDevices deviceStore = postgresDeviceStore{}
+
+// sendPush envoie une notification à un appareil. Un appareil dont le jeton n'est plus valide est oublié.
+func sendPush(payload json.RawMessage) error {
+	var job pushJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+
+	provider, token, err := pushDevices.Device(job.IDDevice)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// The device has been unregistered in the meantime
+			return nil
+		}
+		return err
+	}
+
+	n, err := getNotifier(provider)
+	if err != nil {
+		return err
+	}
+
+	err = n.Send(token, job.Notification)
+	if errors.Is(err, errDeviceTokenInvalid) {
+		err = pushDevices.Forget(job.IDDevice)
+	}
+	return err
+}
+
+// pushToUser met en file une notification pour chacun des téléphones d'un utilisateur.
+func pushToUser(phoneNumber string, notification pushNotification) error {
+	rows, err := db.Query(`SELECT iddevice FROM device WHERE phonenumber = $1`, phoneNumber)
+	if err != nil {
+		return err
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in pushToUser() : ", err)
+		}
+	}(rows)
+
+	var devices []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		devices = append(devices, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range devices {
+		if err := enqueueJob(db, "push.send", pushJob{IDDevice: id, Notification: notification}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyVisitEvent prévient par une notification push la partie d'une visite concernée par un événement : le visiteur
+// pour une nouvelle demande, le prospect pour la suite, et l'autre partie pour une annulation ou un message de actor.
+func notifyVisitEvent(idVisit string, event string, actor string) {
+	var prospect, visitor, start string
+	err := db.QueryRow(`SELECT phonenumberprospect, phonenumbervisitor, TO_CHAR(starttime, 'DD/MM à HH24hMI') FROM visit WHERE idvisit = $1`,
+		idVisit).Scan(&prospect, &visitor, &start)
+	if err != nil {
+		fmt.Println("💥 Error scanning the row in notifyVisitEvent() : ", err)
+		return
+	}
+
+	recipient := prospect
+	notification := pushNotification{Data: map[string]string{"event": event, "visit_id": idVisit}}
+	switch event {
+	case pushVisitCreated:
+		recipient = visitor
+		notification.Title = "Nouvelle demande de visite"
+		notification.Body = fmt.Sprintf("Une visite vous est proposée le %s.", start)
+	case pushVisitAccepted:
+		notification.Title = "Visite acceptée"
+		notification.Body = fmt.Sprintf("Le visiteur a accepté votre visite du %s.", start)
+	case pushVisitCancelled:
+		if actor == prospect {
+			recipient = visitor
+		}
+		notification.Title = "Visite annulée"
+		notification.Body = fmt.Sprintf("La visite du %s a été annulée.", start)
+	case pushMessageReceived:
+		if actor == prospect {
+			recipient = visitor
+		}
+		notification.Title = "Nouveau message"
+		notification.Body = fmt.Sprintf("Vous avez reçu un message à propos de la visite du %s.", start)
+	case pushCriteriaAnswered:
+		notification.Title = "Nouvelle réponse"
+		notification.Body = fmt.Sprintf("Le visiteur a répondu à l'un de vos critères pour la visite du %s.", start)
+	case pushCodeVerified:
+		notification.Title = "Visite terminée"
+		notification.Body = fmt.Sprintf("Le code a été vérifié, la visite du %s est terminée. Son rapport est disponible.", start)
+	default:
+		fmt.Println("💥 Error in notifyVisitEvent() : unknown event ", event)
+		return
+	}
+
+	if err := pushToUser(recipient, notification); err != nil {
+		fmt.Println("💥 Error sending the notification in notifyVisitEvent() : ", err)
+	}
+}
+
+// notifyCriteriaAnswered prévient le prospect de la réponse du visiteur à un critère.
+func notifyCriteriaAnswered(idCriteria string) {
+	var idVisit int
+	err := db.QueryRow(`SELECT idvisit FROM linkcriteriavisit WHERE idcriteria = $1`, idCriteria).Scan(&idVisit)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			fmt.Println("💥 Error scanning the row in notifyCriteriaAnswered() : ", err)
+		}
+		return
+	}
+
+	notifyVisitEvent(strconv.Itoa(idVisit), pushCriteriaAnswered, "")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// fakeDeviceStore garde les appareils en mémoire et note ceux qui ont été oubliés.
+type fakeDeviceStore struct {
+	devices   map[int][2]string
+	forgotten []int
+}
+
+func (s *fakeDeviceStore) Device(id int) (string, string, error) {
+	device, ok := s.devices[id]
+	if !ok {
+		return "", "", sql.ErrNoRows
+	}
+	return device[0], device[1], nil
+}
+
+func (s *fakeDeviceStore) Forget(id int) error {
+	delete(s.devices, id)
+	s.forgotten = append(s.forgotten, id)
+	return nil
+}
+
+func TestSendPush(t *testing.T) {
+	notification := pushNotification{Title: "Visite acceptée", Body: "Votre visite a été acceptée"}
+
+	tests := []struct {
+		name     string
+		deviceID int
+		// Raw payload sent instead of the job built from deviceID
+		raw           string
+		wantErr       bool
+		wantSent      []string
+		wantForgotten []int
+	}{
+		{"valid token", 1, "", false, []string{"token-1"}, nil},
+		{"APNS device", 2, "", false, []string{"token-2"}, nil},
+		{"invalid token is forgotten", 3, "", false, nil, []int{3}},
+		{"unregistered device", 99, "", false, nil, nil},
+		{"unknown provider", 4, "", true, nil, nil},
+		{"invalid payload", 0, `{"device_id":"one"}`, true, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newMemoryNotifier()
+			useMemoryNotifier(t, fake)
+
+			store := &fakeDeviceStore{devices: map[int][2]string{
+				1: {"FCM", "token-1"},
+				2: {"APNS", "token-2"},
+				3: {"FCM", "invalid-token-3"},
+				4: {"WNS", "token-4"},
+			}}
+			previous := pushDevices
+			pushDevices = store
+			t.Cleanup(func() { pushDevices = previous })
+
+			payload := json.RawMessage(tt.raw)
+			if tt.raw == "" {
+				payload, _ = json.Marshal(pushJob{IDDevice: tt.deviceID, Notification: notification})
+			}
+
+			err := sendPush(payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sendPush() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var sent []string
+			for _, s := range fake.Sent() {
+				if !reflect.DeepEqual(s.Notification, notification) {
+					t.Errorf("notification = %+v, want %+v", s.Notification, notification)
+				}
+				sent = append(sent, s.Token)
+			}
+			if !reflect.DeepEqual(sent, tt.wantSent) {
+				t.Errorf("sent to %v, want %v", sent, tt.wantSent)
+			}
+			if !reflect.DeepEqual(store.forgotten, tt.wantForgotten) {
+				t.Errorf("forgotten = %v, want %v", store.forgotten, tt.wantForgotten)
+			}
+		})
+	}
+}
+
+// useMemoryNotifier remplace les services de notifications par n le temps du test.
+func useMemoryNotifier(t *testing.T, n *memoryNotifier) {
+	t.Helper()
+
+	notifiersOnce.Do(func() {})
+	previous := notifiers
+	notifiers = map[string]notifier{"FCM": n, "APNS": n}
+	t.Cleanup(func() { notifiers = previous })
+}
+
+func TestMemoryNotifier(t *testing.T) {
+	n := newMemoryNotifier()
+
+	if err := n.Send("token", pushNotification{Title: "a"}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if err := n.Send("invalid-token", pushNotification{Title: "b"}); !errors.Is(err, errDeviceTokenInvalid) {
+		t.Fatalf("Send() error = %v, want %v", err, errDeviceTokenInvalid)
+	}
+
+	sent := n.Sent()
+	if len(sent) != 1 || sent[0].Token != "token" || sent[0].Notification.Title != "a" {
+		t.Fatalf("Sent() = %+v, want the notification sent to token", sent)
+	}
+
+	// Sent returns a copy
+	sent[0].Token = "changed"
+	if n.Sent()[0].Token != "token" {
+		t.Errorf("Sent() is not a copy")
+	}
+}
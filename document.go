@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	documentMasterKey     []byte
+	documentMasterKeyID   string
+	documentMasterKeyErr  error
+	documentMasterKeyOnce sync.Once
+)
+
+// loadDocumentMasterKey lit la clé maître (32 octets encodés en base64) utilisée pour chiffrer les clés des documents.
+func loadDocumentMasterKey() ([]byte, string, error) {
+	documentMasterKeyOnce.Do(func() {
+		documentMasterKey, documentMasterKeyErr = base64.StdEncoding.DecodeString(os.Getenv("DOCUMENT_MASTER_KEY"))
+		if documentMasterKeyErr == nil && len(documentMasterKey) != 32 {
+			documentMasterKeyErr = fmt.Errorf("DOCUMENT_MASTER_KEY must be 32 bytes encoded in base64")
+		}
+
+		documentMasterKeyID = os.Getenv("DOCUMENT_MASTER_KEY_ID")
+		if documentMasterKeyID == "" {
+			documentMasterKeyID = "local-1"
+		}
+	})
+
+	return documentMasterKey, documentMasterKeyID, documentMasterKeyErr
+}
+
+// gcmSeal chiffre data avec AES-GCM, le nonce est placé en tête du résultat.
+func gcmSeal(key []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// gcmOpen déchiffre une donnée produite par gcmSeal.
+func gcmOpen(key []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+// sealDocument chiffre un document avec une clé de données aléatoire, puis chiffre cette clé avec la clé maître.
+func sealDocument(plain []byte) (ciphertext []byte, wrappedKey []byte, keyID string, err error) {
+	masterKey, keyID, err := loadDocumentMasterKey()
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, "", err
+	}
+
+	ciphertext, err = gcmSeal(dataKey, plain)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	wrappedKey, err = gcmSeal(masterKey, dataKey)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	return ciphertext, wrappedKey, keyID, nil
+}
+
+// openDocument déchiffre un document chiffré par sealDocument.
+func openDocument(ciphertext []byte, wrappedKey []byte, keyID string) ([]byte, error) {
+	masterKey, currentKeyID, err := loadDocumentMasterKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if keyID != currentKeyID {
+		return nil, fmt.Errorf("document encrypted with unknown master key %q", keyID)
+	}
+
+	dataKey, err := gcmOpen(masterKey, wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcmOpen(dataKey, ciphertext)
+}
+
+// decodeDocument extrait le contenu d'une pièce d'identité envoyée par l'application (data URI ou valeur brute).
+func decodeDocument(value string) ([]byte, string) {
+	if strings.HasPrefix(value, "data:") {
+		header, payload, found := strings.Cut(value, ",")
+		if found && strings.HasSuffix(header, ";base64") {
+			if decoded, err := base64.StdEncoding.DecodeString(payload); err == nil {
+				return decoded, strings.TrimSuffix(strings.TrimPrefix(header, "data:"), ";base64")
+			}
+		}
+	}
+
+	return []byte(value), "text/plain"
+}
+
+// storeIdentityDocument chiffre et enregistre une face de la pièce d'identité d'un utilisateur.
+func storeIdentityDocument(tx *sql.Tx, phoneNumber string, side string, value string) (int, error) {
+	plain, contentType := decodeDocument(value)
+
+	ciphertext, wrappedKey, keyID, err := sealDocument(plain)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = tx.QueryRow(`
+		INSERT INTO identitydocument (phonenumber, side, contenttype, keyid, wrappedkey, ciphertext)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING iddocument`,
+		phoneNumber, side, contentType, keyID, wrappedKey, ciphertext,
+	).Scan(&id)
+
+	return id, err
+}
+
+// GetIdentityDocument déchiffre une pièce d'identité à la demande, à partir d'une URL signée. Chaque accès est
+// journalisé avec son motif.
+func GetIdentityDocument(c *fiber.Ctx) error {
+	claims := c.Locals("user").(*CustomClaims)
+	id := strings.TrimSpace(c.Query("id"))
+	reason := strings.TrimSpace(c.Query("reason"))
+
+	if id == "" || reason == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the ID of the document and the reason of the access",
+		})
+	}
+
+	if err := verifySignedURL(c, documentPath); err != nil {
+		return signedURLErrorResponse(c, err)
+	}
+
+	var owner, contentType, keyID string
+	var ciphertext, wrappedKey []byte
+	var purgedAt sql.NullTime
+	err := db.QueryRow(`SELECT phonenumber, contenttype, keyid, ciphertext, wrappedkey, purgedat FROM identitydocument WHERE iddocument = $1`, id).Scan(&owner, &contentType, &keyID, &ciphertext, &wrappedKey, &purgedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Document not found",
+			})
+		}
+
+		fmt.Println("💥 Error scanning the row in GetIdentityDocument() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if claims.Role != "ADMIN" && claims.PhoneNumber != owner {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	}
+
+	_, err = db.Exec(`INSERT INTO documentaccesslog (iddocument, accessedby, reason, ip) VALUES ($1, $2, $3, $4)`, id, claims.PhoneNumber, reason, c.IP())
+	if err != nil {
+		fmt.Println("💥 Error logging the access in GetIdentityDocument() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if purgedAt.Valid {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "This document has been purged",
+		})
+	}
+
+	plain, err := openDocument(ciphertext, wrappedKey, keyID)
+	if err != nil {
+		fmt.Println("💥 Error decrypting the document in GetIdentityDocument() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Send(plain)
+}
+
+// scheduleIdentityDocumentsPurge planifie la suppression des pièces d'identité d'un visiteur validé,
+// après la durée de conservation DOCUMENT_RETENTION.
+func scheduleIdentityDocumentsPurge(tx *sql.Tx, phoneNumber string) error {
+	_, err := tx.Exec(`
+		UPDATE identitydocument
+		SET purgeafter = $1
+		WHERE phonenumber = $2 AND purgedat IS NULL`,
+		time.Now().Add(getEnvDuration("DOCUMENT_RETENTION", 30*24*time.Hour)), phoneNumber)
+	return err
+}
+
+// purgeIdentityDocuments efface le contenu chiffré et la clé des documents dont la durée de conservation est dépassée.
+func purgeIdentityDocuments() (int64, error) {
+	result, err := db.Exec(`
+		UPDATE identitydocument
+		SET ciphertext = NULL, wrappedkey = NULL, purgedat = NOW()
+		WHERE purgeafter <= NOW() AND purgedat IS NULL`)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// migratePlainIdentityDocuments chiffre les pièces d'identité encore stockées en clair, dans les dossiers de
+// vérification puis dans la table "user", et ne vide les anciennes colonnes qu'une fois leur contenu chiffré.
+func migratePlainIdentityDocuments() error {
+	rows, err := db.Query(`
+		SELECT idverificationcase, phonenumber, COALESCE(cnifront, ''), COALESCE(cniback, '')
+		FROM verificationcase
+		WHERE COALESCE(cnifront, '') != '' OR COALESCE(cniback, '') != ''`)
+	if err != nil {
+		return err
+	}
+
+	type plainCase struct {
+		id          int
+		phoneNumber string
+		front       string
+		back        string
+	}
+
+	var cases []plainCase
+	for rows.Next() {
+		var pc plainCase
+		if err := rows.Scan(&pc.id, &pc.phoneNumber, &pc.front, &pc.back); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		cases = append(cases, pc)
+	}
+
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	for _, pc := range cases {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		idFront, idBack, err := sealPlainIdentityDocuments(tx, pc.phoneNumber, pc.front, pc.back)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE verificationcase SET idcnifront = COALESCE($1, idcnifront), idcniback = COALESCE($2, idcniback), cnifront = NULL, cniback = NULL WHERE idverificationcase = $3`, idFront, idBack, pc.id)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	// Migration 001 only copied the documents of the pending visitors into the verification cases: the documents of
+	// the other users are encrypted straight from their row
+	rows, err = db.Query(`
+		SELECT phonenumber, status, COALESCE(cnifront, ''), COALESCE(cniback, '')
+		FROM "user"
+		WHERE COALESCE(cnifront, '') != '' OR COALESCE(cniback, '') != ''`)
+	if err != nil {
+		return err
+	}
+
+	type plainUser struct {
+		phoneNumber string
+		status      string
+		front       string
+		back        string
+	}
+
+	var users []plainUser
+	for rows.Next() {
+		var pu plainUser
+		if err := rows.Scan(&pu.phoneNumber, &pu.status, &pu.front, &pu.back); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		users = append(users, pu)
+	}
+
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	for _, pu := range users {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, _, err := sealPlainIdentityDocuments(tx, pu.phoneNumber, pu.front, pu.back); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if pu.status == "VALIDATED" {
+			if err := scheduleIdentityDocumentsPurge(tx, pu.phoneNumber); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sealPlainIdentityDocuments chiffre les pièces d'identité en clair d'un utilisateur, puis vide les colonnes de la
+// table "user" qui contenaient exactement ces documents.
+func sealPlainIdentityDocuments(tx *sql.Tx, phoneNumber string, front string, back string) (*int, *int, error) {
+	var idFront, idBack *int
+	if front != "" {
+		id, err := storeIdentityDocument(tx, phoneNumber, "FRONT", front)
+		if err != nil {
+			return nil, nil, err
+		}
+		idFront = &id
+	}
+
+	if back != "" {
+		id, err := storeIdentityDocument(tx, phoneNumber, "BACK", back)
+		if err != nil {
+			return nil, nil, err
+		}
+		idBack = &id
+	}
+
+	_, err := tx.Exec(`
+		UPDATE "user"
+		SET CniFront = CASE WHEN CniFront = $2 THEN NULL ELSE CniFront END,
+		    CniBack  = CASE WHEN CniBack = $3 THEN NULL ELSE CniBack END
+		WHERE PhoneNumber = $1`, phoneNumber, front, back)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return idFront, idBack, nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// emailJob est la tâche d'envoi d'un e-mail déjà rendu et enregistré.
+type emailJob struct {
+	IDEmail int `json:"email_id"`
+}
+
+// emailUser envoie un e-mail à un utilisateur, dans sa langue. L'e-mail est mis en file en arrière-plan pour ne pas
+// bloquer la requête.
+func emailUser(phoneNumber string, template string, data map[string]interface{}) {
+	go func() {
+		if err := queueEmail(phoneNumber, template, data); err != nil {
+			fmt.Println("💥 Error queueing the email in emailUser() : ", err)
+		}
+	}()
+}
+
+// queueEmail rend un e-mail pour un utilisateur, l'enregistre et met son envoi en file. Rien n'est envoyé à un
+// utilisateur sans adresse e-mail.
+func queueEmail(phoneNumber string, template string, data map[string]interface{}) error {
+	var recipient, firstName, language string
+	err := db.QueryRow(`SELECT COALESCE(email, ''), COALESCE(firstname, ''), language FROM "user" WHERE phonenumber = $1`,
+		phoneNumber).Scan(&recipient, &firstName, &language)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	recipient = strings.TrimSpace(recipient)
+	if _, err := mail.ParseAddress(recipient); err != nil {
+		return nil
+	}
+
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["FirstName"] = firstName
+
+	subject, text, html, err := renderEmail(template, language, data)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in queueEmail() : ", err)
+		}
+	}(tx)
+
+	var id int
+	err = tx.QueryRow(`
+		INSERT INTO email (phonenumber, recipient, template, language, subject, textbody, htmlbody)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING idemail`,
+		phoneNumber, recipient, template, language, subject, text, html).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	if err := enqueueJob(tx, "email.send", emailJob{IDEmail: id}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deliverEmail envoie un e-mail enregistré et met à jour son statut d'envoi.
+func deliverEmail(payload json.RawMessage) error {
+	var job emailJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+
+	var recipient, subject, text, html, status string
+	err := db.QueryRow(`SELECT recipient, subject, textbody, htmlbody, status FROM email WHERE idemail = $1`, job.IDEmail).
+		Scan(&recipient, &subject, &text, &html, &status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// The user has been erased in the meantime
+			return nil
+		}
+		return err
+	}
+
+	if status == "SENT" {
+		return nil
+	}
+
+	messageID, err := sendSMTP(recipient, subject, text, html)
+	if err != nil {
+		if _, errUpdate := db.Exec(`UPDATE email SET attempts = attempts + 1, lasterror = $1 WHERE idemail = $2`, err.Error(), job.IDEmail); errUpdate != nil {
+			fmt.Println("💥 Error updating the email in deliverEmail() : ", errUpdate)
+		}
+		return err
+	}
+
+	_, err = db.Exec(`
+		UPDATE email
+		SET status = 'SENT', attempts = attempts + 1, lasterror = NULL, messageid = $1, sentat = NOW()
+		WHERE idemail = $2`, messageID, job.IDEmail)
+	return err
+}
+
+// failEmail marque un e-mail comme non envoyé après la dernière tentative.
+func failEmail(payload json.RawMessage, _ error) {
+	var job emailJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return
+	}
+
+	if _, err := db.Exec(`UPDATE email SET status = 'FAILED' WHERE idemail = $1`, job.IDEmail); err != nil {
+		fmt.Println("💥 Error updating the email in failEmail() : ", err)
+	}
+}
+
+// sendSMTP envoie un e-mail par le serveur SMTP_HOST:SMTP_PORT et renvoie son Message-ID. Le chiffrement STARTTLS est
+// utilisé lorsque le serveur le propose, et l'authentification lorsque SMTP_USERNAME est renseigné : un serveur de test
+// local (MailHog, Mailpit, ...) fonctionne donc avec SMTP_HOST=localhost et SMTP_PORT=1025.
+func sendSMTP(recipient string, subject string, text string, html string) (string, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return "", errors.New("SMTP is not configured")
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	from, err := mail.ParseAddress(os.Getenv("SMTP_FROM"))
+	if err != nil {
+		from = &mail.Address{Name: "Voyo", Address: "no-reply@voyo.fr"}
+	}
+
+	token, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	messageID := fmt.Sprintf("%s@%s", token, from.Address[strings.LastIndex(from.Address, "@")+1:])
+
+	message, err := buildEmailMessage(from, recipient, subject, text, html, messageID)
+	if err != nil {
+		return "", err
+	}
+
+	var auth smtp.Auth
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	if err := smtp.SendMail(net.JoinHostPort(host, port), auth, from.Address, []string{recipient}, message); err != nil {
+		return "", err
+	}
+	return messageID, nil
+}
+
+// buildEmailMessage construit un e-mail MIME avec une version texte et une version HTML.
+func buildEmailMessage(from *mail.Address, recipient string, subject string, text string, html string, messageID string) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	for _, header := range [][2]string{
+		{"From", from.String()},
+		{"To", recipient},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + messageID + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", fmt.Sprintf(`multipart/alternative; boundary="%s"`, parts.Boundary())},
+	} {
+		fmt.Fprintf(&message, "%s: %s\r\n", header[0], header[1])
+	}
+	message.WriteString("\r\n")
+	message.Write(body.Bytes())
+
+	return message.Bytes(), nil
+}
+
+// GetEmails renvoie les derniers e-mails envoyés, éventuellement ceux d'un utilisateur ("phoneNumber") ou d'un statut
+// ("status"), avec leur statut d'envoi.
+func GetEmails(c *fiber.Ctx) error {
+	rows, err := db.Query(`
+		SELECT idemail, phonenumber, recipient, template, language, subject, status, attempts, COALESCE(lasterror, ''),
+		       createdat, sentat
+		FROM email
+		WHERE ($1 = '' OR phonenumber = $1) AND ($2 = '' OR status = $2)
+		ORDER BY createdat DESC
+		LIMIT 100`, strings.TrimSpace(c.Query("phoneNumber")), strings.ToUpper(strings.TrimSpace(c.Query("status"))))
+	if err != nil {
+		fmt.Println("💥 Error querying the database in GetEmails() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in GetEmails() : ", err)
+		}
+	}(rows)
+
+	emails := []Email{}
+	for rows.Next() {
+		var email Email
+		err := rows.Scan(&email.ID, &email.PhoneNumber, &email.Recipient, &email.Template, &email.Language, &email.Subject,
+			&email.Status, &email.Attempts, &email.LastError, &email.CreatedAt, &email.SentAt)
+		if err != nil {
+			fmt.Println("💥 Error scanning the row in GetEmails() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+		emails = append(emails, email)
+	}
+
+	return c.JSON(emails)
+}
+
+// emailVisit envoie un e-mail sur une visite à certaines de ses parties ("PROSPECT", "VISITOR"). Le modèle reçoit la
+// date (Start), le prix (Price) et le rôle du destinataire (Role) en plus de data.
+func emailVisit(idVisit string, template string, roles []string, data map[string]interface{}) {
+	var prospect, visitor string
+	var start time.Time
+	var price float64
+	err := db.QueryRow(`SELECT phonenumberprospect, phonenumbervisitor, starttime, price FROM visit WHERE idvisit = $1`, idVisit).
+		Scan(&prospect, &visitor, &start, &price)
+	if err != nil {
+		fmt.Println("💥 Error scanning the row in emailVisit() : ", err)
+		return
+	}
+
+	for _, role := range roles {
+		recipient := prospect
+		if role == "VISITOR" {
+			recipient = visitor
+		}
+
+		values := map[string]interface{}{"Role": role, "Start": start, "Price": price}
+		for key, value := range data {
+			values[key] = value
+		}
+
+		if err := queueEmail(recipient, template, values); err != nil {
+			fmt.Println("💥 Error queueing the email in emailVisit() : ", err)
+		}
+	}
+}
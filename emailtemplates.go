@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// emailTemplate est le contenu d'un e-mail dans une langue. Le sujet et la version texte sont des text/template, la
+// version HTML un html/template inséré dans emailLayout.
+type emailTemplate struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Libellés anglais des motifs de refus d'une vérification d'identité (les libellés français sont ceux des SMS)
+var verificationReasonCodesEN = map[string]string{
+	"DOCUMENT_UNREADABLE": "the document is unreadable",
+	"DOCUMENT_EXPIRED":    "the document has expired",
+	"DOCUMENT_INCOMPLETE": "the front or the back is missing",
+	"NAME_MISMATCH":       "the name does not match your account",
+	"SUSPECTED_FRAUD":     "the document could not be authenticated",
+	"OTHER":               "see the comment of the Voyo team",
+}
+
+// emailFooters est le pied de page commun à tous les e-mails, par langue.
+var emailFooters = map[string]string{
+	"fr": "Vous recevez cet e-mail car vous avez un compte Voyo. Pour toute question, répondez simplement à ce message.",
+	"en": "You are receiving this email because you have a Voyo account. If you have any question, simply reply to this message.",
+}
+
+// emailLayout entoure la version HTML de tous les e-mails.
+const emailLayout = `<!DOCTYPE html>
+<html lang="{{.Language}}">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width"><title>{{.Subject}}</title></head>
+<body style="margin:0;padding:0;background:#f4f4f5;font-family:Helvetica,Arial,sans-serif;color:#18181b">
+<table width="100%" cellpadding="0" cellspacing="0" role="presentation"><tr><td align="center" style="padding:24px">
+<table width="560" cellpadding="0" cellspacing="0" role="presentation" style="max-width:560px;background:#ffffff;border-radius:8px">
+<tr><td style="padding:24px 32px 8px;font-size:22px;font-weight:bold;color:#2563eb">Voyo</td></tr>
+<tr><td style="padding:8px 32px 24px;font-size:15px;line-height:22px">{{.Content}}</td></tr>
+<tr><td style="padding:16px 32px;font-size:12px;line-height:18px;color:#71717a;border-top:1px solid #e4e4e7">{{.Footer}}</td></tr>
+</table>
+</td></tr></table>
+</body>
+</html>`
+
+// Modèles des e-mails transactionnels, par nom puis par langue
+var emailTemplates = map[string]map[string]emailTemplate{
+	"signup": {
+		"fr": {
+			Subject: "Bienvenue sur Voyo",
+			Text: `Bonjour {{.FirstName}},
+
+Votre compte Voyo a bien été créé.
+{{if .Visitor}}Nous vérifions maintenant vos pièces d'identité : vous serez prévenu dès que vous pourrez recevoir des demandes de visite.{{else}}Vous pouvez dès maintenant faire visiter un bien par un visiteur près de chez lui.{{end}}
+
+À bientôt,
+L'équipe Voyo`,
+			HTML: `<p>Bonjour {{.FirstName}},</p>
+<p>Votre compte Voyo a bien été créé.</p>
+<p>{{if .Visitor}}Nous vérifions maintenant vos pièces d'identité : vous serez prévenu dès que vous pourrez recevoir des demandes de visite.{{else}}Vous pouvez dès maintenant faire visiter un bien par un visiteur près de chez lui.{{end}}</p>
+<p>À bientôt,<br>L'équipe Voyo</p>`,
+		},
+		"en": {
+			Subject: "Welcome to Voyo",
+			Text: `Hello {{.FirstName}},
+
+Your Voyo account has been created.
+{{if .Visitor}}We are now reviewing your identity documents: you will be notified as soon as you can receive visit requests.{{else}}You can now have a property visited by a visitor who lives nearby.{{end}}
+
+See you soon,
+The Voyo team`,
+			HTML: `<p>Hello {{.FirstName}},</p>
+<p>Your Voyo account has been created.</p>
+<p>{{if .Visitor}}We are now reviewing your identity documents: you will be notified as soon as you can receive visit requests.{{else}}You can now have a property visited by a visitor who lives nearby.{{end}}</p>
+<p>See you soon,<br>The Voyo team</p>`,
+		},
+	},
+	"verification.approved": {
+		"fr": {
+			Subject: "Votre identité a été vérifiée",
+			Text: `Bonjour {{.FirstName}},
+
+Bonne nouvelle : votre identité a été vérifiée. Vous pouvez dès maintenant recevoir des demandes de visite.
+
+L'équipe Voyo`,
+			HTML: `<p>Bonjour {{.FirstName}},</p>
+<p>Bonne nouvelle : votre identité a été vérifiée. Vous pouvez dès maintenant recevoir des demandes de visite.</p>
+<p>L'équipe Voyo</p>`,
+		},
+		"en": {
+			Subject: "Your identity has been verified",
+			Text: `Hello {{.FirstName}},
+
+Good news: your identity has been verified. You can now receive visit requests.
+
+The Voyo team`,
+			HTML: `<p>Hello {{.FirstName}},</p>
+<p>Good news: your identity has been verified. You can now receive visit requests.</p>
+<p>The Voyo team</p>`,
+		},
+	},
+	"verification.needs_resubmission": {
+		"fr": {
+			Subject: "Vos pièces d'identité doivent être soumises à nouveau",
+			Text: `Bonjour {{.FirstName}},
+
+Nous n'avons pas pu vérifier votre identité :
+{{range .ReasonCodes}}- {{reason .}}
+{{end}}{{with .Comment}}
+Commentaire de l'équipe Voyo : {{.}}
+{{end}}
+Merci de soumettre à nouveau vos pièces d'identité depuis l'application.
+
+L'équipe Voyo`,
+			HTML: `<p>Bonjour {{.FirstName}},</p>
+<p>Nous n'avons pas pu vérifier votre identité :</p>
+<ul>{{range .ReasonCodes}}<li>{{reason .}}</li>{{end}}</ul>
+{{with .Comment}}<p>Commentaire de l'équipe Voyo : {{.}}</p>{{end}}
+<p>Merci de soumettre à nouveau vos pièces d'identité depuis l'application.</p>
+<p>L'équipe Voyo</p>`,
+		},
+		"en": {
+			Subject: "Please submit your identity documents again",
+			Text: `Hello {{.FirstName}},
+
+We could not verify your identity:
+{{range .ReasonCodes}}- {{reason .}}
+{{end}}{{with .Comment}}
+Comment of the Voyo team: {{.}}
+{{end}}
+Please submit your identity documents again from the application.
+
+The Voyo team`,
+			HTML: `<p>Hello {{.FirstName}},</p>
+<p>We could not verify your identity:</p>
+<ul>{{range .ReasonCodes}}<li>{{reason .}}</li>{{end}}</ul>
+{{with .Comment}}<p>Comment of the Voyo team: {{.}}</p>{{end}}
+<p>Please submit your identity documents again from the application.</p>
+<p>The Voyo team</p>`,
+		},
+	},
+	"verification.rejected": {
+		"fr": {
+			Subject: "Votre demande de vérification a été refusée",
+			Text: `Bonjour {{.FirstName}},
+
+Votre demande de vérification d'identité a été refusée :
+{{range .ReasonCodes}}- {{reason .}}
+{{end}}{{with .Comment}}
+Commentaire de l'équipe Voyo : {{.}}
+{{end}}
+L'équipe Voyo`,
+			HTML: `<p>Bonjour {{.FirstName}},</p>
+<p>Votre demande de vérification d'identité a été refusée :</p>
+<ul>{{range .ReasonCodes}}<li>{{reason .}}</li>{{end}}</ul>
+{{with .Comment}}<p>Commentaire de l'équipe Voyo : {{.}}</p>{{end}}
+<p>L'équipe Voyo</p>`,
+		},
+		"en": {
+			Subject: "Your verification request has been rejected",
+			Text: `Hello {{.FirstName}},
+
+Your identity verification request has been rejected:
+{{range .ReasonCodes}}- {{reason .}}
+{{end}}{{with .Comment}}
+Comment of the Voyo team: {{.}}
+{{end}}
+The Voyo team`,
+			HTML: `<p>Hello {{.FirstName}},</p>
+<p>Your identity verification request has been rejected:</p>
+<ul>{{range .ReasonCodes}}<li>{{reason .}}</li>{{end}}</ul>
+{{with .Comment}}<p>Comment of the Voyo team: {{.}}</p>{{end}}
+<p>The Voyo team</p>`,
+		},
+	},
+	"visit.booked": {
+		"fr": {
+			Subject: `{{if eq .Role "VISITOR"}}Nouvelle demande de visite le {{date .Start}}{{else}}Votre visite du {{date .Start}} est réservée{{end}}`,
+			Text: `Bonjour {{.FirstName}},
+
+{{if eq .Role "VISITOR"}}Une visite vous est proposée le {{date .Start}}, rémunérée {{price .Price}}. Acceptez-la ou refusez-la depuis l'application.{{else}}Votre demande de visite du {{date .Start}} ({{price .Price}}) a bien été envoyée au visiteur. Nous vous préviendrons dès qu'il l'aura acceptée.{{end}}
+
+L'équipe Voyo`,
+			HTML: `<p>Bonjour {{.FirstName}},</p>
+<p>{{if eq .Role "VISITOR"}}Une visite vous est proposée le <strong>{{date .Start}}</strong>, rémunérée <strong>{{price .Price}}</strong>. Acceptez-la ou refusez-la depuis l'application.{{else}}Votre demande de visite du <strong>{{date .Start}}</strong> ({{price .Price}}) a bien été envoyée au visiteur. Nous vous préviendrons dès qu'il l'aura acceptée.{{end}}</p>
+<p>L'équipe Voyo</p>`,
+		},
+		"en": {
+			Subject: `{{if eq .Role "VISITOR"}}New visit request on {{date .Start}}{{else}}Your visit on {{date .Start}} is booked{{end}}`,
+			Text: `Hello {{.FirstName}},
+
+{{if eq .Role "VISITOR"}}A visit is offered to you on {{date .Start}}, paid {{price .Price}}. Accept or decline it from the application.{{else}}Your visit request on {{date .Start}} ({{price .Price}}) has been sent to the visitor. We will let you know as soon as they accept it.{{end}}
+
+The Voyo team`,
+			HTML: `<p>Hello {{.FirstName}},</p>
+<p>{{if eq .Role "VISITOR"}}A visit is offered to you on <strong>{{date .Start}}</strong>, paid <strong>{{price .Price}}</strong>. Accept or decline it from the application.{{else}}Your visit request on <strong>{{date .Start}}</strong> ({{price .Price}}) has been sent to the visitor. We will let you know as soon as they accept it.{{end}}</p>
+<p>The Voyo team</p>`,
+		},
+	},
+	"visit.accepted": {
+		"fr": {
+			Subject: "Votre visite du {{date .Start}} est confirmée",
+			Text: `Bonjour {{.FirstName}},
+
+Le visiteur a accepté votre visite du {{date .Start}}. Vous pouvez suivre son déroulement et lui poser vos questions depuis l'application.
+
+L'équipe Voyo`,
+			HTML: `<p>Bonjour {{.FirstName}},</p>
+<p>Le visiteur a accepté votre visite du <strong>{{date .Start}}</strong>. Vous pouvez suivre son déroulement et lui poser vos questions depuis l'application.</p>
+<p>L'équipe Voyo</p>`,
+		},
+		"en": {
+			Subject: "Your visit on {{date .Start}} is confirmed",
+			Text: `Hello {{.FirstName}},
+
+The visitor has accepted your visit on {{date .Start}}. You can follow it and ask your questions from the application.
+
+The Voyo team`,
+			HTML: `<p>Hello {{.FirstName}},</p>
+<p>The visitor has accepted your visit on <strong>{{date .Start}}</strong>. You can follow it and ask your questions from the application.</p>
+<p>The Voyo team</p>`,
+		},
+	},
+	"visit.cancelled": {
+		"fr": {
+			Subject: "La visite du {{date .Start}} a été annulée",
+			Text: `Bonjour {{.FirstName}},
+
+{{if eq .Role .CancelledBy}}Vous avez annulé la visite du {{date .Start}}.{{else if eq .CancelledBy "PROSPECT"}}Le prospect a annulé la visite du {{date .Start}}.{{else}}Le visiteur a annulé la visite du {{date .Start}}.{{end}}
+{{if eq .Role "PROSPECT"}}{{if gt .Refund 0.0}}Vous serez remboursé de {{price .Refund}}.{{end}}{{if gt .Fee 0.0}} Des frais d'annulation de {{price .Fee}} ont été retenus.{{end}}{{else if gt .Compensation 0.0}}Vous recevrez un dédommagement de {{price .Compensation}}.{{end}}
+
+L'équipe Voyo`,
+			HTML: `<p>Bonjour {{.FirstName}},</p>
+<p>{{if eq .Role .CancelledBy}}Vous avez annulé la visite du <strong>{{date .Start}}</strong>.{{else if eq .CancelledBy "PROSPECT"}}Le prospect a annulé la visite du <strong>{{date .Start}}</strong>.{{else}}Le visiteur a annulé la visite du <strong>{{date .Start}}</strong>.{{end}}</p>
+<p>{{if eq .Role "PROSPECT"}}{{if gt .Refund 0.0}}Vous serez remboursé de {{price .Refund}}.{{end}}{{if gt .Fee 0.0}} Des frais d'annulation de {{price .Fee}} ont été retenus.{{end}}{{else if gt .Compensation 0.0}}Vous recevrez un dédommagement de {{price .Compensation}}.{{end}}</p>
+<p>L'équipe Voyo</p>`,
+		},
+		"en": {
+			Subject: "The visit on {{date .Start}} has been cancelled",
+			Text: `Hello {{.FirstName}},
+
+{{if eq .Role .CancelledBy}}You have cancelled the visit on {{date .Start}}.{{else if eq .CancelledBy "PROSPECT"}}The prospect has cancelled the visit on {{date .Start}}.{{else}}The visitor has cancelled the visit on {{date .Start}}.{{end}}
+{{if eq .Role "PROSPECT"}}{{if gt .Refund 0.0}}You will be refunded {{price .Refund}}.{{end}}{{if gt .Fee 0.0}} A cancellation fee of {{price .Fee}} has been kept.{{end}}{{else if gt .Compensation 0.0}}You will receive a compensation of {{price .Compensation}}.{{end}}
+
+The Voyo team`,
+			HTML: `<p>Hello {{.FirstName}},</p>
+<p>{{if eq .Role .CancelledBy}}You have cancelled the visit on <strong>{{date .Start}}</strong>.{{else if eq .CancelledBy "PROSPECT"}}The prospect has cancelled the visit on <strong>{{date .Start}}</strong>.{{else}}The visitor has cancelled the visit on <strong>{{date .Start}}</strong>.{{end}}</p>
+<p>{{if eq .Role "PROSPECT"}}{{if gt .Refund 0.0}}You will be refunded {{price .Refund}}.{{end}}{{if gt .Fee 0.0}} A cancellation fee of {{price .Fee}} has been kept.{{end}}{{else if gt .Compensation 0.0}}You will receive a compensation of {{price .Compensation}}.{{end}}</p>
+<p>The Voyo team</p>`,
+		},
+	},
+	"visit.reminder": {
+		"fr": {
+			Subject: "Rappel : votre visite du {{date .Start}}",
+			Text: `Bonjour {{.FirstName}},
+
+{{if eq .Role "VISITOR"}}Pour rappel, vous effectuez une visite le {{date .Start}}. Pensez à demander son code au prospect à la fin de la visite.{{else}}Pour rappel, votre visite a lieu le {{date .Start}}. Vous pourrez suivre le visiteur et lui poser vos questions depuis l'application.{{end}}
+
+L'équipe Voyo`,
+			HTML: `<p>Bonjour {{.FirstName}},</p>
+<p>{{if eq .Role "VISITOR"}}Pour rappel, vous effectuez une visite le <strong>{{date .Start}}</strong>. Pensez à demander son code au prospect à la fin de la visite.{{else}}Pour rappel, votre visite a lieu le <strong>{{date .Start}}</strong>. Vous pourrez suivre le visiteur et lui poser vos questions depuis l'application.{{end}}</p>
+<p>L'équipe Voyo</p>`,
+		},
+		"en": {
+			Subject: "Reminder: your visit on {{date .Start}}",
+			Text: `Hello {{.FirstName}},
+
+{{if eq .Role "VISITOR"}}As a reminder, you are doing a visit on {{date .Start}}. Remember to ask the prospect for their code at the end of the visit.{{else}}As a reminder, your visit takes place on {{date .Start}}. You will be able to follow the visitor and ask your questions from the application.{{end}}
+
+The Voyo team`,
+			HTML: `<p>Hello {{.FirstName}},</p>
+<p>{{if eq .Role "VISITOR"}}As a reminder, you are doing a visit on <strong>{{date .Start}}</strong>. Remember to ask the prospect for their code at the end of the visit.{{else}}As a reminder, your visit takes place on <strong>{{date .Start}}</strong>. You will be able to follow the visitor and ask your questions from the application.{{end}}</p>
+<p>The Voyo team</p>`,
+		},
+	},
+	"visit.report_ready": {
+		"fr": {
+			Subject: "Le rapport de votre visite du {{date .Start}} est disponible",
+			Text: `Bonjour {{.FirstName}},
+
+La visite du {{date .Start}} est terminée. Son rapport, avec les réponses du visiteur à vos critères et ses photos, est disponible dans l'application.
+
+L'équipe Voyo`,
+			HTML: `<p>Bonjour {{.FirstName}},</p>
+<p>La visite du <strong>{{date .Start}}</strong> est terminée. Son rapport, avec les réponses du visiteur à vos critères et ses photos, est disponible dans l'application.</p>
+<p>L'équipe Voyo</p>`,
+		},
+		"en": {
+			Subject: "The report of your visit on {{date .Start}} is available",
+			Text: `Hello {{.FirstName}},
+
+The visit on {{date .Start}} is over. Its report, with the answers of the visitor to your criteria and their photos, is available in the application.
+
+The Voyo team`,
+			HTML: `<p>Hello {{.FirstName}},</p>
+<p>The visit on <strong>{{date .Start}}</strong> is over. Its report, with the answers of the visitor to your criteria and their photos, is available in the application.</p>
+<p>The Voyo team</p>`,
+		},
+	},
+}
+
+// emailLanguage renvoie la langue des e-mails choisie à l'inscription, le français par défaut.
+func emailLanguage(language *string) string {
+	if language != nil {
+		if _, ok := emailFooters[strings.ToLower(*language)]; ok {
+			return strings.ToLower(*language)
+		}
+	}
+	return "fr"
+}
+
+// emailFuncs renvoie les fonctions utilisables dans les modèles, dans la langue de l'e-mail.
+func emailFuncs(language string) map[string]interface{} {
+	reasons, dateLayout := verificationReasonCodes, "02/01/2006 à 15h04"
+	if language == "en" {
+		reasons, dateLayout = verificationReasonCodesEN, "Monday, January 2 at 3:04 PM"
+	}
+
+	return map[string]interface{}{
+		"date": func(t time.Time) string {
+			return t.Format(dateLayout)
+		},
+		"price": func(amount float64) string {
+			if language == "en" {
+				return fmt.Sprintf("€%.2f", amount)
+			}
+			return strings.Replace(fmt.Sprintf("%.2f €", amount), ".", ",", 1)
+		},
+		"reason": func(code string) string {
+			return reasons[code]
+		},
+	}
+}
+
+// renderEmail rend le sujet, la version texte et la version HTML d'un e-mail. Une langue sans modèle retombe sur le
+// français.
+func renderEmail(name string, language string, data map[string]interface{}) (subject string, text string, html string, err error) {
+	templates, ok := emailTemplates[name]
+	if !ok {
+		return "", "", "", fmt.Errorf("unknown email template %q", name)
+	}
+	tpl, ok := templates[language]
+	if !ok {
+		language, tpl = "fr", templates["fr"]
+	}
+	funcs := emailFuncs(language)
+
+	subject, err = renderTextTemplate(tpl.Subject, funcs, data)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	text, err = renderTextTemplate(tpl.Text, funcs, data)
+	if err != nil {
+		return "", "", "", err
+	}
+	text += "\n\n--\n" + emailFooters[language] + "\n"
+
+	content, err := htmltemplate.New(name).Funcs(funcs).Parse(tpl.HTML)
+	if err != nil {
+		return "", "", "", err
+	}
+	var body bytes.Buffer
+	if err := content.Execute(&body, data); err != nil {
+		return "", "", "", err
+	}
+
+	layout, err := htmltemplate.New("layout").Parse(emailLayout)
+	if err != nil {
+		return "", "", "", err
+	}
+	var page bytes.Buffer
+	err = layout.Execute(&page, map[string]interface{}{
+		"Language": language,
+		"Subject":  subject,
+		"Content":  htmltemplate.HTML(body.String()),
+		"Footer":   emailFooters[language],
+	})
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return strings.TrimSpace(subject), text, page.String(), nil
+}
+
+// renderTextTemplate rend un modèle texte.
+func renderTextTemplate(source string, funcs map[string]interface{}, data map[string]interface{}) (string, error) {
+	tpl, err := template.New("").Funcs(funcs).Parse(source)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	if err := tpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
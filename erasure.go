@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Colonnes qui référencent un utilisateur par son numéro de téléphone. Lors d'un effacement, elles sont
+// redirigées vers l'utilisateur anonyme afin de conserver l'historique de l'autre partie.
+var userReferences = []struct {
+	Table  string
+	Column string
+}{
+	{"visit", "phonenumberprospect"},
+	{"visit", "phonenumbervisitor"},
+	{"criteria", "phonenumber"},
+	{"verificationcase", "phonenumber"},
+	{"verificationcase", "reviewer"},
+	{"identitydocument", "phonenumber"},
+	{"media", "phonenumber"},
+	{"mediaupload", "phonenumber"},
+	{"criteriatemplate", "phonenumber"},
+	{"visitshare", "createdby"},
+	{"visitcancellation", "cancelledby"},
+	{"visitproposal", "proposedby"},
+	{"visitrequest", "phonenumberprospect"},
+	{"visitrequest", "claimedby"},
+	{"visitresponse", "phonenumbervisitor"},
+	{"message", "sender"},
+	{"message", "recipient"},
+}
+
+var errUserAlreadyErased = errors.New("user already erased")
+var errNoErasureToRestore = errors.New("no erasure to restore")
+var errRestoreConflict = errors.New("the phone number or the email address is used by another account")
+
+// erasureSnapshot contient les données personnelles effacées, conservées chiffrées pendant le délai de grâce.
+type erasureSnapshot struct {
+	User           map[string]interface{}   `json:"user"`
+	Availabilities []map[string]interface{} `json:"availabilities"`
+}
+
+// erasurePhoneHash calcule l'empreinte du numéro de téléphone effacé, qui permet de retrouver la demande sans garder le numéro en clair.
+func erasurePhoneHash(phoneNumber string) (string, error) {
+	key, _, err := loadDocumentMasterKey()
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(phoneNumber))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// newSurrogatePhoneNumber génère l'identifiant qui remplace le numéro de téléphone d'un utilisateur effacé.
+func newSurrogatePhoneNumber() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1e12))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("DEL%012d", n.Int64()), nil
+}
+
+// insertMap insère une ligne à partir d'une map colonne -> valeur.
+func insertMap(tx *sql.Tx, table string, row map[string]interface{}) error {
+	columns := make([]string, 0, len(row))
+	for column := range row {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	placeholders := make([]string, len(columns))
+	args := make([]interface{}, len(columns))
+	for i, column := range columns {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = row[column]
+		columns[i] = fmt.Sprintf(`"%s"`, column)
+	}
+
+	_, err := tx.Exec(fmt.Sprintf(`INSERT INTO "%s" (%s) VALUES (%s)`, table, strings.Join(columns, ", "), strings.Join(placeholders, ", ")), args...)
+	return err
+}
+
+// moveUserReferences redirige toutes les références d'un numéro de téléphone vers un autre.
+func moveUserReferences(tx *sql.Tx, from string, to string) error {
+	for _, ref := range userReferences {
+		_, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET %s = $1 WHERE %s = $2`, ref.Table, ref.Column, ref.Column), to, from)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", ref.Table, ref.Column, err)
+		}
+	}
+	return nil
+}
+
+// eraseUser anonymise un utilisateur : ses données personnelles sont remplacées par un utilisateur "supprimé"
+// et une copie chiffrée est gardée jusqu'à la fin du délai de grâce.
+func eraseUser(phoneNumber string, requestedBy string) (time.Time, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in eraseUser() : ", err)
+		}
+	}(tx)
+
+	users, err := queryToMaps(tx, `SELECT * FROM "user" WHERE PhoneNumber = $1 FOR UPDATE`, phoneNumber)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if len(users) == 0 {
+		return time.Time{}, sql.ErrNoRows
+	}
+
+	if users[0]["status"] == "DELETED" {
+		return time.Time{}, errUserAlreadyErased
+	}
+
+	availabilities, err := queryToMaps(tx, `SELECT * FROM availability WHERE PhoneNumber = $1`, phoneNumber)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// 1) Keep an encrypted copy of the personal data for the grace period
+	snapshot, err := json.Marshal(erasureSnapshot{User: users[0], Availabilities: availabilities})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	ciphertext, wrappedKey, keyID, err := sealDocument(snapshot)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	phoneHash, err := erasurePhoneHash(phoneNumber)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	surrogate, err := newSurrogatePhoneNumber()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	graceUntil := time.Now().Add(getEnvDuration("ERASURE_GRACE_PERIOD", 30*24*time.Hour))
+
+	_, err = tx.Exec(`
+		INSERT INTO usererasure (phonehash, surrogate, keyid, wrappedkey, snapshot, requestedby, graceuntil)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		phoneHash, surrogate, keyID, wrappedKey, ciphertext, requestedBy, graceUntil)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// 2) Create the "deleted user" placeholder, which keeps the role so that ratings and history remain consistent
+	_, err = tx.Exec(`
+		INSERT INTO "user" (PhoneNumber, FirstName, LastName, Email, Password, IdRole, Status)
+		VALUES ($1, 'Utilisateur', 'supprimé', $2, '', $3, 'DELETED')`,
+		surrogate, strings.ToLower(surrogate)+"@deleted.voyo.invalid", users[0]["idrole"])
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// 3) Point the visits, criteria and documents to the placeholder and drop what only concerns the user
+	if err := moveUserReferences(tx, phoneNumber, surrogate); err != nil {
+		return time.Time{}, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE visit
+		SET status = 'CANCELLED'
+		WHERE (phonenumberprospect = $1 OR phonenumbervisitor = $1) AND status IN ('PENDING', 'ACCEPTED') AND starttime > NOW()`, surrogate)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	_, err = tx.Exec(`UPDATE visitrequest SET status = 'CANCELLED' WHERE phonenumberprospect = $1 AND status = 'OPEN'`, surrogate)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	_, err = tx.Exec(`UPDATE visitshare SET revokedat = NOW() WHERE createdby = $1 AND revokedat IS NULL`, surrogate)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// The reports show the name of the visitor
+	_, err = tx.Exec(`
+		DELETE FROM visitreport
+		WHERE idvisit IN (SELECT idvisit FROM visit WHERE phonenumberprospect = $1 OR phonenumbervisitor = $1)`, surrogate)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	_, err = tx.Exec(`UPDATE identitydocument SET purgeafter = $1 WHERE phonenumber = $2 AND purgedat IS NULL`, graceUntil, surrogate)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	for _, query := range []string{
+		`DELETE FROM availability WHERE PhoneNumber = $1`,
+		`DELETE FROM dataexport WHERE phonenumber = $1`,
+		`DELETE FROM device WHERE phonenumber = $1`,
+		`DELETE FROM email WHERE phonenumber = $1`,
+		`DELETE FROM visitreminder WHERE phonenumber = $1`,
+		`DELETE FROM "user" WHERE PhoneNumber = $1`, // Revokes every session as VerifyJWT checks that the user exists
+	} {
+		if _, err := tx.Exec(query, phoneNumber); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return graceUntil, tx.Commit()
+}
+
+// restoreUser annule un effacement encore dans son délai de grâce.
+func restoreUser(phoneNumber string) error {
+	phoneHash, err := erasurePhoneHash(phoneNumber)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in restoreUser() : ", err)
+		}
+	}(tx)
+
+	var id int
+	var surrogate, keyID string
+	var wrappedKey, ciphertext []byte
+	err = tx.QueryRow(`
+		SELECT idusererasure, surrogate, keyid, wrappedkey, snapshot
+		FROM usererasure
+		WHERE phonehash = $1 AND restoredat IS NULL AND finalizedat IS NULL AND graceuntil > NOW()
+		ORDER BY requestedat DESC
+		LIMIT 1
+		FOR UPDATE`, phoneHash).Scan(&id, &surrogate, &keyID, &wrappedKey, &ciphertext)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errNoErasureToRestore
+		}
+		return err
+	}
+
+	plain, err := openDocument(ciphertext, wrappedKey, keyID)
+	if err != nil {
+		return err
+	}
+
+	var snapshot erasureSnapshot
+	if err := json.Unmarshal(plain, &snapshot); err != nil {
+		return err
+	}
+
+	// The phone number may have been registered again during the grace period
+	var taken bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM "user" WHERE PhoneNumber = $1)`, phoneNumber).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return errRestoreConflict
+	}
+
+	if err := insertMap(tx, "user", snapshot.User); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return errRestoreConflict
+		}
+		return err
+	}
+
+	for _, availability := range snapshot.Availabilities {
+		if err := insertMap(tx, "availability", availability); err != nil {
+			return err
+		}
+	}
+
+	if err := moveUserReferences(tx, surrogate, phoneNumber); err != nil {
+		return err
+	}
+
+	// The documents are kept according to the usual retention rules again
+	_, err = tx.Exec(`UPDATE identitydocument SET purgeafter = NULL WHERE phonenumber = $1 AND purgedat IS NULL`, phoneNumber)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM "user" WHERE PhoneNumber = $1`, surrogate)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE usererasure SET restoredat = NOW(), snapshot = NULL, wrappedkey = NULL WHERE idusererasure = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// finalizeUserErasures détruit les copies chiffrées des utilisateurs dont le délai de grâce est écoulé.
+func finalizeUserErasures() (int64, error) {
+	result, err := db.Exec(`
+		UPDATE usererasure
+		SET snapshot = NULL, wrappedkey = NULL, finalizedat = NOW()
+		WHERE graceuntil <= NOW() AND restoredat IS NULL AND finalizedat IS NULL`)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// RestoreUser restaure un utilisateur effacé pendant son délai de grâce.
+func RestoreUser(c *fiber.Ctx) error {
+	phoneNumber := strings.TrimSpace(c.Query("phoneNumber"))
+	if phoneNumber == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the phone number of the user",
+		})
+	}
+
+	err := restoreUser(phoneNumber)
+	if err != nil {
+		if errors.Is(err, errNoErasureToRestore) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "No erasure can be restored for this user",
+			})
+		}
+
+		if errors.Is(err, errRestoreConflict) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "The user cannot be restored: their phone number or email address is now used by another account",
+			})
+		}
+
+		fmt.Println("💥 Error restoring the user in RestoreUser() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
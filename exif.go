@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// exifData regroupe les informations EXIF utiles d'une photo.
+type exifData struct {
+	Orientation int
+	CapturedAt  *time.Time
+	Latitude    *float64
+	Longitude   *float64
+}
+
+var errNoExif = errors.New("no exif data")
+
+// Étiquettes EXIF lues par readExif
+const (
+	exifTagOrientation        = 0x0112
+	exifTagExifIFD            = 0x8769
+	exifTagGPSIFD             = 0x8825
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTimeOriginal = 0x9011
+	exifTagGPSLatitudeRef     = 0x0001
+	exifTagGPSLatitude        = 0x0002
+	exifTagGPSLongitudeRef    = 0x0003
+	exifTagGPSLongitude       = 0x0004
+)
+
+// readExif lit les données EXIF d'une image JPEG (segment APP1) ou PNG (bloc eXIf).
+func readExif(data []byte) (exifData, error) {
+	tiff, err := findExif(data)
+	if err != nil {
+		return exifData{}, err
+	}
+	return parseTIFF(tiff)
+}
+
+// findExif renvoie le bloc TIFF contenant les données EXIF de l'image.
+func findExif(data []byte) ([]byte, error) {
+	// JPEG: walk the markers until the APP1 "Exif" segment or the start of the image data
+	if len(data) > 4 && data[0] == 0xFF && data[1] == 0xD8 {
+		for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+			marker := data[i+1]
+			if marker == 0xDA || marker == 0xD9 {
+				break
+			}
+
+			length := int(binary.BigEndian.Uint16(data[i+2:]))
+			if length < 2 || i+2+length > len(data) {
+				break
+			}
+
+			segment := data[i+4 : i+2+length]
+			if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				return segment[6:], nil
+			}
+			i += 2 + length
+		}
+		return nil, errNoExif
+	}
+
+	// PNG: the eXIf chunk directly contains the TIFF block
+	if bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		for i := 8; i+12 <= len(data); {
+			length := int(binary.BigEndian.Uint32(data[i:]))
+			if length < 0 || i+12+length > len(data) {
+				break
+			}
+
+			kind := string(data[i+4 : i+8])
+			if kind == "eXIf" {
+				chunk := data[i+8 : i+8+length]
+				if crc32.ChecksumIEEE(data[i+4:i+8+length]) != binary.BigEndian.Uint32(data[i+8+length:]) {
+					break
+				}
+				return chunk, nil
+			}
+			if kind == "IDAT" || kind == "IEND" {
+				break
+			}
+			i += 12 + length
+		}
+	}
+
+	return nil, errNoExif
+}
+
+// tiffReader lit les entrées d'un bloc TIFF dans le boutisme qu'il déclare.
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// tiffEntry est une entrée d'un répertoire TIFF (IFD).
+type tiffEntry struct {
+	Type  uint16
+	Count uint32
+	Value []byte
+}
+
+// Taille en octets des types de valeurs TIFF
+var tiffTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+// ifd lit le répertoire situé à offset et renvoie ses entrées par étiquette.
+func (r tiffReader) ifd(offset uint32) map[uint16]tiffEntry {
+	entries := map[uint16]tiffEntry{}
+	if offset == 0 || int64(offset)+2 > int64(len(r.data)) {
+		return entries
+	}
+
+	count := int(r.order.Uint16(r.data[offset:]))
+	for i := 0; i < count; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(r.data) {
+			break
+		}
+
+		entry := tiffEntry{
+			Type:  r.order.Uint16(r.data[start+2:]),
+			Count: r.order.Uint32(r.data[start+4:]),
+		}
+
+		size, ok := tiffTypeSizes[entry.Type]
+		if !ok || entry.Count > 1<<16 {
+			continue
+		}
+
+		// Values up to 4 bytes are stored in the entry itself, larger ones at the given offset
+		total := size * entry.Count
+		if total <= 4 {
+			entry.Value = r.data[start+8 : start+8+int(total)]
+		} else {
+			at := r.order.Uint32(r.data[start+8:])
+			if int64(at)+int64(total) > int64(len(r.data)) {
+				continue
+			}
+			entry.Value = r.data[at : at+total]
+		}
+
+		entries[r.order.Uint16(r.data[start:])] = entry
+	}
+
+	return entries
+}
+
+func (r tiffReader) uint(entry tiffEntry) (uint32, bool) {
+	switch {
+	case entry.Type == 3 && len(entry.Value) >= 2:
+		return uint32(r.order.Uint16(entry.Value)), true
+	case entry.Type == 4 && len(entry.Value) >= 4:
+		return r.order.Uint32(entry.Value), true
+	}
+	return 0, false
+}
+
+func (r tiffReader) string(entry tiffEntry) string {
+	return strings.TrimRight(string(entry.Value), "\x00 ")
+}
+
+// rationals lit une liste de fractions (type RATIONAL).
+func (r tiffReader) rationals(entry tiffEntry) []float64 {
+	if entry.Type != 5 {
+		return nil
+	}
+
+	values := make([]float64, 0, entry.Count)
+	for i := 0; i+8 <= len(entry.Value); i += 8 {
+		num, den := r.order.Uint32(entry.Value[i:]), r.order.Uint32(entry.Value[i+4:])
+		if den == 0 {
+			return nil
+		}
+		values = append(values, float64(num)/float64(den))
+	}
+	return values
+}
+
+// coordinate convertit une coordonnée GPS en degrés, minutes et secondes en degrés décimaux.
+func (r tiffReader) coordinate(value tiffEntry, ref tiffEntry, negative string) *float64 {
+	dms := r.rationals(value)
+	if len(dms) != 3 {
+		return nil
+	}
+
+	degrees := dms[0] + dms[1]/60 + dms[2]/3600
+	if r.string(ref) == negative {
+		degrees = -degrees
+	}
+	if math.IsNaN(degrees) || math.Abs(degrees) > 180 {
+		return nil
+	}
+	return &degrees
+}
+
+// parseTIFF lit l'orientation, la date de prise de vue et la position GPS d'un bloc TIFF.
+func parseTIFF(data []byte) (exifData, error) {
+	var exif exifData
+	if len(data) < 8 {
+		return exif, errNoExif
+	}
+
+	r := tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		r.order = binary.LittleEndian
+	case "MM":
+		r.order = binary.BigEndian
+	default:
+		return exif, errNoExif
+	}
+
+	ifd0 := r.ifd(r.order.Uint32(data[4:]))
+
+	if orientation, ok := r.uint(ifd0[exifTagOrientation]); ok {
+		exif.Orientation = int(orientation)
+	}
+
+	if pointer, ok := r.uint(ifd0[exifTagExifIFD]); ok {
+		sub := r.ifd(pointer)
+		if entry, ok := sub[exifTagDateTimeOriginal]; ok {
+			exif.CapturedAt = parseExifTime(r.string(entry), r.string(sub[exifTagOffsetTimeOriginal]))
+		}
+	}
+
+	if pointer, ok := r.uint(ifd0[exifTagGPSIFD]); ok {
+		gps := r.ifd(pointer)
+		exif.Latitude = r.coordinate(gps[exifTagGPSLatitude], gps[exifTagGPSLatitudeRef], "S")
+		exif.Longitude = r.coordinate(gps[exifTagGPSLongitude], gps[exifTagGPSLongitudeRef], "W")
+		if exif.Latitude == nil || exif.Longitude == nil {
+			exif.Latitude, exif.Longitude = nil, nil
+		}
+	}
+
+	return exif, nil
+}
+
+// parseExifTime lit une date EXIF ("2006:01:02 15:04:05"). Sans décalage horaire enregistré, la date est interprétée
+// dans le fuseau MEDIA_CAPTURE_TIMEZONE (Europe/Paris par défaut).
+func parseExifTime(value string, offset string) *time.Time {
+	if offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", value+offset); err == nil {
+			return &t
+		}
+	}
+
+	name := os.Getenv("MEDIA_CAPTURE_TIMEZONE")
+	if name == "" {
+		name = "Europe/Paris"
+	}
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		location = time.UTC
+	}
+
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", value, location)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
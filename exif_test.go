@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+)
+
+// buildTIFF construit un bloc TIFF dont le premier répertoire ne contient que l'orientation, du type TIFF donné
+// (3 : SHORT, 4 : LONG).
+func buildTIFF(order binary.ByteOrder, valueType uint16, orientation uint32) []byte {
+	var b bytes.Buffer
+	if order == binary.LittleEndian {
+		b.WriteString("II")
+	} else {
+		b.WriteString("MM")
+	}
+	_ = binary.Write(&b, order, uint16(42))
+	_ = binary.Write(&b, order, uint32(8))
+
+	_ = binary.Write(&b, order, uint16(1))
+	_ = binary.Write(&b, order, uint16(exifTagOrientation))
+	_ = binary.Write(&b, order, valueType)
+	_ = binary.Write(&b, order, uint32(1))
+	value := make([]byte, 4)
+	if valueType == 3 {
+		order.PutUint16(value, uint16(orientation))
+	} else {
+		order.PutUint32(value, orientation)
+	}
+	b.Write(value)
+	_ = binary.Write(&b, order, uint32(0))
+
+	return b.Bytes()
+}
+
+// buildJPEG place un bloc TIFF dans le segment APP1 d'un JPEG, après un segment APP0.
+func buildJPEG(tiff []byte) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xD8})
+
+	app0 := []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+	b.Write([]byte{0xFF, 0xE0})
+	_ = binary.Write(&b, binary.BigEndian, uint16(len(app0)+2))
+	b.Write(app0)
+
+	if tiff != nil {
+		app1 := append([]byte("Exif\x00\x00"), tiff...)
+		b.Write([]byte{0xFF, 0xE1})
+		_ = binary.Write(&b, binary.BigEndian, uint16(len(app1)+2))
+		b.Write(app1)
+	}
+
+	b.Write([]byte{0xFF, 0xDA, 0x00, 0x02, 0xFF, 0xD9})
+	return b.Bytes()
+}
+
+// buildPNG place un bloc TIFF dans le bloc eXIf d'un PNG. Avec corrupt, la somme de contrôle du bloc est fausse.
+func buildPNG(tiff []byte, corrupt bool) []byte {
+	var b bytes.Buffer
+	b.WriteString("\x89PNG\r\n\x1a\n")
+
+	chunk := func(kind string, data []byte) {
+		_ = binary.Write(&b, binary.BigEndian, uint32(len(data)))
+		b.WriteString(kind)
+		b.Write(data)
+		sum := crc32.ChecksumIEEE(append([]byte(kind), data...))
+		if corrupt && kind == "eXIf" {
+			sum++
+		}
+		_ = binary.Write(&b, binary.BigEndian, sum)
+	}
+
+	chunk("IHDR", make([]byte, 13))
+	chunk("eXIf", tiff)
+	chunk("IEND", nil)
+	return b.Bytes()
+}
+
+func TestReadExifOrientation(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    int
+		wantErr error
+	}{
+		{"JPEG little endian", buildJPEG(buildTIFF(binary.LittleEndian, 3, 6)), 6, nil},
+		{"JPEG big endian", buildJPEG(buildTIFF(binary.BigEndian, 3, 3)), 3, nil},
+		{"orientation stored as a LONG", buildJPEG(buildTIFF(binary.BigEndian, 4, 8)), 8, nil},
+		{"orientation of another type is ignored", buildJPEG(buildTIFF(binary.LittleEndian, 7, 6)), 0, nil},
+		{"PNG", buildPNG(buildTIFF(binary.LittleEndian, 3, 8), false), 8, nil},
+		{"PNG with a wrong checksum", buildPNG(buildTIFF(binary.LittleEndian, 3, 8), true), 0, errNoExif},
+		{"JPEG without EXIF", buildJPEG(nil), 0, errNoExif},
+		{"unknown byte order", buildJPEG(append([]byte("XX"), buildTIFF(binary.LittleEndian, 3, 6)[2:]...)), 0, errNoExif},
+		{"truncated TIFF", buildJPEG([]byte("II*\x00")), 0, errNoExif},
+		{"directory out of the block", buildJPEG([]byte("II*\x00\xff\x00\x00\x00")), 0, nil},
+		{"not an image", []byte("GIF89a"), 0, errNoExif},
+		{"empty", nil, 0, errNoExif},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exif, err := readExif(tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("readExif() error = %v, want %v", err, tt.wantErr)
+			}
+			if exif.Orientation != tt.want {
+				t.Errorf("Orientation = %d, want %d", exif.Orientation, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"time"
+)
+
+var errVisitNotPending = errors.New("visit not pending")
+var errVisitExpired = errors.New("visit expired")
+
+// visitorResponseStatsSQL renvoie les colonnes SQL des statistiques de réponse du visiteur phone : le nombre de
+// demandes qu'il a laissées expirer et son délai moyen de réponse, en heures.
+func visitorResponseStatsSQL(phone string) string {
+	return fmt.Sprintf(`(SELECT COUNT(*) FROM visitresponse WHERE phonenumbervisitor = %[1]s AND outcome = 'EXPIRED'),
+		       (SELECT ROUND((AVG(EXTRACT(EPOCH FROM respondedat - requestedat)) / 3600)::numeric, 1)
+		        FROM visitresponse
+		        WHERE phonenumbervisitor = %[1]s AND respondedat IS NOT NULL)`, phone)
+}
+
+// respondToVisit enregistre la réponse (ACCEPTED ou REFUSED) du visiteur à une demande de visite encore en attente.
+func respondToVisit(idVisit string, phoneNumber string, status string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in respondToVisit() : ", err)
+		}
+	}(tx)
+
+	role, current, _, _, err := getVisitParty(tx, idVisit, phoneNumber, true)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case role != "VISITOR":
+		return errNotVisitParty
+	case current == "EXPIRED":
+		return errVisitExpired
+	case current != "PENDING":
+		return errVisitNotPending
+	}
+
+	_, err = tx.Exec(`UPDATE visit SET status = $1 WHERE idvisit = $2`, status, idVisit)
+	if err == nil {
+		_, err = tx.Exec(`
+			INSERT INTO visitresponse (idvisit, phonenumbervisitor, outcome, requestedat, respondedat)
+			SELECT idvisit, phonenumbervisitor, $2, requestedat, NOW()
+			FROM visit
+			WHERE idvisit = $1`, idVisit, status)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// respondToVisitResponse renvoie la réponse HTTP à la réponse du visiteur à une demande de visite.
+func respondToVisitResponse(c *fiber.Ctx, id string, status string) error {
+	err := respondToVisit(id, c.Locals("user").(*CustomClaims).PhoneNumber, status)
+	switch {
+	case errors.Is(err, errNotVisitParty):
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the visitor can answer a visit request",
+		})
+	case errors.Is(err, errVisitExpired):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "This visit request has expired",
+		})
+	case errors.Is(err, errVisitNotPending):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "This visit request has already been answered",
+		})
+	case err != nil:
+		fmt.Println("💥 Error answering the visit in respondToVisitResponse() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if status == "ACCEPTED" {
+		go notifyVisitEvent(id, pushVisitAccepted, "")
+		go emailVisit(id, "visit.accepted", []string{"PROSPECT"}, nil)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// expireVisits fait expirer les demandes de visite restées sans réponse au-delà de VISIT_RESPONSE_DEADLINE, ou dont
+// l'horaire est passé, et prévient les prospects. Rien n'est encaissé avant que le visiteur accepte : il n'y a donc
+// aucun paiement à libérer.
+func expireVisits() error {
+	deadline := getEnvDuration("VISIT_RESPONSE_DEADLINE", 48*time.Hour)
+
+	rows, err := db.Query(`
+		WITH expired AS (
+		    UPDATE visit
+		    SET status = 'EXPIRED'
+		    WHERE status = 'PENDING' AND (starttime <= NOW() OR requestedat <= $1)
+		    RETURNING idvisit, phonenumberprospect, phonenumbervisitor, starttime, requestedat),
+		     responses AS (
+		         INSERT INTO visitresponse (idvisit, phonenumbervisitor, outcome, requestedat)
+		         SELECT idvisit, phonenumbervisitor, 'EXPIRED', requestedat FROM expired),
+		     proposals AS (
+		         UPDATE visitproposal
+		         SET status = 'SUPERSEDED', respondedat = NOW()
+		         WHERE status = 'PENDING' AND idvisit IN (SELECT idvisit FROM expired))
+		SELECT phonenumberprospect, starttime, starttime > NOW()
+		FROM expired`, time.Now().Add(-deadline))
+	if err != nil {
+		return err
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in expireVisits() : ", err)
+		}
+	}(rows)
+
+	expired := 0
+	for rows.Next() {
+		var prospect string
+		var start time.Time
+		var upcoming bool
+		if err := rows.Scan(&prospect, &start, &upcoming); err != nil {
+			return err
+		}
+		expired++
+
+		message := fmt.Sprintf("Voyo : votre demande de visite du %s n'a pas reçu de réponse du visiteur et a expiré.", start.Format("02/01 à 15h04"))
+		if upcoming {
+			message += " Vous pouvez la confier à un autre visiteur dans l'application."
+		}
+		notifyUser(prospect, message)
+	}
+
+	if expired > 0 {
+		fmt.Printf("=> %d visit request(s) expired\n", expired)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"strings"
+	"time"
+)
+
+// Sections de l'export RGPD : chaque requête produit un fichier JSON de l'archive.
+// Le numéro de téléphone de l'utilisateur exporté est toujours passé en $1.
+var dataExportSections = []struct {
+	File  string
+	Query string
+}{
+	{"profile.json", `
+		SELECT PhoneNumber, FirstName, LastName, Email, r.label AS role, Biography, ProfilePicture, Pricing, IdAddressGMap, Radius, x, y, Status
+		FROM "user" u
+		         JOIN role r ON u.idrole = r.idrole
+		WHERE PhoneNumber = $1`},
+	{"availabilities.json", `
+		SELECT IdAvailability, Availability, Duration::text AS duration, Repeat
+		FROM availability
+		WHERE PhoneNumber = $1
+		ORDER BY Availability`},
+	{"visits_as_prospect.json", `
+		SELECT idvisit, phonenumbervisitor, codeverification, starttime, price, status, note, idaddressgmap, idtyperealestate, x, y
+		FROM visit
+		WHERE phonenumberprospect = $1
+		ORDER BY starttime`},
+	{"visits_as_visitor.json", `
+		SELECT idvisit, phonenumberprospect, starttime, price, status, note, idaddressgmap, idtyperealestate, x, y
+		FROM visit
+		WHERE phonenumbervisitor = $1
+		ORDER BY starttime`},
+	{"criteria.json", `
+		SELECT DISTINCT c.idcriteria, l.idvisit, c.criteria, c.criteriatype, c.options, c.criteriaanswer, c.answer, c.photorequired, c.videorequired, c.reusable
+		FROM criteria c
+		         LEFT JOIN linkcriteriavisit l ON c.idcriteria = l.idcriteria
+		         LEFT JOIN visit v ON l.idvisit = v.idvisit
+		WHERE c.phonenumber = $1 OR v.phonenumberprospect = $1 OR v.phonenumbervisitor = $1
+		ORDER BY c.idcriteria`},
+	{"media.json", `
+		SELECT 'profile_picture' AS kind, NULL::int AS idcriteria, ProfilePicture AS reference
+		FROM "user"
+		WHERE PhoneNumber = $1 AND COALESCE(ProfilePicture, '') != ''
+		UNION ALL
+		SELECT DISTINCT 'criteria_' || LOWER(m.kind), c.idcriteria, m.storagekey
+		FROM criteria c
+		         LEFT JOIN linkcriteriavisit l ON c.idcriteria = l.idcriteria
+		         LEFT JOIN visit v ON l.idvisit = v.idvisit
+		         JOIN criteriamedia cm ON cm.idcriteria = c.idcriteria
+		         JOIN media m ON cm.idmedia = m.idmedia
+		WHERE c.phonenumber = $1 OR v.phonenumberprospect = $1 OR v.phonenumbervisitor = $1`},
+	{"visit_cancellations.json", `
+		SELECT vc.idvisitcancellation, vc.idvisit, vc.role AS cancelled_by, vc.reason, vc.tier, vc.hoursbefore, vc.price, vc.fee,
+		       vc.refund, vc.compensation, vc.counted, vc.cancelledat, vc.rematchedat
+		FROM visitcancellation vc
+		         JOIN visit v ON vc.idvisit = v.idvisit
+		WHERE vc.cancelledby = $1 OR v.phonenumberprospect = $1 OR v.phonenumbervisitor = $1
+		ORDER BY vc.cancelledat`},
+	{"visit_proposals.json", `
+		SELECT p.idvisitproposal, p.idvisit, p.role AS proposed_by, p.message, p.status,
+		       ARRAY(SELECT s.starttime FROM visitproposalslot s WHERE s.idvisitproposal = p.idvisitproposal ORDER BY s.starttime) AS start_times,
+		       p.acceptedstarttime, p.createdat, p.respondedat
+		FROM visitproposal p
+		         JOIN visit v ON p.idvisit = v.idvisit
+		WHERE p.proposedby = $1 OR v.phonenumberprospect = $1 OR v.phonenumbervisitor = $1
+		ORDER BY p.createdat`},
+	{"visit_requests.json", `
+		SELECT idvisitrequest, idaddressgmap, x, y, idtyperealestate, windowstart, windowend, maxprice, note, status, idvisit,
+		       createdat, claimedat
+		FROM visitrequest
+		WHERE phonenumberprospect = $1 OR claimedby = $1
+		ORDER BY createdat`},
+	{"visit_responses.json", `
+		SELECT idvisitresponse, idvisit, outcome, requestedat, respondedat
+		FROM visitresponse
+		WHERE phonenumbervisitor = $1
+		ORDER BY requestedat`},
+	{"messages.json", `
+		SELECT idmessage, idvisit, body, idmedia, createdat, readat
+		FROM message
+		WHERE sender = $1
+		ORDER BY idmessage`},
+	{"visit_reminders.json", `
+		SELECT idvisitreminder, idvisit, offsetminutes, starttime, channel, sentat
+		FROM visitreminder
+		WHERE phonenumber = $1
+		ORDER BY sentat`},
+	{"emails.json", `
+		SELECT idemail, recipient, template, language, subject, status, createdat, sentat
+		FROM email
+		WHERE phonenumber = $1
+		ORDER BY createdat`},
+	{"visit_shares.json", `
+		SELECT idvisitshare, idvisit, label, createdat, expiresat, revokedat, viewcount, lastviewedat
+		FROM visitshare
+		WHERE createdby = $1
+		ORDER BY createdat`},
+	{"identity_verification.json", `
+		SELECT idverificationcase, attempt, status, reasoncodes, comment, submittedat, reviewedat
+		FROM verificationcase
+		WHERE phonenumber = $1
+		ORDER BY attempt`},
+	{"identity_documents.json", `
+		SELECT iddocument, side, contenttype, createdat, purgeafter, purgedat
+		FROM identitydocument
+		WHERE phonenumber = $1
+		ORDER BY iddocument`},
+	{"audit.json", `
+		SELECT 'identity_document_access' AS event, l.accessedat AS date, l.iddocument, l.reason,
+		       CASE WHEN l.accessedby = $1 THEN 'you' ELSE 'voyo_staff' END AS actor
+		FROM documentaccesslog l
+		         JOIN identitydocument d ON l.iddocument = d.iddocument
+		WHERE d.phonenumber = $1
+		UNION ALL
+		SELECT 'data_export', e.createdat, NULL, NULL, CASE WHEN e.requestedby = $1 THEN 'you' ELSE 'voyo_staff' END
+		FROM dataexport e
+		WHERE e.phonenumber = $1
+		ORDER BY date`},
+}
+
+// queryer est implémenté par *sql.DB et *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// queryToMaps exécute une requête et renvoie chaque ligne sous forme de map colonne -> valeur.
+func queryToMaps(q queryer, query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in queryToMaps() : ", err)
+		}
+	}(rows)
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			// The driver returns text, numeric and array columns as bytes
+			if b, ok := values[i].([]byte); ok {
+				row[column] = string(b)
+			} else {
+				row[column] = values[i]
+			}
+		}
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
+
+// buildDataExport assemble l'archive ZIP contenant toutes les données détenues sur un utilisateur.
+func buildDataExport(phoneNumber string) ([]byte, error) {
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+
+	for _, section := range dataExportSections {
+		data, err := queryToMaps(db, section.Query, phoneNumber)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", section.File, err)
+		}
+
+		file, err := archive.Create(section.File)
+		if err != nil {
+			return nil, err
+		}
+
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(data); err != nil {
+			return nil, err
+		}
+	}
+
+	readme, err := archive.Create("README.txt")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fmt.Fprintf(readme, "Export des données personnelles Voyo du compte %s, généré le %s.\n", phoneNumber, time.Now().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// isLargeAccount indique si l'export d'un compte doit être généré en arrière-plan.
+func isLargeAccount(phoneNumber string) (bool, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM visit WHERE phonenumberprospect = $1 OR phonenumbervisitor = $1) +
+		       (SELECT COUNT(*) FROM criteria WHERE phonenumber = $1) +
+		       (SELECT COUNT(*) FROM availability WHERE phonenumber = $1)`, phoneNumber).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count > getEnvInt("EXPORT_SYNC_LIMIT", 200), nil
+}
+
+// generateDataExport construit l'archive d'un export en attente et l'enregistre.
+func generateDataExport(id int, phoneNumber string) error {
+	archive, err := buildDataExport(phoneNumber)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`UPDATE dataexport SET status = 'READY', archive = $1, completedat = NOW() WHERE iddataexport = $2`, archive, id)
+	return err
+}
+
+// dataExportJob est la tâche de génération d'une archive en arrière-plan.
+type dataExportJob struct {
+	IDExport    int    `json:"export_id"`
+	PhoneNumber string `json:"phone_number"`
+}
+
+// failDataExport marque comme échouée une archive dont la génération a été abandonnée.
+func failDataExport(id int) {
+	_, err := db.Exec(`UPDATE dataexport SET status = 'FAILED', completedat = NOW() WHERE iddataexport = $1`, id)
+	if err != nil {
+		fmt.Println("💥 Error updating the export in failDataExport() : ", err)
+	}
+}
+
+// requestDataExport renvoie directement l'archive pour un petit compte, ou lance sa génération en arrière-plan.
+func requestDataExport(c *fiber.Ctx, phoneNumber string) error {
+	requestedBy := c.Locals("user").(*CustomClaims).PhoneNumber
+
+	large, err := isLargeAccount(phoneNumber)
+	if err != nil {
+		fmt.Println("💥 Error counting the user's data in requestDataExport() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	var id int
+	err = db.QueryRow(`INSERT INTO dataexport (phonenumber, requestedby) VALUES ($1, $2) RETURNING iddataexport`, phoneNumber, requestedBy).Scan(&id)
+	if err != nil {
+		fmt.Println("💥 Error creating the export in requestDataExport() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if large {
+		if err := enqueueJob(db, "export.generate", dataExportJob{IDExport: id, PhoneNumber: phoneNumber}); err != nil {
+			fmt.Println("💥 Error enqueuing the export in requestDataExport() : ", err)
+			failDataExport(id)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+			"id":     id,
+			"status": "PENDING",
+		})
+	}
+
+	archive, err := buildDataExport(phoneNumber)
+	if err != nil {
+		fmt.Println("💥 Error building the archive in requestDataExport() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	// The archive itself is not kept: it has been sent right away
+	_, err = db.Exec(`UPDATE dataexport SET status = 'READY', completedat = NOW() WHERE iddataexport = $1`, id)
+	if err != nil {
+		fmt.Println("💥 Error updating the export in requestDataExport() : ", err)
+	}
+
+	return sendDataExportArchive(c, phoneNumber, archive)
+}
+
+// sendDataExportArchive renvoie l'archive en pièce jointe.
+func sendDataExportArchive(c *fiber.Ctx, phoneNumber string, archive []byte) error {
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="voyo-export-%s.zip"`, strings.TrimPrefix(phoneNumber, "+")))
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Send(archive)
+}
+
+// ExportUserData exporte toutes les données de l'utilisateur connecté.
+func ExportUserData(c *fiber.Ctx) error {
+	return requestDataExport(c, c.Locals("user").(*CustomClaims).PhoneNumber)
+}
+
+// AdminExportUserData exporte toutes les données d'un utilisateur à la demande d'un administrateur.
+func AdminExportUserData(c *fiber.Ctx) error {
+	phoneNumber := strings.TrimSpace(c.Query("phoneNumber"))
+	if phoneNumber == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the phone number of the user",
+		})
+	}
+
+	if !checkUserExists(phoneNumber) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	return requestDataExport(c, phoneNumber)
+}
+
+// getDataExport récupère un export si l'utilisateur connecté y a accès.
+func getDataExport(c *fiber.Ctx) (phoneNumber string, status string, archive []byte, err error) {
+	claims := c.Locals("user").(*CustomClaims)
+
+	err = db.QueryRow(`SELECT phonenumber, status, archive FROM dataexport WHERE iddataexport = $1`, c.Query("id")).Scan(&phoneNumber, &status, &archive)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	if claims.Role != "ADMIN" && claims.PhoneNumber != phoneNumber {
+		return "", "", nil, sql.ErrNoRows
+	}
+
+	return phoneNumber, status, archive, nil
+}
+
+// GetDataExportStatus renvoie l'état de génération d'un export.
+func GetDataExportStatus(c *fiber.Ctx) error {
+	_, status, _, err := getDataExport(c)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Export not found",
+			})
+		}
+
+		fmt.Println("💥 Error scanning the row in GetDataExportStatus() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"id":     c.Query("id"),
+		"status": status,
+	})
+}
+
+// DownloadDataExport renvoie l'archive d'un export généré en arrière-plan.
+func DownloadDataExport(c *fiber.Ctx) error {
+	phoneNumber, status, archive, err := getDataExport(c)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Export not found",
+			})
+		}
+
+		fmt.Println("💥 Error scanning the row in DownloadDataExport() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if status != "READY" || archive == nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":  "The export is not available",
+			"status": status,
+		})
+	}
+
+	return sendDataExportArchive(c, phoneNumber, archive)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Versions générées pour chaque photo, avec la taille maximale de leur plus grand côté
+var mediaVariants = []struct {
+	Name    string
+	EnvKey  string
+	MaxSide int
+}{
+	{"THUMB", "MEDIA_THUMB_SIZE", 320},
+	{"WEB", "MEDIA_WEB_SIZE", 1600},
+}
+
+// Au-delà de ce nombre de pixels, une photo n'est pas décodée (protection contre les images piégées)
+const mediaMaxPixels = 80_000_000
+
+// Anomalies relevées sur une photo répondant à un critère
+const (
+	evidenceNoCaptureTime     = "NO_CAPTURE_TIME"
+	evidenceCapturedBefore    = "CAPTURED_BEFORE_VISIT"
+	evidenceCapturedAfter     = "CAPTURED_AFTER_VISIT"
+	evidenceNoCaptureLocation = "NO_CAPTURE_LOCATION"
+	evidenceCapturedFar       = "CAPTURED_FAR_FROM_PROPERTY"
+)
+
+// processPhoto lit les données EXIF de l'original puis génère ses versions réduites, réencodées en JPEG sans aucune
+// métadonnée. Ce sont ces versions qui sont servies aux autres utilisateurs.
+func processPhoto(idMedia int) error {
+	var backend, key string
+	err := db.QueryRow(`SELECT backend, storagekey FROM media WHERE idmedia = $1 AND kind = 'PHOTO'`, idMedia).Scan(&backend, &key)
+	if err != nil {
+		return err
+	}
+
+	store, err := getStorageByName(backend)
+	if err != nil {
+		return err
+	}
+
+	reader, err := store.Get(key)
+	if err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(reader, mediaMaxSize("PHOTO")+1))
+	_ = reader.Close()
+	if err != nil {
+		return err
+	}
+
+	// The capture time and location must be read before they disappear with the re-encoding
+	exif, err := readExif(data)
+	if err != nil && !errors.Is(err, errNoExif) {
+		return err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if config.Width*config.Height > mediaMaxPixels {
+		return fmt.Errorf("image of %dx%d pixels is too large", config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	original := toRGBA(img)
+
+	base := strings.TrimSuffix(key, path.Ext(key))
+	for _, variant := range mediaVariants {
+		resized := orientImage(resizeToFit(original, getEnvInt(variant.EnvKey, variant.MaxSide)), exif.Orientation)
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, resized, &jpeg.Options{Quality: 82}); err != nil {
+			return err
+		}
+
+		variantKey := fmt.Sprintf("%s.%s.jpg", base, strings.ToLower(variant.Name))
+		if err := store.Put(variantKey, bytes.NewReader(buf.Bytes()), int64(buf.Len()), "image/jpeg"); err != nil {
+			return err
+		}
+
+		_, err = db.Exec(`
+			INSERT INTO mediavariant (idmedia, variant, storagekey, contenttype, width, height, size)
+			VALUES ($1, $2, $3, 'image/jpeg', $4, $5, $6)
+			ON CONFLICT (idmedia, variant) DO UPDATE
+			    SET storagekey = EXCLUDED.storagekey, width = EXCLUDED.width, height = EXCLUDED.height, size = EXCLUDED.size`,
+			idMedia, variant.Name, variantKey, resized.Bounds().Dx(), resized.Bounds().Dy(), buf.Len())
+		if err != nil {
+			return err
+		}
+	}
+
+	// As for the visits, X is the latitude and Y the longitude
+	_, err = db.Exec(`UPDATE media SET capturedat = $1, capturex = $2, capturey = $3, processedat = NOW() WHERE idmedia = $4`,
+		exif.CapturedAt, exif.Latitude, exif.Longitude, idMedia)
+	if err != nil {
+		return err
+	}
+
+	return checkCriteriaEvidence(idMedia)
+}
+
+// processPhotoAsync met en file le traitement d'une photo après son envoi.
+func processPhotoAsync(idMedia int) {
+	if err := enqueueJob(db, "media.process", map[string]int{"media_id": idMedia}); err != nil {
+		fmt.Println("💥 Error enqueuing the photo in processPhotoAsync() : ", err)
+	}
+}
+
+// checkCriteriaEvidence vérifie qu'une photo répondant à un critère a été prise pendant la visite (MEDIA_CAPTURE_TOLERANCE
+// de marge) et à moins de MEDIA_CAPTURE_RADIUS mètres du bien, et enregistre les anomalies sur la photo et sur le critère.
+func checkCriteriaEvidence(idMedia int) error {
+	rows, err := db.Query(`
+		SELECT cm.idcriteriamedia, cm.idcriteria, v.starttime, v.starttime + tr.duration, m.capturedat,
+		       CASE
+		           WHEN m.capturex IS NOT NULL THEN ST_Distance(ST_SetSRID(ST_MakePoint(v.y, v.x), 4326)::geography,
+		                                                        ST_SetSRID(ST_MakePoint(m.capturey, m.capturex), 4326)::geography)
+		           END
+		FROM criteriamedia cm
+		         JOIN media m ON cm.idmedia = m.idmedia
+		         JOIN linkcriteriavisit l ON cm.idcriteria = l.idcriteria
+		         JOIN visit v ON l.idvisit = v.idvisit
+		         JOIN typerealestate tr ON v.idtyperealestate = tr.idtyperealestate
+		WHERE cm.idmedia = $1 AND m.kind = 'PHOTO'`, idMedia)
+	if err != nil {
+		return err
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in checkCriteriaEvidence() : ", err)
+		}
+	}(rows)
+
+	tolerance := getEnvDuration("MEDIA_CAPTURE_TOLERANCE", time.Hour)
+	radius := float64(getEnvInt("MEDIA_CAPTURE_RADIUS", 300))
+
+	flags := map[int][]string{}
+	criterias := map[int]bool{}
+	for rows.Next() {
+		var idCriteriaMedia, idCriteria int
+		var start, end time.Time
+		var capturedAt sql.NullTime
+		var distance sql.NullFloat64
+		if err := rows.Scan(&idCriteriaMedia, &idCriteria, &start, &end, &capturedAt, &distance); err != nil {
+			return err
+		}
+
+		found := []string{}
+		switch {
+		case !capturedAt.Valid:
+			found = append(found, evidenceNoCaptureTime)
+		case capturedAt.Time.Before(start.Add(-tolerance)):
+			found = append(found, evidenceCapturedBefore)
+		case capturedAt.Time.After(end.Add(tolerance)):
+			found = append(found, evidenceCapturedAfter)
+		}
+
+		switch {
+		case !distance.Valid:
+			found = append(found, evidenceNoCaptureLocation)
+		case distance.Float64 > radius:
+			found = append(found, evidenceCapturedFar)
+		}
+
+		flags[idCriteriaMedia] = found
+		criterias[idCriteria] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for idCriteriaMedia, found := range flags {
+		if _, err := db.Exec(`UPDATE criteriamedia SET evidenceflags = $1 WHERE idcriteriamedia = $2`, pq.Array(found), idCriteriaMedia); err != nil {
+			return err
+		}
+	}
+
+	for idCriteria := range criterias {
+		if err := refreshCriteriaEvidence(strconv.Itoa(idCriteria)); err != nil {
+			return err
+		}
+
+		// The thumbnail is now available for the report
+		if err := invalidateVisitReports(strconv.Itoa(idCriteria)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// toRGBA copie une image décodée dans une image RGBA, plus simple à parcourir.
+func toRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+	return dst
+}
+
+// resizeToFit réduit une image pour que son plus grand côté ne dépasse pas maxSide, en moyennant les pixels couverts
+// par chaque pixel de destination.
+func resizeToFit(src *image.RGBA, maxSide int) *image.RGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w <= maxSide && h <= maxSide {
+		return src
+	}
+
+	scale := float64(maxSide) / float64(max(w, h))
+	dw := max(1, int(math.Round(float64(w)*scale)))
+	dh := max(1, int(math.Round(float64(h)*scale)))
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy0 := y * h / dh
+		sy1 := max((y+1)*h/dh, sy0+1)
+
+		for x := 0; x < dw; x++ {
+			sx0 := x * w / dw
+			sx1 := max((x+1)*w/dw, sx0+1)
+
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := sx0; sx < sx1; sx++ {
+					i := sx * 4
+					r += uint64(row[i])
+					g += uint64(row[i+1])
+					b += uint64(row[i+2])
+					a += uint64(row[i+3])
+					n++
+				}
+			}
+
+			o := y*dst.Stride + x*4
+			dst.Pix[o] = uint8(r / n)
+			dst.Pix[o+1] = uint8(g / n)
+			dst.Pix[o+2] = uint8(b / n)
+			dst.Pix[o+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
+
+// orientImage applique l'orientation EXIF (1 à 8) pour que l'image s'affiche à l'endroit une fois les métadonnées retirées.
+func orientImage(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[sy*src.Stride+sx*4:sy*src.Stride+sx*4+4])
+		}
+	}
+
+	return dst
+}
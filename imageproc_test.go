@@ -0,0 +1,44 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"strconv"
+	"testing"
+)
+
+func TestOrientImage(t *testing.T) {
+	// 3x2 image whose top-left pixel is the only red one
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	src.Set(0, 0, color.RGBA{R: 255, A: 255})
+
+	tests := []struct {
+		orientation   int
+		width, height int
+		x, y          int
+	}{
+		{0, 3, 2, 0, 0},
+		{1, 3, 2, 0, 0},
+		{2, 3, 2, 2, 0},
+		{3, 3, 2, 2, 1},
+		{4, 3, 2, 0, 1},
+		{5, 2, 3, 0, 0},
+		{6, 2, 3, 1, 0},
+		{7, 2, 3, 1, 2},
+		{8, 2, 3, 0, 2},
+		{9, 3, 2, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.orientation), func(t *testing.T) {
+			dst := orientImage(src, tt.orientation)
+
+			if dst.Bounds().Dx() != tt.width || dst.Bounds().Dy() != tt.height {
+				t.Fatalf("size = %dx%d, want %dx%d", dst.Bounds().Dx(), dst.Bounds().Dy(), tt.width, tt.height)
+			}
+			if r, _, _, _ := dst.At(tt.x, tt.y).RGBA(); r == 0 {
+				t.Errorf("the top-left pixel is not at (%d, %d)", tt.x, tt.y)
+			}
+		})
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// jobDefinition décrit un type de tâche : Run l'exécute, et OnFailure, facultatif, est appelé lorsque la tâche est
+// abandonnée après sa dernière tentative.
+type jobDefinition struct {
+	Run         func(payload json.RawMessage) error
+	OnFailure   func(payload json.RawMessage, err error)
+	MaxAttempts int
+}
+
+// recurringJob est une tâche mise en file selon une expression cron.
+type recurringJob struct {
+	Name string
+	Spec string
+	Run  func() error
+}
+
+// Tâches exécutées en arrière-plan, par type
+var jobDefinitions = map[string]jobDefinition{
+	"media.process": {
+		Run: func(payload json.RawMessage) error {
+			var p struct {
+				IDMedia int `json:"media_id"`
+			}
+			if err := json.Unmarshal(payload, &p); err != nil {
+				return err
+			}
+			return processPhoto(p.IDMedia)
+		},
+		MaxAttempts: 3,
+	},
+	"export.generate": {
+		Run: func(payload json.RawMessage) error {
+			var p dataExportJob
+			if err := json.Unmarshal(payload, &p); err != nil {
+				return err
+			}
+			return generateDataExport(p.IDExport, p.PhoneNumber)
+		},
+		OnFailure: func(payload json.RawMessage, _ error) {
+			var p dataExportJob
+			if err := json.Unmarshal(payload, &p); err == nil {
+				failDataExport(p.IDExport)
+			}
+		},
+		MaxAttempts: 3,
+	},
+	"push.send": {
+		Run:         sendPush,
+		MaxAttempts: 5,
+	},
+	"email.send": {
+		Run:         deliverEmail,
+		OnFailure:   failEmail,
+		MaxAttempts: 5,
+	},
+}
+
+// Tâches récurrentes, mises en file par une seule des instances du serveur
+var recurringJobs = []recurringJob{
+	{Name: "documents.purge", Spec: "0 * * * *", Run: func() error {
+		purged, err := purgeIdentityDocuments()
+		if purged > 0 {
+			fmt.Printf("=> %d identity document(s) purged\n", purged)
+		}
+		return err
+	}},
+	{Name: "erasures.finalize", Spec: "30 * * * *", Run: func() error {
+		finalized, err := finalizeUserErasures()
+		if finalized > 0 {
+			fmt.Printf("=> %d user erasure(s) finalized\n", finalized)
+		}
+		return err
+	}},
+	{Name: "media.uploads.purge", Spec: "15 * * * *", Run: func() error {
+		purged, err := purgeMediaUploads()
+		if purged > 0 {
+			fmt.Printf("=> %d abandoned media upload(s) purged\n", purged)
+		}
+		return err
+	}},
+	{Name: "ratelimit.prune", Spec: "*/10 * * * *", Run: pruneRateLimitBuckets},
+	{Name: "visits.expire", Spec: "*/5 * * * *", Run: expireVisits},
+	{Name: "visits.remind", Spec: "* * * * *", Run: sendVisitReminders},
+	{Name: "visitrequests.expire", Spec: "*/5 * * * *", Run: func() error {
+		expired, err := expireVisitRequests()
+		if expired > 0 {
+			fmt.Printf("=> %d visit request(s) expired\n", expired)
+		}
+		return err
+	}},
+}
+
+// Identifiant de cette instance dans les verrous des tâches
+var jobWorkerID = func() string {
+	host, _ := os.Hostname()
+	token, _ := randomToken(4)
+	return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), token)
+}()
+
+var errUnknownJob = errors.New("unknown job")
+
+// jobExecer est implémenté par *sql.DB et *sql.Tx, pour mettre une tâche en file dans la transaction qui la justifie.
+type jobExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// enqueueJob met une tâche en file pour une exécution immédiate.
+func enqueueJob(q jobExecer, kind string, payload interface{}) error {
+	return enqueueJobAt(q, kind, payload, time.Now())
+}
+
+// enqueueJobAt met une tâche en file pour une exécution à runAt.
+func enqueueJobAt(q jobExecer, kind string, payload interface{}, runAt time.Time) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	maxAttempts := getEnvInt("JOB_MAX_ATTEMPTS", 5)
+	if definition, ok := jobDefinitions[kind]; ok && definition.MaxAttempts > 0 {
+		maxAttempts = definition.MaxAttempts
+	}
+
+	_, err = q.Exec(`INSERT INTO job (kind, payload, maxattempts, runat) VALUES ($1, $2, $3, $4)`, kind, data, maxAttempts, runAt)
+	return err
+}
+
+// jobBackoff renvoie le délai avant la tentative suivante : 30 secondes doublées à chaque échec, dans la limite d'une
+// heure, avec un peu d'aléa pour que les tâches en échec ne soient pas relancées ensemble.
+func jobBackoff(attempts int) time.Duration {
+	delay := 30 * time.Second << uint(min(attempts-1, 7))
+	delay = min(delay, time.Hour)
+	return delay + time.Duration(rand.Int63n(int64(delay/5)+1))
+}
+
+// claimJob réserve la prochaine tâche à exécuter. SKIP LOCKED permet à plusieurs instances de se partager la file sans
+// jamais prendre la même tâche.
+func claimJob() (id int64, kind string, payload json.RawMessage, attempts int, maxAttempts int, err error) {
+	var data []byte
+	err = db.QueryRow(`
+		UPDATE job
+		SET status = 'RUNNING', lockedat = NOW(), lockedby = $1, attempts = attempts + 1
+		WHERE idjob = (SELECT idjob
+		               FROM job
+		               WHERE status = 'QUEUED' AND runat <= NOW()
+		               ORDER BY runat, idjob
+		               LIMIT 1 FOR UPDATE SKIP LOCKED)
+		RETURNING idjob, kind, payload, attempts, maxattempts`, jobWorkerID).Scan(&id, &kind, &data, &attempts, &maxAttempts)
+	return id, kind, data, attempts, maxAttempts, err
+}
+
+// runJob exécute une tâche, en transformant une panique en erreur pour que le worker continue.
+func runJob(kind string, payload json.RawMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	definition, ok := jobDefinitions[kind]
+	if !ok {
+		return errUnknownJob
+	}
+	return definition.Run(payload)
+}
+
+// jobLockTimeout renvoie la durée après laquelle une tâche dont le verrou n'a pas été renouvelé est remise en file
+// (JOB_LOCK_TIMEOUT).
+func jobLockTimeout() time.Duration {
+	if timeout := getEnvDuration("JOB_LOCK_TIMEOUT", 15*time.Minute); timeout >= time.Second {
+		return timeout
+	}
+	return 15 * time.Minute
+}
+
+// startJobHeartbeat renouvelle régulièrement le verrou d'une tâche en cours, pour qu'une tâche longue ne soit pas
+// remise en file par releaseStaleJobs et exécutée une seconde fois. La fonction renvoyée arrête le renouvellement.
+func startJobHeartbeat(id int64) func() {
+	done := make(chan struct{})
+	ticker := time.NewTicker(jobLockTimeout() / 3)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := db.Exec(`UPDATE job SET lockedat = NOW() WHERE idjob = $1 AND lockedby = $2`, id, jobWorkerID); err != nil {
+					fmt.Println("💥 Error renewing the job lock in startJobHeartbeat() : ", err)
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// finishJob supprime une tâche réussie, la remet en file après un délai si elle a échoué, ou la déplace dans les
+// tâches abandonnées après sa dernière tentative.
+func finishJob(id int64, kind string, payload json.RawMessage, attempts int, maxAttempts int, jobErr error) error {
+	if jobErr == nil {
+		_, err := db.Exec(`DELETE FROM job WHERE idjob = $1`, id)
+		return err
+	}
+
+	if attempts < maxAttempts && !errors.Is(jobErr, errUnknownJob) {
+		_, err := db.Exec(`UPDATE job SET status = 'QUEUED', runat = $1, lockedat = NULL, lockedby = NULL, lasterror = $2 WHERE idjob = $3`,
+			time.Now().Add(jobBackoff(attempts)), jobErr.Error(), id)
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in finishJob() : ", err)
+		}
+	}(tx)
+
+	_, err = tx.Exec(`
+		INSERT INTO jobdeadletter (idjob, kind, payload, attempts, lasterror, createdat)
+		SELECT idjob, kind, payload, attempts, $2, createdat
+		FROM job
+		WHERE idjob = $1`, id, jobErr.Error())
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM job WHERE idjob = $1`, id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return err
+	}
+
+	if definition, ok := jobDefinitions[kind]; ok && definition.OnFailure != nil {
+		definition.OnFailure(payload, jobErr)
+	}
+	return nil
+}
+
+// workJobs exécute les tâches de la file les unes après les autres, et attend pollInterval lorsqu'elle est vide.
+func workJobs(pollInterval time.Duration) {
+	for {
+		id, kind, payload, attempts, maxAttempts, err := claimJob()
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				fmt.Println("💥 Error claiming a job in workJobs() : ", err)
+			}
+			time.Sleep(pollInterval + time.Duration(rand.Int63n(int64(pollInterval)/2+1)))
+			continue
+		}
+
+		stopHeartbeat := startJobHeartbeat(id)
+		jobErr := runJob(kind, payload)
+		stopHeartbeat()
+		if jobErr != nil {
+			fmt.Printf("💥 Error running the job %d (%s, attempt %d/%d) in workJobs() : %v\n", id, kind, attempts, maxAttempts, jobErr)
+		}
+
+		if err := finishJob(id, kind, payload, attempts, maxAttempts, jobErr); err != nil {
+			fmt.Println("💥 Error finishing the job in workJobs() : ", err)
+		}
+	}
+}
+
+// scheduleRecurringJobs met en file les tâches récurrentes arrivées à échéance. Chaque échéance est verrouillée par
+// l'instance qui la traite, et la clé d'unicité empêche de mettre deux fois en file la même exécution.
+func scheduleRecurringJobs(schedules map[string]*cronSchedule) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in scheduleRecurringJobs() : ", err)
+		}
+	}(tx)
+
+	rows, err := tx.Query(`SELECT name, nextrunat FROM jobschedule WHERE nextrunat <= NOW() FOR UPDATE SKIP LOCKED`)
+	if err != nil {
+		return err
+	}
+
+	due := map[string]time.Time{}
+	for rows.Next() {
+		var name string
+		var runAt time.Time
+		if err := rows.Scan(&name, &runAt); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		due[name] = runAt
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	for name, runAt := range due {
+		schedule, ok := schedules[name]
+		if !ok {
+			// Left over by a job which no longer exists, or by a newer version of the server
+			continue
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO job (kind, maxattempts, runat, uniquekey)
+			VALUES ($1, 1, NOW(), $2)
+			ON CONFLICT (kind, uniquekey) WHERE uniquekey IS NOT NULL DO NOTHING`, name, runAt.UTC().Format(time.RFC3339))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE jobschedule SET nextrunat = $1, lastrunat = NOW() WHERE name = $2`, schedule.Next(time.Now()), name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// releaseStaleJobs remet en file les tâches dont le verrou n'est plus renouvelé, laissées par une instance arrêtée en
+// cours d'exécution.
+func releaseStaleJobs() (int64, error) {
+	result, err := db.Exec(`
+		UPDATE job
+		SET status = 'QUEUED', lockedat = NULL, lockedby = NULL, lasterror = 'released after the lock timeout'
+		WHERE status = 'RUNNING' AND lockedat < $1`, time.Now().Add(-jobLockTimeout()))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// startJobs enregistre les tâches récurrentes et lance les workers (JOB_WORKERS) ainsi que la planification.
+func startJobs() error {
+	schedules := map[string]*cronSchedule{}
+	for _, job := range recurringJobs {
+		schedule, err := parseCron(job.Spec)
+		if err != nil {
+			return fmt.Errorf("recurring job %s: %w", job.Name, err)
+		}
+		schedules[job.Name] = schedule
+
+		run := job.Run
+		jobDefinitions[job.Name] = jobDefinition{Run: func(json.RawMessage) error { return run() }, MaxAttempts: 1}
+
+		// A changed expression takes effect right away, otherwise the next run set by another instance is kept
+		_, err = db.Exec(`
+			INSERT INTO jobschedule (name, spec, nextrunat)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (name) DO UPDATE SET spec = EXCLUDED.spec, nextrunat = EXCLUDED.nextrunat
+			WHERE jobschedule.spec != EXCLUDED.spec`, job.Name, job.Spec, schedule.Next(time.Now()))
+		if err != nil {
+			return err
+		}
+	}
+
+	pollInterval := getEnvDuration("JOB_POLL_INTERVAL", 2*time.Second)
+	for i := 0; i < getEnvInt("JOB_WORKERS", 4); i++ {
+		go workJobs(pollInterval)
+	}
+
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+
+		for ; true; <-ticker.C {
+			if err := scheduleRecurringJobs(schedules); err != nil {
+				fmt.Println("💥 Error scheduling the recurring jobs in startJobs() : ", err)
+			}
+
+			released, err := releaseStaleJobs()
+			if err != nil {
+				fmt.Println("💥 Error releasing the stale jobs in startJobs() : ", err)
+			} else if released > 0 {
+				fmt.Printf("=> %d stale job(s) released\n", released)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// GetDeadJobs renvoie les tâches abandonnées, des plus récentes aux plus anciennes.
+func GetDeadJobs(c *fiber.Ctx) error {
+	rows, err := db.Query(`
+		SELECT idjob, kind, payload, attempts, COALESCE(lasterror, ''), createdat, failedat
+		FROM jobdeadletter
+		ORDER BY failedat DESC
+		LIMIT 100`)
+	if err != nil {
+		fmt.Println("💥 Error querying the database in GetDeadJobs() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in GetDeadJobs() : ", err)
+		}
+	}(rows)
+
+	jobs := []DeadJob{}
+	for rows.Next() {
+		var job DeadJob
+		var payload []byte
+		if err := rows.Scan(&job.ID, &job.Kind, &payload, &job.Attempts, &job.LastError, &job.CreatedAt, &job.FailedAt); err != nil {
+			fmt.Println("💥 Error scanning the row in GetDeadJobs() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+		job.Payload = payload
+		jobs = append(jobs, job)
+	}
+
+	return c.JSON(jobs)
+}
+
+// RetryDeadJob remet en file une tâche abandonnée, avec un nouveau nombre de tentatives.
+func RetryDeadJob(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println("💥 Error starting the transaction in RetryDeadJob() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in RetryDeadJob() : ", err)
+		}
+	}(tx)
+
+	var kind string
+	var payload []byte
+	err = tx.QueryRow(`DELETE FROM jobdeadletter WHERE idjob = $1 RETURNING kind, payload`, id).Scan(&kind, &payload)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Job not found",
+			})
+		}
+
+		fmt.Println("💥 Error deleting the dead job in RetryDeadJob() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	err = enqueueJob(tx, kind, json.RawMessage(payload))
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		fmt.Println("💥 Error enqueuing the job in RetryDeadJob() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		base     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{4, 4 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{20, time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.base.String(), func(t *testing.T) {
+			// The jitter adds up to a fifth of the delay
+			for i := 0; i < 100; i++ {
+				got := jobBackoff(tt.attempts)
+				if got < tt.base || got > tt.base+tt.base/5 {
+					t.Fatalf("jobBackoff(%d) = %s, want between %s and %s", tt.attempts, got, tt.base, tt.base+tt.base/5)
+				}
+			}
+		})
+	}
+}
+
+func TestRecurringJobSpecs(t *testing.T) {
+	for _, job := range recurringJobs {
+		if _, err := parseCron(job.Spec); err != nil {
+			t.Errorf("recurring job %s: %v", job.Name, err)
+		}
+	}
+}
@@ -0,0 +1,776 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types de contenu acceptés pour chaque type de média, avec l'extension utilisée pour le stockage
+var mediaContentTypes = map[string]map[string]string{
+	// Only the formats that can be decoded to generate the variants without their EXIF data are accepted
+	"PHOTO": {
+		"image/jpeg": ".jpg",
+		"image/png":  ".png",
+	},
+	"VIDEO": {
+		"video/mp4":       ".mp4",
+		"video/quicktime": ".mov",
+		"video/webm":      ".webm",
+	},
+}
+
+var errMediaTooLarge = errors.New("media too large")
+var errMediaType = errors.New("media type not allowed")
+
+// parseMediaKind convertit le paramètre "kind" (photo ou video) en type de média.
+func parseMediaKind(kind string) (string, bool) {
+	kind = strings.ToUpper(strings.TrimSpace(kind))
+	_, ok := mediaContentTypes[kind]
+	return kind, ok
+}
+
+// mediaMaxSize renvoie la taille maximale d'un média (MEDIA_MAX_PHOTO_SIZE et MEDIA_MAX_VIDEO_SIZE, en octets).
+func mediaMaxSize(kind string) int64 {
+	if kind == "VIDEO" {
+		return int64(getEnvInt("MEDIA_MAX_VIDEO_SIZE", 200<<20))
+	}
+	return int64(getEnvInt("MEDIA_MAX_PHOTO_SIZE", 15<<20))
+}
+
+// sniffMediaType détermine le type réel d'un fichier à partir de ses premiers octets, sans faire confiance au client.
+func sniffMediaType(head []byte) string {
+	// ISO base media files (mp4, mov, heic) start with a "ftyp" box followed by their brand
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		switch string(head[8:12]) {
+		case "qt  ":
+			return "video/quicktime"
+		case "heic", "heix", "mif1", "msf1":
+			return "image/heic"
+		default:
+			return "video/mp4"
+		}
+	}
+
+	contentType, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	return contentType
+}
+
+// validateMedia vérifie le type et la taille d'un média, et renvoie son type de contenu réel.
+func validateMedia(kind string, head []byte, size int64) (string, error) {
+	if size > mediaMaxSize(kind) {
+		return "", errMediaTooLarge
+	}
+
+	contentType := sniffMediaType(head)
+	if _, ok := mediaContentTypes[kind][contentType]; !ok {
+		return "", errMediaType
+	}
+
+	return contentType, nil
+}
+
+// randomToken génère un identifiant aléatoire de n octets encodé en hexadécimal.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// storeMedia enregistre un fichier dans le stockage configuré et crée l'objet média correspondant.
+func storeMedia(r io.Reader, size int64, kind string, contentType string, owner string, prefix string) (int, error) {
+	token, err := randomToken(16)
+	if err != nil {
+		return 0, err
+	}
+
+	key := fmt.Sprintf("%s/%s%s", prefix, token, mediaContentTypes[kind][contentType])
+	hash := sha256.New()
+
+	store := getMediaStorage()
+	if err := store.Put(key, io.TeeReader(r, hash), size, contentType); err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = db.QueryRow(`
+		INSERT INTO media (backend, storagekey, kind, contenttype, size, sha256, phonenumber)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING idmedia`,
+		store.Name(), key, kind, contentType, size, hex.EncodeToString(hash.Sum(nil)), owner,
+	).Scan(&id)
+	if err != nil {
+		if errDelete := store.Delete(key); errDelete != nil {
+			fmt.Println("💥 Error deleting the orphan media in storeMedia() : ", errDelete)
+		}
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// canUploadCriteriaMedia vérifie que l'utilisateur connecté est le visiteur d'une visite liée au critère.
+func canUploadCriteriaMedia(c *fiber.Ctx, idCriteria string) bool {
+	claims := c.Locals("user").(*CustomClaims)
+	return idCriteria != "" && claims.Role == "VISITOR" && hasAuthorizedCriteriaAccess(claims.PhoneNumber, idCriteria)
+}
+
+// mediaErrorResponse renvoie la réponse adaptée à une erreur de validation d'un média.
+func mediaErrorResponse(c *fiber.Ctx, kind string, err error) error {
+	if errors.Is(err, errMediaTooLarge) {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": fmt.Sprintf("The file is too large, the maximum size is %d MB", mediaMaxSize(kind)>>20),
+		})
+	}
+
+	allowed := make([]string, 0, len(mediaContentTypes[kind]))
+	for contentType := range mediaContentTypes[kind] {
+		allowed = append(allowed, contentType)
+	}
+
+	return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+		"error":   "This type of file is not allowed",
+		"allowed": allowed,
+	})
+}
+
+// UploadCriteriaMedia reçoit en une fois (multipart, champ "file") la photo répondant à un critère. Le corps des
+// requêtes étant limité, les vidéos passent par l'envoi reprenable (CreateMediaUpload).
+func UploadCriteriaMedia(c *fiber.Ctx) error {
+	idCriteria := strings.TrimSpace(c.Query("id"))
+	kind, ok := parseMediaKind(c.Query("kind"))
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the kind of media (photo or video)",
+		})
+	}
+
+	if kind == "VIDEO" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Videos must be sent with the resumable upload",
+		})
+	}
+
+	if !canUploadCriteriaMedia(c, idCriteria) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	}
+
+	done, err := criteriaVisitDone(idCriteria)
+	if err != nil {
+		fmt.Println("💥 Error checking the visit in UploadCriteriaMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+	if done {
+		return criteriaClosedResponse(c)
+	}
+
+	caption, err := parseMediaCaption(c.FormValue("caption"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the file in the \"file\" field",
+		})
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		fmt.Println("💥 Error opening the file in UploadCriteriaMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		fmt.Println("💥 Error reading the file in UploadCriteriaMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+	head = head[:n]
+
+	contentType, err := validateMedia(kind, head, header.Size)
+	if err != nil {
+		return mediaErrorResponse(c, kind, err)
+	}
+
+	idMedia, err := storeMedia(io.MultiReader(bytes.NewReader(head), file), header.Size, kind, contentType, c.Locals("user").(*CustomClaims).PhoneNumber, "criteria/"+idCriteria)
+	if err != nil {
+		fmt.Println("💥 Error storing the media in UploadCriteriaMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	idCriteriaMedia, err := attachCriteriaMedia(idCriteria, idMedia, caption)
+	if err != nil {
+		fmt.Println("💥 Error attaching the media in UploadCriteriaMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if kind == "PHOTO" {
+		processPhotoAsync(idMedia)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"id":       idCriteriaMedia,
+		"media_id": idMedia,
+		"url":      mediaURL(&idMedia, "", c.Locals("user").(*CustomClaims).PhoneNumber),
+	})
+}
+
+// ============================================= RESUMABLE UPLOADS ============================================= //
+
+// mediaUploadPath renvoie le fichier temporaire d'un envoi en cours (dossier MEDIA_UPLOAD_DIR).
+func mediaUploadPath(id string) string {
+	dir := os.Getenv("MEDIA_UPLOAD_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "voyo-uploads")
+	}
+	return filepath.Join(dir, filepath.Base(id))
+}
+
+// CreateMediaUpload démarre un envoi reprenable. La taille totale est donnée dans l'en-tête Upload-Length.
+func CreateMediaUpload(c *fiber.Ctx) error {
+	idCriteria := strings.TrimSpace(c.Query("id"))
+	kind, ok := parseMediaKind(c.Query("kind"))
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the kind of media (photo or video)",
+		})
+	}
+
+	if !canUploadCriteriaMedia(c, idCriteria) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	}
+
+	done, err := criteriaVisitDone(idCriteria)
+	if err != nil {
+		fmt.Println("💥 Error checking the visit in CreateMediaUpload() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+	if done {
+		return criteriaClosedResponse(c)
+	}
+
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the size of the file in the Upload-Length header",
+		})
+	}
+
+	if length > mediaMaxSize(kind) {
+		return mediaErrorResponse(c, kind, errMediaTooLarge)
+	}
+
+	caption, err := parseMediaCaption(tusMetadata(c.Get("Upload-Metadata"))["caption"])
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	id, err := randomToken(16)
+	if err != nil {
+		fmt.Println("💥 Error generating the upload ID in CreateMediaUpload() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if err := os.MkdirAll(filepath.Dir(mediaUploadPath(id)), 0o750); err != nil {
+		fmt.Println("💥 Error creating the upload directory in CreateMediaUpload() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	// The real content type is known once the first bytes have been received
+	_, err = db.Exec(`
+		INSERT INTO mediaupload (idmediaupload, idcriteria, kind, contenttype, length, phonenumber, caption)
+		VALUES ($1, $2, $3, '', $4, $5, $6)`,
+		id, idCriteria, kind, length, c.Locals("user").(*CustomClaims).PhoneNumber, caption)
+	if err != nil {
+		fmt.Println("💥 Error creating the upload in CreateMediaUpload() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	c.Set("Tus-Resumable", "1.0.0")
+	c.Set(fiber.HeaderLocation, "/api/criteria/media/uploads/"+id)
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"id": id,
+	})
+}
+
+// mediaUpload est l'état d'un envoi reprenable.
+type mediaUpload struct {
+	ID          string
+	IDCriteria  string
+	Kind        string
+	ContentType string
+	Length      int64
+	Offset      int64
+	Owner       string
+	Caption     *string
+	IDMedia     *int
+}
+
+// getMediaUpload charge un envoi reprenable appartenant à l'utilisateur connecté.
+func getMediaUpload(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, c *fiber.Ctx, lock bool) (mediaUpload, error) {
+	query := `SELECT idmediaupload, idcriteria, kind, contenttype, length, "offset", phonenumber, caption, idmedia FROM mediaupload WHERE idmediaupload = $1 AND phonenumber = $2`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+
+	var upload mediaUpload
+	err := q.QueryRow(query, c.Params("id"), c.Locals("user").(*CustomClaims).PhoneNumber).Scan(&upload.ID, &upload.IDCriteria, &upload.Kind, &upload.ContentType, &upload.Length, &upload.Offset, &upload.Owner, &upload.Caption, &upload.IDMedia)
+	return upload, err
+}
+
+// HeadMediaUpload renvoie la progression d'un envoi reprenable, pour savoir où reprendre.
+func HeadMediaUpload(c *fiber.Ctx) error {
+	upload, err := getMediaUpload(db, c, false)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+
+		fmt.Println("💥 Error scanning the row in HeadMediaUpload() : ", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	c.Set("Tus-Resumable", "1.0.0")
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// PatchMediaUpload ajoute un morceau à un envoi reprenable, à la position donnée dans l'en-tête Upload-Offset.
+// Une fois le fichier complet, il est validé, stocké et associé au critère.
+func PatchMediaUpload(c *fiber.Ctx) error {
+	c.Set("Tus-Resumable", "1.0.0")
+
+	if c.Get(fiber.HeaderContentType) != "application/offset+octet-stream" {
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+			"error": "The Content-Type must be application/offset+octet-stream",
+		})
+	}
+
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the Upload-Offset header",
+		})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println("💥 Error starting the transaction in PatchMediaUpload() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in PatchMediaUpload() : ", err)
+		}
+	}(tx)
+
+	// The row stays locked while the chunk is written so that two requests cannot write at the same offset
+	upload, err := getMediaUpload(tx, c, true)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Upload not found",
+			})
+		}
+
+		fmt.Println("💥 Error scanning the row in PatchMediaUpload() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if upload.IDMedia != nil || offset != upload.Offset {
+		c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The offset does not match the data already received",
+		})
+	}
+
+	done, err := criteriaVisitDone(upload.IDCriteria)
+	if err != nil {
+		fmt.Println("💥 Error checking the visit in PatchMediaUpload() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+	if done {
+		return criteriaClosedResponse(c)
+	}
+
+	chunk := c.Body()
+	if upload.Offset+int64(len(chunk)) > upload.Length {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": "The data exceeds the announced Upload-Length",
+		})
+	}
+
+	// Reject a wrong type of file as soon as the first chunk is received
+	if upload.Offset == 0 {
+		upload.ContentType, err = validateMedia(upload.Kind, chunk[:min(len(chunk), 512)], upload.Length)
+		if err != nil {
+			return mediaErrorResponse(c, upload.Kind, err)
+		}
+	}
+
+	file, err := os.OpenFile(mediaUploadPath(upload.ID), os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		fmt.Println("💥 Error opening the upload file in PatchMediaUpload() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	_, err = file.WriteAt(chunk, upload.Offset)
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		fmt.Println("💥 Error writing the upload file in PatchMediaUpload() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	upload.Offset += int64(len(chunk))
+
+	if upload.Offset == upload.Length {
+		file, err := os.Open(mediaUploadPath(upload.ID))
+		if err != nil {
+			fmt.Println("💥 Error opening the upload file in PatchMediaUpload() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+
+		idMedia, err := storeMedia(file, upload.Length, upload.Kind, upload.ContentType, upload.Owner, "criteria/"+upload.IDCriteria)
+		_ = file.Close()
+		if err != nil {
+			fmt.Println("💥 Error storing the media in PatchMediaUpload() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+
+		if _, err := attachCriteriaMedia(upload.IDCriteria, idMedia, upload.Caption); err != nil {
+			fmt.Println("💥 Error attaching the media in PatchMediaUpload() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+
+		upload.IDMedia = &idMedia
+	}
+
+	_, err = tx.Exec(`UPDATE mediaupload SET "offset" = $1, contenttype = $2, idmedia = $3, updatedat = NOW() WHERE idmediaupload = $4`, upload.Offset, upload.ContentType, upload.IDMedia, upload.ID)
+	if err != nil {
+		fmt.Println("💥 Error updating the upload in PatchMediaUpload() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		fmt.Println("💥 Error committing the transaction in PatchMediaUpload() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if upload.IDMedia != nil {
+		if err := os.Remove(mediaUploadPath(upload.ID)); err != nil {
+			fmt.Println("💥 Error removing the upload file in PatchMediaUpload() : ", err)
+		}
+
+		if upload.Kind == "PHOTO" {
+			processPhotoAsync(*upload.IDMedia)
+		}
+	}
+
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// purgeMediaUploads supprime les envois reprenables sans activité depuis MEDIA_UPLOAD_TTL, ainsi que les fichiers
+// temporaires restés dans MEDIA_UPLOAD_DIR.
+func purgeMediaUploads() (int64, error) {
+	cutoff := time.Now().Add(-getEnvDuration("MEDIA_UPLOAD_TTL", 24*time.Hour))
+
+	result, err := db.Exec(`DELETE FROM mediaupload WHERE updatedat < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	// The files of the uploads deleted with their criteria are removed here as well
+	dir := filepath.Dir(mediaUploadPath("upload"))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return purged, nil
+		}
+		return purged, err
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || !info.ModTime().Before(cutoff) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Println("💥 Error removing the upload file in purgeMediaUploads() : ", err)
+		}
+	}
+
+	return purged, nil
+}
+
+// ============================================= SERVING ============================================= //
+
+// hasAuthorizedMediaAccess vérifie que l'utilisateur a envoyé le média, participe à une visite dont un critère l'utilise,
+// l'a reçu dans un message, ou que le média est une photo de profil.
+func hasAuthorizedMediaAccess(phoneNumber string, idMedia string) bool {
+	var allowed bool
+	err := db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM media WHERE idmedia = $1 AND phonenumber = $2)
+		    OR EXISTS(SELECT 1 FROM "user" WHERE idprofilemedia = $1)
+		    OR EXISTS(SELECT 1
+		              FROM criteriamedia cm
+		                       JOIN linkcriteriavisit l ON cm.idcriteria = l.idcriteria
+		                       JOIN visit v ON l.idvisit = v.idvisit
+		              WHERE cm.idmedia = $1
+		                AND (v.phonenumberprospect = $2 OR v.phonenumbervisitor = $2))
+		    OR EXISTS(SELECT 1
+		              FROM message m
+		              WHERE m.idmedia = $1
+		                AND (m.sender = $2 OR m.recipient = $2))`, idMedia, phoneNumber).Scan(&allowed)
+	if err != nil {
+		fmt.Println("💥 Error scanning the row in hasAuthorizedMediaAccess() : ", err)
+		return false
+	}
+
+	return allowed
+}
+
+// GetMedia renvoie le contenu d'un média à partir d'une URL signée. Pour une photo, la version web est servie par défaut : l'original, qui
+// contient encore ses données EXIF (position GPS, ...), n'est accessible qu'à la personne qui l'a envoyé.
+func GetMedia(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+	if id == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the ID of the media",
+		})
+	}
+
+	variant := strings.ToUpper(c.Query("variant", "web"))
+	if variant != "THUMB" && variant != "WEB" && variant != "ORIGINAL" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The variant must be thumb, web or original",
+		})
+	}
+
+	if err := verifySignedURL(c, mediaPath); err != nil {
+		return signedURLErrorResponse(c, err)
+	}
+
+	// The access is checked again as it may have been lost since the link was given
+	phoneNumber := c.Locals("user").(*CustomClaims).PhoneNumber
+	if !hasAuthorizedMediaAccess(phoneNumber, id) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	}
+
+	return sendMedia(c, id, variant, phoneNumber)
+}
+
+// sendMedia envoie le contenu d'un média, ou d'une de ses versions, depuis son stockage.
+func sendMedia(c *fiber.Ctx, id string, variant string, phoneNumber string) error {
+	var backend, key, kind, contentType string
+	var owner sql.NullString
+	var size int64
+	err := db.QueryRow(`SELECT backend, storagekey, kind, contenttype, size, phonenumber FROM media WHERE idmedia = $1`, id).Scan(&backend, &key, &kind, &contentType, &size, &owner)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Media not found",
+			})
+		}
+
+		fmt.Println("💥 Error scanning the row in sendMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	// Media migrated from the old free text fields are still hosted elsewhere
+	if backend == "external" {
+		return c.Redirect(key, fiber.StatusFound)
+	}
+
+	if kind == "PHOTO" && variant != "ORIGINAL" {
+		err := db.QueryRow(`SELECT storagekey, contenttype, size FROM mediavariant WHERE idmedia = $1 AND variant = $2`, id, variant).Scan(&key, &contentType, &size)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": "The photo is still being processed, please try again in a few moments",
+				})
+			}
+
+			fmt.Println("💥 Error scanning the row in sendMedia() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+	} else if kind == "PHOTO" && owner.String != phoneNumber {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the web and thumb versions of this photo are available",
+		})
+	}
+
+	store, err := getStorageByName(backend)
+	if err != nil {
+		fmt.Println("💥 Error getting the storage in sendMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	reader, err := store.Get(key)
+	if err != nil {
+		fmt.Println("💥 Error reading the media in sendMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderCacheControl, "private, max-age=300")
+	return c.SendStream(reader, int(size))
+}
+
+// ============================================= PROFILE PICTURE ============================================= //
+
+// UploadProfilePicture reçoit la photo de profil de l'utilisateur connecté (multipart, champ "file"). La photo est
+// traitée immédiatement pour que sa version web, sans données EXIF, soit disponible dès la réponse.
+func UploadProfilePicture(c *fiber.Ctx) error {
+	phoneNumber := c.Locals("user").(*CustomClaims).PhoneNumber
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the file in the \"file\" field",
+		})
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		fmt.Println("💥 Error opening the file in UploadProfilePicture() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		fmt.Println("💥 Error reading the file in UploadProfilePicture() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+	head = head[:n]
+
+	contentType, err := validateMedia("PHOTO", head, header.Size)
+	if err != nil {
+		return mediaErrorResponse(c, "PHOTO", err)
+	}
+
+	idMedia, err := storeMedia(io.MultiReader(bytes.NewReader(head), file), header.Size, "PHOTO", contentType, phoneNumber, "profiles")
+	if err != nil {
+		fmt.Println("💥 Error storing the media in UploadProfilePicture() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if err := processPhoto(idMedia); err != nil {
+		fmt.Println("💥 Error processing the photo in UploadProfilePicture() : ", err)
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "The photo could not be read, please try another one",
+		})
+	}
+
+	// The stored reference is signed each time it is returned, see profilePictureURL
+	picture := fmt.Sprintf("%s?id=%d&variant=web", mediaPath, idMedia)
+	_, err = db.Exec(`UPDATE "user" SET idprofilemedia = $1, ProfilePicture = $2 WHERE PhoneNumber = $3`, idMedia, picture, phoneNumber)
+	if err != nil {
+		fmt.Println("💥 Error updating the user in UploadProfilePicture() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"id":        idMedia,
+		"url":       profilePictureURL(picture, phoneNumber),
+		"thumbnail": mediaURL(&idMedia, "thumb", phoneNumber),
+	})
+}
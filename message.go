@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"io"
+	"mime/multipart"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Longueur maximale d'un message, en caractères
+const messageMaxLength = 2000
+
+// Statuts des visites dont le fil de discussion est ouvert : les questions restent possibles après le rapport
+var messageOpenStatuses = map[string]bool{"PENDING": true, "ACCEPTED": true, "DONE": true}
+
+// messageScanner est implémenté par *sql.Row et *sql.Rows.
+type messageScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// visitThreadSQL renvoie la condition SQL limitant les messages m d'une visite v à ceux échangés entre son prospect et
+// son visiteur actuels : après un changement de visiteur, le nouveau ne voit pas la conversation avec le précédent.
+func visitThreadSQL(m string, v string) string {
+	return fmt.Sprintf(`((%[1]s.sender = %[2]s.phonenumberprospect AND %[1]s.recipient = %[2]s.phonenumbervisitor)
+		    OR (%[1]s.sender = %[2]s.phonenumbervisitor AND %[1]s.recipient = %[2]s.phonenumberprospect))`, m, v)
+}
+
+// Colonnes lues par scanVisitMessage
+const visitMessageColumns = `m.idmessage, m.idvisit, m.sender, m.body, m.idmedia, md.kind, m.createdat, m.readat`
+
+// scanVisitMessage lit un message et signe l'URL de sa pièce jointe pour l'utilisateur phoneNumber.
+func scanVisitMessage(row messageScanner, phoneNumber string) (VisitMessage, error) {
+	var message VisitMessage
+	var idMedia *int
+	var kind *string
+	err := row.Scan(&message.ID, &message.IdVisit, &message.Sender, &message.Body, &idMedia, &kind, &message.CreatedAt, &message.ReadAt)
+	if err != nil {
+		return message, err
+	}
+
+	fillVisitMessage(&message, idMedia, kind, phoneNumber)
+	return message, nil
+}
+
+// fillVisitMessage complète un message lu pour l'utilisateur phoneNumber, avec l'URL signée de sa pièce jointe.
+func fillVisitMessage(message *VisitMessage, idMedia *int, kind *string, phoneNumber string) {
+	message.Mine = message.Sender == phoneNumber
+	if idMedia == nil || kind == nil {
+		return
+	}
+
+	message.Attachment = &MessageAttachment{MediaID: *idMedia, Kind: *kind}
+	if *kind == "PHOTO" {
+		message.Attachment.URL = mediaURL(idMedia, "web", phoneNumber)
+		message.Attachment.Thumbnail = mediaURL(idMedia, "thumb", phoneNumber)
+	} else {
+		message.Attachment.URL = mediaURL(idMedia, "", phoneNumber)
+	}
+}
+
+// countUnreadMessages compte les messages reçus et pas encore lus par un utilisateur, toutes visites confondues.
+func countUnreadMessages(phoneNumber string) (int, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*)
+		FROM message m
+		         JOIN visit v ON m.idvisit = v.idvisit
+		WHERE m.recipient = $1
+		  AND `+visitThreadSQL("m", "v")+`
+		  AND m.readat IS NULL`, phoneNumber).Scan(&count)
+	return count, err
+}
+
+// messagePartyErrorResponse renvoie la réponse adaptée lorsque le fil d'une visite ne peut pas être lu.
+func messagePartyErrorResponse(c *fiber.Ctx, err error) error {
+	if errors.Is(err, errNotVisitParty) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	}
+
+	fmt.Println("💥 Error reading the visit in messagePartyErrorResponse() : ", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "An error has occurred, please try again later.",
+	})
+}
+
+// GetMessageThreads renvoie les fils de discussion de l'utilisateur connecté, du plus récemment actif au plus ancien,
+// avec leur dernier message et le nombre de messages non lus.
+func GetMessageThreads(c *fiber.Ctx) error {
+	phoneNumber := c.Locals("user").(*CustomClaims).PhoneNumber
+
+	rows, err := db.Query(`
+		SELECT v.idvisit, v.starttime, v.status, u.firstname, u.lastname, u.idprofilemedia,
+		       (SELECT COUNT(*) FROM message r WHERE r.idvisit = v.idvisit AND r.recipient = $1 AND `+visitThreadSQL("r", "v")+` AND r.readat IS NULL),
+		       `+visitMessageColumns+`
+		FROM visit v
+		         JOIN LATERAL (SELECT *
+		                       FROM message l
+		                       WHERE l.idvisit = v.idvisit AND `+visitThreadSQL("l", "v")+`
+		                       ORDER BY l.idmessage DESC
+		                       LIMIT 1) m ON TRUE
+		         LEFT JOIN media md ON m.idmedia = md.idmedia
+		         JOIN "user" u ON u.phonenumber = CASE WHEN v.phonenumberprospect = $1 THEN v.phonenumbervisitor ELSE v.phonenumberprospect END
+		WHERE v.phonenumberprospect = $1 OR v.phonenumbervisitor = $1
+		ORDER BY m.idmessage DESC`, phoneNumber)
+	if err != nil {
+		fmt.Println("💥 Error querying the database in GetMessageThreads() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in GetMessageThreads() : ", err)
+		}
+	}(rows)
+
+	threads := []MessageThread{}
+	for rows.Next() {
+		var thread MessageThread
+		var idProfileMedia, idMedia *int
+		var kind *string
+		message := &thread.LastMessage
+
+		err := rows.Scan(&thread.IdVisit, &thread.StartTime, &thread.Status, &thread.Contact.FirstName, &thread.Contact.LastName,
+			&idProfileMedia, &thread.Unread,
+			&message.ID, &message.IdVisit, &message.Sender, &message.Body, &idMedia, &kind, &message.CreatedAt, &message.ReadAt)
+		if err != nil {
+			fmt.Println("💥 Error scanning the row in GetMessageThreads() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+
+		thread.Contact.ProfilePicture = mediaURL(idProfileMedia, "thumb", phoneNumber)
+		fillVisitMessage(message, idMedia, kind, phoneNumber)
+
+		threads = append(threads, thread)
+	}
+
+	return c.JSON(threads)
+}
+
+// GetVisitMessages renvoie les messages d'une visite, du plus récent au plus ancien, par pages de "limit" messages
+// (50 par défaut). La page suivante s'obtient en passant dans "before" l'identifiant du dernier message reçu.
+func GetVisitMessages(c *fiber.Ctx) error {
+	idVisit := strings.TrimSpace(c.Query("idVisit"))
+	phoneNumber := c.Locals("user").(*CustomClaims).PhoneNumber
+
+	before, err := strconv.Atoi(c.Query("before", "0"))
+	if err != nil || before < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The before parameter must be the ID of a message",
+		})
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "50"))
+	if err != nil || limit < 1 || limit > 100 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The limit must be between 1 and 100",
+		})
+	}
+
+	if _, _, _, _, err := getVisitParty(db, idVisit, phoneNumber, false); err != nil {
+		return messagePartyErrorResponse(c, err)
+	}
+
+	// One more message is read to know whether there is another page
+	rows, err := db.Query(`
+		SELECT `+visitMessageColumns+`
+		FROM message m
+		         JOIN visit v ON m.idvisit = v.idvisit
+		         LEFT JOIN media md ON m.idmedia = md.idmedia
+		WHERE m.idvisit = $1 AND `+visitThreadSQL("m", "v")+` AND ($2 = 0 OR m.idmessage < $2)
+		ORDER BY m.idmessage DESC
+		LIMIT $3`, idVisit, before, limit+1)
+	if err != nil {
+		fmt.Println("💥 Error querying the database in GetVisitMessages() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in GetVisitMessages() : ", err)
+		}
+	}(rows)
+
+	messages := []VisitMessage{}
+	for rows.Next() {
+		message, err := scanVisitMessage(rows, phoneNumber)
+		if err != nil {
+			fmt.Println("💥 Error scanning the row in GetVisitMessages() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+		messages = append(messages, message)
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+
+	return c.JSON(fiber.Map{
+		"messages": messages,
+		"has_more": hasMore,
+	})
+}
+
+// SendVisitMessage envoie un message à l'autre partie d'une visite. Le texte est donné dans "body", en JSON ou en
+// multipart, et une photo ou une vidéo peut être jointe dans le champ multipart "file".
+func SendVisitMessage(c *fiber.Ctx) error {
+	idVisit := strings.TrimSpace(c.Query("idVisit"))
+	phoneNumber := c.Locals("user").(*CustomClaims).PhoneNumber
+
+	var request struct {
+		Body string `json:"body" form:"body"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the message in the \"body\" field",
+		})
+	}
+
+	var body *string
+	if text := strings.TrimSpace(request.Body); text != "" {
+		if utf8.RuneCountInString(text) > messageMaxLength {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("The message must not exceed %d characters", messageMaxLength),
+			})
+		}
+		body = &text
+	}
+
+	header, _ := c.FormFile("file")
+
+	if body == nil && header == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide a message or a file",
+		})
+	}
+
+	_, status, _, _, err := getVisitParty(db, idVisit, phoneNumber, false)
+	if err != nil {
+		return messagePartyErrorResponse(c, err)
+	}
+
+	if !messageOpenStatuses[status] {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The conversation of this visit is closed",
+		})
+	}
+
+	var idMedia *int
+	if header != nil {
+		id, kind, err := storeMessageAttachment(header, idVisit, phoneNumber)
+		if errors.Is(err, errMediaTooLarge) || errors.Is(err, errMediaType) {
+			return mediaErrorResponse(c, kind, err)
+		}
+		if err != nil {
+			fmt.Println("💥 Error storing the attachment in SendVisitMessage() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+		idMedia = &id
+	}
+
+	row := db.QueryRow(`
+		WITH inserted AS (
+		    INSERT INTO message (idvisit, sender, recipient, body, idmedia)
+		    SELECT idvisit, $2, CASE WHEN phonenumberprospect = $2 THEN phonenumbervisitor ELSE phonenumberprospect END, $3, $4
+		    FROM visit
+		    WHERE idvisit = $1
+		    RETURNING *)
+		SELECT `+visitMessageColumns+`
+		FROM inserted m
+		         LEFT JOIN media md ON m.idmedia = md.idmedia`, idVisit, phoneNumber, body, idMedia)
+	message, err := scanVisitMessage(row, phoneNumber)
+	if err != nil {
+		fmt.Println("💥 Error inserting the message in SendVisitMessage() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	go notifyVisitEvent(idVisit, pushMessageReceived, phoneNumber)
+
+	return c.Status(fiber.StatusCreated).JSON(message)
+}
+
+// storeMessageAttachment valide et stocke la photo ou la vidéo jointe à un message, et renvoie son type avec
+// l'identifiant du média.
+func storeMessageAttachment(header *multipart.FileHeader, idVisit string, phoneNumber string) (int, string, error) {
+	file, err := header.Open()
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, "", err
+	}
+	head = head[:n]
+
+	// The kind of the attachment is deduced from its content
+	kind := "PHOTO"
+	if _, ok := mediaContentTypes["VIDEO"][sniffMediaType(head)]; ok {
+		kind = "VIDEO"
+	}
+
+	contentType, err := validateMedia(kind, head, header.Size)
+	if err != nil {
+		return 0, kind, err
+	}
+
+	idMedia, err := storeMedia(io.MultiReader(bytes.NewReader(head), file), header.Size, kind, contentType, phoneNumber, "messages/"+idVisit)
+	if err != nil {
+		return 0, kind, err
+	}
+
+	if kind == "PHOTO" {
+		processPhotoAsync(idMedia)
+	}
+	return idMedia, kind, nil
+}
+
+// MarkVisitMessagesRead marque comme lus les messages reçus sur une visite, jusqu'au message "upTo" s'il est donné.
+// L'autre partie voit alors la date de lecture de ses messages.
+func MarkVisitMessagesRead(c *fiber.Ctx) error {
+	idVisit := strings.TrimSpace(c.Query("idVisit"))
+	phoneNumber := c.Locals("user").(*CustomClaims).PhoneNumber
+
+	upTo, err := strconv.Atoi(c.Query("upTo", "0"))
+	if err != nil || upTo < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The upTo parameter must be the ID of a message",
+		})
+	}
+
+	if _, _, _, _, err := getVisitParty(db, idVisit, phoneNumber, false); err != nil {
+		return messagePartyErrorResponse(c, err)
+	}
+
+	_, err = db.Exec(`
+		UPDATE message
+		SET readat = NOW()
+		WHERE idvisit = $1 AND recipient = $2 AND readat IS NULL AND ($3 = 0 OR idmessage <= $3)`, idVisit, phoneNumber, upTo)
+	if err != nil {
+		fmt.Println("💥 Error updating the messages in MarkVisitMessagesRead() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -8,6 +8,9 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Function to get coordinates from address using the Google Maps Geocoding API
@@ -199,6 +202,7 @@ func Search(c *fiber.Ctx) error {
 				"error": "An error has occurred, please try again later.",
 			})
 		}
+		user.ProfilePicture = profilePictureURL(user.ProfilePicture, c.Locals("user").(*CustomClaims).PhoneNumber)
 		users = append(users, user)
 	}
 
@@ -266,6 +270,7 @@ func Search(c *fiber.Ctx) error {
 					"error": "An error has occurred, please try again later.",
 				})
 			}
+			user.ProfilePicture = profilePictureURL(user.ProfilePicture, c.Locals("user").(*CustomClaims).PhoneNumber)
 			users = append(users, user)
 		}
 	}
@@ -290,3 +295,32 @@ func checkUserRole(phoneNumber string, role string) bool {
 	}
 	return exists
 }
+
+// getEnvDuration lit une durée (ex: "24h") dans les variables d'environnement, ou renvoie la valeur par défaut.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// getEnvInt lit un entier dans les variables d'environnement, ou renvoie la valeur par défaut.
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// getEnvList lit une liste de valeurs séparées par des virgules dans les variables d'environnement.
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,27 @@
+-- Dossiers de vérification d'identité des visiteurs.
+-- Chaque soumission crée une nouvelle ligne : l'historique des re-soumissions est donc conservé.
+CREATE TABLE IF NOT EXISTS verificationcase
+(
+    idverificationcase SERIAL PRIMARY KEY,
+    phonenumber        VARCHAR(20) NOT NULL REFERENCES "user" (phonenumber),
+    attempt            INT         NOT NULL DEFAULT 1,
+    cnifront           TEXT,
+    cniback            TEXT,
+    status             VARCHAR(32) NOT NULL DEFAULT 'SUBMITTED',
+    reviewer           VARCHAR(20) REFERENCES "user" (phonenumber),
+    reasoncodes        TEXT[]      NOT NULL DEFAULT '{}',
+    comment            TEXT,
+    submittedat        TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    reviewedat         TIMESTAMPTZ,
+    CONSTRAINT verificationcase_status_check CHECK (status IN ('SUBMITTED', 'APPROVED', 'REJECTED', 'NEEDS_RESUBMISSION'))
+);
+
+CREATE INDEX IF NOT EXISTS verificationcase_phonenumber_idx ON verificationcase (phonenumber);
+CREATE INDEX IF NOT EXISTS verificationcase_queue_idx ON verificationcase (submittedat) WHERE status = 'SUBMITTED';
+
+-- Reprise des visiteurs déjà en attente de validation
+INSERT INTO verificationcase (phonenumber, cnifront, cniback)
+SELECT phonenumber, cnifront, cniback
+FROM "user"
+WHERE status = 'PENDING_VALIDATION'
+  AND NOT EXISTS (SELECT 1 FROM verificationcase vc WHERE vc.phonenumber = "user".phonenumber);
@@ -0,0 +1,38 @@
+-- Pièces d'identité chiffrées (chiffrement enveloppe : chaque document a sa propre clé de données,
+-- elle-même chiffrée avec la clé maître DOCUMENT_MASTER_KEY).
+CREATE TABLE IF NOT EXISTS identitydocument
+(
+    iddocument  SERIAL PRIMARY KEY,
+    phonenumber VARCHAR(20) NOT NULL REFERENCES "user" (phonenumber),
+    side        VARCHAR(8)  NOT NULL CHECK (side IN ('FRONT', 'BACK')),
+    contenttype VARCHAR(128) NOT NULL,
+    keyid       VARCHAR(64) NOT NULL,
+    wrappedkey  BYTEA,
+    ciphertext  BYTEA,
+    createdat   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    purgeafter  TIMESTAMPTZ,
+    purgedat    TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS identitydocument_purge_idx ON identitydocument (purgeafter) WHERE purgedat IS NULL;
+
+-- Journal de tous les accès aux pièces d'identité
+CREATE TABLE IF NOT EXISTS documentaccesslog
+(
+    iddocumentaccess SERIAL PRIMARY KEY,
+    iddocument       INT         NOT NULL REFERENCES identitydocument (iddocument),
+    accessedby       VARCHAR(20) NOT NULL,
+    reason           TEXT        NOT NULL,
+    ip               VARCHAR(64),
+    accessedat       TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS documentaccesslog_document_idx ON documentaccesslog (iddocument);
+
+-- Les dossiers de vérification référencent désormais les documents chiffrés
+ALTER TABLE verificationcase
+    ADD COLUMN IF NOT EXISTS idcnifront INT REFERENCES identitydocument (iddocument),
+    ADD COLUMN IF NOT EXISTS idcniback  INT REFERENCES identitydocument (iddocument);
+
+-- Les colonnes en clair (verificationcase.cnifront/cniback et "user".cnifront/cniback) sont chiffrées puis
+-- vidées au démarrage du serveur par migratePlainIdentityDocuments(). Elles pourront être supprimées ensuite.
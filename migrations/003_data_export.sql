@@ -0,0 +1,13 @@
+-- Exports RGPD des données personnelles d'un utilisateur
+CREATE TABLE IF NOT EXISTS dataexport
+(
+    iddataexport SERIAL PRIMARY KEY,
+    phonenumber  VARCHAR(20) NOT NULL,
+    requestedby  VARCHAR(20) NOT NULL,
+    status       VARCHAR(16) NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'READY', 'FAILED')),
+    archive      BYTEA,
+    createdat    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    completedat  TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS dataexport_phonenumber_idx ON dataexport (phonenumber);
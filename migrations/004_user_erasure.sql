@@ -0,0 +1,19 @@
+-- Demandes d'effacement (droit à l'oubli). Les données personnelles sont anonymisées immédiatement et une copie
+-- chiffrée est conservée pendant le délai de grâce pour permettre une restauration.
+CREATE TABLE IF NOT EXISTS usererasure
+(
+    idusererasure SERIAL PRIMARY KEY,
+    phonehash     VARCHAR(64) NOT NULL,
+    surrogate     VARCHAR(20) NOT NULL UNIQUE,
+    keyid         VARCHAR(64) NOT NULL,
+    wrappedkey    BYTEA,
+    snapshot      BYTEA,
+    requestedby   VARCHAR(20) NOT NULL,
+    requestedat   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    graceuntil    TIMESTAMPTZ NOT NULL,
+    restoredat    TIMESTAMPTZ,
+    finalizedat   TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS usererasure_phonehash_idx ON usererasure (phonehash);
+CREATE INDEX IF NOT EXISTS usererasure_grace_idx ON usererasure (graceuntil) WHERE restoredat IS NULL AND finalizedat IS NULL;
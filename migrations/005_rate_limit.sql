@@ -0,0 +1,8 @@
+-- Seaux de jetons du limiteur de débit, partagés entre toutes les instances du serveur (RATE_LIMIT_BACKEND=postgres)
+CREATE UNLOGGED TABLE IF NOT EXISTS ratelimitbucket
+(
+    key       VARCHAR(255) PRIMARY KEY,
+    tokens    DOUBLE PRECISION NOT NULL,
+    allowed   BOOLEAN          NOT NULL DEFAULT TRUE,
+    updatedat TIMESTAMPTZ      NOT NULL DEFAULT NOW()
+);
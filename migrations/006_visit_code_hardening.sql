@@ -0,0 +1,5 @@
+-- Codes de vérification des visites : tentatives, secret TOTP et date de fin de visite
+ALTER TABLE visit
+    ADD COLUMN IF NOT EXISTS codeattempts INT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS codesecret   BYTEA,
+    ADD COLUMN IF NOT EXISTS completedat  TIMESTAMPTZ;
@@ -0,0 +1,14 @@
+-- Arrivée et départ du visiteur sur le lieu de la visite, d'après la position GPS de son téléphone
+CREATE TABLE IF NOT EXISTS visitcheck
+(
+    idvisitcheck SERIAL PRIMARY KEY,
+    idvisit      INT              NOT NULL REFERENCES visit (idvisit),
+    kind         VARCHAR(8)       NOT NULL CHECK (kind IN ('IN', 'OUT')),
+    x            DOUBLE PRECISION NOT NULL,
+    y            DOUBLE PRECISION NOT NULL,
+    accuracy     DOUBLE PRECISION,
+    distance     DOUBLE PRECISION NOT NULL,
+    outofrange   BOOLEAN          NOT NULL,
+    checkedat    TIMESTAMPTZ      NOT NULL DEFAULT NOW(),
+    UNIQUE (idvisit, kind)
+);
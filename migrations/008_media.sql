@@ -0,0 +1,59 @@
+-- Objets média (photos et vidéos) stockés sur le disque local ou sur un stockage compatible S3
+CREATE TABLE IF NOT EXISTS media
+(
+    idmedia     SERIAL PRIMARY KEY,
+    backend     VARCHAR(16)  NOT NULL CHECK (backend IN ('local', 's3', 'external')),
+    storagekey  TEXT         NOT NULL,
+    kind        VARCHAR(8)   NOT NULL CHECK (kind IN ('PHOTO', 'VIDEO')),
+    contenttype VARCHAR(128) NOT NULL,
+    size        BIGINT       NOT NULL DEFAULT 0,
+    sha256      VARCHAR(64),
+    phonenumber VARCHAR(20) REFERENCES "user" (phonenumber),
+    createdat   TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+-- Envois en plusieurs morceaux (protocole inspiré de tus), reprenables après une coupure réseau
+CREATE TABLE IF NOT EXISTS mediaupload
+(
+    idmediaupload VARCHAR(32) PRIMARY KEY,
+    idcriteria    INT          NOT NULL REFERENCES criteria (idcriteria) ON DELETE CASCADE,
+    kind          VARCHAR(8)   NOT NULL CHECK (kind IN ('PHOTO', 'VIDEO')),
+    contenttype   VARCHAR(128) NOT NULL,
+    length        BIGINT       NOT NULL,
+    "offset"      BIGINT       NOT NULL DEFAULT 0,
+    phonenumber   VARCHAR(20)  NOT NULL REFERENCES "user" (phonenumber),
+    idmedia       INT REFERENCES media (idmedia),
+    createdat     TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+-- Les critères référencent désormais des objets média au lieu de texte libre
+ALTER TABLE criteria
+    ADD COLUMN IF NOT EXISTS idphotomedia INT REFERENCES media (idmedia),
+    ADD COLUMN IF NOT EXISTS idvideomedia INT REFERENCES media (idmedia);
+
+-- Reprise des URL déjà renseignées, conservées comme médias externes
+WITH photos AS (
+    INSERT INTO media (backend, storagekey, kind, contenttype, phonenumber)
+        SELECT 'external', photo, 'PHOTO', 'application/octet-stream', NULL
+        FROM criteria
+        WHERE COALESCE(photo, '') != ''
+        RETURNING idmedia, storagekey)
+UPDATE criteria c
+SET idphotomedia = p.idmedia
+FROM photos p
+WHERE c.photo = p.storagekey;
+
+WITH videos AS (
+    INSERT INTO media (backend, storagekey, kind, contenttype, phonenumber)
+        SELECT 'external', video, 'VIDEO', 'application/octet-stream', NULL
+        FROM criteria
+        WHERE COALESCE(video, '') != ''
+        RETURNING idmedia, storagekey)
+UPDATE criteria c
+SET idvideomedia = v.idmedia
+FROM videos v
+WHERE c.video = v.storagekey;
+
+ALTER TABLE criteria
+    DROP COLUMN IF EXISTS photo,
+    DROP COLUMN IF EXISTS video;
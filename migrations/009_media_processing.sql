@@ -0,0 +1,27 @@
+-- Versions redimensionnées des photos (miniature et taille web), réencodées sans métadonnées EXIF
+CREATE TABLE IF NOT EXISTS mediavariant
+(
+    idmedia     INT          NOT NULL REFERENCES media (idmedia) ON DELETE CASCADE,
+    variant     VARCHAR(8)   NOT NULL CHECK (variant IN ('THUMB', 'WEB')),
+    storagekey  TEXT         NOT NULL,
+    contenttype VARCHAR(128) NOT NULL,
+    width       INT          NOT NULL,
+    height      INT          NOT NULL,
+    size        BIGINT       NOT NULL,
+    PRIMARY KEY (idmedia, variant)
+);
+
+-- Date et lieu de prise de vue lus dans les données EXIF de l'original avant leur suppression
+ALTER TABLE media
+    ADD COLUMN IF NOT EXISTS capturedat  TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS capturex    DOUBLE PRECISION,
+    ADD COLUMN IF NOT EXISTS capturey    DOUBLE PRECISION,
+    ADD COLUMN IF NOT EXISTS processedat TIMESTAMPTZ;
+
+-- Anomalies relevées sur les photos répondant à un critère (prise hors de la visite, loin du bien, ...)
+ALTER TABLE criteria
+    ADD COLUMN IF NOT EXISTS evidenceflags TEXT[] NOT NULL DEFAULT '{}';
+
+-- Photo de profil envoyée par l'utilisateur
+ALTER TABLE "user"
+    ADD COLUMN IF NOT EXISTS idprofilemedia INT REFERENCES media (idmedia);
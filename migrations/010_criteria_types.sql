@@ -0,0 +1,12 @@
+-- Critères typés : oui/non, note, mesure, choix unique ou multiple, texte libre
+ALTER TABLE criteria
+    ADD COLUMN IF NOT EXISTS criteriatype VARCHAR(16) NOT NULL DEFAULT 'TEXT'
+        CHECK (criteriatype IN ('TEXT', 'YES_NO', 'RATING', 'NUMBER', 'SINGLE_CHOICE', 'MULTIPLE_CHOICE')),
+    ADD COLUMN IF NOT EXISTS options      JSONB,
+    ADD COLUMN IF NOT EXISTS answer       JSONB;
+
+-- Les réponses existantes sont du texte libre
+UPDATE criteria
+SET answer = to_jsonb(criteriaanswer)
+WHERE answer IS NULL
+  AND COALESCE(criteriaanswer, '') != '';
@@ -0,0 +1,26 @@
+-- Modèles de listes de critères, proposés par Voyo (phonenumber NULL) ou enregistrés par un prospect,
+-- éventuellement liés à un type de bien (maison : jardin, toiture ; appartement : parties communes, ...)
+CREATE TABLE IF NOT EXISTS criteriatemplate
+(
+    idcriteriatemplate SERIAL PRIMARY KEY,
+    name               VARCHAR(100) NOT NULL,
+    idtyperealestate   INT REFERENCES typerealestate (idtyperealestate),
+    phonenumber        VARCHAR(20) REFERENCES "user" (phonenumber),
+    createdat          TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    updatedat          TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS criteriatemplate_typerealestate_idx ON criteriatemplate (idtyperealestate);
+
+CREATE TABLE IF NOT EXISTS criteriatemplateitem
+(
+    idcriteriatemplateitem SERIAL PRIMARY KEY,
+    idcriteriatemplate     INT         NOT NULL REFERENCES criteriatemplate (idcriteriatemplate) ON DELETE CASCADE,
+    position               INT         NOT NULL,
+    criteria               TEXT        NOT NULL,
+    criteriatype           VARCHAR(16) NOT NULL DEFAULT 'TEXT',
+    options                JSONB,
+    photorequired          BOOLEAN     NOT NULL DEFAULT FALSE,
+    videorequired          BOOLEAN     NOT NULL DEFAULT FALSE,
+    UNIQUE (idcriteriatemplate, position)
+);
@@ -0,0 +1,36 @@
+-- Collection ordonnée de photos et vidéos pour chaque réponse à un critère, à la place des colonnes uniques
+CREATE TABLE IF NOT EXISTS criteriamedia
+(
+    idcriteriamedia SERIAL PRIMARY KEY,
+    idcriteria      INT         NOT NULL REFERENCES criteria (idcriteria) ON DELETE CASCADE,
+    idmedia         INT         NOT NULL REFERENCES media (idmedia),
+    position        INT         NOT NULL,
+    caption         VARCHAR(500),
+    evidenceflags   TEXT[]      NOT NULL DEFAULT '{}',
+    addedat         TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (idcriteria, idmedia)
+);
+
+CREATE INDEX IF NOT EXISTS criteriamedia_criteria_idx ON criteriamedia (idcriteria, position);
+CREATE INDEX IF NOT EXISTS criteriamedia_media_idx ON criteriamedia (idmedia);
+
+-- Reprise de la photo et de la vidéo existantes, la photo en premier
+INSERT INTO criteriamedia (idcriteria, idmedia, position, evidenceflags, addedat)
+SELECT c.idcriteria, c.idphotomedia, 0, c.evidenceflags, m.createdat
+FROM criteria c
+         JOIN media m ON m.idmedia = c.idphotomedia
+ON CONFLICT DO NOTHING;
+
+INSERT INTO criteriamedia (idcriteria, idmedia, position, addedat)
+SELECT c.idcriteria, c.idvideomedia, CASE WHEN c.idphotomedia IS NULL THEN 0 ELSE 1 END, m.createdat
+FROM criteria c
+         JOIN media m ON m.idmedia = c.idvideomedia
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE criteria
+    DROP COLUMN IF EXISTS idphotomedia,
+    DROP COLUMN IF EXISTS idvideomedia;
+
+-- Légende donnée lors d'un envoi reprenable (en-tête Upload-Metadata)
+ALTER TABLE mediaupload
+    ADD COLUMN IF NOT EXISTS caption VARCHAR(500);
@@ -0,0 +1,7 @@
+-- Rapports PDF des visites terminées, générés à la première demande puis conservés
+CREATE TABLE IF NOT EXISTS visitreport
+(
+    idvisit   INT PRIMARY KEY REFERENCES visit (idvisit) ON DELETE CASCADE,
+    pdf       BYTEA       NOT NULL,
+    createdat TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,16 @@
+-- Liens de partage en lecture seule du rapport d'une visite, pour des personnes sans compte Voyo
+CREATE TABLE IF NOT EXISTS visitshare
+(
+    idvisitshare SERIAL PRIMARY KEY,
+    idvisit      INT         NOT NULL REFERENCES visit (idvisit) ON DELETE CASCADE,
+    tokenhash    CHAR(64)    NOT NULL UNIQUE,
+    createdby    VARCHAR(20) NOT NULL,
+    label        VARCHAR(100),
+    createdat    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expiresat    TIMESTAMPTZ NOT NULL,
+    revokedat    TIMESTAMPTZ,
+    viewcount    INT         NOT NULL DEFAULT 0,
+    lastviewedat TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS visitshare_visit_idx ON visitshare (idvisit);
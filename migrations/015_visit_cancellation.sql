@@ -0,0 +1,23 @@
+-- Annulations des visites, avec l'issue financière calculée selon la politique d'annulation en vigueur
+CREATE TABLE IF NOT EXISTS visitcancellation
+(
+    idvisitcancellation SERIAL PRIMARY KEY,
+    idvisit             INT            NOT NULL REFERENCES visit (idvisit) ON DELETE CASCADE,
+    cancelledby         VARCHAR(20)    NOT NULL,
+    role                VARCHAR(16)    NOT NULL CHECK (role IN ('PROSPECT', 'VISITOR')),
+    reason              VARCHAR(500),
+    tier                VARCHAR(16)    NOT NULL CHECK (tier IN ('FREE', 'LATE', 'LAST_MINUTE', 'VISITOR')),
+    hoursbefore         NUMERIC(10, 2) NOT NULL,
+    price               NUMERIC(10, 2) NOT NULL,
+    fee                 NUMERIC(10, 2) NOT NULL DEFAULT 0,
+    refund              NUMERIC(10, 2) NOT NULL DEFAULT 0,
+    compensation        NUMERIC(10, 2) NOT NULL DEFAULT 0,
+    -- Only the cancellations of accepted visits are counted against the reliability of the visitor
+    counted             BOOLEAN        NOT NULL DEFAULT FALSE,
+    cancelledat         TIMESTAMPTZ    NOT NULL DEFAULT NOW(),
+    -- Set when the prospect gives the visit to another visitor after a cancellation by the visitor
+    rematchedat         TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS visitcancellation_visit_idx ON visitcancellation (idvisit);
+CREATE INDEX IF NOT EXISTS visitcancellation_cancelledby_idx ON visitcancellation (cancelledby) WHERE counted;
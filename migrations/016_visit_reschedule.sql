@@ -0,0 +1,25 @@
+-- Propositions de nouveaux horaires pour une visite en attente, et contre-propositions de l'autre partie
+CREATE TABLE IF NOT EXISTS visitproposal
+(
+    idvisitproposal   SERIAL PRIMARY KEY,
+    idvisit           INT         NOT NULL REFERENCES visit (idvisit) ON DELETE CASCADE,
+    proposedby        VARCHAR(20) NOT NULL,
+    role              VARCHAR(16) NOT NULL CHECK (role IN ('PROSPECT', 'VISITOR')),
+    message           VARCHAR(500),
+    status            VARCHAR(16) NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'ACCEPTED', 'DECLINED', 'WITHDRAWN', 'SUPERSEDED')),
+    acceptedstarttime TIMESTAMP,
+    createdat         TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    respondedat       TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS visitproposal_visit_idx ON visitproposal (idvisit);
+
+-- Only one proposal is open at a time on a visit: a counter-offer replaces the previous one
+CREATE UNIQUE INDEX IF NOT EXISTS visitproposal_pending_idx ON visitproposal (idvisit) WHERE status = 'PENDING';
+
+CREATE TABLE IF NOT EXISTS visitproposalslot
+(
+    idvisitproposal INT       NOT NULL REFERENCES visitproposal (idvisitproposal) ON DELETE CASCADE,
+    starttime       TIMESTAMP NOT NULL,
+    PRIMARY KEY (idvisitproposal, starttime)
+);
@@ -0,0 +1,32 @@
+-- Demandes de visite ouvertes : le prospect ne choisit pas de visiteur, le premier visiteur éligible qui la prend l'obtient
+CREATE TABLE IF NOT EXISTS visitrequest
+(
+    idvisitrequest      SERIAL PRIMARY KEY,
+    phonenumberprospect VARCHAR(20)      NOT NULL,
+    idaddressgmap       VARCHAR(255)     NOT NULL DEFAULT '',
+    x                   DOUBLE PRECISION NOT NULL,
+    y                   DOUBLE PRECISION NOT NULL,
+    idtyperealestate    INT              NOT NULL REFERENCES typerealestate (idtyperealestate),
+    windowstart         TIMESTAMP        NOT NULL,
+    windowend           TIMESTAMP        NOT NULL,
+    maxprice            NUMERIC(10, 2)   NOT NULL CHECK (maxprice > 0),
+    note                VARCHAR(500),
+    status              VARCHAR(16)      NOT NULL DEFAULT 'OPEN' CHECK (status IN ('OPEN', 'CLAIMED', 'CANCELLED')),
+    -- Set once a visitor has claimed the request and the visit has been created
+    idvisit             INT REFERENCES visit (idvisit) ON DELETE SET NULL,
+    claimedby           VARCHAR(20),
+    createdat           TIMESTAMPTZ      NOT NULL DEFAULT NOW(),
+    claimedat           TIMESTAMPTZ,
+    CONSTRAINT visitrequest_window_check CHECK (windowend > windowstart)
+);
+
+CREATE INDEX IF NOT EXISTS visitrequest_prospect_idx ON visitrequest (phonenumberprospect);
+CREATE INDEX IF NOT EXISTS visitrequest_open_idx ON visitrequest (windowend) WHERE status = 'OPEN';
+
+-- Criteria of the request, linked to the visit when it is claimed
+CREATE TABLE IF NOT EXISTS visitrequestcriteria
+(
+    idvisitrequest INT NOT NULL REFERENCES visitrequest (idvisitrequest) ON DELETE CASCADE,
+    idcriteria     INT NOT NULL REFERENCES criteria (idcriteria) ON DELETE CASCADE,
+    PRIMARY KEY (idvisitrequest, idcriteria)
+);
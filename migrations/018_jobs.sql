@@ -0,0 +1,42 @@
+-- File des tâches exécutées en arrière-plan, partagée entre toutes les instances du serveur
+CREATE TABLE IF NOT EXISTS job
+(
+    idjob       BIGSERIAL PRIMARY KEY,
+    kind        VARCHAR(64) NOT NULL,
+    payload     JSONB       NOT NULL DEFAULT '{}',
+    status      VARCHAR(16) NOT NULL DEFAULT 'QUEUED' CHECK (status IN ('QUEUED', 'RUNNING')),
+    attempts    INT         NOT NULL DEFAULT 0,
+    maxattempts INT         NOT NULL DEFAULT 5,
+    runat       TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    lockedat    TIMESTAMPTZ,
+    lockedby    VARCHAR(64),
+    lasterror   TEXT,
+    -- Prevents the same job from being queued twice, e.g. a recurring job by two instances
+    uniquekey   VARCHAR(128),
+    createdat   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS job_queue_idx ON job (runat) WHERE status = 'QUEUED';
+CREATE INDEX IF NOT EXISTS job_running_idx ON job (lockedat) WHERE status = 'RUNNING';
+CREATE UNIQUE INDEX IF NOT EXISTS job_unique_idx ON job (kind, uniquekey) WHERE uniquekey IS NOT NULL;
+
+-- Tâches abandonnées après leur dernière tentative, gardées pour être examinées ou relancées
+CREATE TABLE IF NOT EXISTS jobdeadletter
+(
+    idjob     BIGINT PRIMARY KEY,
+    kind      VARCHAR(64) NOT NULL,
+    payload   JSONB       NOT NULL,
+    attempts  INT         NOT NULL,
+    lasterror TEXT,
+    createdat TIMESTAMPTZ NOT NULL,
+    failedat  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Prochaine exécution des tâches récurrentes
+CREATE TABLE IF NOT EXISTS jobschedule
+(
+    name      VARCHAR(64) PRIMARY KEY,
+    spec      VARCHAR(64) NOT NULL,
+    nextrunat TIMESTAMPTZ NOT NULL,
+    lastrunat TIMESTAMPTZ
+);
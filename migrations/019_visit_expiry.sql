@@ -0,0 +1,19 @@
+-- Date à laquelle la demande de visite a été envoyée au visiteur actuel, point de départ du délai de réponse
+ALTER TABLE visit
+    ADD COLUMN IF NOT EXISTS requestedat TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+CREATE INDEX IF NOT EXISTS visit_pending_idx ON visit (requestedat) WHERE status = 'PENDING';
+
+-- Réponses des visiteurs aux demandes de visite, pour mesurer leur délai de réponse et les demandes laissées sans réponse
+CREATE TABLE IF NOT EXISTS visitresponse
+(
+    idvisitresponse    SERIAL PRIMARY KEY,
+    idvisit            INT         NOT NULL REFERENCES visit (idvisit) ON DELETE CASCADE,
+    phonenumbervisitor VARCHAR(20) NOT NULL,
+    outcome            VARCHAR(16) NOT NULL CHECK (outcome IN ('ACCEPTED', 'REFUSED', 'EXPIRED')),
+    requestedat        TIMESTAMPTZ NOT NULL,
+    -- Empty when the request expired without an answer
+    respondedat        TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS visitresponse_visitor_idx ON visitresponse (phonenumbervisitor);
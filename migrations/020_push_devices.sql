@@ -0,0 +1,13 @@
+-- Téléphones des utilisateurs qui reçoivent les notifications push
+CREATE TABLE IF NOT EXISTS device
+(
+    iddevice    SERIAL PRIMARY KEY,
+    phonenumber VARCHAR(20)  NOT NULL,
+    provider    VARCHAR(8)   NOT NULL CHECK (provider IN ('FCM', 'APNS')),
+    -- A token identifies one installation of the application: it moves to the last user who logged in on the phone
+    token       VARCHAR(512) NOT NULL UNIQUE,
+    createdat   TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    lastseenat  TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS device_phonenumber_idx ON device (phonenumber);
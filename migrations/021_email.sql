@@ -0,0 +1,26 @@
+-- Langue des e-mails envoyés à l'utilisateur
+ALTER TABLE "user"
+    ADD COLUMN IF NOT EXISTS language VARCHAR(2) NOT NULL DEFAULT 'fr' CHECK (language IN ('fr', 'en'));
+
+-- E-mails transactionnels envoyés aux utilisateurs, avec leur statut d'envoi
+CREATE TABLE IF NOT EXISTS email
+(
+    idemail     SERIAL PRIMARY KEY,
+    phonenumber VARCHAR(20)  NOT NULL,
+    recipient   VARCHAR(255) NOT NULL,
+    template    VARCHAR(64)  NOT NULL,
+    language    VARCHAR(2)   NOT NULL,
+    subject     VARCHAR(255) NOT NULL,
+    -- Rendered when the email is queued so that a retry sends exactly the same message
+    textbody    TEXT         NOT NULL,
+    htmlbody    TEXT         NOT NULL,
+    status      VARCHAR(16)  NOT NULL DEFAULT 'QUEUED' CHECK (status IN ('QUEUED', 'SENT', 'FAILED')),
+    attempts    INT          NOT NULL DEFAULT 0,
+    lasterror   TEXT,
+    messageid   VARCHAR(255),
+    createdat   TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    sentat      TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS email_phonenumber_idx ON email (phonenumber);
+CREATE INDEX IF NOT EXISTS email_status_idx ON email (status, createdat);
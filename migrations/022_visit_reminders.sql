@@ -0,0 +1,20 @@
+-- Canal par lequel l'utilisateur préfère recevoir ses rappels
+ALTER TABLE "user"
+    ADD COLUMN IF NOT EXISTS notificationchannel VARCHAR(8) NOT NULL DEFAULT 'PUSH' CHECK (notificationchannel IN ('PUSH', 'SMS', 'EMAIL'));
+
+-- Rappels envoyés aux parties d'une visite avant son début
+CREATE TABLE IF NOT EXISTS visitreminder
+(
+    idvisitreminder SERIAL PRIMARY KEY,
+    idvisit         INT         NOT NULL REFERENCES visit (idvisit) ON DELETE CASCADE,
+    phonenumber     VARCHAR(20) NOT NULL,
+    role            VARCHAR(16) NOT NULL CHECK (role IN ('PROSPECT', 'VISITOR')),
+    offsetminutes   INT         NOT NULL,
+    -- Start of the visit the reminder was sent for: a rescheduled visit gets its reminders again
+    starttime       TIMESTAMPTZ NOT NULL,
+    channel         VARCHAR(8) CHECK (channel IN ('PUSH', 'SMS', 'EMAIL')),
+    sentat          TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (idvisit, phonenumber, starttime, offsetminutes)
+);
+
+CREATE INDEX IF NOT EXISTS visitreminder_phonenumber_idx ON visitreminder (phonenumber);
@@ -0,0 +1,17 @@
+-- Messages échangés entre le prospect et le visiteur : chaque visite a un seul fil de discussion
+CREATE TABLE IF NOT EXISTS message
+(
+    idmessage SERIAL PRIMARY KEY,
+    idvisit   INT         NOT NULL REFERENCES visit (idvisit) ON DELETE CASCADE,
+    sender    VARCHAR(20) NOT NULL,
+    body      TEXT,
+    idmedia   INT REFERENCES media (idmedia),
+    createdat TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    -- Read receipt: when the other party of the visit read the message
+    readat    TIMESTAMPTZ,
+    CHECK (body IS NOT NULL OR idmedia IS NOT NULL)
+);
+
+CREATE INDEX IF NOT EXISTS message_visit_idx ON message (idvisit, idmessage DESC);
+CREATE INDEX IF NOT EXISTS message_unread_idx ON message (idvisit) WHERE readat IS NULL;
+CREATE INDEX IF NOT EXISTS message_media_idx ON message (idmedia) WHERE idmedia IS NOT NULL;
@@ -0,0 +1,5 @@
+-- Dernière activité d'un envoi reprenable, pour supprimer les envois abandonnés (MEDIA_UPLOAD_TTL)
+ALTER TABLE mediaupload
+    ADD COLUMN IF NOT EXISTS updatedat TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+CREATE INDEX IF NOT EXISTS mediaupload_updatedat_idx ON mediaupload (updatedat);
@@ -0,0 +1,6 @@
+-- Demandes de visite ouvertes dont le créneau est passé sans qu'aucun visiteur ne les ait prises
+ALTER TABLE visitrequest
+    DROP CONSTRAINT IF EXISTS visitrequest_status_check;
+
+ALTER TABLE visitrequest
+    ADD CONSTRAINT visitrequest_status_check CHECK (status IN ('OPEN', 'CLAIMED', 'CANCELLED', 'EXPIRED'));
@@ -0,0 +1,16 @@
+-- Destinataire de chaque message : quand une visite change de visiteur, le fil ne montre que les messages échangés
+-- entre le prospect et le visiteur actuel
+ALTER TABLE message
+    ADD COLUMN IF NOT EXISTS recipient VARCHAR(20);
+
+-- The messages sent by the prospect before the visitor changed went to a previous visitor, who is not known anymore
+UPDATE message m
+SET recipient = CASE
+                    WHEN m.sender != v.phonenumberprospect THEN v.phonenumberprospect
+                    WHEN m.createdat >= v.requestedat THEN v.phonenumbervisitor
+                END
+FROM visit v
+WHERE m.idvisit = v.idvisit
+  AND m.recipient IS NULL;
+
+CREATE INDEX IF NOT EXISTS message_recipient_idx ON message (recipient) WHERE readat IS NULL;
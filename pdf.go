@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+)
+
+// Format A4 en points (1/72 de pouce)
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+)
+
+// Largeurs des caractères ASCII imprimables (32 à 126) des polices standard Helvetica et Helvetica-Bold, en millièmes de
+// la taille de la police
+var pdfFontWidths = map[bool][95]int{
+	false: {
+		278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+		1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+		667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+		333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+		556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+	},
+	true: {
+		278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+		975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+		667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+		333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+		611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+	},
+}
+
+// Caractères de Windows-1252 (WinAnsiEncoding) qui ne sont pas à la même place qu'en Latin-1
+var pdfWinAnsi = map[rune]byte{
+	'€': 0x80, '…': 0x85, 'Œ': 0x8C, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, 'œ': 0x9C,
+}
+
+// pdfImage est une image JPEG intégrée telle quelle au document.
+type pdfImage struct {
+	data   []byte
+	width  int
+	height int
+}
+
+// pdfDocument construit un document PDF simple : du texte dans les polices standard, des traits et des images JPEG.
+type pdfDocument struct {
+	pages  []*bytes.Buffer
+	images []pdfImage
+}
+
+// pdfEncode convertit un texte en WinAnsiEncoding, les caractères non représentables étant remplacés par "?".
+func pdfEncode(text string) []byte {
+	encoded := make([]byte, 0, len(text))
+	for _, r := range text {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+			encoded = append(encoded, ' ')
+		case r >= 32 && r < 127, r >= 0xA0 && r <= 0xFF:
+			encoded = append(encoded, byte(r))
+		default:
+			if b, ok := pdfWinAnsi[r]; ok {
+				encoded = append(encoded, b)
+			} else {
+				encoded = append(encoded, '?')
+			}
+		}
+	}
+	return encoded
+}
+
+// pdfTextWidth renvoie la largeur d'un texte en points.
+func pdfTextWidth(text string, size float64, bold bool) float64 {
+	widths := pdfFontWidths[bold]
+
+	total := 0
+	for _, b := range pdfEncode(text) {
+		if b >= 32 && b < 127 {
+			total += widths[b-32]
+		} else {
+			// Accented letters are about as wide as the average lowercase letter
+			total += 556
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// pdfWrap découpe un texte en lignes qui tiennent dans la largeur donnée.
+func pdfWrap(text string, size float64, bold bool, width float64) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			candidate := strings.TrimSpace(line + " " + word)
+			if line != "" && pdfTextWidth(candidate, size, bold) > width {
+				lines = append(lines, line)
+				candidate = word
+			}
+
+			// A single word wider than the line is cut
+			for pdfTextWidth(candidate, size, bold) > width && len([]rune(candidate)) > 1 {
+				runes := []rune(candidate)
+				cut := len(runes) - 1
+				for cut > 1 && pdfTextWidth(string(runes[:cut]), size, bold) > width {
+					cut--
+				}
+				lines = append(lines, string(runes[:cut]))
+				candidate = string(runes[cut:])
+			}
+
+			line = candidate
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// AddPage ajoute une page, sur laquelle s'écrit la suite du document.
+func (d *pdfDocument) AddPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+}
+
+// PageCount renvoie le nombre de pages du document.
+func (d *pdfDocument) PageCount() int {
+	return len(d.pages)
+}
+
+// page renvoie le contenu d'une page, ou de la page en cours pour -1.
+func (d *pdfDocument) page(index int) *bytes.Buffer {
+	if index < 0 {
+		index = len(d.pages) - 1
+	}
+	return d.pages[index]
+}
+
+// Text écrit une ligne de texte dont la ligne de base est en y, l'origine étant en haut à gauche de la page.
+func (d *pdfDocument) Text(x, y float64, size float64, bold bool, gray float64, text string) {
+	d.TextOnPage(-1, x, y, size, bold, gray, text)
+}
+
+// TextOnPage écrit une ligne de texte sur une page donnée (-1 pour la page en cours).
+func (d *pdfDocument) TextOnPage(index int, x, y float64, size float64, bold bool, gray float64, text string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+
+	var escaped bytes.Buffer
+	for _, b := range pdfEncode(text) {
+		if b == '(' || b == ')' || b == '\\' {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteByte(b)
+	}
+
+	_, _ = fmt.Fprintf(d.page(index), "BT %.3f g /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", gray, font, size, x, pdfPageHeight-y, escaped.Bytes())
+}
+
+// Line trace un trait gris entre deux points.
+func (d *pdfDocument) Line(x1, y1, x2, y2 float64) {
+	_, _ = fmt.Fprintf(d.page(-1), "0.8 G 0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, pdfPageHeight-y1, x2, pdfPageHeight-y2)
+}
+
+// Image place une image JPEG dont le coin supérieur gauche est en (x, y).
+func (d *pdfDocument) Image(data []byte, width int, height int, x, y, w, h float64) {
+	d.images = append(d.images, pdfImage{data: data, width: width, height: height})
+	_, _ = fmt.Fprintf(d.page(-1), "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", w, h, x, pdfPageHeight-y-h, len(d.images))
+}
+
+// Bytes assemble le fichier PDF.
+func (d *pdfDocument) Bytes() ([]byte, error) {
+	var out bytes.Buffer
+	var offsets []int
+
+	object := func(body string, stream []byte) {
+		offsets = append(offsets, out.Len())
+		_, _ = fmt.Fprintf(&out, "%d 0 obj\n%s\n", len(offsets), body)
+		if stream != nil {
+			out.WriteString("stream\n")
+			out.Write(stream)
+			out.WriteString("\nendstream\n")
+		}
+		out.WriteString("endobj\n")
+	}
+
+	out.WriteString("%PDF-1.4\n%\xE2\xE3\xCF\xD3\n")
+
+	// Objects 1 to 4 are the catalog, the page tree and the two fonts, then come the images and the pages
+	firstImage := 5
+	firstPage := firstImage + len(d.images)
+
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+
+	object("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)), nil)
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>", nil)
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>", nil)
+
+	var xObjects strings.Builder
+	for i, img := range d.images {
+		object(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>",
+			img.width, img.height, len(img.data)), img.data)
+		_, _ = fmt.Fprintf(&xObjects, "/Im%d %d 0 R ", i+1, firstImage+i)
+	}
+	resources := fmt.Sprintf("<< /Font << /F1 3 0 R /F2 4 0 R >> /XObject << %s>> >>", xObjects.String())
+
+	for i, page := range d.pages {
+		var content bytes.Buffer
+		w := zlib.NewWriter(&content)
+		if _, err := w.Write(page.Bytes()); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources %s /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, resources, firstPage+2*i+1), nil)
+		object(fmt.Sprintf("<< /Filter /FlateDecode /Length %d >>", content.Len()), content.Bytes())
+	}
+
+	xref := out.Len()
+	_, _ = fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		_, _ = fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	_, _ = fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return out.Bytes(), nil
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pushNotification est une notification affichée sur le téléphone, avec des données lues par l'application.
+type pushNotification struct {
+	Title string            `json:"title"`
+	Body  string            `json:"body"`
+	Data  map[string]string `json:"data"`
+}
+
+// notifier est l'interface commune aux services de notifications push.
+type notifier interface {
+	// Name renvoie le nom du service, enregistré avec chaque appareil.
+	Name() string
+	Send(token string, notification pushNotification) error
+}
+
+// errDeviceTokenInvalid est renvoyée lorsque le service indique que le jeton de l'appareil n'est plus valide
+// (application désinstallée, jeton renouvelé, ...) : l'appareil doit alors être oublié.
+var errDeviceTokenInvalid = errors.New("device token no longer valid")
+
+var (
+	notifiers     map[string]notifier
+	notifiersOnce sync.Once
+)
+
+// getNotifier renvoie le service de notifications d'un appareil (FCM ou APNS). Avec PUSH_BACKEND=memory, les
+// notifications sont gardées en mémoire au lieu d'être envoyées, pour les tests et le développement.
+func getNotifier(provider string) (notifier, error) {
+	notifiersOnce.Do(func() {
+		if strings.ToLower(os.Getenv("PUSH_BACKEND")) == "memory" {
+			fake := newMemoryNotifier()
+			notifiers = map[string]notifier{"FCM": fake, "APNS": fake}
+			return
+		}
+
+		notifiers = map[string]notifier{"FCM": newFCMNotifier(), "APNS": newAPNSNotifier()}
+	})
+
+	if n, ok := notifiers[provider]; ok {
+		return n, nil
+	}
+	return nil, fmt.Errorf("unknown push provider %q", provider)
+}
+
+// readPushResponse lit la réponse d'un service de notifications pour l'ajouter à une erreur.
+func readPushResponse(resp *http.Response) string {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// ============================================= FCM ============================================= //
+
+// fcmNotifier envoie les notifications avec l'API HTTP v1 de Firebase Cloud Messaging, authentifiée par le compte de
+// service de FCM_CREDENTIALS_FILE.
+type fcmNotifier struct {
+	projectID   string
+	clientEmail string
+	tokenURI    string
+	key         *rsa.PrivateKey
+	err         error
+	client      *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+func newFCMNotifier() *fcmNotifier {
+	n := &fcmNotifier{client: &http.Client{Timeout: 10 * time.Second}}
+
+	data, err := os.ReadFile(os.Getenv("FCM_CREDENTIALS_FILE"))
+	if err != nil {
+		n.err = fmt.Errorf("FCM is not configured: %w", err)
+		return n
+	}
+
+	var credentials struct {
+		ProjectID   string `json:"project_id"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		n.err = fmt.Errorf("invalid FCM credentials: %w", err)
+		return n
+	}
+
+	n.projectID = credentials.ProjectID
+	if projectID := os.Getenv("FCM_PROJECT_ID"); projectID != "" {
+		n.projectID = projectID
+	}
+	n.clientEmail = credentials.ClientEmail
+	n.tokenURI = credentials.TokenURI
+	if n.tokenURI == "" {
+		n.tokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	n.key, err = jwt.ParseRSAPrivateKeyFromPEM([]byte(credentials.PrivateKey))
+	if err != nil {
+		n.err = fmt.Errorf("invalid FCM private key: %w", err)
+	}
+	return n
+}
+
+func (n *fcmNotifier) Name() string {
+	return "FCM"
+}
+
+// token renvoie un jeton d'accès OAuth 2.0, échangé contre une assertion signée avec la clé du compte de service et
+// renouvelé peu avant son expiration.
+func (n *fcmNotifier) token() (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.accessToken != "" && time.Now().Before(n.expiresAt) {
+		return n.accessToken, nil
+	}
+
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   n.clientEmail,
+		"scope": "https://www.googleapis.com/auth/firebase.messaging",
+		"aud":   n.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(n.key)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := n.client.PostForm(n.tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("FCM token exchange failed: %s", readPushResponse(resp))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	n.accessToken = token.AccessToken
+	n.expiresAt = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return n.accessToken, nil
+}
+
+func (n *fcmNotifier) Send(token string, notification pushNotification) error {
+	if n.err != nil {
+		return n.err
+	}
+
+	accessToken, err := n.token()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"token": token,
+			"notification": map[string]string{
+				"title": notification.Title,
+				"body":  notification.Body,
+			},
+			"data": notification.Data,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://fcm.googleapis.com/v1/projects/%s/messages:send", n.projectID), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusNotFound:
+		// UNREGISTERED: the application has been uninstalled or the token has expired
+		return errDeviceTokenInvalid
+	}
+
+	message := readPushResponse(resp)
+	if resp.StatusCode == http.StatusBadRequest && strings.Contains(message, "registration token") {
+		return errDeviceTokenInvalid
+	}
+	return fmt.Errorf("FCM send failed: %s", message)
+}
+
+// ============================================= APNS ============================================= //
+
+// apnsNotifier envoie les notifications aux iPhone avec l'API HTTP/2 d'Apple, authentifiée par un jeton signé avec la
+// clé APNS_KEY_FILE (.p8).
+type apnsNotifier struct {
+	keyID  string
+	teamID string
+	topic  string
+	host   string
+	key    *ecdsa.PrivateKey
+	err    error
+	client *http.Client
+
+	mu       sync.Mutex
+	jwt      string
+	issuedAt time.Time
+}
+
+func newAPNSNotifier() *apnsNotifier {
+	n := &apnsNotifier{
+		keyID:  os.Getenv("APNS_KEY_ID"),
+		teamID: os.Getenv("APNS_TEAM_ID"),
+		topic:  os.Getenv("APNS_TOPIC"),
+		host:   "https://api.push.apple.com",
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if os.Getenv("APNS_SANDBOX") == "true" {
+		n.host = "https://api.sandbox.push.apple.com"
+	}
+
+	data, err := os.ReadFile(os.Getenv("APNS_KEY_FILE"))
+	if err != nil {
+		n.err = fmt.Errorf("APNs is not configured: %w", err)
+		return n
+	}
+
+	n.key, err = jwt.ParseECPrivateKeyFromPEM(data)
+	if err != nil {
+		n.err = fmt.Errorf("invalid APNs key: %w", err)
+	}
+	return n
+}
+
+func (n *apnsNotifier) Name() string {
+	return "APNS"
+}
+
+// token renvoie le jeton d'authentification, qu'Apple demande de renouveler entre 20 et 60 minutes.
+func (n *apnsNotifier) token() (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.jwt != "" && time.Since(n.issuedAt) < 40*time.Minute {
+		return n.jwt, nil
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": n.teamID,
+		"iat": now.Unix(),
+	})
+	token.Header["kid"] = n.keyID
+
+	signed, err := token.SignedString(n.key)
+	if err != nil {
+		return "", err
+	}
+
+	n.jwt, n.issuedAt = signed, now
+	return signed, nil
+}
+
+func (n *apnsNotifier) Send(token string, notification pushNotification) error {
+	if n.err != nil {
+		return n.err
+	}
+
+	authorization, err := n.token()
+	if err != nil {
+		return err
+	}
+
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert": map[string]string{
+				"title": notification.Title,
+				"body":  notification.Body,
+			},
+			"sound": "default",
+		},
+	}
+	for key, value := range notification.Data {
+		payload[key] = value
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/3/device/%s", n.host, url.PathEscape(token)), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+authorization)
+	req.Header.Set("apns-topic", n.topic)
+	req.Header.Set("apns-push-type", "alert")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	message := readPushResponse(resp)
+	if resp.StatusCode == http.StatusGone || strings.Contains(message, "BadDeviceToken") || strings.Contains(message, "DeviceTokenNotForTopic") {
+		return errDeviceTokenInvalid
+	}
+	return fmt.Errorf("APNs send failed: %s", message)
+}
+
+// ============================================= MEMORY ============================================= //
+
+// sentPushNotification est une notification gardée par memoryNotifier.
+type sentPushNotification struct {
+	Token        string
+	Notification pushNotification
+	SentAt       time.Time
+}
+
+// memoryNotifier garde les notifications en mémoire au lieu de les envoyer. Les jetons commençant par "invalid" sont
+// refusés, pour simuler un appareil désinstallé.
+type memoryNotifier struct {
+	mu   sync.Mutex
+	sent []sentPushNotification
+}
+
+func newMemoryNotifier() *memoryNotifier {
+	return &memoryNotifier{}
+}
+
+func (n *memoryNotifier) Name() string {
+	return "MEMORY"
+}
+
+func (n *memoryNotifier) Send(token string, notification pushNotification) error {
+	if strings.HasPrefix(token, "invalid") {
+		return errDeviceTokenInvalid
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.sent = append(n.sent, sentPushNotification{Token: token, Notification: notification, SentAt: time.Now()})
+	return nil
+}
+
+// Sent renvoie une copie des notifications gardées.
+func (n *memoryNotifier) Sent() []sentPushNotification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return append([]sentPushNotification(nil), n.sent...)
+}
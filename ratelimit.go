@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitRule décrit un seau de jetons : Rate jetons sont ajoutés par seconde, dans la limite de Burst.
+type rateLimitRule struct {
+	Rate  float64
+	Burst float64
+}
+
+// Règles par défaut de chaque classe de routes, surchargeables avec RATE_LIMIT_<CLASSE>="<requêtes>/<période>:<rafale>"
+// (ex: RATE_LIMIT_AUTH="5/1m:5").
+var rateLimitDefaults = map[string]rateLimitRule{
+	"default": {Rate: 10, Burst: 50},
+	"auth":    {Rate: 5.0 / 60, Burst: 5},
+	"search":  {Rate: 30.0 / 60, Burst: 10},
+	"code":    {Rate: 5.0 / 600, Burst: 5},
+	"share":   {Rate: 30.0 / 60, Burst: 30},
+}
+
+// rateLimitStore consomme un jeton dans le seau identifié par key.
+type rateLimitStore interface {
+	Take(key string, rule rateLimitRule) (allowed bool, retryAfter time.Duration, err error)
+}
+
+var (
+	rateLimiter     rateLimitStore
+	rateLimiterOnce sync.Once
+)
+
+// getRateLimitStore renvoie le stockage configuré avec RATE_LIMIT_BACKEND (memory par défaut, ou postgres).
+func getRateLimitStore() rateLimitStore {
+	rateLimiterOnce.Do(func() {
+		if strings.ToLower(os.Getenv("RATE_LIMIT_BACKEND")) == "postgres" {
+			rateLimiter = newPostgresRateLimitStore()
+		} else {
+			rateLimiter = newMemoryRateLimitStore()
+		}
+	})
+
+	return rateLimiter
+}
+
+// getRateLimitRule renvoie la règle d'une classe de routes.
+func getRateLimitRule(class string) rateLimitRule {
+	rule := rateLimitDefaults[class]
+
+	value := os.Getenv("RATE_LIMIT_" + strings.ToUpper(class))
+	if value == "" {
+		return rule
+	}
+
+	limit, burst, _ := strings.Cut(value, ":")
+	count, period, found := strings.Cut(limit, "/")
+	if !found {
+		fmt.Printf("💥 Invalid RATE_LIMIT_%s value, the default rule is used\n", strings.ToUpper(class))
+		return rule
+	}
+
+	requests, errCount := strconv.ParseFloat(count, 64)
+	duration, errPeriod := time.ParseDuration(period)
+	if errCount != nil || errPeriod != nil || requests <= 0 || duration <= 0 {
+		fmt.Printf("💥 Invalid RATE_LIMIT_%s value, the default rule is used\n", strings.ToUpper(class))
+		return rule
+	}
+
+	rule.Rate = requests / duration.Seconds()
+	rule.Burst = requests
+	if b, err := strconv.ParseFloat(burst, 64); err == nil && b > 0 {
+		rule.Burst = b
+	}
+
+	return rule
+}
+
+// retryDelay calcule le temps nécessaire pour qu'un jeton soit de nouveau disponible.
+func retryDelay(tokens float64, rule rateLimitRule) time.Duration {
+	return time.Duration(math.Ceil((1-tokens)/rule.Rate)) * time.Second
+}
+
+// rateLimit limite le débit d'une classe de routes par utilisateur lorsque la requête porte un jeton valide, et par
+// adresse IP sinon. Le jeton est lu ici car le limiteur s'exécute avant VerifyJWT.
+func rateLimit(class string) fiber.Handler {
+	rule := getRateLimitRule(class)
+
+	return func(c *fiber.Ctx) error {
+		key := class + ":ip:" + c.IP()
+		claims, ok := c.Locals("user").(*CustomClaims)
+		if !ok {
+			claims, ok = bearerClaims(c)
+		}
+		if ok {
+			key = class + ":user:" + claims.PhoneNumber
+		}
+
+		allowed, retryAfter, err := getRateLimitStore().Take(key, rule)
+		if err != nil {
+			// The API stays available if the limiter cannot be reached
+			fmt.Println("💥 Error taking a token in rateLimit() : ", err)
+			return c.Next()
+		}
+
+		if !allowed {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(retryAfter.Seconds())))
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": "Too many requests, please try again later.",
+			})
+		}
+
+		return c.Next()
+	}
+}
+
+// ============================================= IN-MEMORY STORE ============================================= //
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// memoryRateLimitStore garde les seaux dans la mémoire du processus (une seule instance du serveur).
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: make(map[string]*tokenBucket), lastPrune: time.Now()}
+}
+
+func (s *memoryRateLimitStore) Take(key string, rule rateLimitRule) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	// Forget the buckets which have been full for a while
+	if now.Sub(s.lastPrune) > time.Minute {
+		for k, b := range s.buckets {
+			if now.Sub(b.updatedAt) > 10*time.Minute {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastPrune = now
+	}
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: rule.Burst, updatedAt: now}
+		s.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(rule.Burst, bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*rule.Rate)
+	bucket.updatedAt = now
+
+	if bucket.tokens < 1 {
+		return false, retryDelay(bucket.tokens, rule), nil
+	}
+
+	bucket.tokens--
+	return true, 0, nil
+}
+
+// ============================================= POSTGRES STORE ============================================= //
+
+// postgresRateLimitStore partage les seaux entre toutes les instances du serveur via la table ratelimitbucket.
+type postgresRateLimitStore struct{}
+
+func newPostgresRateLimitStore() *postgresRateLimitStore {
+	return &postgresRateLimitStore{}
+}
+
+// pruneRateLimitBuckets supprime les seaux de nouveau pleins, de façon récurrente.
+func pruneRateLimitBuckets() error {
+	_, err := db.Exec(`DELETE FROM ratelimitbucket WHERE updatedat < NOW() - INTERVAL '1 hour'`)
+	return err
+}
+
+func (s *postgresRateLimitStore) Take(key string, rule rateLimitRule) (bool, time.Duration, error) {
+	// The bucket is refilled and consumed in a single statement so that concurrent instances stay consistent
+	var tokens float64
+	var allowed bool
+	err := db.QueryRow(`
+		INSERT INTO ratelimitbucket AS b (key, tokens, allowed, updatedat)
+		VALUES ($1, $2 - 1, TRUE, clock_timestamp())
+		ON CONFLICT (key) DO UPDATE SET
+			tokens    = CASE
+			                WHEN LEAST($2, b.tokens + EXTRACT(EPOCH FROM clock_timestamp() - b.updatedat) * $3) >= 1
+			                    THEN LEAST($2, b.tokens + EXTRACT(EPOCH FROM clock_timestamp() - b.updatedat) * $3) - 1
+			                ELSE LEAST($2, b.tokens + EXTRACT(EPOCH FROM clock_timestamp() - b.updatedat) * $3)
+			            END,
+			allowed   = LEAST($2, b.tokens + EXTRACT(EPOCH FROM clock_timestamp() - b.updatedat) * $3) >= 1,
+			updatedat = clock_timestamp()
+		RETURNING tokens, allowed`,
+		key, rule.Burst, rule.Rate,
+	).Scan(&tokens, &allowed)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if !allowed {
+		return false, retryDelay(tokens, rule), nil
+	}
+
+	return true, 0, nil
+}
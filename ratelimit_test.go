@@ -0,0 +1,159 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetRateLimitRule(t *testing.T) {
+	tests := []struct {
+		name  string
+		class string
+		value string
+		want  rateLimitRule
+	}{
+		{"default rule", "auth", "", rateLimitDefaults["auth"]},
+		{"requests per period", "auth", "10/1m", rateLimitRule{Rate: 10.0 / 60, Burst: 10}},
+		{"with a burst", "search", "60/1m:20", rateLimitRule{Rate: 1, Burst: 20}},
+		{"fractional requests", "code", "0.5/1s", rateLimitRule{Rate: 0.5, Burst: 0.5}},
+		{"invalid burst is ignored", "search", "60/1m:none", rateLimitRule{Rate: 1, Burst: 60}},
+		{"zero burst is ignored", "search", "60/1m:0", rateLimitRule{Rate: 1, Burst: 60}},
+		{"missing period", "auth", "10", rateLimitDefaults["auth"]},
+		{"invalid period", "auth", "10/minute", rateLimitDefaults["auth"]},
+		{"zero period", "auth", "10/0s", rateLimitDefaults["auth"]},
+		{"zero requests", "auth", "0/1m", rateLimitDefaults["auth"]},
+		{"negative requests", "auth", "-5/1m", rateLimitDefaults["auth"]},
+		{"unknown class", "upload", "", rateLimitRule{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RATE_LIMIT_"+strings.ToUpper(tt.class), tt.value)
+
+			if got := getRateLimitRule(tt.class); got != tt.want {
+				t.Errorf("getRateLimitRule(%q) = %+v, want %+v", tt.class, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		tokens float64
+		rule   rateLimitRule
+		want   time.Duration
+	}{
+		{0, rateLimitRule{Rate: 1, Burst: 5}, time.Second},
+		{0.5, rateLimitRule{Rate: 1, Burst: 5}, time.Second},
+		{0, rateLimitRule{Rate: 5.0 / 60, Burst: 5}, 12 * time.Second},
+		{0.9, rateLimitRule{Rate: 5.0 / 600, Burst: 5}, 12 * time.Second},
+		{0, rateLimitRule{Rate: 10, Burst: 50}, time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := retryDelay(tt.tokens, tt.rule); got != tt.want {
+			t.Errorf("retryDelay(%v, %+v) = %s, want %s", tt.tokens, tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	rule := rateLimitRule{Rate: 1, Burst: 3}
+
+	tests := []struct {
+		name string
+		// Time elapsed since the previous request, simulated by moving the bucket back in time
+		elapsed   time.Duration
+		allowed   bool
+		remaining float64
+	}{
+		{"first request", 0, true, 2},
+		{"second request", 0, true, 1},
+		{"last token of the burst", 0, true, 0},
+		{"bucket empty", 0, false, 0},
+		{"half a token refilled", 500 * time.Millisecond, false, 0.5},
+		{"token refilled", 500 * time.Millisecond, true, 0},
+		{"refill capped at the burst", time.Hour, true, 2},
+	}
+
+	store := newMemoryRateLimitStore()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if bucket, ok := store.buckets["key"]; ok {
+				bucket.updatedAt = bucket.updatedAt.Add(-tt.elapsed)
+			}
+
+			allowed, retryAfter, err := store.Take("key", rule)
+			if err != nil {
+				t.Fatalf("Take() error = %v", err)
+			}
+			if allowed != tt.allowed {
+				t.Errorf("allowed = %v, want %v", allowed, tt.allowed)
+			}
+			if !allowed && retryAfter <= 0 {
+				t.Errorf("retryAfter = %s, want a delay", retryAfter)
+			}
+
+			if tokens := store.buckets["key"].tokens; tokens < tt.remaining-0.01 || tokens > tt.remaining+0.01 {
+				t.Errorf("tokens = %v, want %v", tokens, tt.remaining)
+			}
+		})
+	}
+
+	// Each key has its own bucket
+	if allowed, _, _ := store.Take("other", rule); !allowed {
+		t.Errorf("Take(\"other\") = false, want true")
+	}
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	t.Setenv("RATE_LIMIT_KEYS", "1/1h")
+
+	app := fiber.New()
+	app.Get("/", rateLimit("keys"), func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	first, err := GenerateJWT("0600000001", "PROSPECT")
+	if err != nil {
+		t.Fatalf("GenerateJWT() error = %v", err)
+	}
+	second, err := GenerateJWT("0600000002", "PROSPECT")
+	if err != nil {
+		t.Fatalf("GenerateJWT() error = %v", err)
+	}
+
+	// Every request comes from the same address
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"first user", first, fiber.StatusNoContent},
+		{"second user", second, fiber.StatusNoContent},
+		{"first user again", first, fiber.StatusTooManyRequests},
+		{"anonymous", "", fiber.StatusNoContent},
+		{"anonymous again", "", fiber.StatusTooManyRequests},
+		{"invalid token counted by address", "invalid.token.value", fiber.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
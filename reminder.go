@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"net/mail"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// visitReminderOffsets renvoie, en minutes, les délais avant le début d'une visite auxquels ses parties reçoivent un
+// rappel, lus dans VISIT_REMINDERS (ex: "24h,1h").
+func visitReminderOffsets() []int64 {
+	var offsets []int64
+	for _, value := range strings.Split(os.Getenv("VISIT_REMINDERS"), ",") {
+		offset, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || offset < time.Minute {
+			continue
+		}
+		offsets = append(offsets, int64(offset/time.Minute))
+	}
+
+	if len(offsets) == 0 {
+		return []int64{24 * 60, 60}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] > offsets[j] })
+	return offsets
+}
+
+// sendVisitReminders envoie les rappels dus aux deux parties des visites acceptées. Pour chaque partie, seul le plus
+// proche des rappels dus est envoyé, une seule fois par horaire de visite : une visite réservée la veille ne reçoit pas
+// à la fois le rappel de 24h et celui de 1h, et une visite reprogrammée reçoit ses rappels pour son nouvel horaire.
+// Les rappels étant calculés au moment de l'envoi, ceux d'une visite annulée ou reprogrammée ne partent jamais.
+func sendVisitReminders() error {
+	rows, err := db.Query(`
+		WITH due AS (
+		    SELECT DISTINCT ON (v.idvisit, p.phonenumber) v.idvisit, p.phonenumber, p.role, o.minutes, v.starttime
+		    FROM visit v
+		             CROSS JOIN LATERAL (VALUES (v.phonenumberprospect, 'PROSPECT'), (v.phonenumbervisitor, 'VISITOR')) AS p (phonenumber, role)
+		             CROSS JOIN unnest($1::int[]) AS o (minutes)
+		    WHERE v.status = 'ACCEPTED'
+		      AND v.starttime > NOW()
+		      AND v.starttime - make_interval(mins => o.minutes) <= NOW()
+		    ORDER BY v.idvisit, p.phonenumber, o.minutes
+		)
+		INSERT INTO visitreminder (idvisit, phonenumber, role, offsetminutes, starttime)
+		SELECT d.idvisit, d.phonenumber, d.role, d.minutes, d.starttime
+		FROM due d
+		WHERE NOT EXISTS (SELECT 1
+		                  FROM visitreminder r
+		                  WHERE r.idvisit = d.idvisit
+		                    AND r.phonenumber = d.phonenumber
+		                    AND r.starttime = d.starttime
+		                    AND r.offsetminutes <= d.minutes)
+		ON CONFLICT DO NOTHING
+		RETURNING idvisitreminder, idvisit, phonenumber, role, starttime`, pq.Array(visitReminderOffsets()))
+	if err != nil {
+		return err
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in sendVisitReminders() : ", err)
+		}
+	}(rows)
+
+	type reminder struct {
+		id          int
+		idVisit     int
+		phoneNumber string
+		role        string
+		start       time.Time
+	}
+
+	var reminders []reminder
+	for rows.Next() {
+		var r reminder
+		if err := rows.Scan(&r.id, &r.idVisit, &r.phoneNumber, &r.role, &r.start); err != nil {
+			return err
+		}
+		reminders = append(reminders, r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	sent := 0
+	for _, r := range reminders {
+		channel, err := sendVisitReminder(r.idVisit, r.phoneNumber, r.role, r.start)
+		if err != nil {
+			fmt.Println("💥 Error sending the reminder in sendVisitReminders() : ", err)
+
+			// The reminder is recorded again, and sent, at the next run
+			if _, err := db.Exec(`DELETE FROM visitreminder WHERE idvisitreminder = $1`, r.id); err != nil {
+				fmt.Println("💥 Error deleting the reminder in sendVisitReminders() : ", err)
+			}
+			continue
+		}
+		sent++
+
+		if _, err := db.Exec(`UPDATE visitreminder SET channel = $1 WHERE idvisitreminder = $2`, channel, r.id); err != nil {
+			fmt.Println("💥 Error updating the reminder in sendVisitReminders() : ", err)
+		}
+	}
+
+	if sent > 0 {
+		fmt.Printf("=> %d visit reminder(s) sent\n", sent)
+	}
+	return nil
+}
+
+// sendVisitReminder envoie un rappel par le canal préféré de l'utilisateur, ou par SMS lorsque ce canal n'est pas
+// utilisable (aucun téléphone enregistré, aucune adresse e-mail), et renvoie le canal utilisé.
+func sendVisitReminder(idVisit int, phoneNumber string, role string, start time.Time) (string, error) {
+	var channel, email string
+	var hasDevice bool
+	err := db.QueryRow(`
+		SELECT u.notificationchannel, COALESCE(u.email, ''), EXISTS(SELECT 1 FROM device d WHERE d.phonenumber = u.phonenumber)
+		FROM "user" u
+		WHERE u.phonenumber = $1`, phoneNumber).Scan(&channel, &email, &hasDevice)
+	if err != nil {
+		return "", err
+	}
+
+	date := start.Format("02/01 à 15h04")
+	switch {
+	case channel == "PUSH" && hasDevice:
+		return channel, pushToUser(phoneNumber, pushNotification{
+			Title: "Rappel de visite",
+			Body:  fmt.Sprintf("Votre visite a lieu le %s.", date),
+			Data:  map[string]string{"event": pushVisitReminder, "visit_id": strconv.Itoa(idVisit)},
+		})
+	case channel == "EMAIL" && email != "":
+		if _, err := mail.ParseAddress(email); err == nil {
+			return channel, queueEmail(phoneNumber, "visit.reminder", map[string]interface{}{"Role": role, "Start": start})
+		}
+	}
+
+	notifyUser(phoneNumber, fmt.Sprintf("Voyo : rappel, votre visite a lieu le %s.", date))
+	return "SMS", nil
+}
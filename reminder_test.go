@@ -0,0 +1,33 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVisitReminderOffsets(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []int64
+	}{
+		{"", []int64{24 * 60, 60}},
+		{"24h,1h", []int64{24 * 60, 60}},
+		{"1h, 24h", []int64{24 * 60, 60}},
+		{"30m", []int64{30}},
+		{"2h,15m,48h", []int64{48 * 60, 2 * 60, 15}},
+		{"1h30m", []int64{90}},
+		// Invalid or too short delays are ignored
+		{"1h,soon,30s", []int64{60}},
+		{"soon", []int64{24 * 60, 60}},
+		{"-1h", []int64{24 * 60, 60}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("VISIT_REMINDERS", tt.value)
+			if got := visitReminderOffsets(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("visitReminderOffsets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"io"
+	"strings"
+	"time"
+)
+
+// Mise en page du rapport de visite, en points
+const (
+	reportMargin       = 50.0
+	reportPhotoBox     = 150.0
+	reportPhotoGap     = 22.5
+	reportFooterHeight = 40.0
+)
+
+// Libellés des statuts de visite affichés dans le rapport
+var reportVisitStatus = map[string]string{
+	"PENDING":   "En attente",
+	"ACCEPTED":  "Acceptée",
+	"DONE":      "Terminée",
+	"CANCELLED": "Annulée",
+	"REFUSED":   "Refusée",
+	"EXPIRED":   "Expirée",
+}
+
+// reportWriter écrit le rapport de haut en bas, en passant à la page suivante lorsque la page en cours est pleine.
+type reportWriter struct {
+	doc *pdfDocument
+	y   float64
+}
+
+// reserve passe à la page suivante si la hauteur demandée ne tient pas sur la page en cours.
+func (w *reportWriter) reserve(height float64) {
+	if w.doc.PageCount() == 0 || w.y+height > pdfPageHeight-reportMargin-reportFooterHeight {
+		w.doc.AddPage()
+		w.y = reportMargin
+	}
+}
+
+// paragraph écrit un texte sur toute la largeur de la page, découpé en lignes.
+func (w *reportWriter) paragraph(text string, size float64, bold bool, gray float64) {
+	lineHeight := size * 1.35
+	for _, line := range pdfWrap(text, size, bold, pdfPageWidth-2*reportMargin) {
+		w.reserve(lineHeight)
+		w.y += lineHeight
+		w.doc.Text(reportMargin, w.y-size*0.3, size, bold, gray, line)
+	}
+}
+
+// field écrit une ligne "libellé : valeur" du résumé de la visite.
+func (w *reportWriter) field(label string, value string) {
+	if strings.TrimSpace(value) == "" {
+		return
+	}
+
+	const size = 10.0
+	const labelWidth = 110.0
+	for i, line := range pdfWrap(value, size, false, pdfPageWidth-2*reportMargin-labelWidth) {
+		w.reserve(size * 1.6)
+		w.y += size * 1.6
+		if i == 0 {
+			w.doc.Text(reportMargin, w.y, size, true, 0.4, label)
+		}
+		w.doc.Text(reportMargin+labelWidth, w.y, size, false, 0, line)
+	}
+}
+
+// separator trace un trait horizontal sur toute la largeur de la page.
+func (w *reportWriter) separator() {
+	w.reserve(20)
+	w.y += 10
+	w.doc.Line(reportMargin, w.y, pdfPageWidth-reportMargin, w.y)
+	w.y += 10
+}
+
+// photos place les miniatures d'un critère en grille, avec leur légende.
+func (w *reportWriter) photos(media []CriteriaMedia) {
+	column := 0
+	rowHeight := 0.0
+	for _, item := range media {
+		if item.Kind != "PHOTO" {
+			continue
+		}
+
+		data, width, height, err := readMediaVariant(item.MediaID, "THUMB")
+		if err != nil {
+			// Photos that are still being processed or hosted elsewhere are left out
+			if !errors.Is(err, sql.ErrNoRows) {
+				fmt.Println("💥 Error reading the thumbnail in buildVisitReport() : ", err)
+			}
+			continue
+		}
+
+		var caption []string
+		if item.Caption != nil {
+			caption = pdfWrap(*item.Caption, 8, false, reportPhotoBox)
+			if len(caption) > 2 {
+				caption = append(caption[:1], strings.TrimSpace(caption[1])+"…")
+			}
+		}
+
+		if column == 0 {
+			w.reserve(reportPhotoBox + 30)
+			w.y += 8
+		}
+
+		scale := min(reportPhotoBox/float64(width), reportPhotoBox/float64(height))
+		x := reportMargin + float64(column)*(reportPhotoBox+reportPhotoGap)
+		w.doc.Image(data, width, height, x, w.y, float64(width)*scale, float64(height)*scale)
+
+		captionY := w.y + float64(height)*scale
+		for _, line := range caption {
+			captionY += 10
+			w.doc.Text(x, captionY, 8, false, 0.4, line)
+		}
+		rowHeight = max(rowHeight, captionY-w.y)
+
+		column++
+		if column == 3 {
+			w.y += rowHeight
+			column, rowHeight = 0, 0
+		}
+	}
+
+	w.y += rowHeight
+}
+
+// readMediaVariant lit une version réduite d'une photo, avec ses dimensions.
+func readMediaVariant(idMedia int, variant string) ([]byte, int, int, error) {
+	var backend, key string
+	var width, height int
+	err := db.QueryRow(`
+		SELECT m.backend, mv.storagekey, mv.width, mv.height
+		FROM mediavariant mv
+		         JOIN media m ON mv.idmedia = m.idmedia
+		WHERE mv.idmedia = $1 AND mv.variant = $2 AND mv.contenttype = 'image/jpeg'`, idMedia, variant).Scan(&backend, &key, &width, &height)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	store, err := getStorageByName(backend)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	reader, err := store.Get(key)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	defer func(reader io.ReadCloser) {
+		err := reader.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the thumbnail in readMediaVariant() : ", err)
+		}
+	}(reader)
+
+	data, err := io.ReadAll(reader)
+	return data, width, height, err
+}
+
+// reportDate convertit la date d'une visite au format jj/mm/aaaa.
+func reportDate(date string) string {
+	if parsed, err := time.Parse(time.RFC3339, date); err == nil {
+		return parsed.Format("02/01/2006")
+	}
+	if parsed, err := time.Parse("2006-01-02", date); err == nil {
+		return parsed.Format("02/01/2006")
+	}
+	return date
+}
+
+// buildVisitReport génère le rapport PDF d'une visite : son résumé, puis chaque critère avec sa réponse et les
+// miniatures des photos envoyées par le visiteur.
+func buildVisitReport(visit visitDetails) ([]byte, error) {
+	w := &reportWriter{doc: &pdfDocument{}}
+	details := visit.Visit.Details
+
+	w.paragraph("Voyo", 10, true, 0.5)
+	w.paragraph(fmt.Sprintf("Rapport de visite n°%d", visit.Visit.IDVisit), 20, true, 0)
+	w.y += 10
+
+	address := visit.Visit.Address.IdAddressGmap
+	if len(visit.Visit.Address.Results) > 0 {
+		address = visit.Visit.Address.Results[0].FormattedAddress
+	}
+
+	status := details.Status
+	if label, ok := reportVisitStatus[status]; ok {
+		status = label
+	}
+
+	w.field("Adresse", address)
+	w.field("Date", reportDate(details.Date))
+	w.field("Horaires", fmt.Sprintf("%s - %s", details.StartTime, details.EndTime))
+	w.field("Visiteur", strings.TrimSpace(visit.Visitor.FirstName+" "+visit.Visitor.LastName))
+	w.field("Prix", details.Price+" €")
+	w.field("Statut", status)
+	w.field("Temps sur place", details.TimeOnSite)
+	if details.Note > 0 {
+		w.field("Note", fmt.Sprintf("%.1f / 5", details.Note))
+	}
+
+	w.separator()
+	w.paragraph("Critères", 14, true, 0)
+
+	if len(visit.Visit.Criterias) == 0 {
+		w.y += 4
+		w.paragraph("Aucun critère n'a été défini pour cette visite.", 10, false, 0.4)
+	}
+
+	for _, crit := range visit.Visit.Criterias {
+		w.y += 10
+		w.reserve(40)
+		w.paragraph(crit.Criteria, 11, true, 0)
+
+		if strings.TrimSpace(crit.CriteriaAnswer) == "" {
+			w.paragraph("Sans réponse", 10, false, 0.5)
+		} else {
+			w.paragraph(crit.CriteriaAnswer, 10, false, 0)
+		}
+
+		w.photos(crit.Media)
+
+		videos := 0
+		for _, item := range crit.Media {
+			if item.Kind == "VIDEO" {
+				videos++
+			}
+		}
+		if videos > 0 {
+			w.y += 4
+			w.paragraph(fmt.Sprintf("%d vidéo(s) à consulter dans l'application Voyo", videos), 9, false, 0.5)
+		}
+	}
+
+	generatedAt := time.Now().Format("02/01/2006 à 15h04")
+	for i := 0; i < w.doc.PageCount(); i++ {
+		w.doc.TextOnPage(i, reportMargin, pdfPageHeight-reportMargin+20, 8, false, 0.5,
+			fmt.Sprintf("Rapport généré le %s - page %d/%d", generatedAt, i+1, w.doc.PageCount()))
+	}
+
+	return w.doc.Bytes()
+}
+
+// invalidateVisitReports supprime les rapports déjà générés des visites liées à un critère dont la réponse a changé.
+func invalidateVisitReports(idCriteria string) error {
+	_, err := db.Exec(`DELETE FROM visitreport WHERE idvisit IN (SELECT idvisit FROM linkcriteriavisit WHERE idcriteria = $1)`, idCriteria)
+	return err
+}
+
+// invalidateVisitReport supprime le rapport déjà généré d'une visite, par exemple quand sa note change.
+func invalidateVisitReport(idVisit string) error {
+	_, err := db.Exec(`DELETE FROM visitreport WHERE idvisit = $1`, idVisit)
+	return err
+}
+
+// GetVisitReport renvoie le rapport PDF d'une visite. Une fois la visite terminée, le rapport est conservé et n'est
+// généré à nouveau que si une réponse, un média ou la note change.
+func GetVisitReport(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+	claims := c.Locals("user").(*CustomClaims)
+
+	if id == "" || !hasAuthorizedVisitAccess(claims.PhoneNumber, id) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	}
+
+	report, err := getVisitReport(id, claims)
+	if err != nil {
+		fmt.Println("💥 Error getting the report in GetVisitReport() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	return sendVisitReport(c, id, report)
+}
+
+// getVisitReport renvoie le rapport conservé d'une visite, ou le génère.
+func getVisitReport(id string, claims *CustomClaims) ([]byte, error) {
+	var report []byte
+	err := db.QueryRow(`SELECT pdf FROM visitreport WHERE idvisit = $1`, id).Scan(&report)
+	if err == nil {
+		return report, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	visit, err := getVisitDetails(id, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	report, err = buildVisitReport(visit)
+	if err != nil {
+		return nil, err
+	}
+
+	if visit.Visit.Details.Status == "DONE" {
+		_, err := db.Exec(`
+			INSERT INTO visitreport (idvisit, pdf)
+			VALUES ($1, $2)
+			ON CONFLICT (idvisit) DO UPDATE SET pdf = EXCLUDED.pdf, createdat = NOW()`, id, report)
+		if err != nil {
+			fmt.Println("💥 Error saving the report in getVisitReport() : ", err)
+		}
+	}
+
+	return report, nil
+}
+
+// sendVisitReport envoie le rapport PDF d'une visite.
+func sendVisitReport(c *fiber.Ctx, id string, report []byte) error {
+	c.Set(fiber.HeaderContentType, "application/pdf")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`inline; filename="visite-%s.pdf"`, id))
+	c.Set(fiber.HeaderCacheControl, "private, no-cache")
+	return c.Send(report)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Nombre maximal d'horaires dans une proposition
+const visitProposalMaxSlots = 5
+
+var errProposalNotFound = errors.New("proposal not found")
+var errProposalClosed = errors.New("proposal closed")
+var errVisitorUnavailable = errors.New("visitor unavailable")
+var errVisitorBusy = errors.New("visitor busy")
+
+// checkVisitorSlot vérifie, avant de déplacer une visite, que le visiteur n'a pas d'autre visite sur le nouveau créneau
+// et, si checkAvailability, que le créneau fait partie de ses disponibilités.
+func checkVisitorSlot(q visitRowQueryer, idVisit string, start time.Time, checkAvailability bool) error {
+	var available, busy bool
+	err := q.QueryRow(fmt.Sprintf(`
+		SELECT %s, %s
+		FROM visit v
+		         JOIN typerealestate tr ON v.idtyperealestate = tr.idtyperealestate
+		WHERE v.idvisit = $1`,
+		visitorAvailableSQL("v.phonenumbervisitor", "$2::timestamp", "tr.duration"),
+		visitorBusySQL("v.phonenumbervisitor", "$2::timestamp", "tr.duration", "v.idvisit")), idVisit, start).Scan(&available, &busy)
+	if err != nil {
+		return err
+	}
+
+	if busy {
+		return errVisitorBusy
+	}
+	if checkAvailability && !available {
+		return errVisitorUnavailable
+	}
+	return nil
+}
+
+// getVisitProposals renvoie les propositions d'horaires d'une visite, de la plus ancienne à la plus récente.
+func getVisitProposals(idVisit string) ([]VisitProposal, error) {
+	rows, err := db.Query(`
+		SELECT p.idvisitproposal, p.role, p.message, p.status, p.acceptedstarttime, p.createdat, p.respondedat, s.starttime
+		FROM visitproposal p
+		         JOIN visitproposalslot s ON p.idvisitproposal = s.idvisitproposal
+		WHERE p.idvisit = $1
+		ORDER BY p.createdat, p.idvisitproposal, s.starttime`, idVisit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in getVisitProposals() : ", err)
+		}
+	}(rows)
+
+	proposals := []VisitProposal{}
+	for rows.Next() {
+		var proposal VisitProposal
+		var slot time.Time
+		err := rows.Scan(&proposal.ID, &proposal.ProposedBy, &proposal.Message, &proposal.Status, &proposal.AcceptedStartTime,
+			&proposal.CreatedAt, &proposal.RespondedAt, &slot)
+		if err != nil {
+			return nil, err
+		}
+
+		// The rows of a proposal follow each other, one per proposed start time
+		if n := len(proposals); n > 0 && proposals[n-1].ID == proposal.ID {
+			proposals[n-1].StartTimes = append(proposals[n-1].StartTimes, slot)
+			continue
+		}
+
+		proposal.StartTimes = []time.Time{slot}
+		proposals = append(proposals, proposal)
+	}
+
+	return proposals, rows.Err()
+}
+
+// getProposalParty lit une proposition en la verrouillant, avec la visite concernée et le rôle de l'utilisateur dans
+// celle-ci.
+func getProposalParty(tx *sql.Tx, idProposal string, phoneNumber string) (proposal VisitProposal, idVisit string, role string, err error) {
+	err = tx.QueryRow(`SELECT idvisit, role, status FROM visitproposal WHERE idvisitproposal = $1 FOR UPDATE`, idProposal).Scan(&idVisit, &proposal.ProposedBy, &proposal.Status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errProposalNotFound
+		}
+		return
+	}
+
+	var status string
+	role, status, _, _, err = getVisitParty(tx, idVisit, phoneNumber, true)
+	if errors.Is(err, errNotVisitParty) {
+		err = errProposalNotFound
+	}
+	if err != nil {
+		return
+	}
+
+	if proposal.Status != "PENDING" || status != "PENDING" {
+		err = errProposalClosed
+	}
+	return
+}
+
+// visitProposalErrorResponse renvoie la réponse adaptée à une action refusée sur une proposition d'horaires.
+func visitProposalErrorResponse(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errNotVisitParty), errors.Is(err, errProposalNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Proposal not found",
+		})
+	case errors.Is(err, errProposalClosed):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "This proposal has already been answered or the visit is no longer pending",
+		})
+	case errors.Is(err, errVisitorBusy):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The visitor already has another visit at this time",
+		})
+	case errors.Is(err, errVisitorUnavailable):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The visitor is not available at this time",
+		})
+	}
+
+	fmt.Println("💥 Error handling the proposal in visitProposalErrorResponse() : ", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "An error has occurred, please try again later.",
+	})
+}
+
+// notifyVisitParty prévient l'autre partie d'une visite.
+func notifyVisitParty(idVisit string, role string, message string) {
+	column := "phonenumbervisitor"
+	if role == "VISITOR" {
+		column = "phonenumberprospect"
+	}
+
+	var phoneNumber string
+	if err := db.QueryRow(`SELECT `+column+` FROM visit WHERE idvisit = $1`, idVisit).Scan(&phoneNumber); err != nil {
+		fmt.Println("💥 Error scanning the row in notifyVisitParty() : ", err)
+		return
+	}
+
+	notifyUser(phoneNumber, message)
+}
+
+// ProposeVisitReschedule propose un ou plusieurs nouveaux horaires ("start_times") pour une visite en attente.
+// Une proposition encore ouverte sur la visite est remplacée : c'est une contre-proposition.
+func ProposeVisitReschedule(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+	phoneNumber := c.Locals("user").(*CustomClaims).PhoneNumber
+
+	var body struct {
+		StartTimes []time.Time `json:"start_times"`
+		Message    string      `json:"message"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the proposed start times in the RFC 3339 format",
+		})
+	}
+
+	if len(body.StartTimes) == 0 || len(body.StartTimes) > visitProposalMaxSlots {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Please propose between 1 and %d start times", visitProposalMaxSlots),
+		})
+	}
+
+	sort.Slice(body.StartTimes, func(i, j int) bool { return body.StartTimes[i].Before(body.StartTimes[j]) })
+	for i, start := range body.StartTimes {
+		if !start.After(time.Now()) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "The proposed start times must be in the future",
+			})
+		}
+		if i > 0 && start.Equal(body.StartTimes[i-1]) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "The proposed start times must be different",
+			})
+		}
+	}
+
+	var message *string
+	if trimmed := strings.TrimSpace(body.Message); trimmed != "" {
+		if len([]rune(trimmed)) > 500 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "The message must not exceed 500 characters",
+			})
+		}
+		message = &trimmed
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println("💥 Error starting the transaction in ProposeVisitReschedule() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in ProposeVisitReschedule() : ", err)
+		}
+	}(tx)
+
+	role, status, _, _, err := getVisitParty(tx, id, phoneNumber, true)
+	if err != nil {
+		if errors.Is(err, errNotVisitParty) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Unauthorized access",
+			})
+		}
+		return visitProposalErrorResponse(c, err)
+	}
+
+	if status != "PENDING" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only a pending visit can be rescheduled",
+		})
+	}
+
+	_, err = tx.Exec(`UPDATE visitproposal SET status = 'SUPERSEDED', respondedat = NOW() WHERE idvisit = $1 AND status = 'PENDING'`, id)
+	if err != nil {
+		return visitProposalErrorResponse(c, err)
+	}
+
+	proposal := VisitProposal{ProposedBy: role, Message: message, StartTimes: body.StartTimes, Status: "PENDING"}
+	err = tx.QueryRow(`
+		INSERT INTO visitproposal (idvisit, proposedby, role, message)
+		VALUES ($1, $2, $3, $4)
+		RETURNING idvisitproposal, createdat`, id, phoneNumber, role, message).Scan(&proposal.ID, &proposal.CreatedAt)
+	if err != nil {
+		return visitProposalErrorResponse(c, err)
+	}
+
+	for _, start := range body.StartTimes {
+		if _, err := tx.Exec(`INSERT INTO visitproposalslot (idvisitproposal, starttime) VALUES ($1, $2)`, proposal.ID, start); err != nil {
+			return visitProposalErrorResponse(c, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return visitProposalErrorResponse(c, err)
+	}
+
+	go notifyVisitParty(id, role, "Voyo : de nouveaux horaires vous sont proposés pour une visite, répondez-y dans l'application.")
+
+	return c.Status(fiber.StatusCreated).JSON(proposal)
+}
+
+// AcceptVisitReschedule accepte l'un des horaires ("start_time") d'une proposition de l'autre partie. L'horaire de la
+// visite est modifié après avoir vérifié que le visiteur est disponible et n'a pas d'autre visite sur ce créneau.
+func AcceptVisitReschedule(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+
+	var body struct {
+		StartTime time.Time `json:"start_time"`
+	}
+	if err := c.BodyParser(&body); err != nil || body.StartTime.IsZero() {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the accepted start time in the RFC 3339 format",
+		})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println("💥 Error starting the transaction in AcceptVisitReschedule() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in AcceptVisitReschedule() : ", err)
+		}
+	}(tx)
+
+	proposal, idVisit, role, err := getProposalParty(tx, id, c.Locals("user").(*CustomClaims).PhoneNumber)
+	if err != nil {
+		return visitProposalErrorResponse(c, err)
+	}
+
+	if role == proposal.ProposedBy {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the other party can accept this proposal",
+		})
+	}
+
+	var start time.Time
+	err = tx.QueryRow(`SELECT starttime FROM visitproposalslot WHERE idvisitproposal = $1 AND starttime = $2`, id, body.StartTime).Scan(&start)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "This start time is not part of the proposal",
+			})
+		}
+		return visitProposalErrorResponse(c, err)
+	}
+
+	if !start.After(time.Now()) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "This start time has already passed",
+		})
+	}
+
+	// The visitor's row stays locked until the commit, like when a visit request is claimed, so that two visits cannot
+	// be placed on the same slot concurrently
+	_, err = tx.Exec(`SELECT 1 FROM "user" WHERE phonenumber = (SELECT phonenumbervisitor FROM visit WHERE idvisit = $1) FOR UPDATE`, idVisit)
+	if err != nil {
+		return visitProposalErrorResponse(c, err)
+	}
+
+	// The times proposed by the visitor are the ones they are available at
+	if err := checkVisitorSlot(tx, idVisit, start, proposal.ProposedBy == "PROSPECT"); err != nil {
+		return visitProposalErrorResponse(c, err)
+	}
+
+	_, err = tx.Exec(`UPDATE visit SET starttime = $1 WHERE idvisit = $2`, start, idVisit)
+	if err == nil {
+		_, err = tx.Exec(`UPDATE visitproposal SET status = 'ACCEPTED', acceptedstarttime = $1, respondedat = NOW() WHERE idvisitproposal = $2`, start, id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return visitProposalErrorResponse(c, err)
+	}
+
+	go notifyVisitParty(idVisit, role, fmt.Sprintf("Voyo : votre proposition a été acceptée, la visite aura lieu le %s.", start.Format("02/01 à 15h04")))
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// DeclineVisitReschedule refuse une proposition de l'autre partie, ou retire sa propre proposition.
+func DeclineVisitReschedule(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println("💥 Error starting the transaction in DeclineVisitReschedule() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in DeclineVisitReschedule() : ", err)
+		}
+	}(tx)
+
+	proposal, idVisit, role, err := getProposalParty(tx, id, c.Locals("user").(*CustomClaims).PhoneNumber)
+	if err != nil {
+		return visitProposalErrorResponse(c, err)
+	}
+
+	status := "DECLINED"
+	if role == proposal.ProposedBy {
+		status = "WITHDRAWN"
+	}
+
+	_, err = tx.Exec(`UPDATE visitproposal SET status = $1, respondedat = NOW() WHERE idvisitproposal = $2`, status, id)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return visitProposalErrorResponse(c, err)
+	}
+
+	if status == "DECLINED" {
+		go notifyVisitParty(idVisit, role, "Voyo : votre proposition de nouveaux horaires a été refusée.")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -94,6 +94,24 @@ func VerifyJWT(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token"})
 }
 
+// bearerClaims returns the claims of the token when its signature is valid, without checking the user in the database.
+func bearerClaims(c *fiber.Ctx) (*CustomClaims, bool) {
+	authHeader := c.Get("Authorization")
+	if len(authHeader) <= 7 {
+		return nil, false
+	}
+
+	token, err := jwt.ParseWithClaims(authHeader[7:], &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	})
+	if err != nil || !token.Valid {
+		return nil, false
+	}
+
+	claims, ok := token.Claims.(*CustomClaims)
+	return claims, ok
+}
+
 // UserExists is a placeholder function to check if a user exists (replace with your own logic)
 func UserExists(PhoneNumber string) bool {
 	// Prepare the request
@@ -156,8 +174,6 @@ func PasswordChanged(PhoneNumber string, Date int64) bool {
 	} else {
 		return false
 	}
-
-	return false
 }
 
 func hasAuthorizedVisitAccess(phoneNumber string, idVisit string) bool {
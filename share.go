@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Préfixe des routes publiques ouvertes avec un lien de partage
+const sharePath = "/api/share/"
+
+var errShareNotFound = errors.New("share not found")
+var errShareExpired = errors.New("share expired or revoked")
+
+// visitShareAccess décrit le lien de partage avec lequel une visite est consultée.
+type visitShareAccess struct {
+	ID      int
+	IdVisit int
+	Token   string
+	Expires time.Time
+}
+
+// subject renvoie le destinataire auquel sont liées les URL signées des médias du partage.
+func (s visitShareAccess) subject() string {
+	return fmt.Sprintf("share:%d", s.ID)
+}
+
+// mediaPath renvoie le chemin auquel les médias de la visite sont servis pour ce partage.
+func (s visitShareAccess) mediaPath() string {
+	return sharePath + s.Token + "/media"
+}
+
+// hashShareToken calcule l'empreinte d'un jeton de partage : seule l'empreinte est enregistrée.
+func hashShareToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// getVisitShare retrouve le partage correspondant au jeton de l'URL, s'il est encore valable.
+func getVisitShare(c *fiber.Ctx) (visitShareAccess, error) {
+	share := visitShareAccess{Token: c.Params("token")}
+
+	var revokedAt sql.NullTime
+	err := db.QueryRow(`SELECT idvisitshare, idvisit, expiresat, revokedat FROM visitshare WHERE tokenhash = $1`,
+		hashShareToken(share.Token)).Scan(&share.ID, &share.IdVisit, &share.Expires, &revokedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return share, errShareNotFound
+		}
+		return share, err
+	}
+
+	if revokedAt.Valid || time.Now().After(share.Expires) {
+		return share, errShareExpired
+	}
+
+	return share, nil
+}
+
+// visitShareErrorResponse renvoie la réponse adaptée à un lien de partage refusé.
+func visitShareErrorResponse(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errShareNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "This link does not exist",
+		})
+	case errors.Is(err, errShareExpired):
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "This link has expired or has been revoked",
+		})
+	}
+
+	fmt.Println("💥 Error getting the share in visitShareErrorResponse() : ", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "An error has occurred, please try again later.",
+	})
+}
+
+// countVisitShareView compte une consultation du partage.
+func countVisitShareView(share visitShareAccess) {
+	if _, err := db.Exec(`UPDATE visitshare SET viewcount = viewcount + 1, lastviewedat = NOW() WHERE idvisitshare = $1`, share.ID); err != nil {
+		fmt.Println("💥 Error counting the view in countVisitShareView() : ", err)
+	}
+}
+
+// getProspectVisitStatus renvoie le statut d'une visite si l'utilisateur connecté en est le prospect.
+func getProspectVisitStatus(c *fiber.Ctx, idVisit string) (string, error) {
+	var status string
+	err := db.QueryRow(`SELECT status FROM visit WHERE idvisit = $1 AND phonenumberprospect = $2`,
+		idVisit, c.Locals("user").(*CustomClaims).PhoneNumber).Scan(&status)
+	return status, err
+}
+
+// ============================================= PROSPECT ============================================= //
+
+// GetVisitShares renvoie les liens de partage d'une visite du prospect connecté, avec leur nombre de consultations.
+func GetVisitShares(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+
+	if _, err := getProspectVisitStatus(c, id); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			fmt.Println("💥 Error scanning the row in GetVisitShares() : ", err)
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	}
+
+	rows, err := db.Query(`
+		SELECT idvisitshare, idvisit, label, createdat, expiresat, revokedat, viewcount, lastviewedat
+		FROM visitshare
+		WHERE idvisit = $1
+		ORDER BY createdat DESC`, id)
+	if err != nil {
+		fmt.Println("💥 Error querying the database in GetVisitShares() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in GetVisitShares() : ", err)
+		}
+	}(rows)
+
+	shares := []VisitShare{}
+	for rows.Next() {
+		var share VisitShare
+		if err := rows.Scan(&share.ID, &share.IdVisit, &share.Label, &share.CreatedAt, &share.ExpiresAt, &share.RevokedAt, &share.ViewCount, &share.LastViewedAt); err != nil {
+			fmt.Println("💥 Error scanning the rows in GetVisitShares() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+		shares = append(shares, share)
+	}
+
+	return c.JSON(shares)
+}
+
+// CreateVisitShare crée un lien de partage du rapport d'une visite terminée. Le lien expire après "expires_in_days"
+// jours (30 par défaut, VISIT_SHARE_MAX_DAYS au plus).
+func CreateVisitShare(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+	claims := c.Locals("user").(*CustomClaims)
+
+	status, err := getProspectVisitStatus(c, id)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			fmt.Println("💥 Error scanning the row in CreateVisitShare() : ", err)
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	}
+
+	if status != "DONE" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only a finished visit can be shared",
+		})
+	}
+
+	var body struct {
+		Label         string `json:"label"`
+		ExpiresInDays int    `json:"expires_in_days"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&body); err != nil {
+			fmt.Println("💥 Error parsing the body in CreateVisitShare() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+	}
+
+	maxDays := getEnvInt("VISIT_SHARE_MAX_DAYS", 90)
+	if body.ExpiresInDays == 0 {
+		body.ExpiresInDays = min(30, maxDays)
+	}
+	if body.ExpiresInDays < 1 || body.ExpiresInDays > maxDays {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("The link must expire in 1 to %d days", maxDays),
+		})
+	}
+
+	var label *string
+	if trimmed := strings.TrimSpace(body.Label); trimmed != "" {
+		if len([]rune(trimmed)) > 100 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "The label must not exceed 100 characters",
+			})
+		}
+		label = &trimmed
+	}
+
+	token, err := randomToken(24)
+	if err != nil {
+		fmt.Println("💥 Error generating the token in CreateVisitShare() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	share := VisitShare{Label: label, Token: token, URL: sharePath + token}
+	err = db.QueryRow(`
+		INSERT INTO visitshare (idvisit, tokenhash, createdby, label, expiresat)
+		VALUES ($1, $2, $3, $4, NOW() + $5 * INTERVAL '1 day')
+		RETURNING idvisitshare, idvisit, createdat, expiresat`,
+		id, hashShareToken(token), claims.PhoneNumber, label, body.ExpiresInDays).Scan(&share.ID, &share.IdVisit, &share.CreatedAt, &share.ExpiresAt)
+	if err != nil {
+		fmt.Println("💥 Error inserting the share in CreateVisitShare() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(share)
+}
+
+// RevokeVisitShare révoque un lien de partage : il ne permet plus d'ouvrir la visite.
+func RevokeVisitShare(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+
+	result, err := db.Exec(`
+		UPDATE visitshare s
+		SET revokedat = NOW()
+		FROM visit v
+		WHERE s.idvisit = v.idvisit AND s.idvisitshare = $1 AND v.phonenumberprospect = $2 AND s.revokedat IS NULL`,
+		id, c.Locals("user").(*CustomClaims).PhoneNumber)
+	if err != nil {
+		fmt.Println("💥 Error revoking the share in RevokeVisitShare() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if count, _ := result.RowsAffected(); count == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Share not found",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ============================================= PUBLIC ============================================= //
+
+// getSharedVisitDetails rassemble le détail d'une visite pour un partage. Les URL signées pour un utilisateur sont
+// remplacées par celles du partage.
+func getSharedVisitDetails(share visitShareAccess) (visitDetails, error) {
+	// Without a phone number, none of the URLs signed by getVisitDetails can be used
+	return getVisitDetails(strconv.Itoa(share.IdVisit), &CustomClaims{Role: "SHARE"})
+}
+
+// GetSharedVisit renvoie la vue en lecture seule d'une visite ouverte avec un lien de partage.
+func GetSharedVisit(c *fiber.Ctx) error {
+	share, err := getVisitShare(c)
+	if err != nil {
+		return visitShareErrorResponse(c, err)
+	}
+
+	visit, err := getSharedVisitDetails(share)
+	if err != nil {
+		fmt.Println("💥 Error getting the visit in GetSharedVisit() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	details := visit.Visit.Details
+	shared := SharedVisit{
+		ID:         visit.Visit.IDVisit,
+		Address:    visit.Visit.Address.IdAddressGmap,
+		Date:       details.Date,
+		StartTime:  details.StartTime,
+		EndTime:    details.EndTime,
+		Duration:   details.Duration,
+		Status:     details.Status,
+		Price:      details.Price,
+		TimeOnSite: details.TimeOnSite,
+		Visitor:    strings.TrimSpace(visit.Visitor.FirstName + " " + visit.Visitor.LastName),
+		Criterias:  []Criteria{},
+		ExpiresAt:  share.Expires,
+		ReportURL:  sharePath + share.Token + "/report.pdf",
+	}
+	if len(visit.Visit.Address.Results) > 0 {
+		shared.Address = visit.Visit.Address.Results[0].FormattedAddress
+	}
+
+	for _, crit := range visit.Visit.Criterias {
+		// The anti-fraud checks of the photos are only shown to the users of the visit
+		crit.EvidenceFlags = nil
+		crit.Photo, crit.Video = "", ""
+
+		for i := range crit.Media {
+			item := &crit.Media[i]
+			item.EvidenceFlags = nil
+			item.Thumbnail = ""
+			if item.Kind == "PHOTO" {
+				item.URL = signedURL(share.mediaPath(), strconv.Itoa(item.MediaID), "web", share.subject())
+				item.Thumbnail = signedURL(share.mediaPath(), strconv.Itoa(item.MediaID), "thumb", share.subject())
+				if crit.Photo == "" {
+					crit.Photo = item.URL
+				}
+			} else {
+				item.URL = signedURL(share.mediaPath(), strconv.Itoa(item.MediaID), "", share.subject())
+				if crit.Video == "" {
+					crit.Video = item.URL
+				}
+			}
+		}
+
+		shared.Criterias = append(shared.Criterias, crit)
+	}
+
+	countVisitShareView(share)
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(shared)
+}
+
+// GetSharedVisitReport renvoie le rapport PDF d'une visite ouverte avec un lien de partage.
+func GetSharedVisitReport(c *fiber.Ctx) error {
+	share, err := getVisitShare(c)
+	if err != nil {
+		return visitShareErrorResponse(c, err)
+	}
+
+	id := strconv.Itoa(share.IdVisit)
+	report, err := getVisitReport(id, &CustomClaims{Role: "SHARE"})
+	if err != nil {
+		fmt.Println("💥 Error getting the report in GetSharedVisitReport() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	countVisitShareView(share)
+
+	return sendVisitReport(c, id, report)
+}
+
+// GetSharedMedia sert une photo (versions thumb et web uniquement) ou une vidéo d'une visite ouverte avec un lien de
+// partage, au moyen d'une URL signée pour ce partage.
+func GetSharedMedia(c *fiber.Ctx) error {
+	share, err := getVisitShare(c)
+	if err != nil {
+		return visitShareErrorResponse(c, err)
+	}
+
+	id := strings.TrimSpace(c.Query("id"))
+	variant := strings.ToUpper(c.Query("variant", "web"))
+	if variant != "THUMB" && variant != "WEB" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The variant must be thumb or web",
+		})
+	}
+
+	if err := verifySignedURLFor(c, share.mediaPath(), share.subject()); err != nil {
+		return signedURLErrorResponse(c, err)
+	}
+
+	// The media must still answer one of the criteria of the shared visit
+	var found bool
+	err = db.QueryRow(`
+		SELECT EXISTS(SELECT 1
+		              FROM criteriamedia cm
+		                       JOIN linkcriteriavisit l ON cm.idcriteria = l.idcriteria
+		              WHERE cm.idmedia = $1 AND l.idvisit = $2)`, id, share.IdVisit).Scan(&found)
+	if err != nil {
+		fmt.Println("💥 Error scanning the row in GetSharedMedia() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Media not found",
+		})
+	}
+
+	return sendMedia(c, id, variant, "")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chemins des gestionnaires qui servent des fichiers privés au moyen d'URL signées
+const (
+	mediaPath    = "/api/media"
+	documentPath = "/api/user/verification/document"
+)
+
+var errSignedURLInvalid = errors.New("invalid signature")
+var errSignedURLExpired = errors.New("expired url")
+
+// signedURLKey renvoie la clé de signature des URL (MEDIA_URL_KEY, ou à défaut la clé des JWT).
+func signedURLKey() []byte {
+	if key := os.Getenv("MEDIA_URL_KEY"); key != "" {
+		return []byte(key)
+	}
+	return jwtSecret
+}
+
+// signedURLSignature calcule la signature d'une URL. Elle couvre le fichier demandé, l'expiration et l'utilisateur à
+// qui l'URL a été donnée : elle ne fonctionne pas avec le jeton d'un autre utilisateur.
+func signedURLSignature(path string, id string, variant string, expires int64, phoneNumber string) string {
+	mac := hmac.New(sha256.New, signedURLKey())
+	mac.Write([]byte(strings.Join([]string{path, id, variant, strconv.FormatInt(expires, 10), phoneNumber}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedURL renvoie une URL signée valable MEDIA_URL_TTL (15 minutes par défaut) pour l'utilisateur phoneNumber.
+func signedURL(path string, id string, variant string, phoneNumber string) string {
+	expires := time.Now().Add(getEnvDuration("MEDIA_URL_TTL", 15*time.Minute)).Unix()
+
+	query := url.Values{}
+	query.Set("id", id)
+	if variant != "" {
+		query.Set("variant", variant)
+	}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("sig", signedURLSignature(path, id, variant, expires, phoneNumber))
+
+	return path + "?" + query.Encode()
+}
+
+// verifySignedURL vérifie la signature et l'expiration de l'URL appelée, pour l'utilisateur connecté.
+func verifySignedURL(c *fiber.Ctx, path string) error {
+	return verifySignedURLFor(c, path, c.Locals("user").(*CustomClaims).PhoneNumber)
+}
+
+// verifySignedURLFor vérifie la signature et l'expiration de l'URL appelée, pour le destinataire donné (un utilisateur ou
+// un lien de partage).
+func verifySignedURLFor(c *fiber.Ctx, path string, subject string) error {
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil {
+		return errSignedURLInvalid
+	}
+
+	expected := signedURLSignature(path, c.Query("id"), c.Query("variant"), expires, subject)
+	if !hmac.Equal([]byte(expected), []byte(c.Query("sig"))) {
+		return errSignedURLInvalid
+	}
+
+	if time.Now().Unix() > expires {
+		return errSignedURLExpired
+	}
+
+	return nil
+}
+
+// signedURLErrorResponse renvoie la réponse adaptée à une URL signée refusée.
+func signedURLErrorResponse(c *fiber.Ctx, err error) error {
+	if errors.Is(err, errSignedURLExpired) {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "This link has expired, please reload the page to get a new one",
+		})
+	}
+
+	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+		"error": "Invalid link",
+	})
+}
+
+// mediaURL renvoie l'URL signée à laquelle l'utilisateur phoneNumber peut récupérer un média, éventuellement dans une
+// de ses versions réduites (thumb ou web).
+func mediaURL(idMedia *int, variant string, phoneNumber string) string {
+	if idMedia == nil {
+		return ""
+	}
+	return signedURL(mediaPath, strconv.Itoa(*idMedia), variant, phoneNumber)
+}
+
+// documentURL renvoie l'URL signée d'une pièce d'identité. Le motif de l'accès reste à ajouter dans le paramètre "reason".
+func documentURL(idDocument *int, phoneNumber string) string {
+	if idDocument == nil {
+		return ""
+	}
+	return signedURL(documentPath, strconv.Itoa(*idDocument), "", phoneNumber)
+}
+
+// profilePictureURL signe la photo de profil enregistrée pour un utilisateur lorsqu'elle a été envoyée sur Voyo.
+// Les anciennes photos hébergées ailleurs sont renvoyées telles quelles.
+func profilePictureURL(picture string, phoneNumber string) string {
+	if !strings.HasPrefix(picture, mediaPath+"?") {
+		return picture
+	}
+
+	query, err := url.ParseQuery(strings.TrimPrefix(picture, mediaPath+"?"))
+	if err != nil {
+		fmt.Println("💥 Error parsing the profile picture in profilePictureURL() : ", err)
+		return ""
+	}
+
+	return signedURL(mediaPath, query.Get("id"), query.Get("variant"), phoneNumber)
+}
+
+// signProfilePicture remplace, dans une réponse, la photo de profil enregistrée par son URL signée.
+func signProfilePicture(picture *string, phoneNumber string) {
+	if picture != nil {
+		*picture = profilePictureURL(*picture, phoneNumber)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// verifySignedURLStatus appelle path avec la requête de l'URL signée et renvoie le résultat de verifySignedURLFor.
+func verifySignedURLStatus(t *testing.T, path string, rawURL string, subject string) error {
+	t.Helper()
+
+	var result error
+	app := fiber.New()
+	app.Get(path, func(c *fiber.Ctx) error {
+		result = verifySignedURLFor(c, path, subject)
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	resp, err := app.Test(httptest.NewRequest("GET", rawURL, nil))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	if resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, fiber.StatusNoContent)
+	}
+	return result
+}
+
+func TestSignedURL(t *testing.T) {
+	t.Setenv("MEDIA_URL_KEY", "test-key")
+	t.Setenv("MEDIA_URL_TTL", "15m")
+
+	signed := signedURL(mediaPath, "42", "thumb", "0600000001")
+	parsed, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("url.Parse(%q) error = %v", signed, err)
+	}
+
+	if parsed.Path != mediaPath {
+		t.Errorf("path = %q, want %q", parsed.Path, mediaPath)
+	}
+
+	query := parsed.Query()
+	if query.Get("id") != "42" || query.Get("variant") != "thumb" || query.Get("sig") == "" {
+		t.Errorf("query = %v, want the id, the variant and the signature", query)
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		t.Fatalf("expires = %q, want a timestamp", query.Get("expires"))
+	}
+	if delay := time.Until(time.Unix(expires, 0)); delay < 14*time.Minute || delay > 15*time.Minute {
+		t.Errorf("expires in %s, want 15m", delay)
+	}
+
+	unsigned, err := url.Parse(signedURL(mediaPath, "42", "", "0600000001"))
+	if err != nil {
+		t.Fatalf("url.Parse() error = %v", err)
+	}
+	if unsigned.Query().Has("variant") {
+		t.Errorf("query = %v, want no variant parameter", unsigned.Query())
+	}
+}
+
+func TestVerifySignedURLFor(t *testing.T) {
+	t.Setenv("MEDIA_URL_KEY", "test-key")
+
+	owner := "0600000001"
+	expires := time.Now().Add(time.Hour).Unix()
+	expired := time.Now().Add(-time.Minute).Unix()
+
+	// The URL which is called and the one which was signed are described separately to tamper with each part
+	type urlParts struct {
+		path    string
+		id      string
+		variant string
+		expires int64
+		subject string
+	}
+	valid := urlParts{mediaPath, "42", "", expires, owner}
+
+	encode := func(called urlParts, signed urlParts) string {
+		query := url.Values{}
+		query.Set("id", called.id)
+		if called.variant != "" {
+			query.Set("variant", called.variant)
+		}
+		query.Set("expires", strconv.FormatInt(called.expires, 10))
+		query.Set("sig", signedURLSignature(signed.path, signed.id, signed.variant, signed.expires, signed.subject))
+		return called.path + "?" + query.Encode()
+	}
+
+	with := func(parts urlParts, change func(*urlParts)) urlParts {
+		change(&parts)
+		return parts
+	}
+
+	tests := []struct {
+		name    string
+		url     string
+		path    string
+		subject string
+		want    error
+	}{
+		{"valid", encode(valid, valid), mediaPath, owner, nil},
+		{"valid with a variant", encode(with(valid, func(p *urlParts) { p.variant = "web" }), with(valid, func(p *urlParts) { p.variant = "web" })), mediaPath, owner, nil},
+		{"issued by signedURL", signedURL(mediaPath, "42", "thumb", owner), mediaPath, owner, nil},
+		{"expired", encode(with(valid, func(p *urlParts) { p.expires = expired }), with(valid, func(p *urlParts) { p.expires = expired })), mediaPath, owner, errSignedURLExpired},
+		{"other user", encode(valid, valid), mediaPath, "0600000002", errSignedURLInvalid},
+		{"other file", encode(with(valid, func(p *urlParts) { p.id = "43" }), valid), mediaPath, owner, errSignedURLInvalid},
+		{"other variant", encode(with(valid, func(p *urlParts) { p.variant = "web" }), with(valid, func(p *urlParts) { p.variant = "thumb" })), mediaPath, owner, errSignedURLInvalid},
+		{"other handler", encode(with(valid, func(p *urlParts) { p.path = documentPath }), valid), documentPath, owner, errSignedURLInvalid},
+		{"expiration pushed back", encode(valid, with(valid, func(p *urlParts) { p.expires = expired })), mediaPath, owner, errSignedURLInvalid},
+		{"missing signature", mediaPath + "?id=42&expires=" + strconv.FormatInt(expires, 10), mediaPath, owner, errSignedURLInvalid},
+		{"missing expiration", mediaPath + "?id=42&sig=abc", mediaPath, owner, errSignedURLInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := verifySignedURLStatus(t, tt.path, tt.url, tt.subject)
+			if got != tt.want {
+				t.Errorf("verifySignedURLFor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
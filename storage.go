@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mediaStorage est l'interface commune aux stockages des fichiers média.
+type mediaStorage interface {
+	// Name renvoie le nom du stockage, enregistré avec chaque média.
+	Name() string
+	Put(key string, r io.Reader, size int64, contentType string) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+var (
+	storage     mediaStorage
+	storageOnce sync.Once
+)
+
+// getMediaStorage renvoie le stockage configuré avec MEDIA_STORAGE (local par défaut, ou s3).
+func getMediaStorage() mediaStorage {
+	storageOnce.Do(func() {
+		if strings.ToLower(os.Getenv("MEDIA_STORAGE")) == "s3" {
+			storage = newS3Storage()
+		} else {
+			storage = newLocalStorage()
+		}
+	})
+
+	return storage
+}
+
+// getStorageByName renvoie le stockage dans lequel un média a été enregistré.
+func getStorageByName(name string) (mediaStorage, error) {
+	if s := getMediaStorage(); s.Name() == name {
+		return s, nil
+	}
+
+	switch name {
+	case "local":
+		return newLocalStorage(), nil
+	case "s3":
+		return newS3Storage(), nil
+	}
+
+	return nil, fmt.Errorf("unknown media storage %q", name)
+}
+
+// ============================================= LOCAL STORAGE ============================================= //
+
+// localStorage enregistre les fichiers dans le dossier MEDIA_LOCAL_DIR.
+type localStorage struct {
+	root string
+}
+
+func newLocalStorage() *localStorage {
+	root := os.Getenv("MEDIA_LOCAL_DIR")
+	if root == "" {
+		root = "media"
+	}
+	return &localStorage{root: root}
+}
+
+func (s *localStorage) Name() string {
+	return "local"
+}
+
+// path renvoie le chemin d'un fichier en empêchant de sortir du dossier racine.
+func (s *localStorage) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" {
+		return "", fmt.Errorf("invalid media key %q", key)
+	}
+	return filepath.Join(s.root, clean), nil
+}
+
+func (s *localStorage) Put(key string, r io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a failed upload never leaves a truncated file
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localStorage) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (s *localStorage) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ============================================= S3 STORAGE ============================================= //
+
+// s3Storage enregistre les fichiers dans un bucket compatible S3 (AWS, MinIO, ...), avec des requêtes signées en SigV4.
+type s3Storage struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Storage() *s3Storage {
+	region := os.Getenv("S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &s3Storage{
+		endpoint:  strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+		bucket:    os.Getenv("S3_BUCKET"),
+		region:    region,
+		accessKey: os.Getenv("S3_ACCESS_KEY"),
+		secretKey: os.Getenv("S3_SECRET_KEY"),
+		client:    &http.Client{Timeout: 10 * time.Minute},
+	}
+}
+
+func (s *s3Storage) Name() string {
+	return "s3"
+}
+
+// objectURL renvoie l'URL d'un objet, en adressage par chemin (compatible MinIO).
+func (s *s3Storage) objectURL(key string) string {
+	escaped := strings.Split(strings.TrimPrefix(key, "/"), "/")
+	for i, part := range escaped {
+		escaped[i] = url.PathEscape(part)
+	}
+	return fmt.Sprintf("%s/%s/%s", s.endpoint, s.bucket, strings.Join(escaped, "/"))
+}
+
+// sign ajoute la signature AWS SigV4 à une requête. Le corps n'est pas inclus dans la signature (UNSIGNED-PAYLOAD).
+func (s *s3Storage) sign(req *http.Request) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:UNSIGNED-PAYLOAD\nx-amz-date:%s\n", req.URL.Host, amzDate)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.region)
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(hashedRequest[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// do envoie une requête signée et vérifie son code de retour.
+func (s *s3Storage) do(method string, key string, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	s.sign(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s %s", method, key, resp.Status, message)
+	}
+
+	return resp, nil
+}
+
+func (s *s3Storage) Put(key string, r io.Reader, size int64, contentType string) error {
+	resp, err := s.do(http.MethodPut, key, r, size, contentType)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *s3Storage) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -28,23 +28,25 @@ type Role struct {
 }
 
 type User struct {
-	PhoneNumber    string   `json:"phone_number"`
-	FirstName      string   `json:"first_name"`
-	LastName       string   `json:"last_name"`
-	Email          string   `json:"email"`
-	Password       string   `json:"password"`
-	IdRole         int      `json:"role_id"`
-	Biography      *string  `json:"biography"`
-	ProfilePicture *string  `json:"profile_picture"`
-	Pricing        *float64 `json:"pricing"`
-	IdAddressGMap  *string  `json:"address_id"`
-	Radius         *float64 `json:"radius"`
-	X              *float64 `json:"x"`
-	Y              *float64 `json:"y"`
-	Geom           *string  `json:"geom"`
-	Status         *string  `json:"status"`
-	CniBack        *string  `json:"cni_back"`
-	CniFront       *string  `json:"cni_front"`
+	PhoneNumber         string   `json:"phone_number"`
+	FirstName           string   `json:"first_name"`
+	LastName            string   `json:"last_name"`
+	Email               string   `json:"email"`
+	Password            string   `json:"password"`
+	IdRole              int      `json:"role_id"`
+	Biography           *string  `json:"biography"`
+	ProfilePicture      *string  `json:"profile_picture"`
+	Pricing             *float64 `json:"pricing"`
+	IdAddressGMap       *string  `json:"address_id"`
+	Radius              *float64 `json:"radius"`
+	X                   *float64 `json:"x"`
+	Y                   *float64 `json:"y"`
+	Geom                *string  `json:"geom"`
+	Status              *string  `json:"status"`
+	CniBack             *string  `json:"cni_back"`
+	CniFront            *string  `json:"cni_front"`
+	Language            *string  `json:"language"`
+	NotificationChannel *string  `json:"notification_channel"`
 }
 
 type Duration struct {
@@ -91,15 +93,73 @@ type Visit struct {
 }
 
 type Criteria struct {
-	ID             int    `json:"id"`
-	Criteria       string `json:"criteria"`
-	CriteriaAnswer string `json:"criteria_answer"`
-	PhotoRequired  bool   `json:"photo_required"`
-	Photo          string `json:"photo"`
-	VideoRequired  bool   `json:"video_required"`
-	Video          string `json:"video"`
-	PhoneNumber    string `json:"phone_number"`
-	Reusable       bool   `json:"reusable"`
+	ID             int              `json:"id"`
+	Criteria       string           `json:"criteria"`
+	Type           string           `json:"type"`
+	Options        *CriteriaOptions `json:"options,omitempty"`
+	CriteriaAnswer string           `json:"criteria_answer"`
+	Answer         json.RawMessage  `json:"answer,omitempty"`
+	PhotoRequired  bool             `json:"photo_required"`
+	Photo          string           `json:"photo"`
+	VideoRequired  bool             `json:"video_required"`
+	Video          string           `json:"video"`
+	Media          []CriteriaMedia  `json:"media"`
+	EvidenceFlags  []string         `json:"evidence_flags"`
+	PhoneNumber    string           `json:"phone_number"`
+	Reusable       bool             `json:"reusable"`
+}
+
+// CriteriaMedia est une photo ou une vidéo de la collection répondant à un critère.
+type CriteriaMedia struct {
+	ID            int        `json:"id"`
+	MediaID       int        `json:"media_id"`
+	Kind          string     `json:"kind"`
+	Position      int        `json:"position"`
+	Caption       *string    `json:"caption"`
+	URL           string     `json:"url"`
+	Thumbnail     string     `json:"thumbnail,omitempty"`
+	CapturedAt    *time.Time `json:"captured_at"`
+	AddedAt       time.Time  `json:"added_at"`
+	EvidenceFlags []string   `json:"evidence_flags"`
+}
+
+// CriteriaOptions décrit les réponses possibles d'un critère selon son type.
+type CriteriaOptions struct {
+	Choices []string `json:"choices,omitempty"`
+	Min     *float64 `json:"min,omitempty"`
+	Max     *float64 `json:"max,omitempty"`
+	Unit    string   `json:"unit,omitempty"`
+}
+
+// CriteriaTemplate est une liste de critères réutilisable lors de la création d'une visite.
+type CriteriaTemplate struct {
+	ID               int        `json:"id"`
+	Name             string     `json:"name"`
+	IdTypeRealEstate *int       `json:"type_real_estate_id"`
+	Global           bool       `json:"global"`
+	Criterias        []Criteria `json:"criterias"`
+}
+
+type VerificationCase struct {
+	ID          int        `json:"id"`
+	PhoneNumber string     `json:"phone_number"`
+	Attempt     int        `json:"attempt"`
+	CniFrontID  *int       `json:"cni_front_id,omitempty"`
+	CniFrontURL string     `json:"cni_front_url,omitempty"`
+	CniBackID   *int       `json:"cni_back_id,omitempty"`
+	CniBackURL  string     `json:"cni_back_url,omitempty"`
+	Status      string     `json:"status"`
+	Reviewer    *string    `json:"reviewer"`
+	ReasonCodes []string   `json:"reason_codes"`
+	Comment     *string    `json:"comment"`
+	SubmittedAt time.Time  `json:"submitted_at"`
+	ReviewedAt  *time.Time `json:"reviewed_at"`
+}
+
+type VerificationDecision struct {
+	Decision    string   `json:"decision"`
+	ReasonCodes []string `json:"reason_codes"`
+	Comment     *string  `json:"comment"`
 }
 
 type LinkCriteriaVisit struct {
@@ -123,13 +183,26 @@ type googleMapsResponse struct {
 	Status string `json:"status"`
 }
 
+type VisitCheck struct {
+	X          float64   `json:"x"`
+	Y          float64   `json:"y"`
+	Accuracy   *float64  `json:"accuracy"`
+	Distance   float64   `json:"distance"`
+	OutOfRange bool      `json:"outOfRange"`
+	CheckedAt  time.Time `json:"checkedAt"`
+}
+
 type visitDetails struct {
 	Visitor struct {
-		FirstName      string  `json:"firstName"`
-		LastName       string  `json:"lastName"`
-		ProfilePicture string  `json:"profilePicture"`
-		NoteAVG        float32 `json:"noteAVG"`
-		VisitCount     int     `json:"visitCount"`
+		FirstName      string   `json:"firstName"`
+		LastName       string   `json:"lastName"`
+		ProfilePicture string   `json:"profilePicture"`
+		NoteAVG        float32  `json:"noteAVG"`
+		VisitCount     int      `json:"visitCount"`
+		Cancellations  int      `json:"cancellationCount"`
+		Reliability    float32  `json:"reliability"`
+		ExpiredCount   int      `json:"expiredCount"`
+		ResponseHours  *float32 `json:"responseHours"`
 		//Distance   int     `json:"distance"`
 	} `json:"visitor"`
 	Visit struct {
@@ -138,18 +211,193 @@ type visitDetails struct {
 			googleMapsResponse
 		} `json:"address"`
 		Details struct {
-			StartTime     string  `json:"startTime"`
-			EndTime       string  `json:"endTime"`
-			Date          string  `json:"date"`
-			Duration      string  `json:"duration"`
-			Status        string  `json:"status"`
-			VisitAccepted bool    `json:"visitAccepted"`
-			CriteriaSent  bool    `json:"criteriaSent"`
-			Price         string  `json:"price"`
-			Note          float32 `json:"note"`
-			Code          int     `json:"code"`
+			StartTime     string             `json:"startTime"`
+			EndTime       string             `json:"endTime"`
+			Date          string             `json:"date"`
+			Duration      string             `json:"duration"`
+			Status        string             `json:"status"`
+			VisitAccepted bool               `json:"visitAccepted"`
+			CriteriaSent  bool               `json:"criteriaSent"`
+			Price         string             `json:"price"`
+			Note          float32            `json:"note"`
+			Code          int                `json:"code"`
+			CheckIn       *VisitCheck        `json:"checkIn"`
+			CheckOut      *VisitCheck        `json:"checkOut"`
+			TimeOnSite    string             `json:"timeOnSite"`
+			Cancellation  *VisitCancellation `json:"cancellation"`
+			Proposals     []VisitProposal    `json:"proposals"`
 		} `json:"details"`
 		IDVisit   int        `json:"id"`
 		Criterias []Criteria `json:"criterias"`
 	} `json:"visit"`
 }
+
+// VisitShare est un lien de partage du rapport d'une visite. Le jeton n'est renvoyé qu'à la création du lien.
+type VisitShare struct {
+	ID           int        `json:"id"`
+	IdVisit      int        `json:"visit_id"`
+	Label        *string    `json:"label"`
+	Token        string     `json:"token,omitempty"`
+	URL          string     `json:"url,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	RevokedAt    *time.Time `json:"revoked_at"`
+	ViewCount    int        `json:"view_count"`
+	LastViewedAt *time.Time `json:"last_viewed_at"`
+}
+
+// SharedVisit est la vue publique d'une visite ouverte avec un lien de partage : ni numéro de téléphone, ni code de
+// vérification.
+type SharedVisit struct {
+	ID         int        `json:"id"`
+	Address    string     `json:"address"`
+	Date       string     `json:"date"`
+	StartTime  string     `json:"startTime"`
+	EndTime    string     `json:"endTime"`
+	Duration   string     `json:"duration"`
+	Status     string     `json:"status"`
+	Price      string     `json:"price"`
+	TimeOnSite string     `json:"timeOnSite"`
+	Visitor    string     `json:"visitor"`
+	Criterias  []Criteria `json:"criterias"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	ReportURL  string     `json:"reportUrl"`
+}
+
+// VisitCancellation est l'annulation d'une visite et son issue financière : les frais à la charge du prospect, la
+// somme qui lui est remboursée et le dédommagement du visiteur.
+type VisitCancellation struct {
+	ID           int        `json:"id"`
+	IdVisit      int        `json:"visit_id"`
+	CancelledBy  string     `json:"cancelled_by"`
+	Reason       *string    `json:"reason"`
+	Tier         string     `json:"tier"`
+	HoursBefore  float64    `json:"hours_before"`
+	Price        float64    `json:"price"`
+	Fee          float64    `json:"fee"`
+	Refund       float64    `json:"refund"`
+	Compensation float64    `json:"visitor_compensation"`
+	Counted      bool       `json:"counted_against_visitor"`
+	CancelledAt  time.Time  `json:"cancelled_at"`
+	RematchedAt  *time.Time `json:"rematched_at,omitempty"`
+}
+
+// VisitCandidate est un visiteur qui peut remplacer celui qui a annulé une visite.
+type VisitCandidate struct {
+	PhoneNumber    string   `json:"phoneNumber"`
+	FirstName      string   `json:"firstName"`
+	LastName       string   `json:"lastName"`
+	ProfilePicture string   `json:"profilePicture"`
+	Pricing        float64  `json:"pricing"`
+	NoteAvg        float64  `json:"noteAvg"`
+	VisitCount     int      `json:"visitCount"`
+	Reliability    float64  `json:"reliability"`
+	ExpiredCount   int      `json:"expiredCount"`
+	ResponseHours  *float64 `json:"responseHours"`
+}
+
+// VisitProposal est une proposition de nouveaux horaires pour une visite en attente, parmi lesquels l'autre partie
+// peut en accepter un.
+type VisitProposal struct {
+	ID                int         `json:"id"`
+	ProposedBy        string      `json:"proposed_by"`
+	Message           *string     `json:"message"`
+	StartTimes        []time.Time `json:"start_times"`
+	Status            string      `json:"status"`
+	AcceptedStartTime *time.Time  `json:"accepted_start_time"`
+	CreatedAt         time.Time   `json:"created_at"`
+	RespondedAt       *time.Time  `json:"responded_at"`
+}
+
+// VisitRequest est une demande de visite ouverte : le prospect ne choisit pas de visiteur, et le premier visiteur
+// éligible qui la prend obtient la visite.
+type VisitRequest struct {
+	ID               int        `json:"id"`
+	IdAddressGMap    string     `json:"address_id"`
+	X                float64    `json:"x"`
+	Y                float64    `json:"y"`
+	IdTypeRealEstate int        `json:"type_real_estate_id"`
+	WindowStart      time.Time  `json:"window_start"`
+	WindowEnd        time.Time  `json:"window_end"`
+	MaxPrice         float64    `json:"max_price"`
+	Note             *string    `json:"note"`
+	Status           string     `json:"status"`
+	IdVisit          *int       `json:"visit_id"`
+	CreatedAt        time.Time  `json:"created_at"`
+	ClaimedAt        *time.Time `json:"claimed_at"`
+}
+
+// OpenVisitRequest est une demande de visite ouverte telle que la voit un visiteur qui peut la prendre.
+type OpenVisitRequest struct {
+	ID                 int       `json:"id"`
+	IdAddressGMap      string    `json:"address_id"`
+	X                  float64   `json:"x"`
+	Y                  float64   `json:"y"`
+	IdTypeRealEstate   int       `json:"type_real_estate_id"`
+	WindowStart        time.Time `json:"window_start"`
+	WindowEnd          time.Time `json:"window_end"`
+	Price              float64   `json:"price"`
+	Note               *string   `json:"note"`
+	Criterias          []string  `json:"criterias"`
+	FirstAvailableTime time.Time `json:"first_available_start_time"`
+}
+
+// DeadJob est une tâche d'arrière-plan abandonnée après sa dernière tentative.
+type DeadJob struct {
+	ID        int64           `json:"id"`
+	Kind      string          `json:"kind"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error"`
+	CreatedAt time.Time       `json:"created_at"`
+	FailedAt  time.Time       `json:"failed_at"`
+}
+
+// VisitMessage est un message du fil de discussion d'une visite.
+type VisitMessage struct {
+	ID         int                `json:"id"`
+	IdVisit    int                `json:"visit_id"`
+	Sender     string             `json:"sender"`
+	Mine       bool               `json:"mine"`
+	Body       *string            `json:"body"`
+	Attachment *MessageAttachment `json:"attachment,omitempty"`
+	CreatedAt  time.Time          `json:"created_at"`
+	ReadAt     *time.Time         `json:"read_at"`
+}
+
+// MessageAttachment est la photo ou la vidéo jointe à un message.
+type MessageAttachment struct {
+	MediaID   int    `json:"media_id"`
+	Kind      string `json:"kind"`
+	URL       string `json:"url"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+}
+
+// MessageThread est le fil de discussion d'une visite, vu par l'une de ses parties.
+type MessageThread struct {
+	IdVisit   int       `json:"visit_id"`
+	StartTime time.Time `json:"start_time"`
+	Status    string    `json:"status"`
+	Contact   struct {
+		FirstName      string `json:"first_name"`
+		LastName       string `json:"last_name"`
+		ProfilePicture string `json:"profile_picture"`
+	} `json:"contact"`
+	LastMessage VisitMessage `json:"last_message"`
+	Unread      int          `json:"unread"`
+}
+
+// Email est un e-mail transactionnel envoyé à un utilisateur, avec son statut d'envoi.
+type Email struct {
+	ID          int        `json:"id"`
+	PhoneNumber string     `json:"phone_number"`
+	Recipient   string     `json:"recipient"`
+	Template    string     `json:"template"`
+	Language    string     `json:"language"`
+	Subject     string     `json:"subject"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error"`
+	CreatedAt   time.Time  `json:"created_at"`
+	SentAt      *time.Time `json:"sent_at"`
+}
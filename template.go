@@ -0,0 +1,419 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+	"strings"
+)
+
+var errTemplateNotFound = errors.New("criteria template not found")
+var errTemplateWrongType = errors.New("criteria template for another type of real estate")
+
+// canSeeCriteriaTemplate indique si l'utilisateur peut utiliser un modèle : ceux de Voyo sont visibles de tous.
+func canSeeCriteriaTemplate(claims *CustomClaims, owner sql.NullString) bool {
+	return !owner.Valid || owner.String == claims.PhoneNumber || claims.Role == "ADMIN"
+}
+
+// canEditCriteriaTemplate indique si l'utilisateur peut modifier un modèle : les administrateurs gèrent ceux de Voyo,
+// les prospects les leurs.
+func canEditCriteriaTemplate(claims *CustomClaims, owner sql.NullString) bool {
+	if !owner.Valid {
+		return claims.Role == "ADMIN"
+	}
+	return owner.String == claims.PhoneNumber
+}
+
+// validateCriteriaTemplate vérifie un modèle envoyé par un utilisateur et normalise ses critères.
+func validateCriteriaTemplate(template *CriteriaTemplate) error {
+	template.Name = strings.TrimSpace(template.Name)
+	if template.Name == "" || len(template.Name) > 100 {
+		return errors.New("the name of the template must contain 1 to 100 characters")
+	}
+
+	if len(template.Criterias) == 0 {
+		return errors.New("the template must contain at least one criteria")
+	}
+
+	for i := range template.Criterias {
+		template.Criterias[i].Criteria = strings.TrimSpace(template.Criterias[i].Criteria)
+		if template.Criterias[i].Criteria == "" {
+			return fmt.Errorf("criteria %d: the question is empty", i+1)
+		}
+		if err := normalizeCriteriaDefinition(&template.Criterias[i]); err != nil {
+			return fmt.Errorf("criteria %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// insertCriteriaTemplateItems enregistre les critères d'un modèle, dans l'ordre donné.
+func insertCriteriaTemplateItems(tx *sql.Tx, idTemplate int, criterias []Criteria) error {
+	for position, crit := range criterias {
+		options, err := criteriaOptionsValue(crit.Options)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO criteriatemplateitem (idcriteriatemplate, position, criteria, criteriatype, options, photorequired, videorequired)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			idTemplate, position, crit.Criteria, crit.Type, options, crit.PhotoRequired, crit.VideoRequired)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getCriteriaTemplateItems renvoie les critères des modèles demandés, par modèle.
+func getCriteriaTemplateItems(ids []int) (map[int][]Criteria, error) {
+	rows, err := db.Query(`
+		SELECT idcriteriatemplate, criteria, criteriatype, options, photorequired, videorequired
+		FROM criteriatemplateitem
+		WHERE idcriteriatemplate = ANY ($1)
+		ORDER BY idcriteriatemplate, position`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in getCriteriaTemplateItems() : ", err)
+		}
+	}(rows)
+
+	items := map[int][]Criteria{}
+	for rows.Next() {
+		var idTemplate int
+		var crit Criteria
+		var options []byte
+		if err := rows.Scan(&idTemplate, &crit.Criteria, &crit.Type, &options, &crit.PhotoRequired, &crit.VideoRequired); err != nil {
+			return nil, err
+		}
+		if err := scanCriteriaTyping(&crit, options, nil); err != nil {
+			return nil, err
+		}
+		items[idTemplate] = append(items[idTemplate], crit)
+	}
+
+	return items, rows.Err()
+}
+
+// getTemplateCriterias renvoie les critères à créer pour une visite à partir d'un modèle, après avoir vérifié que
+// l'utilisateur y a accès et que le modèle correspond au type du bien visité.
+func getTemplateCriterias(claims *CustomClaims, idTemplate int, idTypeRealEstate int) ([]Criteria, error) {
+	var owner sql.NullString
+	var templateType sql.NullInt64
+	err := db.QueryRow(`SELECT phonenumber, idtyperealestate FROM criteriatemplate WHERE idcriteriatemplate = $1`, idTemplate).Scan(&owner, &templateType)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errTemplateNotFound
+		}
+		return nil, err
+	}
+
+	if !canSeeCriteriaTemplate(claims, owner) {
+		return nil, errTemplateNotFound
+	}
+
+	if templateType.Valid && int(templateType.Int64) != idTypeRealEstate {
+		return nil, errTemplateWrongType
+	}
+
+	items, err := getCriteriaTemplateItems([]int{idTemplate})
+	if err != nil {
+		return nil, err
+	}
+
+	return items[idTemplate], nil
+}
+
+// GetCriteriaTemplates renvoie un modèle (paramètre "id"), ou les modèles de Voyo et ceux de l'utilisateur, éventuellement
+// limités à un type de bien (paramètre "idTypeRealEstate", les modèles sans type restent proposés).
+func GetCriteriaTemplates(c *fiber.Ctx) error {
+	claims := c.Locals("user").(*CustomClaims)
+	id := strings.TrimSpace(c.Query("id"))
+	idTypeRealEstate := strings.TrimSpace(c.Query("idTypeRealEstate"))
+
+	query := `
+		SELECT idcriteriatemplate, name, idtyperealestate, phonenumber
+		FROM criteriatemplate
+		WHERE (phonenumber IS NULL OR phonenumber = $1)`
+	args := []interface{}{claims.PhoneNumber}
+
+	if id != "" {
+		args = append(args, id)
+		query += fmt.Sprintf(` AND idcriteriatemplate = $%d`, len(args))
+	}
+
+	if idTypeRealEstate != "" {
+		args = append(args, idTypeRealEstate)
+		query += fmt.Sprintf(` AND (idtyperealestate IS NULL OR idtyperealestate = $%d)`, len(args))
+	}
+
+	rows, err := db.Query(query+` ORDER BY phonenumber NULLS FIRST, name`, args...)
+	if err != nil {
+		fmt.Println("💥 Error querying the database in GetCriteriaTemplates() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in GetCriteriaTemplates() : ", err)
+			return
+		}
+	}(rows)
+
+	templates := []CriteriaTemplate{}
+	ids := []int{}
+	for rows.Next() {
+		var template CriteriaTemplate
+		var owner sql.NullString
+		if err := rows.Scan(&template.ID, &template.Name, &template.IdTypeRealEstate, &owner); err != nil {
+			fmt.Println("💥 Error scanning the rows in GetCriteriaTemplates() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+
+		template.Global = !owner.Valid
+		templates = append(templates, template)
+		ids = append(ids, template.ID)
+	}
+
+	if err := rows.Err(); err != nil {
+		fmt.Println("💥 Error iterating over the rows in GetCriteriaTemplates() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	items, err := getCriteriaTemplateItems(ids)
+	if err != nil {
+		fmt.Println("💥 Error getting the criterias in GetCriteriaTemplates() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	for i := range templates {
+		templates[i].Criterias = items[templates[i].ID]
+	}
+
+	if id != "" {
+		if len(templates) == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Template not found",
+			})
+		}
+		return c.JSON(templates[0])
+	}
+
+	return c.JSON(templates)
+}
+
+// CreateCriteriaTemplate enregistre un modèle. Ceux créés par un administrateur sont proposés à tous les prospects.
+func CreateCriteriaTemplate(c *fiber.Ctx) error {
+	claims := c.Locals("user").(*CustomClaims)
+
+	var template CriteriaTemplate
+	if err := c.BodyParser(&template); err != nil {
+		fmt.Println("💥 Error parsing the body in CreateCriteriaTemplate() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if err := validateCriteriaTemplate(&template); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var owner *string
+	if claims.Role != "ADMIN" {
+		owner = &claims.PhoneNumber
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println("💥 Error starting the transaction in CreateCriteriaTemplate() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in CreateCriteriaTemplate() : ", err)
+		}
+	}(tx)
+
+	err = tx.QueryRow(`INSERT INTO criteriatemplate (name, idtyperealestate, phonenumber) VALUES ($1, $2, $3) RETURNING idcriteriatemplate`,
+		template.Name, template.IdTypeRealEstate, owner).Scan(&template.ID)
+	if err != nil {
+		fmt.Println("💥 Error inserting the template in CreateCriteriaTemplate() : ", err)
+		if strings.Contains(err.Error(), "violates foreign key constraint") {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "This type of real estate does not exist",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if err := insertCriteriaTemplateItems(tx, template.ID, template.Criterias); err != nil {
+		fmt.Println("💥 Error inserting the criterias in CreateCriteriaTemplate() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		fmt.Println("💥 Error committing the transaction in CreateCriteriaTemplate() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	template.Global = owner == nil
+	return c.Status(fiber.StatusCreated).JSON(template)
+}
+
+// UpdateCriteriaTemplate remplace le nom, le type de bien et les critères d'un modèle.
+func UpdateCriteriaTemplate(c *fiber.Ctx) error {
+	claims := c.Locals("user").(*CustomClaims)
+	id := strings.TrimSpace(c.Query("id"))
+
+	if id == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the ID of the template to update",
+		})
+	}
+
+	var template CriteriaTemplate
+	if err := c.BodyParser(&template); err != nil {
+		fmt.Println("💥 Error parsing the body in UpdateCriteriaTemplate() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if err := validateCriteriaTemplate(&template); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println("💥 Error starting the transaction in UpdateCriteriaTemplate() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in UpdateCriteriaTemplate() : ", err)
+		}
+	}(tx)
+
+	var owner sql.NullString
+	err = tx.QueryRow(`SELECT idcriteriatemplate, phonenumber FROM criteriatemplate WHERE idcriteriatemplate = $1 FOR UPDATE`, id).Scan(&template.ID, &owner)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Template not found",
+			})
+		}
+
+		fmt.Println("💥 Error scanning the row in UpdateCriteriaTemplate() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if !canEditCriteriaTemplate(claims, owner) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	}
+
+	_, err = tx.Exec(`UPDATE criteriatemplate SET name = $1, idtyperealestate = $2, updatedat = NOW() WHERE idcriteriatemplate = $3`, template.Name, template.IdTypeRealEstate, template.ID)
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM criteriatemplateitem WHERE idcriteriatemplate = $1`, template.ID)
+	}
+	if err == nil {
+		err = insertCriteriaTemplateItems(tx, template.ID, template.Criterias)
+	}
+	if err != nil {
+		fmt.Println("💥 Error updating the template in UpdateCriteriaTemplate() : ", err)
+		if strings.Contains(err.Error(), "violates foreign key constraint") {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "This type of real estate does not exist",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		fmt.Println("💥 Error committing the transaction in UpdateCriteriaTemplate() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	template.Global = !owner.Valid
+	return c.JSON(template)
+}
+
+// DeleteCriteriaTemplate supprime un modèle. Les visites déjà créées à partir de lui gardent leurs critères.
+func DeleteCriteriaTemplate(c *fiber.Ctx) error {
+	claims := c.Locals("user").(*CustomClaims)
+	id := strings.TrimSpace(c.Query("id"))
+
+	var owner sql.NullString
+	err := db.QueryRow(`SELECT phonenumber FROM criteriatemplate WHERE idcriteriatemplate = $1`, id).Scan(&owner)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Template not found",
+			})
+		}
+
+		fmt.Println("💥 Error scanning the row in DeleteCriteriaTemplate() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if !canEditCriteriaTemplate(claims, owner) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	}
+
+	if _, err := db.Exec(`DELETE FROM criteriatemplate WHERE idcriteriatemplate = $1`, id); err != nil {
+		fmt.Println("💥 Error deleting the template in DeleteCriteriaTemplate() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
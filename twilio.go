@@ -6,7 +6,9 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/log"
 	"github.com/twilio/twilio-go"
+	openapi "github.com/twilio/twilio-go/rest/api/v2010"
 	verify "github.com/twilio/twilio-go/rest/verify/v2"
+	"os"
 )
 
 var validate = validator.New()
@@ -46,6 +48,28 @@ func twilioVerifyOTP(phoneNumber string, code string) (string, error) {
 	return *resp.Status, nil
 }
 
+// twilioSendSMS envoie un SMS au numéro indiqué depuis le numéro configuré dans TWILIO_FROM_NUMBER.
+func twilioSendSMS(phoneNumber string, body string) error {
+	client := twilio.NewRestClient()
+
+	params := &openapi.CreateMessageParams{}
+	params.SetTo(phoneNumber)
+	params.SetFrom(os.Getenv("TWILIO_FROM_NUMBER"))
+	params.SetBody(body)
+
+	_, err := client.Api.CreateMessage(params)
+	return err
+}
+
+// notifyUser prévient un utilisateur par SMS. L'envoi est fait en arrière-plan pour ne pas bloquer la requête.
+func notifyUser(phoneNumber string, message string) {
+	go func() {
+		if err := twilioSendSMS(phoneNumber, message); err != nil {
+			fmt.Println("💥 Error sending the notification in notifyUser() : ", err)
+		}
+	}()
+}
+
 func sendOTP(c *fiber.Ctx) error {
 	var body OTPData
 	if err := c.BodyParser(&body); err != nil {
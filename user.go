@@ -2,11 +2,11 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/utils"
 	"golang.org/x/crypto/bcrypt"
-	"math/rand"
 	"strconv"
 	"strings"
 )
@@ -29,7 +29,7 @@ func CreateUser(c *fiber.Ctx) error {
 		})
 	}
 
-	stmt, err := db.Prepare(`INSERT INTO "user" (PhoneNumber, FirstName, LastName, Email, Password, IdRole, Biography, ProfilePicture, Pricing, IdAddressGMap, Radius, Status, CniFront, CniBack) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`)
+	stmt, err := db.Prepare(`INSERT INTO "user" (PhoneNumber, FirstName, LastName, Email, Password, IdRole, Biography, ProfilePicture, Pricing, IdAddressGMap, Radius, Status, Language) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`)
 	if err != nil {
 		fmt.Println("💥 Error preparing the request in CreateUser() : ", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -45,12 +45,18 @@ func CreateUser(c *fiber.Ctx) error {
 	}(stmt)
 
 	status := "VALIDATED"
+	hasDocuments := user.CniFront != nil && strings.TrimSpace(*user.CniFront) != "" &&
+		user.CniBack != nil && strings.TrimSpace(*user.CniBack) != ""
 
+	// A visitor without identity documents is asked to submit them before being reviewed
 	if user.IdRole == 1 {
-		status = "PENDING_VALIDATION"
+		status = verificationUserStatus[verificationSubmitted]
+		if !hasDocuments {
+			status = verificationUserStatus[verificationNeedsResubmission]
+		}
 	}
 
-	_, err = stmt.Exec(user.PhoneNumber, user.FirstName, user.LastName, user.Email, hashedPassword, user.IdRole, user.Biography, user.ProfilePicture, user.Pricing, user.IdAddressGMap, user.Radius, status, user.CniFront, user.CniBack)
+	_, err = stmt.Exec(user.PhoneNumber, user.FirstName, user.LastName, user.Email, hashedPassword, user.IdRole, user.Biography, user.ProfilePicture, user.Pricing, user.IdAddressGMap, user.Radius, status, emailLanguage(user.Language))
 	if err != nil {
 		fmt.Println("💥 Error executing the request in CreateUser() : ", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -58,6 +64,18 @@ func CreateUser(c *fiber.Ctx) error {
 		})
 	}
 
+	// Visitors start with a verification case so that they appear in the reviewers' queue. The identity documents are
+	// only stored encrypted, never on the user row.
+	if user.IdRole == 1 && hasDocuments {
+		_, err = createVerificationCase(user.PhoneNumber, *user.CniFront, *user.CniBack)
+		if err != nil {
+			fmt.Println("💥 Error creating the verification case in CreateUser() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+	}
+
 	// Get the X and Y coordinates from the address using the google maps api
 	if user.IdAddressGMap != nil {
 		// Dereference the pointer and get coordinates
@@ -135,6 +153,8 @@ func CreateUser(c *fiber.Ctx) error {
 		})
 	}
 
+	emailUser(user.PhoneNumber, "signup", map[string]interface{}{"Visitor": user.IdRole == 1})
+
 	// Return the token in the response
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
 		"Message": "User successfully created",
@@ -291,6 +311,7 @@ func GetUser(c *fiber.Ctx) error {
 				"error": "User not found",
 			})
 		}
+		signProfilePicture(user.ProfilePicture, phoneNumber)
 		return c.JSON(user)
 	} else if phoneNumber != "" {
 		var user User
@@ -318,6 +339,7 @@ func GetUser(c *fiber.Ctx) error {
 				"error": "User not found",
 			})
 		}
+		signProfilePicture(user.ProfilePicture, phoneNumber)
 		return c.JSON(user)
 	} else {
 		// Select all users
@@ -348,6 +370,7 @@ func GetUser(c *fiber.Ctx) error {
 					"error": "An error has occurred, please try again later.",
 				})
 			}
+			signProfilePicture(user.ProfilePicture, phoneNumber)
 			users = append(users, user)
 		}
 
@@ -442,15 +465,26 @@ func UpdateUser(c *fiber.Ctx) error {
 		placeholderIndex++
 	}
 
-	if user.CniFront != nil {
-		updateQuery += fmt.Sprintf(`CniFront=$%d,`, placeholderIndex)
-		args = append(args, user.CniFront)
+	if user.Language != nil {
+		if _, ok := emailFooters[strings.ToLower(*user.Language)]; !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "The language must be fr or en.",
+			})
+		}
+		updateQuery += fmt.Sprintf(`Language=$%d,`, placeholderIndex)
+		args = append(args, strings.ToLower(*user.Language))
 		placeholderIndex++
 	}
 
-	if user.CniBack != nil {
-		updateQuery += fmt.Sprintf(`CniBack=$%d,`, placeholderIndex)
-		args = append(args, user.CniBack)
+	if user.NotificationChannel != nil {
+		channel := strings.ToUpper(*user.NotificationChannel)
+		if channel != "PUSH" && channel != "SMS" && channel != "EMAIL" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "The notification channel must be PUSH, SMS or EMAIL.",
+			})
+		}
+		updateQuery += fmt.Sprintf(`NotificationChannel=$%d,`, placeholderIndex)
+		args = append(args, channel)
 		placeholderIndex++
 	}
 
@@ -505,30 +539,34 @@ func UpdateUser(c *fiber.Ctx) error {
 	return c.SendStatus(fiber.StatusNoContent)
 }
 
-// DeleteUser supprime un utilisateur de la base de données.
+// DeleteUser efface un utilisateur : ses données personnelles sont anonymisées, ses visites sont conservées pour l'autre
+// partie, et l'effacement peut être annulé par un administrateur pendant le délai de grâce.
 func DeleteUser(c *fiber.Ctx) error {
-	id := c.Query("id")
+	claims := c.Locals("user").(*CustomClaims)
 
-	stmt, err := db.Prepare(`DELETE FROM "user" WHERE PhoneNumber=$1`)
-	if err != nil {
-		fmt.Println("💥 Error preparing the request in DeleteUser() : ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "An error has occurred, please try again later.",
-		})
+	// A user can only erase their own account, unless they are an administrator
+	phoneNumber := claims.PhoneNumber
+	if claims.Role == "ADMIN" && c.Query("id") != "" {
+		phoneNumber = c.Query("id")
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(id)
+	graceUntil, err := eraseUser(phoneNumber, claims.PhoneNumber)
 	if err != nil {
-		fmt.Println("💥 Error executing the request in DeleteUser() : ", err)
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, errUserAlreadyErased) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+
+		fmt.Println("💥 Error erasing the user in DeleteUser() : ", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "An error has occurred, please try again later.",
 		})
 	}
 
-	// TODO: instead of removing the user, set all data to null or User deleted in the database to avoid errors on foreign keys
-
-	return c.SendStatus(fiber.StatusNoContent)
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"grace_until": graceUntil,
+	})
 }
 
 func GetHomeStats(c *fiber.Ctx) error {
@@ -571,7 +609,13 @@ func GetHomeStats(c *fiber.Ctx) error {
 		}
 
 		// 2) Unread messages
-		homeStats.UnreadMessages = rand.Int() % 10 // TODO: get the real number by requesting the firebase database
+		homeStats.UnreadMessages, err = countUnreadMessages(c.Locals("user").(*CustomClaims).PhoneNumber)
+		if err != nil {
+			fmt.Println("💥 Error executing the request in GetHomeStats() unread messages : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
 
 		// 3) Visits done
 		stmt, err = db.Prepare(`SELECT COUNT(*) FROM visit WHERE PhoneNumberProspect = $1 AND Status = 'DONE'`)
@@ -644,7 +688,13 @@ func GetHomeStats(c *fiber.Ctx) error {
 		}
 
 		// 2) Unread messages
-		homeStats.UnreadMessages = rand.Int() % 10 // TODO: get the real number by requesting the firebase database
+		homeStats.UnreadMessages, err = countUnreadMessages(c.Locals("user").(*CustomClaims).PhoneNumber)
+		if err != nil {
+			fmt.Println("💥 Error executing the request in GetHomeStats() unread messages : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
 
 		// 3) Awaiting approval
 		stmt, err = db.Prepare(`SELECT COUNT(*) FROM visit WHERE PhoneNumberVisitor = $1 AND Status = 'PROGRAMMED'`)
@@ -690,7 +740,7 @@ func SearchUsers(c *fiber.Ctx) error {
 	query := strings.Replace(c.Query("q"), " ", "%", -1)
 
 	// Prepare the request
-	stmt, err := db.Prepare(`SELECT PhoneNumber, FirstName, LastName, Email, IdRole, Biography, ProfilePicture, Pricing, idaddressgmap, Radius, x, y, status, cniback, cnifront FROM "user" WHERE PhoneNumber LIKE $1 OR FirstName LIKE $1 OR LastName LIKE $1 OR Email LIKE $1`)
+	stmt, err := db.Prepare(`SELECT PhoneNumber, FirstName, LastName, Email, IdRole, Biography, ProfilePicture, Pricing, idaddressgmap, Radius, x, y, status FROM "user" WHERE PhoneNumber LIKE $1 OR FirstName LIKE $1 OR LastName LIKE $1 OR Email LIKE $1`)
 	if err != nil {
 		fmt.Println("💥 Error preparing the request in SearchUsers() : ", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -725,13 +775,14 @@ func SearchUsers(c *fiber.Ctx) error {
 	var users []User
 	for rows.Next() {
 		var user User
-		err := rows.Scan(&user.PhoneNumber, &user.FirstName, &user.LastName, &user.Email, &user.IdRole, &user.Biography, &user.ProfilePicture, &user.Pricing, &user.IdAddressGMap, &user.Radius, &user.X, &user.Y, &user.Status, &user.CniBack, &user.CniFront)
+		err := rows.Scan(&user.PhoneNumber, &user.FirstName, &user.LastName, &user.Email, &user.IdRole, &user.Biography, &user.ProfilePicture, &user.Pricing, &user.IdAddressGMap, &user.Radius, &user.X, &user.Y, &user.Status)
 		if err != nil {
 			fmt.Println("💥 Error scanning the rows in SearchUsers() : ", err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "An error has occurred, please try again later.",
 			})
 		}
+		signProfilePicture(user.ProfilePicture, c.Locals("user").(*CustomClaims).PhoneNumber)
 		users = append(users, user)
 
 	}
@@ -739,40 +790,6 @@ func SearchUsers(c *fiber.Ctx) error {
 	return c.JSON(users)
 }
 
-func UsersToBeValidated(c *fiber.Ctx) error {
-	rows, err := db.Query(`SELECT 																				PhoneNumber, FirstName, LastName, Email, IdRole, Biography, ProfilePicture, Pricing, idaddressgmap, Radius, x, y, status, cniback, cnifront FROM "user" WHERE status = 'PENDING_VALIDATION'`)
-	if err != nil {
-		fmt.Println("💥 Error querying the database in UsersToBeValidated() : ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "An error has occurred, please try again later.",
-		})
-
-	}
-
-	defer func(rows *sql.Rows) {
-		err := rows.Close()
-		if err != nil {
-			fmt.Println("💥 Error closing the rows in UsersToBeValidated()")
-			return
-		}
-	}(rows)
-
-	var users []User
-	for rows.Next() {
-		var user User
-		err := rows.Scan(&user.PhoneNumber, &user.FirstName, &user.LastName, &user.Email, &user.IdRole, &user.Biography, &user.ProfilePicture, &user.Pricing, &user.IdAddressGMap, &user.Radius, &user.X, &user.Y, &user.Status, &user.CniBack, &user.CniFront)
-		if err != nil {
-			fmt.Println("💥 Error scanning the rows in UsersToBeValidated() : ", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "An error has occurred, please try again later.",
-			})
-		}
-		users = append(users, user)
-	}
-
-	return c.JSON(users)
-}
-
 func GetUserStatus(c *fiber.Ctx) error {
 	phoneNumber := c.Locals("user").(*CustomClaims).PhoneNumber
 
@@ -814,6 +831,13 @@ func AdminUpdateUser(c *fiber.Ctx) error {
 		})
 	}
 
+	// The status follows the verification case, so that the documents are reviewed and purged like any other
+	if user.Status != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The status of a user is changed by reviewing their verification case",
+		})
+	}
+
 	var updateQuery string
 	var args []interface{}
 
@@ -904,16 +928,6 @@ func AdminUpdateUser(c *fiber.Ctx) error {
 		placeholderIndex++
 	}
 
-	if user.Status != nil {
-		if *user.Status == "VALIDATED" {
-			updateQuery += fmt.Sprintf(`Status=$%d, CniFront='', CniBack='', `, placeholderIndex)
-		} else {
-			updateQuery += fmt.Sprintf(`Status=$%d, `, placeholderIndex)
-		}
-		args = append(args, user.Status)
-		placeholderIndex++
-	}
-
 	// Remove the last comma and space
 	updateQuery = strings.TrimSuffix(updateQuery, ", ")
 
@@ -976,6 +990,7 @@ func GetAllUsers(c *fiber.Ctx) error {
 				"error": "An error has occurred, please try again later.",
 			})
 		}
+		signProfilePicture(user.ProfilePicture, c.Locals("user").(*CustomClaims).PhoneNumber)
 		users = append(users, user)
 	}
 
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+// Statuts d'un dossier de vérification
+const (
+	verificationSubmitted         = "SUBMITTED"
+	verificationApproved          = "APPROVED"
+	verificationRejected          = "REJECTED"
+	verificationNeedsResubmission = "NEEDS_RESUBMISSION"
+)
+
+// Statut de l'utilisateur correspondant à chaque décision
+var verificationUserStatus = map[string]string{
+	verificationSubmitted:         "PENDING_VALIDATION",
+	verificationApproved:          "VALIDATED",
+	verificationRejected:          "REJECTED",
+	verificationNeedsResubmission: "RESUBMISSION_REQUIRED",
+}
+
+// Codes de motif acceptés pour un refus ou une demande de re-soumission
+var verificationReasonCodes = map[string]string{
+	"DOCUMENT_UNREADABLE": "le document est illisible",
+	"DOCUMENT_EXPIRED":    "le document est expiré",
+	"DOCUMENT_INCOMPLETE": "le recto ou le verso est manquant",
+	"NAME_MISMATCH":       "le nom ne correspond pas à votre compte",
+	"SUSPECTED_FRAUD":     "le document n'a pas pu être authentifié",
+	"OTHER":               "voir le commentaire de l'équipe Voyo",
+}
+
+// createVerificationCase chiffre et enregistre une nouvelle soumission de pièces d'identité, puis repasse le visiteur
+// en attente de validation.
+func createVerificationCase(phoneNumber string, cniFront string, cniBack string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in createVerificationCase() : ", err)
+		}
+	}(tx)
+
+	idFront, err := storeIdentityDocument(tx, phoneNumber, "FRONT", cniFront)
+	if err != nil {
+		return 0, err
+	}
+
+	idBack, err := storeIdentityDocument(tx, phoneNumber, "BACK", cniBack)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = tx.QueryRow(`
+		INSERT INTO verificationcase (phonenumber, attempt, idcnifront, idcniback, status)
+		VALUES ($1, (SELECT COUNT(*) + 1 FROM verificationcase WHERE phonenumber = $1), $2, $3, $4)
+		RETURNING idverificationcase`,
+		phoneNumber, idFront, idBack, verificationSubmitted,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`UPDATE "user" SET Status = $1 WHERE PhoneNumber = $2`, verificationUserStatus[verificationSubmitted], phoneNumber)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// SubmitVerification permet à un visiteur de soumettre (ou re-soumettre) ses pièces d'identité.
+func SubmitVerification(c *fiber.Ctx) error {
+	phoneNumber := c.Locals("user").(*CustomClaims).PhoneNumber
+
+	var user User
+	if err := c.BodyParser(&user); err != nil {
+		fmt.Println("💥 Error parsing the body in SubmitVerification() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if user.CniFront == nil || user.CniBack == nil || strings.TrimSpace(*user.CniFront) == "" || strings.TrimSpace(*user.CniBack) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide both sides of your identity card.",
+		})
+	}
+
+	var status string
+	err := db.QueryRow(`SELECT status FROM "user" WHERE PhoneNumber = $1`, phoneNumber).Scan(&status)
+	if err != nil {
+		fmt.Println("💥 Error scanning the row in SubmitVerification() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if status == verificationUserStatus[verificationApproved] {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Your identity has already been verified.",
+		})
+	}
+
+	var pending bool
+	err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM verificationcase WHERE phonenumber = $1 AND status = $2)`, phoneNumber, verificationSubmitted).Scan(&pending)
+	if err != nil {
+		fmt.Println("💥 Error scanning the row in SubmitVerification() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if pending {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "A verification request is already being reviewed.",
+		})
+	}
+
+	id, err := createVerificationCase(phoneNumber, *user.CniFront, *user.CniBack)
+	if err != nil {
+		fmt.Println("💥 Error creating the verification case in SubmitVerification() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"id":     id,
+		"status": verificationSubmitted,
+	})
+}
+
+// GetVerificationHistory renvoie l'historique des soumissions de l'utilisateur connecté, ou d'un utilisateur précis pour un administrateur.
+func GetVerificationHistory(c *fiber.Ctx) error {
+	claims := c.Locals("user").(*CustomClaims)
+
+	phoneNumber := claims.PhoneNumber
+	if claims.Role == "ADMIN" && c.Query("phoneNumber") != "" {
+		phoneNumber = c.Query("phoneNumber")
+	}
+
+	rows, err := db.Query(`
+		SELECT idverificationcase, phonenumber, attempt, idcnifront, idcniback, status, reviewer, reasoncodes, comment, submittedat, reviewedat
+		FROM verificationcase
+		WHERE phonenumber = $1
+		ORDER BY attempt DESC`, phoneNumber)
+	if err != nil {
+		fmt.Println("💥 Error querying the database in GetVerificationHistory() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in GetVerificationHistory() : ", err)
+			return
+		}
+	}(rows)
+
+	cases := []VerificationCase{}
+	for rows.Next() {
+		var vc VerificationCase
+		err := rows.Scan(&vc.ID, &vc.PhoneNumber, &vc.Attempt, &vc.CniFrontID, &vc.CniBackID, &vc.Status, &vc.Reviewer, pq.Array(&vc.ReasonCodes), &vc.Comment, &vc.SubmittedAt, &vc.ReviewedAt)
+		if err != nil {
+			fmt.Println("💥 Error scanning the rows in GetVerificationHistory() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+
+		// Only reviewers need to see the documents again
+		if claims.Role != "ADMIN" {
+			vc.CniFrontID, vc.CniBackID = nil, nil
+		}
+		vc.CniFrontURL = documentURL(vc.CniFrontID, claims.PhoneNumber)
+		vc.CniBackURL = documentURL(vc.CniBackID, claims.PhoneNumber)
+
+		cases = append(cases, vc)
+	}
+
+	return c.JSON(cases)
+}
+
+// GetVerificationQueue renvoie les dossiers en attente de revue, du plus ancien au plus récent.
+func GetVerificationQueue(c *fiber.Ctx) error {
+	rows, err := db.Query(`
+		SELECT vc.idverificationcase, vc.phonenumber, vc.attempt, vc.idcnifront, vc.idcniback, vc.status, vc.submittedat,
+		       u.FirstName, u.LastName, u.Email, u.ProfilePicture
+		FROM verificationcase vc
+		         JOIN "user" u ON vc.phonenumber = u.phonenumber
+		WHERE vc.status = $1
+		ORDER BY vc.submittedat ASC`, verificationSubmitted)
+	if err != nil {
+		fmt.Println("💥 Error querying the database in GetVerificationQueue() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in GetVerificationQueue() : ", err)
+			return
+		}
+	}(rows)
+
+	type queuedCase struct {
+		VerificationCase
+		FirstName      string  `json:"first_name"`
+		LastName       string  `json:"last_name"`
+		Email          string  `json:"email"`
+		ProfilePicture *string `json:"profile_picture"`
+	}
+
+	queue := []queuedCase{}
+	for rows.Next() {
+		var qc queuedCase
+		err := rows.Scan(&qc.ID, &qc.PhoneNumber, &qc.Attempt, &qc.CniFrontID, &qc.CniBackID, &qc.Status, &qc.SubmittedAt, &qc.FirstName, &qc.LastName, &qc.Email, &qc.ProfilePicture)
+		if err != nil {
+			fmt.Println("💥 Error scanning the rows in GetVerificationQueue() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+
+		phoneNumber := c.Locals("user").(*CustomClaims).PhoneNumber
+		qc.CniFrontURL = documentURL(qc.CniFrontID, phoneNumber)
+		qc.CniBackURL = documentURL(qc.CniBackID, phoneNumber)
+		signProfilePicture(qc.ProfilePicture, phoneNumber)
+		queue = append(queue, qc)
+	}
+
+	return c.JSON(queue)
+}
+
+// ReviewVerification enregistre la décision d'un administrateur sur un dossier et en informe le visiteur.
+func ReviewVerification(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+	if id == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the ID of the verification case",
+		})
+	}
+
+	var decision VerificationDecision
+	if err := c.BodyParser(&decision); err != nil {
+		fmt.Println("💥 Error parsing the body in ReviewVerification() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	decision.Decision = strings.ToUpper(decision.Decision)
+	if decision.Decision != verificationApproved && decision.Decision != verificationRejected && decision.Decision != verificationNeedsResubmission {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The decision must be APPROVED, REJECTED or NEEDS_RESUBMISSION.",
+		})
+	}
+
+	if decision.Decision != verificationApproved && len(decision.ReasonCodes) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide at least one reason code.",
+		})
+	}
+
+	for _, code := range decision.ReasonCodes {
+		if _, ok := verificationReasonCodes[code]; !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Unknown reason code: %s", code),
+			})
+		}
+	}
+
+	if decision.ReasonCodes == nil {
+		decision.ReasonCodes = []string{}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println("💥 Error starting the transaction in ReviewVerification() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in ReviewVerification() : ", err)
+		}
+	}(tx)
+
+	// Only a case still waiting for a review can receive a decision
+	var phoneNumber string
+	err = tx.QueryRow(`
+		UPDATE verificationcase
+		SET status = $1, reasoncodes = $2, comment = $3, reviewer = $4, reviewedat = $5
+		WHERE idverificationcase = $6 AND status = $7
+		RETURNING phonenumber`,
+		decision.Decision, pq.Array(decision.ReasonCodes), decision.Comment, c.Locals("user").(*CustomClaims).PhoneNumber, time.Now(), id, verificationSubmitted,
+	).Scan(&phoneNumber)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "This verification case does not exist or has already been reviewed.",
+			})
+		}
+
+		fmt.Println("💥 Error executing the request in ReviewVerification() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	_, err = tx.Exec(`UPDATE "user" SET Status = $1 WHERE PhoneNumber = $2`, verificationUserStatus[decision.Decision], phoneNumber)
+	if err != nil {
+		fmt.Println("💥 Error executing the request in ReviewVerification() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	// Once the visitor is validated, the documents are only kept for the retention period
+	if decision.Decision == verificationApproved {
+		if err := scheduleIdentityDocumentsPurge(tx, phoneNumber); err != nil {
+			fmt.Println("💥 Error scheduling the documents purge in ReviewVerification() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		fmt.Println("💥 Error committing the transaction in ReviewVerification() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	notifyUser(phoneNumber, verificationMessage(decision))
+
+	comment := ""
+	if decision.Comment != nil {
+		comment = *decision.Comment
+	}
+	emailUser(phoneNumber, "verification."+strings.ToLower(decision.Decision), map[string]interface{}{
+		"ReasonCodes": decision.ReasonCodes,
+		"Comment":     comment,
+	})
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// verificationMessage construit le message envoyé au visiteur après la revue de son dossier.
+func verificationMessage(decision VerificationDecision) string {
+	var reasons []string
+	for _, code := range decision.ReasonCodes {
+		reasons = append(reasons, verificationReasonCodes[code])
+	}
+
+	switch decision.Decision {
+	case verificationApproved:
+		return "Voyo : votre identité a été vérifiée, vous pouvez dès maintenant recevoir des demandes de visite."
+	case verificationNeedsResubmission:
+		return fmt.Sprintf("Voyo : merci de soumettre à nouveau vos pièces d'identité (%s).", strings.Join(reasons, ", "))
+	default:
+		return fmt.Sprintf("Voyo : votre demande de vérification a été refusée (%s).", strings.Join(reasons, ", "))
+	}
+}
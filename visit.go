@@ -2,11 +2,13 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/gofiber/fiber/v2"
-	"math/rand"
+	"github.com/lib/pq"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func CreateVisit(c *fiber.Ctx) error {
@@ -18,7 +20,8 @@ func CreateVisit(c *fiber.Ctx) error {
 
 	type VisitToCreate struct {
 		Visit
-		Criterias []Criteria `json:"criterias"`
+		Criterias  []Criteria `json:"criterias"`
+		IdTemplate *int       `json:"template_id"`
 	}
 
 	var vtc VisitToCreate
@@ -38,6 +41,38 @@ func CreateVisit(c *fiber.Ctx) error {
 
 	// TODO: x or y is empty and if so fill them by doing a request to gmap
 
+	// The criteria of the template are created first, followed by the ones added for this visit
+	if vtc.IdTemplate != nil {
+		templateCriterias, err := getTemplateCriterias(c.Locals("user").(*CustomClaims), *vtc.IdTemplate, vtc.IdTypeRealEstate)
+		if err != nil {
+			if errors.Is(err, errTemplateNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": "Template not found",
+				})
+			}
+			if errors.Is(err, errTemplateWrongType) {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "This template is meant for another type of real estate",
+				})
+			}
+
+			fmt.Println("💥 Error getting the template in CreateVisit() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+
+		vtc.Criterias = append(templateCriterias, vtc.Criterias...)
+	}
+
+	for i := range vtc.Criterias {
+		if err := normalizeCriteriaDefinition(&vtc.Criterias[i]); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Criteria %d: %s", i+1, err.Error()),
+			})
+		}
+	}
+
 	// Check if the user exists
 	if !checkUserExists(vtc.PhoneNumberVisitor) || !checkUserRole(vtc.PhoneNumberVisitor, "VISITOR") {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -48,7 +83,7 @@ func CreateVisit(c *fiber.Ctx) error {
 	// TODO: Check if the user is available or not
 
 	// 1) Prepare the request
-	stmt, err := db.Prepare("INSERT INTO visit (phonenumberprospect, phonenumbervisitor, codeverification, starttime, price, status, note, idaddressgmap, idtyperealestate, x, y) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)")
+	stmt, err := db.Prepare("INSERT INTO visit (phonenumberprospect, phonenumbervisitor, codeverification, codesecret, starttime, price, status, note, idaddressgmap, idtyperealestate, x, y) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)")
 	if err != nil {
 		fmt.Println("💥 Error preparing the SQL statement in CreateVisit() : ", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -56,11 +91,26 @@ func CreateVisit(c *fiber.Ctx) error {
 		})
 	}
 
-	// Generate a random codeverification number for the visit
-	vtc.CodeVerification = rand.Intn(999999-100000) + 100000
+	// Generate the verification code of the visit, and the secret used when the codes rotate
+	vtc.CodeVerification, err = generateVisitCode()
+	if err != nil {
+		fmt.Println("💥 Error generating the verification code in CreateVisit() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	codeSecret, err := generateVisitCodeSecret()
+	if err != nil {
+		fmt.Println("💥 Error generating the verification code secret in CreateVisit() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
 	vtc.Status = "PENDING"
 	// 2) Execute the request
-	_, err = stmt.Exec(c.Locals("user").(*CustomClaims).PhoneNumber, vtc.PhoneNumberVisitor, vtc.CodeVerification, vtc.StartTime, vtc.Price, vtc.Status, vtc.Note, vtc.IdAddressGMap, vtc.IdTypeRealEstate, vtc.X, vtc.Y)
+	_, err = stmt.Exec(c.Locals("user").(*CustomClaims).PhoneNumber, vtc.PhoneNumberVisitor, vtc.CodeVerification, codeSecret, vtc.StartTime, vtc.Price, vtc.Status, vtc.Note, vtc.IdAddressGMap, vtc.IdTypeRealEstate, vtc.X, vtc.Y)
 	if err != nil {
 		fmt.Println("💥 Error executing the SQL statement in CreateVisit() : ", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -88,9 +138,18 @@ func CreateVisit(c *fiber.Ctx) error {
 
 	// Loop through the criterias and insert them in the database
 	for _, crit := range vtc.Criterias {
+		options, err := criteriaOptionsValue(crit.Options)
+		if err != nil {
+			fmt.Println("💥 Error encoding the options in CreateVisit() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+
 		stmt, err := db.Prepare(`
-				INSERT INTO criteria (criteria, criteriaAnswer, photoRequired, photo, videoRequired, video, phoneNumber, reusable)
-				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+				INSERT INTO criteria (criteria, criteriaType, options, photoRequired, videoRequired, phoneNumber, reusable)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)
+				RETURNING idcriteria
 			`)
 		if err != nil {
 			fmt.Println("💥 Error preparing the SQL statement in CreateCriteria() : ", err)
@@ -107,16 +166,17 @@ func CreateVisit(c *fiber.Ctx) error {
 			}
 		}(stmt)
 
-		_, err = stmt.Exec(
+		// Get the new criteria id
+		var idCriteria int
+		err = stmt.QueryRow(
 			crit.Criteria,
-			crit.CriteriaAnswer,
+			crit.Type,
+			options,
 			crit.PhotoRequired,
-			crit.Photo,
 			crit.VideoRequired,
-			crit.Video,
 			c.Locals("user").(*CustomClaims).PhoneNumber, // Retrieve the phone number from the context (middleware
 			crit.Reusable,
-		)
+		).Scan(&idCriteria)
 		if err != nil {
 			fmt.Println("💥 Error executing the SQL statement in CreateCriteria() : ", err)
 			if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
@@ -129,24 +189,6 @@ func CreateVisit(c *fiber.Ctx) error {
 			})
 		}
 
-		// Get the new criteria id
-		row := db.QueryRow("SELECT idcriteria FROM criteria WHERE criteria = $1 AND criteriaanswer = $2 AND photo = $3 AND video = $4 AND phonenumber = $5", crit.Criteria, crit.CriteriaAnswer, crit.Photo, crit.Video, c.Locals("user").(*CustomClaims).PhoneNumber)
-		if err != nil {
-			fmt.Println("💥 Error querying the database in CreateVisit() : ", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "An error has occurred, please try again later.",
-			})
-		}
-
-		var idCriteria int
-		err = row.Scan(&idCriteria)
-		if err != nil {
-			fmt.Println("💥 Error scanning the row in CreateVisit() : ", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "An error has occurred, please try again later.",
-			})
-		}
-
 		// Insert the link between the criteria and the visit
 		stmt, err = db.Prepare("INSERT INTO linkcriteriavisit (idcriteria, idvisit) VALUES ($1, $2)")
 		if err != nil {
@@ -173,6 +215,9 @@ func CreateVisit(c *fiber.Ctx) error {
 		}
 	}
 
+	go notifyVisitEvent(strconv.Itoa(id), pushVisitCreated, "")
+	go emailVisit(strconv.Itoa(id), "visit.booked", []string{"PROSPECT", "VISITOR"}, nil)
+
 	return c.Status(fiber.StatusCreated).SendString("Visit created successfully")
 }
 
@@ -237,7 +282,7 @@ func GetVisitsList(c *fiber.Ctx) error {
 		FROM visit
 		         JOIN public."user" u ON visit.%s = u.phonenumber
 		         JOIN typerealestate t ON visit.idtyperealestate = t.idtyperealestate
-		WHERE %s = '%s' AND visit.Status %s IN ('PENDING', 'ACCEPTED')
+		WHERE %s = '%s' AND %s (visit.Status = 'ACCEPTED' OR (visit.Status = 'PENDING' AND StartTime > NOW()))
 		ORDER BY StartTime ASC
 `, searchString2, searchString, phoneNumber, isNot)
 
@@ -293,93 +338,134 @@ func GetVisitsList(c *fiber.Ctx) error {
 	return c.JSON(visits)
 }
 
+// getVisitDetails rassemble le détail d'une visite (adresse, visiteur, déroulement et critères) tel que le voit
+// l'utilisateur connecté.
+func getVisitDetails(id string, claims *CustomClaims) (visitDetails, error) {
+	request := fmt.Sprintf(`
+	SELECT idvisit,
+	       v.idaddressgmap,
+	       Date(StartTime)                                                       AS Date,
+	       TO_CHAR(StartTime, 'HH24hMI')                                         AS StartTime,
+	       TO_CHAR(starttime + tr.duration, 'HH24hMI')                           AS EndTime,
+	       tr.duration,
+	       v.Status,
+	       FirstName,
+	       UPPER(CONCAT(LEFT(LastName, 1), '.'))                                 AS LastName,
+	       profilepicture,
+	       vc.count                                                              AS VisitCount,
+	       (SELECT COUNT(*) FROM visitcancellation WHERE cancelledby = v.phonenumbervisitor AND counted) AS CancellationCount,
+	       %[2]s,
+	       COALESCE(navg.avg, 0)                                                              AS NoteAvg,
+	       price,
+	       note,
+	       v.codeverification,
+	       CASE WHEN v.status NOT IN ('DONE', 'ACCEPTED') THEN FALSE ELSE TRUE END AS VisitAccepted,
+	       CASE
+	           WHEN (SELECT COUNT(idVisit) FROM public.linkcriteriavisit WHERE idVisit = %[1]s) > 0 THEN TRUE
+	           ELSE FALSE END                                                    AS CriteriaSent
+	FROM visit v
+	         JOIN public.typerealestate tr ON v.idtyperealestate = tr.idtyperealestate
+	         JOIN public."user" u ON v.phonenumbervisitor = u.phonenumber
+	         JOIN (SELECT COUNT(idvisit) AS count
+	               FROM public.visit
+	               WHERE phonenumbervisitor = (SELECT phonenumbervisitor FROM visit WHERE idvisit = %[1]s)
+	                 AND status = 'DONE') AS vc ON TRUE
+	         JOIN (SELECT AVG(note) AS avg
+	               FROM public.visit
+	               WHERE phonenumbervisitor = (SELECT phonenumbervisitor FROM visit WHERE idvisit = %[1]s)
+	                 AND status = 'DONE'
+	                 AND note != 0.0) AS navg ON TRUE
+	WHERE idvisit = %[1]s;`,
+		id, visitorResponseStatsSQL("v.phonenumbervisitor"))
+
+	row := db.QueryRow(request)
+
+	var visit visitDetails
+	err := row.Scan(&visit.Visit.IDVisit, &visit.Visit.Address.IdAddressGmap, &visit.Visit.Details.Date, &visit.Visit.Details.StartTime, &visit.Visit.Details.EndTime, &visit.Visit.Details.Duration, &visit.Visit.Details.Status, &visit.Visitor.FirstName, &visit.Visitor.LastName, &visit.Visitor.ProfilePicture, &visit.Visitor.VisitCount, &visit.Visitor.Cancellations, &visit.Visitor.ExpiredCount, &visit.Visitor.ResponseHours, &visit.Visitor.NoteAVG, &visit.Visit.Details.Price, &visit.Visit.Details.Note, &visit.Visit.Details.Code, &visit.Visit.Details.VisitAccepted, &visit.Visit.Details.CriteriaSent)
+	if err != nil {
+		return visit, err
+	}
+
+	visit.Visit.Address.googleMapsResponse, _ = getAddressFromGMapsID(visit.Visit.Address.IdAddressGmap)
+	visit.Visitor.ProfilePicture = profilePictureURL(visit.Visitor.ProfilePicture, claims.PhoneNumber)
+	visit.Visitor.Reliability = float32(visitorReliability(visit.Visitor.VisitCount, visit.Visitor.Cancellations))
+
+	// The financial outcome of the cancellation is shown to both the prospect and the visitor
+	if visit.Visit.Details.Status == "CANCELLED" {
+		visit.Visit.Details.Cancellation, err = getVisitCancellation(id)
+		if err != nil {
+			return visit, err
+		}
+	}
+
+	// The reschedule proposals exchanged by the prospect and the visitor
+	visit.Visit.Details.Proposals, err = getVisitProposals(id)
+	if err != nil {
+		return visit, err
+	}
+
+	// Actual time on site, to compare with the planned duration of the type of real estate
+	visit.Visit.Details.CheckIn, visit.Visit.Details.CheckOut, visit.Visit.Details.TimeOnSite, err = getVisitChecks(id)
+	if err != nil {
+		return visit, err
+	}
+
+	if claims.Role == "VISITOR" && visit.Visit.Details.Status != "DONE" {
+		visit.Visit.Details.Code = 0
+	} else if state, err := getVisitCodeState(id); err == nil {
+		visit.Visit.Details.Code = state.currentCode(time.Now())
+	}
+
+	// Select all criterias for the visit
+	rows, err := db.Query("SELECT criteria.idcriteria, criteria.criteria, criteriatype, options, criteriaanswer, answer, photorequired, videorequired, evidenceflags FROM public.criteria join public.linkcriteriavisit on criteria.idcriteria = linkcriteriavisit.idcriteria where idvisit = $1", id)
+	if err != nil {
+		return visit, err
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in getVisitDetails() : ", err)
+			return
+		}
+	}(rows)
+
+	for rows.Next() {
+		var crit Criteria
+		var options, answer []byte
+		err := rows.Scan(&crit.ID, &crit.Criteria, &crit.Type, &options, &crit.CriteriaAnswer, &answer, &crit.PhotoRequired, &crit.VideoRequired, pq.Array(&crit.EvidenceFlags))
+		if err == nil {
+			err = scanCriteriaTyping(&crit, options, answer)
+		}
+		if err != nil {
+			return visit, err
+		}
+
+		visit.Visit.Criterias = append(visit.Visit.Criterias, crit)
+	}
+
+	if err := rows.Err(); err != nil {
+		return visit, err
+	}
+
+	err = fillCriteriaMedia(visit.Visit.Criterias, claims.PhoneNumber)
+	return visit, err
+
+}
+
 func GetVisit(c *fiber.Ctx) error {
 	id := strings.TrimSpace(c.Query("id"))
 
 	if id != "" {
 		if hasAuthorizedVisitAccess(c.Locals("user").(*CustomClaims).PhoneNumber, id) {
-			request := fmt.Sprintf(`
-			SELECT idvisit,
-			       v.idaddressgmap,
-			       Date(StartTime)                                                       AS Date,
-			       TO_CHAR(StartTime, 'HH24hMI')                                         AS StartTime,
-			       TO_CHAR(starttime + tr.duration, 'HH24hMI')                           AS EndTime,
-			       tr.duration,
-			       v.Status,
-			       FirstName,
-			       UPPER(CONCAT(LEFT(LastName, 1), '.'))                                 AS LastName,
-			       profilepicture,
-			       vc.count                                                              AS VisitCount,
-			       COALESCE(navg.avg, 0)                                                              AS NoteAvg,
-			       price,
-			       note,
-			       v.codeverification,
-			       CASE WHEN v.status NOT IN ('DONE', 'ACCEPTED') THEN FALSE ELSE TRUE END AS VisitAccepted,
-			       CASE
-			           WHEN (SELECT COUNT(idVisit) FROM public.linkcriteriavisit WHERE idVisit = %[1]s) > 0 THEN TRUE
-			           ELSE FALSE END                                                    AS CriteriaSent
-			FROM visit v
-			         JOIN public.typerealestate tr ON v.idtyperealestate = tr.idtyperealestate
-			         JOIN public."user" u ON v.phonenumbervisitor = u.phonenumber
-			         JOIN (SELECT COUNT(idvisit) AS count
-			               FROM public.visit
-			               WHERE phonenumbervisitor = (SELECT phonenumbervisitor FROM visit WHERE idvisit = %[1]s)
-			                 AND status = 'DONE') AS vc ON TRUE
-			         JOIN (SELECT AVG(note) AS avg
-			               FROM public.visit
-			               WHERE phonenumbervisitor = (SELECT phonenumbervisitor FROM visit WHERE idvisit = %[1]s)
-			                 AND status = 'DONE'
-			                 AND note != 0.0) AS navg ON TRUE
-			WHERE idvisit = %[1]s;`,
-				id)
-
-			row := db.QueryRow(request)
-
-			var visit visitDetails
-			err := row.Scan(&visit.Visit.IDVisit, &visit.Visit.Address.IdAddressGmap, &visit.Visit.Details.Date, &visit.Visit.Details.StartTime, &visit.Visit.Details.EndTime, &visit.Visit.Details.Duration, &visit.Visit.Details.Status, &visit.Visitor.FirstName, &visit.Visitor.LastName, &visit.Visitor.ProfilePicture, &visit.Visitor.VisitCount, &visit.Visitor.NoteAVG, &visit.Visit.Details.Price, &visit.Visit.Details.Note, &visit.Visit.Details.Code, &visit.Visit.Details.VisitAccepted, &visit.Visit.Details.CriteriaSent)
-			if err != nil {
-				fmt.Println("💥 Error scanning the row in GetVisit() : ", err)
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error": "An error has occurred, please try again later.",
-				})
-			}
-
-			visit.Visit.Address.googleMapsResponse, _ = getAddressFromGMapsID(visit.Visit.Address.IdAddressGmap)
-
-			if c.Locals("user").(*CustomClaims).Role == "VISITOR" && visit.Visit.Details.Status != "DONE" {
-				visit.Visit.Details.Code = 0
-			}
-
-			// Select all criterias for the visit
-			rows, err := db.Query("SELECT criteria.idcriteria, criteria.criteria, criteriaanswer, photo, video, photorequired, videorequired FROM public.criteria join public.linkcriteriavisit on criteria.idcriteria = linkcriteriavisit.idcriteria where idvisit = $1", id)
+			visit, err := getVisitDetails(id, c.Locals("user").(*CustomClaims))
 			if err != nil {
-				fmt.Println("💥 Error querying the database in GetVisit() : ", err)
+				fmt.Println("💥 Error getting the visit in GetVisit() : ", err)
 				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 					"error": "An error has occurred, please try again later.",
 				})
 			}
 
-			defer func(rows *sql.Rows) {
-				err := rows.Close()
-				if err != nil {
-					fmt.Println("💥 Error closing the rows in GetVisit() : ", err)
-					return
-				}
-			}(rows)
-
-			for rows.Next() {
-				var crit Criteria
-				err := rows.Scan(&crit.ID, &crit.Criteria, &crit.CriteriaAnswer, &crit.Photo, &crit.Video, &crit.PhotoRequired, &crit.VideoRequired)
-				if err != nil {
-					fmt.Println("💥 Error scanning the rows in GetVisit() : ", err)
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-						"error": "An error has occurred, please try again later.",
-					})
-				}
-
-				visit.Visit.Criterias = append(visit.Visit.Criterias, crit)
-			}
-
 			return c.JSON(visit)
 		} else {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
@@ -429,6 +515,12 @@ func GetVisit(c *fiber.Ctx) error {
 	}
 }
 
+// Changements de statut possibles avec UpdateVisit, et statuts depuis lesquels ils le sont. Les annulations, les
+// réponses du visiteur et les reprogrammations passent par leurs propres règles.
+var visitStatusTransitions = map[string][]string{
+	"DONE": {"ACCEPTED"},
+}
+
 func UpdateVisit(c *fiber.Ctx) error {
 	id := strings.TrimSpace(c.Query("id"))
 
@@ -463,12 +555,47 @@ func UpdateVisit(c *fiber.Ctx) error {
 		})
 	}
 
-	var updateQuery string
+	var updateQuery, condition string
 	var args []interface{}
+	var fromStatuses []string
 
 	placeholderIndex := 1 // Start with placeholder index 1
 
+	// A cancellation goes through the cancellation policy, which computes its fee and refund
+	if visit.Status == "CANCELLED" {
+		return cancelVisitResponse(c, id, "")
+	}
+
+	// Only the visitor answers a visit request, as long as it has not expired
+	if visit.Status == "ACCEPTED" || visit.Status == "REFUSED" {
+		return respondToVisitResponse(c, id, visit.Status)
+	}
+
 	if visit.Status != "" {
+		var ok bool
+		if fromStatuses, ok = visitStatusTransitions[visit.Status]; !ok {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "The visit cannot be changed to this status",
+			})
+		}
+
+		// A visit can only be closed once every criteria has been completed
+		if visit.Status == "DONE" {
+			report, err := getVisitCompletion(id)
+			if err != nil {
+				fmt.Println("💥 Error getting the completion in UpdateVisit() : ", err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "An error has occurred, please try again later.",
+				})
+			}
+
+			if !report.Complete {
+				return visitIncompleteResponse(c, report)
+			}
+
+			updateQuery += "completedat=COALESCE(completedat, NOW()), "
+		}
+
 		updateQuery += fmt.Sprintf("Status=$%d, ", placeholderIndex)
 		args = append(args, visit.Status)
 		placeholderIndex++
@@ -483,8 +610,16 @@ func UpdateVisit(c *fiber.Ctx) error {
 	// Remove the trailing comma and space
 	updateQuery = strings.TrimSuffix(updateQuery, ", ")
 
-	query := fmt.Sprintf("UPDATE visit SET %s WHERE idvisit=$%d", updateQuery, len(args)+1)
+	// The current status is checked in the same statement so that a concurrent change cannot be overwritten
+	if visit.Status != "" {
+		condition = fmt.Sprintf(" AND status = ANY($%d)", len(args)+2)
+	}
+
+	query := fmt.Sprintf("UPDATE visit SET %s WHERE idvisit=$%d%s", updateQuery, len(args)+1, condition)
 	args = append(args, id)
+	if condition != "" {
+		args = append(args, pq.Array(fromStatuses))
+	}
 
 	stmt, err := db.Prepare(query)
 	if err != nil {
@@ -500,7 +635,7 @@ func UpdateVisit(c *fiber.Ctx) error {
 		}
 	}(stmt)
 
-	_, err = stmt.Exec(args...)
+	result, err := stmt.Exec(args...)
 	if err != nil {
 		fmt.Println("💥 Error executing the SQL statement in UpdateVisit() : ", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -508,6 +643,25 @@ func UpdateVisit(c *fiber.Ctx) error {
 		})
 	}
 
+	if updated, _ := result.RowsAffected(); updated == 0 && condition != "" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The visit cannot be changed to this status from its current status",
+		})
+	}
+
+	// A visit closed without the verification code is announced like one closed with it
+	if visit.Status == "DONE" {
+		go notifyVisitEvent(id, pushCodeVerified, "")
+		go emailVisit(id, "visit.report_ready", []string{"PROSPECT"}, nil)
+	}
+
+	// The report shows the rating, so it is generated again with the new one
+	if visit.Note != 0 {
+		if err := invalidateVisitReport(id); err != nil {
+			fmt.Println("💥 Error invalidating the report in UpdateVisit() : ", err)
+		}
+	}
+
 	return c.SendStatus(fiber.StatusNoContent)
 }
 
@@ -526,10 +680,7 @@ func GetVisitVerificationCode(c *fiber.Ctx) error {
 		})
 	}
 
-	row := db.QueryRow("SELECT codeverification FROM visit WHERE idvisit = $1", idVisit)
-
-	var code int
-	err := row.Scan(&code)
+	state, err := getVisitCodeState(idVisit)
 	if err != nil {
 		fmt.Println("💥 Error scanning the row in GetVisitVerificationCode() : ", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -538,10 +689,65 @@ func GetVisitVerificationCode(c *fiber.Ctx) error {
 	}
 
 	return c.JSON(fiber.Map{
-		"code": code,
+		"code":         state.currentCode(time.Now()),
+		"rotating":     state.totpEnabled(),
+		"valid_from":   state.WindowStart,
+		"valid_until":  state.WindowEnd,
+		"locked":       state.Attempts >= visitCodeMaxAttempts(),
+		"attempts":     state.Attempts,
+		"max_attempts": visitCodeMaxAttempts(),
 	})
 }
 
+// ResetVisitVerificationCode génère un nouveau code pour une visite, par exemple après un blocage. Réservé au prospect.
+func ResetVisitVerificationCode(c *fiber.Ctx) error {
+	idVisit := c.Query("idVisit")
+
+	if idVisit == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the ID of the visit",
+		})
+	}
+
+	if !hasAuthorizedVisitAccess(c.Locals("user").(*CustomClaims).PhoneNumber, idVisit) || c.Locals("user").(*CustomClaims).Role != "PROSPECT" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized access",
+		})
+	}
+
+	code, err := generateVisitCode()
+	if err != nil {
+		fmt.Println("💥 Error generating the verification code in ResetVisitVerificationCode() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	secret, err := generateVisitCodeSecret()
+	if err != nil {
+		fmt.Println("💥 Error generating the verification code secret in ResetVisitVerificationCode() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	result, err := db.Exec(`UPDATE visit SET codeverification = $1, codesecret = $2, codeattempts = 0 WHERE idvisit = $3 AND status NOT IN ('DONE', 'CANCELLED')`, code, secret, idVisit)
+	if err != nil {
+		fmt.Println("💥 Error executing the request in ResetVisitVerificationCode() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The verification code of this visit cannot be changed anymore",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
 func CheckVisitVerificationCode(c *fiber.Ctx) error {
 	idVisit := c.Query("idVisit")
 	code := c.Query("code")
@@ -558,10 +764,7 @@ func CheckVisitVerificationCode(c *fiber.Ctx) error {
 		})
 	}
 
-	row := db.QueryRow("SELECT codeverification FROM visit WHERE idvisit = $1", idVisit)
-
-	var dbCode int
-	err := row.Scan(&dbCode)
+	state, err := getVisitCodeState(idVisit)
 	if err != nil {
 		fmt.Println("💥 Error scanning the row in CheckVisitVerificationCode() : ", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -569,13 +772,75 @@ func CheckVisitVerificationCode(c *fiber.Ctx) error {
 		})
 	}
 
-	if strconv.Itoa(dbCode) == code {
-		return c.SendStatus(fiber.StatusNoContent)
+	if state.Status != "ACCEPTED" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The verification code can only be checked for an accepted visit",
+		})
 	}
 
-	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-		"error": "The verification code is incorrect",
-	})
+	if state.Attempts >= visitCodeMaxAttempts() {
+		return c.Status(fiber.StatusLocked).JSON(fiber.Map{
+			"error": "Too many failed attempts, the prospect must generate a new code",
+		})
+	}
+
+	now := time.Now()
+	if !state.inWindow(now) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "The verification code can only be used around the time of the visit",
+		})
+	}
+
+	// Checked before the code so that an incomplete visit does not use up the attempts
+	report, err := getVisitCompletion(idVisit)
+	if err != nil {
+		fmt.Println("💥 Error getting the completion in CheckVisitVerificationCode() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if !report.Complete {
+		return visitIncompleteResponse(c, report)
+	}
+
+	// The attempt is reserved before comparing the code so that concurrent requests cannot exceed the limit
+	var attempts int
+	err = db.QueryRow("UPDATE visit SET codeattempts = codeattempts + 1 WHERE idvisit = $1 AND codeattempts < $2 RETURNING codeattempts",
+		idVisit, visitCodeMaxAttempts()).Scan(&attempts)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(fiber.StatusLocked).JSON(fiber.Map{
+				"error": "Too many failed attempts, the prospect must generate a new code",
+			})
+		}
+
+		fmt.Println("💥 Error counting the attempt in CheckVisitVerificationCode() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if !state.matches(code, now) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error":              "The verification code is incorrect",
+			"remaining_attempts": max(visitCodeMaxAttempts()-attempts, 0),
+		})
+	}
+
+	// The visit is completed as soon as the code has been checked
+	_, err = db.Exec("UPDATE visit SET status = 'DONE', completedat = NOW(), codeattempts = 0 WHERE idvisit = $1 AND status = 'ACCEPTED'", idVisit)
+	if err != nil {
+		fmt.Println("💥 Error completing the visit in CheckVisitVerificationCode() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	go notifyVisitEvent(idVisit, pushCodeVerified, "")
+	go emailVisit(idVisit, "visit.report_ready", []string{"PROSPECT"}, nil)
+
+	return c.SendStatus(fiber.StatusNoContent)
 }
 
 func GetUserEmailByPhoneNumber(c *fiber.Ctx) error {
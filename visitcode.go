@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// generateVisitCode tire un code de vérification à 6 chiffres avec un générateur cryptographique.
+func generateVisitCode() (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(900000))
+	if err != nil {
+		return 0, err
+	}
+	return int(n.Int64()) + 100000, nil
+}
+
+// generateVisitCodeSecret génère le secret utilisé pour les codes tournants (mode TOTP).
+func generateVisitCodeSecret() ([]byte, error) {
+	secret := make([]byte, 20)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// visitCodeTOTPEnabled indique si les codes de visite tournent dans le temps (VISIT_CODE_MODE=totp).
+func visitCodeTOTPEnabled() bool {
+	return strings.ToLower(os.Getenv("VISIT_CODE_MODE")) == "totp"
+}
+
+// visitCodeTOTPStep renvoie la durée de validité d'un code tournant (VISIT_CODE_TOTP_STEP).
+func visitCodeTOTPStep() time.Duration {
+	return getEnvDuration("VISIT_CODE_TOTP_STEP", 5*time.Minute)
+}
+
+// checkVisitCodeConfig vérifie la configuration des codes de visite au démarrage du serveur.
+func checkVisitCodeConfig() error {
+	if step := visitCodeTOTPStep(); step < time.Second {
+		return fmt.Errorf("VISIT_CODE_TOTP_STEP must be at least 1s, got %s", step)
+	}
+	return nil
+}
+
+// totpCode calcule le code à 6 chiffres de la période contenant t (RFC 6238).
+func totpCode(secret []byte, t time.Time, step time.Duration) int {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(t.Unix()/int64(step.Seconds())))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return int(value%900000) + 100000
+}
+
+// visitCodeState regroupe ce qu'il faut savoir d'une visite pour vérifier son code.
+type visitCodeState struct {
+	Code        int
+	Secret      []byte
+	Attempts    int
+	Status      string
+	WindowStart time.Time
+	WindowEnd   time.Time
+}
+
+// getVisitCodeState charge le code d'une visite et sa fenêtre de validité, autour de l'heure de début et de la durée
+// prévue pour le type de bien.
+func getVisitCodeState(idVisit string) (visitCodeState, error) {
+	var state visitCodeState
+	var start, end time.Time
+	err := db.QueryRow(`
+		SELECT v.codeverification, v.codesecret, v.codeattempts, v.status, v.starttime, v.starttime + tr.duration
+		FROM visit v
+		         JOIN typerealestate tr ON v.idtyperealestate = tr.idtyperealestate
+		WHERE v.idvisit = $1`, idVisit).Scan(&state.Code, &state.Secret, &state.Attempts, &state.Status, &start, &end)
+	if err != nil {
+		return state, err
+	}
+
+	state.WindowStart = start.Add(-getEnvDuration("VISIT_CODE_WINDOW_BEFORE", 30*time.Minute))
+	state.WindowEnd = end.Add(getEnvDuration("VISIT_CODE_WINDOW_AFTER", 2*time.Hour))
+	return state, nil
+}
+
+// totpEnabled indique si cette visite utilise un code tournant.
+func (s visitCodeState) totpEnabled() bool {
+	return visitCodeTOTPEnabled() && len(s.Secret) > 0
+}
+
+// currentCode renvoie le code à communiquer au visiteur à l'instant now.
+func (s visitCodeState) currentCode(now time.Time) int {
+	if s.totpEnabled() {
+		return totpCode(s.Secret, now, visitCodeTOTPStep())
+	}
+	return s.Code
+}
+
+// matches vérifie un code saisi. En mode TOTP, le code de la période précédente est aussi accepté.
+func (s visitCodeState) matches(code string, now time.Time) bool {
+	candidates := []int{s.currentCode(now)}
+	if s.totpEnabled() {
+		candidates = append(candidates, s.currentCode(now.Add(-visitCodeTOTPStep())))
+	}
+
+	for _, candidate := range candidates {
+		if subtle.ConstantTimeCompare([]byte(fmt.Sprintf("%06d", candidate)), []byte(strings.TrimSpace(code))) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// inWindow indique si le code peut être utilisé à l'instant now.
+func (s visitCodeState) inWindow(now time.Time) bool {
+	return !now.Before(s.WindowStart) && !now.After(s.WindowEnd)
+}
+
+// visitCodeMaxAttempts renvoie le nombre d'essais avant le blocage du code (VISIT_CODE_MAX_ATTEMPTS).
+func visitCodeMaxAttempts() int {
+	return getEnvInt("VISIT_CODE_MAX_ATTEMPTS", 5)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTotpCode(t *testing.T) {
+	// Truncated HMAC values of RFC 4226 (appendix D) for this secret: 1284755224, 1094287082, 137359152
+	secret := []byte("12345678901234567890")
+
+	tests := []struct {
+		name string
+		t    time.Time
+		step time.Duration
+		want int
+	}{
+		{"first period", time.Unix(0, 0), 30 * time.Second, 555224},
+		{"end of the first period", time.Unix(29, 0), 30 * time.Second, 555224},
+		{"second period", time.Unix(30, 0), 30 * time.Second, 887082},
+		{"third period", time.Unix(60, 0), 30 * time.Second, 659152},
+		{"longer step", time.Unix(299, 0), 5 * time.Minute, 555224},
+		{"next longer step", time.Unix(300, 0), 5 * time.Minute, 887082},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := totpCode(secret, tt.t, tt.step)
+			if got != tt.want {
+				t.Errorf("totpCode() = %d, want %d", got, tt.want)
+			}
+			if got < 100000 || got > 999999 {
+				t.Errorf("totpCode() = %d, want 6 digits", got)
+			}
+		})
+	}
+}
+
+func TestVisitCodeMatches(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(75, 0) // Third period with a 30s step
+
+	tests := []struct {
+		name  string
+		mode  string
+		state visitCodeState
+		code  string
+		want  bool
+	}{
+		{"fixed code", "", visitCodeState{Code: 123456}, "123456", true},
+		{"fixed code with spaces", "", visitCodeState{Code: 123456}, " 123456 ", true},
+		{"wrong fixed code", "", visitCodeState{Code: 123456}, "654321", false},
+		{"fixed code with leading zeros", "", visitCodeState{Code: 42}, "000042", true},
+		{"empty code", "", visitCodeState{Code: 123456}, "", false},
+		{"secret ignored without the TOTP mode", "", visitCodeState{Code: 123456, Secret: secret}, "659152", false},
+		{"current period", "totp", visitCodeState{Code: 123456, Secret: secret}, "659152", true},
+		{"previous period", "totp", visitCodeState{Code: 123456, Secret: secret}, "887082", true},
+		{"two periods ago", "totp", visitCodeState{Code: 123456, Secret: secret}, "555224", false},
+		{"fixed code in the TOTP mode", "totp", visitCodeState{Code: 123456, Secret: secret}, "123456", false},
+		{"visit created before the TOTP mode", "totp", visitCodeState{Code: 123456}, "123456", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("VISIT_CODE_MODE", tt.mode)
+			t.Setenv("VISIT_CODE_TOTP_STEP", "30s")
+
+			if got := tt.state.matches(tt.code, now); got != tt.want {
+				t.Errorf("matches(%q) = %v, want %v", tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckVisitCodeConfig(t *testing.T) {
+	tests := []struct {
+		step    string
+		wantErr bool
+	}{
+		{"", false},
+		{"30s", false},
+		{"1s", false},
+		{"500ms", true},
+		{"0s", true},
+		{"-5m", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.step, func(t *testing.T) {
+			t.Setenv("VISIT_CODE_TOTP_STEP", tt.step)
+			if err := checkVisitCodeConfig(); (err != nil) != tt.wantErr {
+				t.Errorf("checkVisitCodeConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
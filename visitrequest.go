@@ -0,0 +1,523 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errVisitRequestNotFound = errors.New("visit request not found")
+var errVisitRequestClosed = errors.New("visit request closed")
+var errVisitRequestSlot = errors.New("start time outside of the visit request")
+var errVisitorNotEligible = errors.New("visitor not eligible")
+
+// visitorAvailableSQL renvoie la condition SQL vérifiant qu'une visite commençant à start et durant duration fait
+// partie des disponibilités du visiteur phone.
+func visitorAvailableSQL(phone string, start string, duration string) string {
+	return fmt.Sprintf(`EXISTS(SELECT 1
+		              FROM availability a
+		              WHERE a.phonenumber = %[1]s
+		                AND CASE a.repeat
+		                        WHEN 'DAILY' THEN a.availability::date <= %[2]s::date
+		                        WHEN 'WEEKLY' THEN a.availability::date <= %[2]s::date
+		                            AND EXTRACT(DOW FROM a.availability) = EXTRACT(DOW FROM %[2]s)
+		                        WHEN 'MONTHLY' THEN a.availability::date <= %[2]s::date
+		                            AND EXTRACT(DAY FROM a.availability) = EXTRACT(DAY FROM %[2]s)
+		                        WHEN 'YEARLY' THEN a.availability::date <= %[2]s::date
+		                            AND TO_CHAR(a.availability, 'MM-DD') = TO_CHAR(%[2]s, 'MM-DD')
+		                        ELSE a.availability::date = %[2]s::date
+		                  END
+		                AND a.availability::time <= %[2]s::time
+		                AND a.availability::time + a.duration::interval >= %[2]s::time + %[3]s)`, phone, start, duration)
+}
+
+// visitorBusySQL renvoie la condition SQL vérifiant que le visiteur phone a déjà une visite, autre que excludedVisit,
+// qui chevauche une visite commençant à start et durant duration.
+func visitorBusySQL(phone string, start string, duration string, excludedVisit string) string {
+	return fmt.Sprintf(`EXISTS(SELECT 1
+		              FROM visit o
+		                       JOIN typerealestate otr ON o.idtyperealestate = otr.idtyperealestate
+		              WHERE o.phonenumbervisitor = %[1]s
+		                AND o.idvisit != %[4]s
+		                AND o.status IN ('PENDING', 'ACCEPTED')
+		                AND o.starttime < %[2]s + %[3]s
+		                AND o.starttime + otr.duration > %[2]s)`, phone, start, duration, excludedVisit)
+}
+
+// insertVisitCriterias crée les critères d'une visite ou d'une demande de visite et renvoie leurs identifiants.
+func insertVisitCriterias(tx *sql.Tx, phoneNumber string, criterias []Criteria) ([]int, error) {
+	ids := make([]int, 0, len(criterias))
+	for _, crit := range criterias {
+		options, err := criteriaOptionsValue(crit.Options)
+		if err != nil {
+			return nil, err
+		}
+
+		var idCriteria int
+		err = tx.QueryRow(`
+			INSERT INTO criteria (criteria, criteriaType, options, photoRequired, videoRequired, phoneNumber, reusable)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING idcriteria`,
+			crit.Criteria, crit.Type, options, crit.PhotoRequired, crit.VideoRequired, phoneNumber, crit.Reusable).Scan(&idCriteria)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, idCriteria)
+	}
+
+	return ids, nil
+}
+
+// CreateVisitRequest publie une demande de visite ouverte, sans choisir de visiteur : l'adresse, le créneau pendant
+// lequel la visite peut avoir lieu, le type de bien, les critères et le prix maximal.
+func CreateVisitRequest(c *fiber.Ctx) error {
+	claims := c.Locals("user").(*CustomClaims)
+
+	var body struct {
+		IdAddressGMap    string     `json:"address_id"`
+		X                float64    `json:"x"`
+		Y                float64    `json:"y"`
+		IdTypeRealEstate int        `json:"type_real_estate_id"`
+		WindowStart      time.Time  `json:"window_start"`
+		WindowEnd        time.Time  `json:"window_end"`
+		MaxPrice         float64    `json:"max_price"`
+		Note             string     `json:"note"`
+		Criterias        []Criteria `json:"criterias"`
+		IdTemplate       *int       `json:"template_id"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide a valid visit request",
+		})
+	}
+
+	if (body.X == 0 && body.Y == 0) || body.IdTypeRealEstate == 0 || body.WindowStart.IsZero() || body.WindowEnd.IsZero() || body.MaxPrice <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide all the required fields.",
+		})
+	}
+
+	maxWindow := time.Duration(getEnvInt("VISIT_REQUEST_MAX_DAYS", 14)) * 24 * time.Hour
+	if !body.WindowStart.After(time.Now()) || body.WindowEnd.Sub(body.WindowStart) > maxWindow {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("The time window must start in the future and last at most %d days", int(maxWindow.Hours()/24)),
+		})
+	}
+
+	var note *string
+	if trimmed := strings.TrimSpace(body.Note); trimmed != "" {
+		if len([]rune(trimmed)) > 500 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "The note must not exceed 500 characters",
+			})
+		}
+		note = &trimmed
+	}
+
+	// The window must be long enough for a visit of this type of real estate
+	var fits bool
+	err := db.QueryRow(`SELECT $2::timestamp + duration <= $3::timestamp FROM typerealestate WHERE idtyperealestate = $1`,
+		body.IdTypeRealEstate, body.WindowStart, body.WindowEnd).Scan(&fits)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		fmt.Println("💥 Error checking the time window in CreateVisitRequest() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "This type of real estate does not exist",
+		})
+	}
+	if !fits {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The time window is too short for a visit of this type of real estate",
+		})
+	}
+
+	// The criteria of the template are created first, followed by the ones added for this request
+	if body.IdTemplate != nil {
+		templateCriterias, err := getTemplateCriterias(claims, *body.IdTemplate, body.IdTypeRealEstate)
+		if err != nil {
+			if errors.Is(err, errTemplateNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": "Template not found",
+				})
+			}
+			if errors.Is(err, errTemplateWrongType) {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "This template is meant for another type of real estate",
+				})
+			}
+
+			fmt.Println("💥 Error getting the template in CreateVisitRequest() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+
+		body.Criterias = append(templateCriterias, body.Criterias...)
+	}
+
+	for i := range body.Criterias {
+		if err := normalizeCriteriaDefinition(&body.Criterias[i]); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Criteria %d: %s", i+1, err.Error()),
+			})
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println("💥 Error starting the transaction in CreateVisitRequest() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in CreateVisitRequest() : ", err)
+		}
+	}(tx)
+
+	request := VisitRequest{
+		IdAddressGMap:    body.IdAddressGMap,
+		X:                body.X,
+		Y:                body.Y,
+		IdTypeRealEstate: body.IdTypeRealEstate,
+		WindowStart:      body.WindowStart,
+		WindowEnd:        body.WindowEnd,
+		MaxPrice:         body.MaxPrice,
+		Note:             note,
+		Status:           "OPEN",
+	}
+	err = tx.QueryRow(`
+		INSERT INTO visitrequest (phonenumberprospect, idaddressgmap, x, y, idtyperealestate, windowstart, windowend, maxprice, note)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING idvisitrequest, createdat`,
+		claims.PhoneNumber, request.IdAddressGMap, request.X, request.Y, request.IdTypeRealEstate, request.WindowStart,
+		request.WindowEnd, request.MaxPrice, request.Note).Scan(&request.ID, &request.CreatedAt)
+	if err != nil {
+		fmt.Println("💥 Error inserting the visit request in CreateVisitRequest() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	ids, err := insertVisitCriterias(tx, claims.PhoneNumber, body.Criterias)
+	if err == nil {
+		_, err = tx.Exec(`INSERT INTO visitrequestcriteria (idvisitrequest, idcriteria) SELECT $1, UNNEST($2::int[])`, request.ID, pq.Array(ids))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		fmt.Println("💥 Error saving the visit request in CreateVisitRequest() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(request)
+}
+
+// GetVisitRequests renvoie les demandes de visite ouvertes publiées par le prospect connecté, des plus récentes aux
+// plus anciennes.
+func GetVisitRequests(c *fiber.Ctx) error {
+	rows, err := db.Query(`
+		SELECT idvisitrequest, idaddressgmap, x, y, idtyperealestate, windowstart, windowend, maxprice, note, status, idvisit,
+		       createdat, claimedat
+		FROM visitrequest
+		WHERE phonenumberprospect = $1
+		ORDER BY createdat DESC`, c.Locals("user").(*CustomClaims).PhoneNumber)
+	if err != nil {
+		fmt.Println("💥 Error querying the database in GetVisitRequests() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in GetVisitRequests() : ", err)
+		}
+	}(rows)
+
+	requests := []VisitRequest{}
+	for rows.Next() {
+		var request VisitRequest
+		err := rows.Scan(&request.ID, &request.IdAddressGMap, &request.X, &request.Y, &request.IdTypeRealEstate, &request.WindowStart,
+			&request.WindowEnd, &request.MaxPrice, &request.Note, &request.Status, &request.IdVisit, &request.CreatedAt, &request.ClaimedAt)
+		if err != nil {
+			fmt.Println("💥 Error scanning the row in GetVisitRequests() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+		requests = append(requests, request)
+	}
+
+	return c.JSON(requests)
+}
+
+// CancelVisitRequest retire une demande de visite ouverte qu'aucun visiteur n'a encore prise.
+func CancelVisitRequest(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+
+	result, err := db.Exec(`UPDATE visitrequest SET status = 'CANCELLED' WHERE idvisitrequest = $1 AND phonenumberprospect = $2 AND status = 'OPEN'`,
+		id, c.Locals("user").(*CustomClaims).PhoneNumber)
+	if err != nil {
+		fmt.Println("💥 Error cancelling the visit request in CancelVisitRequest() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No open visit request found",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// expireVisitRequests ferme les demandes de visite ouvertes dont le créneau est terminé sans qu'un visiteur les ait
+// prises.
+func expireVisitRequests() (int64, error) {
+	result, err := db.Exec(`UPDATE visitrequest SET status = 'EXPIRED' WHERE status = 'OPEN' AND windowend <= NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetOpenVisitRequests renvoie les demandes de visite ouvertes que le visiteur connecté peut prendre : l'adresse est
+// dans sa zone, son tarif ne dépasse pas le prix maximal, et il est disponible à au moins un horaire du créneau, avec
+// le premier de ces horaires.
+func GetOpenVisitRequests(c *fiber.Ctx) error {
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT r.idvisitrequest,
+		       r.idaddressgmap,
+		       r.x,
+		       r.y,
+		       r.idtyperealestate,
+		       r.windowstart,
+		       r.windowend,
+		       CASE WHEN COALESCE(u.pricing, 0) > 0 THEN u.pricing ELSE r.maxprice END,
+		       r.note,
+		       ARRAY(SELECT c.criteria
+		             FROM visitrequestcriteria rc
+		                      JOIN criteria c ON rc.idcriteria = c.idcriteria
+		             WHERE rc.idvisitrequest = r.idvisitrequest
+		             ORDER BY c.idcriteria),
+		       slot.starttime
+		FROM visitrequest r
+		         JOIN typerealestate tr ON r.idtyperealestate = tr.idtyperealestate
+		         JOIN "user" u ON u.phonenumber = $1
+		         JOIN LATERAL (SELECT s.starttime
+		                       FROM generate_series(GREATEST(r.windowstart, DATE_TRUNC('hour', NOW()::timestamp) + INTERVAL '1 hour'),
+		                                            r.windowend - tr.duration, INTERVAL '15 minutes') AS s(starttime)
+		                       WHERE %s
+		                         AND NOT %s
+		                       ORDER BY s.starttime
+		                       LIMIT 1) AS slot ON TRUE
+		WHERE r.status = 'OPEN'
+		  AND u.idrole = 1
+		  AND u.status = 'VALIDATED'
+		  AND r.phonenumberprospect != u.phonenumber
+		  AND COALESCE(u.pricing, 0) <= r.maxprice
+		  AND st_intersects(u.geom, st_transform(ST_SetSRID(ST_MakePoint(r.y, r.x), 4326), 2154))
+		ORDER BY slot.starttime`,
+		visitorAvailableSQL("u.phonenumber", "s.starttime", "tr.duration"),
+		visitorBusySQL("u.phonenumber", "s.starttime", "tr.duration", "0")), c.Locals("user").(*CustomClaims).PhoneNumber)
+	if err != nil {
+		fmt.Println("💥 Error querying the database in GetOpenVisitRequests() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			fmt.Println("💥 Error closing the rows in GetOpenVisitRequests() : ", err)
+		}
+	}(rows)
+
+	requests := []OpenVisitRequest{}
+	for rows.Next() {
+		var request OpenVisitRequest
+		err := rows.Scan(&request.ID, &request.IdAddressGMap, &request.X, &request.Y, &request.IdTypeRealEstate, &request.WindowStart,
+			&request.WindowEnd, &request.Price, &request.Note, pq.Array(&request.Criterias), &request.FirstAvailableTime)
+		if err != nil {
+			fmt.Println("💥 Error scanning the row in GetOpenVisitRequests() : ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "An error has occurred, please try again later.",
+			})
+		}
+		requests = append(requests, request)
+	}
+
+	return c.JSON(requests)
+}
+
+// claimVisitRequest crée la visite d'une demande ouverte pour le visiteur qui la prend à l'horaire start. La demande et
+// le visiteur sont verrouillés : seule la première prise valide aboutit, et un visiteur ne peut pas prendre deux
+// demandes sur le même créneau.
+func claimVisitRequest(idRequest string, phoneNumber string, start time.Time) (idVisit int, prospect string, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			fmt.Println("💥 Error rolling back the transaction in claimVisitRequest() : ", err)
+		}
+	}(tx)
+
+	var visit Visit
+	var status string
+	var inWindow, eligible, available, busy bool
+	err = tx.QueryRow(fmt.Sprintf(`
+		SELECT r.status,
+		       r.phonenumberprospect,
+		       r.idaddressgmap,
+		       r.idtyperealestate,
+		       r.x,
+		       r.y,
+		       CASE WHEN COALESCE(u.pricing, 0) > 0 THEN u.pricing ELSE r.maxprice END,
+		       $3::timestamp >= r.windowstart AND $3::timestamp + tr.duration <= r.windowend AND $3::timestamp > NOW(),
+		       u.idrole = 1
+		           AND u.status = 'VALIDATED'
+		           AND r.phonenumberprospect != u.phonenumber
+		           AND COALESCE(u.pricing, 0) <= r.maxprice
+		           AND st_intersects(u.geom, st_transform(ST_SetSRID(ST_MakePoint(r.y, r.x), 4326), 2154)),
+		       %s,
+		       %s
+		FROM visitrequest r
+		         JOIN typerealestate tr ON r.idtyperealestate = tr.idtyperealestate
+		         JOIN "user" u ON u.phonenumber = $2
+		WHERE r.idvisitrequest = $1
+		FOR UPDATE OF r, u`,
+		visitorAvailableSQL("u.phonenumber", "$3::timestamp", "tr.duration"),
+		visitorBusySQL("u.phonenumber", "$3::timestamp", "tr.duration", "0")), idRequest, phoneNumber, start).Scan(
+		&status, &visit.PhoneNumberProspect, &visit.IdAddressGMap, &visit.IdTypeRealEstate, &visit.X, &visit.Y,
+		&visit.Price, &inWindow, &eligible, &available, &busy)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return 0, "", errVisitRequestNotFound
+	case err != nil:
+		return 0, "", err
+	case status != "OPEN":
+		return 0, "", errVisitRequestClosed
+	case !eligible:
+		return 0, "", errVisitorNotEligible
+	case !inWindow:
+		return 0, "", errVisitRequestSlot
+	case busy:
+		return 0, "", errVisitorBusy
+	case !available:
+		return 0, "", errVisitorUnavailable
+	}
+
+	code, err := generateVisitCode()
+	if err != nil {
+		return 0, "", err
+	}
+
+	codeSecret, err := generateVisitCodeSecret()
+	if err != nil {
+		return 0, "", err
+	}
+
+	// Claiming the request is how the visitor accepts the visit
+	err = tx.QueryRow(`
+		INSERT INTO visit (phonenumberprospect, phonenumbervisitor, codeverification, codesecret, starttime, price, status, note, idaddressgmap, idtyperealestate, x, y)
+		VALUES ($1, $2, $3, $4, $5, $6, 'ACCEPTED', 0, $7, $8, $9, $10)
+		RETURNING idvisit`,
+		visit.PhoneNumberProspect, phoneNumber, code, codeSecret, start, visit.Price, visit.IdAddressGMap,
+		visit.IdTypeRealEstate, visit.X, visit.Y).Scan(&idVisit)
+	if err != nil {
+		return 0, "", err
+	}
+
+	_, err = tx.Exec(`INSERT INTO linkcriteriavisit (idcriteria, idvisit) SELECT idcriteria, $2 FROM visitrequestcriteria WHERE idvisitrequest = $1`, idRequest, idVisit)
+	if err != nil {
+		return 0, "", err
+	}
+
+	_, err = tx.Exec(`UPDATE visitrequest SET status = 'CLAIMED', idvisit = $1, claimedby = $2, claimedat = NOW() WHERE idvisitrequest = $3`, idVisit, phoneNumber, idRequest)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return idVisit, visit.PhoneNumberProspect, tx.Commit()
+}
+
+// ClaimVisitRequest permet au visiteur connecté de prendre une demande de visite ouverte, à l'un des horaires
+// ("start_time") du créneau où il est disponible. La visite est alors créée et acceptée.
+func ClaimVisitRequest(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Query("id"))
+
+	var body struct {
+		StartTime time.Time `json:"start_time"`
+	}
+	if err := c.BodyParser(&body); err != nil || body.StartTime.IsZero() {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please provide the start time of the visit in the RFC 3339 format",
+		})
+	}
+
+	idVisit, prospect, err := claimVisitRequest(id, c.Locals("user").(*CustomClaims).PhoneNumber, body.StartTime)
+	switch {
+	case errors.Is(err, errVisitRequestNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Visit request not found",
+		})
+	case errors.Is(err, errVisitRequestClosed):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "This visit request has already been claimed or withdrawn",
+		})
+	case errors.Is(err, errVisitorNotEligible):
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You cannot claim this visit request",
+		})
+	case errors.Is(err, errVisitRequestSlot):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The start time must be in the future and leave enough time for the visit within the time window",
+		})
+	case errors.Is(err, errVisitorBusy):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "You already have another visit at this time",
+		})
+	case errors.Is(err, errVisitorUnavailable):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "This start time is not part of your availabilities",
+		})
+	case err != nil:
+		fmt.Println("💥 Error claiming the visit request in ClaimVisitRequest() : ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "An error has occurred, please try again later.",
+		})
+	}
+
+	go notifyVisitEvent(strconv.Itoa(idVisit), pushVisitAccepted, "")
+	go emailVisit(strconv.Itoa(idVisit), "visit.accepted", []string{"PROSPECT"}, nil)
+	go notifyUser(prospect, fmt.Sprintf("Voyo : un visiteur a pris votre demande de visite, elle aura lieu le %s.", body.StartTime.Format("02/01 à 15h04")))
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"visit_id": idVisit,
+	})
+}